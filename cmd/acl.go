@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ErrDenied is returned for writes by peers the ACL does not allow on
+// their key.
+var ErrDenied = errors.New("peer may not write this key")
+
+// aclRule lists the peers allowed to write under a prefix.
+type aclRule struct {
+	prefix ds.Key
+	peers  map[peer.ID]bool
+	// anyone allows every peer.
+	anyone bool
+}
+
+// peerACL restricts who may write to the database. Head announcements are
+// only accepted from the peers it mentions, and values must be signed by
+// a peer allowed on their key, the rule of the longest matching prefix
+// applying. Keys under no rule may not be written. The rules are
+// swapped as a whole on reload.
+type peerACL struct {
+	rules atomic.Pointer[[]aclRule] // longest prefix first
+	self  peer.ID
+}
+
+// loadACL builds the ACL of the peers allowed everywhere, as given with
+// -allow-peer, and of an ACL file, if any. ACL files hold one rule per
+// line, a prefix followed by the peers allowed to write under it:
+//
+//	# prefix   peers, comma-separated, or * for anyone
+//	/          12D3KooW...,12D3KooW...
+//	/public    *
+//
+// The node itself is not implied: like every node, it only accepts its
+// own values on the keys the ACL allows it to write.
+func loadACL(path string, allowed []string, self peer.ID) (*peerACL, error) {
+	byPrefix := make(map[ds.Key]*aclRule)
+	rule := func(prefix ds.Key) *aclRule {
+		r, ok := byPrefix[prefix]
+		if !ok {
+			r = &aclRule{prefix: prefix, peers: make(map[peer.ID]bool)}
+			byPrefix[prefix] = r
+		}
+		return r
+	}
+	add := func(prefix ds.Key, peers string) error {
+		r := rule(prefix)
+		for _, s := range strings.Split(peers, ",") {
+			s = strings.TrimSpace(s)
+			if s == "*" {
+				r.anyone = true
+				continue
+			}
+			id, err := peer.Decode(s)
+			if err != nil {
+				return fmt.Errorf("invalid peer %q: %w", s, err)
+			}
+			r.peers[id] = true
+		}
+		return nil
+	}
+	for _, p := range allowed {
+		if err := add(ds.NewKey("/"), p); err != nil {
+			return nil, fmt.Errorf("-allow-peer: %w", err)
+		}
+	}
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for n := 1; sc.Scan(); n++ {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 2 || !strings.HasPrefix(fields[0], "/") {
+				return nil, fmt.Errorf("%s:%d: expected a prefix and peers", path, n)
+			}
+			if err := add(ds.NewKey(fields[0]), fields[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	rules := make([]aclRule, 0, len(byPrefix))
+	for _, r := range byPrefix {
+		rules = append(rules, *r)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return len(rules[i].prefix.String()) > len(rules[j].prefix.String())
+	})
+	acl := &peerACL{self: self}
+	acl.rules.Store(&rules)
+	return acl, nil
+}
+
+// reload replaces the rules with those of path and allowed, keeping the
+// current ones when they do not load.
+func (a *peerACL) reload(path string, allowed []string) error {
+	if path == "" && len(allowed) == 0 {
+		return errors.New("the ACL cannot be removed without a restart")
+	}
+	next, err := loadACL(path, allowed, a.self)
+	if err != nil {
+		return err
+	}
+	a.rules.Store(next.rules.Load())
+	return nil
+}
+
+// mayAnnounce tells whether heads announced by a peer are accepted: the
+// peer must be allowed to write somewhere. The node always accepts its
+// own announcements.
+func (a *peerACL) mayAnnounce(p peer.ID) bool {
+	if a == nil || p == a.self {
+		return true
+	}
+	for _, r := range *a.rules.Load() {
+		if r.anyone || r.peers[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// mayWrite checks that a peer may write a key.
+func (a *peerACL) mayWrite(p peer.ID, k ds.Key) error {
+	if a == nil {
+		return nil
+	}
+	for _, r := range *a.rules.Load() {
+		if r.prefix.Equal(k) || r.prefix.IsAncestorOf(k) || r.prefix.String() == "/" {
+			if r.anyone || r.peers[p] {
+				return nil
+			}
+			break
+		}
+	}
+	return fmt.Errorf("%w: %s on %s", ErrDenied, p, k)
+}
+
+// mayWriteSelf checks that the node itself may write a key, so that
+// writes the other nodes would reject fail early.
+func (a *peerACL) mayWriteSelf(k ds.Key) error {
+	if a == nil {
+		return nil
+	}
+	return a.mayWrite(a.self, k)
+}
+
+// authorize checks the signer of a value, for dkv.Pipelines.Authorize.
+func (a *peerACL) authorize(k ds.Key, signer crypto.PubKey) error {
+	id, err := peer.IDFromPublicKey(signer)
+	if err != nil {
+		return err
+	}
+	return a.mayWrite(id, k)
+}
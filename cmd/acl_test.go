@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func newTestPeer(t *testing.T) (crypto.PrivKey, peer.ID) {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, id
+}
+
+// writeACL writes an ACL file of the given lines.
+func writeACL(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "acl")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPeerACLMayWrite(t *testing.T) {
+	_, a := newTestPeer(t)
+	_, b := newTestPeer(t)
+	_, c := newTestPeer(t)
+	_, d := newTestPeer(t)
+	path := writeACL(t,
+		"# team keys",
+		"/team      "+a.String()+","+b.String(),
+		"/team/ops  "+b.String(),
+		"/public    *",
+	)
+	acl, err := loadACL(path, []string{c.String()}, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		peer    peer.ID
+		key     string
+		allowed bool
+	}{
+		{"listed", a, "/team/x", true},
+		{"on the prefix itself", a, "/team", true},
+		{"longest prefix wins", a, "/team/ops/x", false},
+		{"listed on the longer prefix", b, "/team/ops/x", true},
+		{"anyone", d, "/public/x", true},
+		{"not listed", d, "/team/x", false},
+		{"allowed everywhere", c, "/other", true},
+		{"allowed everywhere but under a rule", c, "/team/x", false},
+		{"under no rule of the peer", a, "/other", false},
+		{"sibling prefix", a, "/teams/x", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := acl.mayWrite(tt.peer, ds.NewKey(tt.key))
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Fatalf("mayWrite(%s): %v, want allowed %t", tt.key, err, tt.allowed)
+			}
+			if err != nil && !errors.Is(err, ErrDenied) {
+				t.Errorf("mayWrite(%s): %v, want ErrDenied", tt.key, err)
+			}
+		})
+	}
+}
+
+func TestPeerACLReload(t *testing.T) {
+	_, self := newTestPeer(t)
+	_, a := newTestPeer(t)
+	_, other := newTestPeer(t)
+	tests := []struct {
+		name    string
+		lines   []string
+		allowed []string
+		ok      bool
+		// announce tells whether other may announce heads after the
+		// reload, which it may before.
+		announce bool
+	}{
+		{"narrowed", []string{"/ " + a.String()}, nil, true, false},
+		{"allowed peers only", nil, []string{a.String()}, true, false},
+		{"invalid peer", []string{"/ nobody"}, nil, false, true},
+		{"invalid line", []string{"/a"}, nil, false, true},
+		{"nothing", nil, nil, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl, err := loadACL(writeACL(t, "/public *"), nil, self)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := ""
+			if tt.lines != nil {
+				path = writeACL(t, tt.lines...)
+			}
+			if err := acl.reload(path, tt.allowed); (err == nil) != tt.ok {
+				t.Fatalf("reload: %v, want ok %t", err, tt.ok)
+			}
+			if got := acl.mayAnnounce(other); got != tt.announce {
+				t.Errorf("mayAnnounce = %t, want %t", got, tt.announce)
+			}
+			if !acl.mayAnnounce(self) {
+				t.Error("the node may not announce its own heads")
+			}
+		})
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// adminAPI serves the destructive or node-wide operations. It runs on its
+// own listener and only accepts the admin token, so the tokens handed out
+// for the key-value API can never reach it.
+type adminAPI struct {
+	token string
+
+	h     host.Host
+	store ds.Datastore
+	bs    blockstore.Blockstore
+	dbs   *databases
+	pins  *pinPolicy
+	grace time.Duration
+	maint *maintenance
+	// stop triggers the graceful shutdown of the node, followed by a
+	// restart when asked. It is nil when the node cannot be stopped
+	// remotely, such as when it runs the interactive shell.
+	stop    func(restart bool)
+	reload  *reloader
+	events  *peerEvents
+	mems    *members
+	sources *headSources
+	// usageMeter is nil unless -usage-accounting is on.
+	usageMeter *usageMeter
+}
+
+// authorized checks the admin bearer token.
+func (a *adminAPI) authorized(r *http.Request) bool {
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(a.token), []byte(bearer)) == 1
+}
+
+// handle registers an admin endpoint that only answers the given method
+// to requests carrying the admin token.
+func (a *adminAPI) handle(mux *http.ServeMux, method, path string, fn http.HandlerFunc) {
+	name := "admin" + strings.ReplaceAll(strings.TrimPrefix(path, "/admin"), "/", "_")
+	mux.Handle(path, instrument(name, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			http.Error(w, "missing or invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fn(w, r)
+	})))
+}
+
+func (a *adminAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	a.handle(mux, http.MethodGet, "/admin/peers", a.peers)
+	a.handle(mux, http.MethodGet, "/admin/peers/events", a.peerEvents)
+	a.handle(mux, http.MethodPost, "/admin/peers/connect", a.connect)
+	a.handle(mux, http.MethodPost, "/admin/peers/disconnect", a.disconnect)
+	a.handle(mux, http.MethodGet, "/admin/members", a.members)
+	a.handle(mux, http.MethodPost, "/admin/gc", a.gc)
+	a.handle(mux, http.MethodPost, "/admin/maintenance", a.maintenance)
+	a.handle(mux, http.MethodPut, "/admin/loglevel", a.logLevel)
+	a.handle(mux, http.MethodGet, "/admin/heads", a.heads)
+	a.handle(mux, http.MethodPost, "/admin/heads/pin", a.changeHead("pin"))
+	a.handle(mux, http.MethodPost, "/admin/heads/drop", a.changeHead("drop"))
+	a.handle(mux, http.MethodGet, "/admin/usage", a.usage)
+	a.handle(mux, http.MethodPost, "/admin/usage/reset", a.resetUsage)
+	a.handle(mux, http.MethodPost, "/admin/reload", a.reloadConfig)
+	a.handle(mux, http.MethodPost, "/admin/shutdown", a.shutdown(false))
+	a.handle(mux, http.MethodPost, "/admin/restart", a.shutdown(true))
+	return mux
+}
+
+// peers lists the connected peers and their addresses.
+func (a *adminAPI) peers(w http.ResponseWriter, r *http.Request) {
+	var addrs []string
+	for _, p := range connectedPeers(a.h) {
+		pa, err := peer.AddrInfoToP2pAddrs(p)
+		if err != nil {
+			continue
+		}
+		for _, addr := range pa {
+			addrs = append(addrs, addr.String())
+		}
+	}
+	writeJSON(w, addrs)
+}
+
+// peerEvents lists the recent connections, disconnections and rejected
+// messages, oldest first.
+func (a *adminAPI) peerEvents(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.events.list())
+}
+
+// connect dials the peer at ?addr=<multiaddr>.
+func (a *adminAPI) connect(w http.ResponseWriter, r *http.Request) {
+	pi, err := peer.AddrInfoFromString(r.URL.Query().Get("addr"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.h.Connect(r.Context(), *pi); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// disconnect closes the connections to ?peer=<peer ID>.
+func (a *adminAPI) disconnect(w http.ResponseWriter, r *http.Request) {
+	pid, err := peer.Decode(r.URL.Query().Get("peer"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.h.Network().ClosePeer(pid); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// members lists the nodes seen recently, as the members command does.
+func (a *adminAPI) members(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.mems.Membership())
+}
+
+// gc runs the garbage collector, like the gc command.
+func (a *adminAPI) gc(w http.ResponseWriter, r *http.Request) {
+	res, err := collectGarbage(r.Context(), a.store, a.bs, a.dbs.all(), a.pins, a.grace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, res)
+}
+
+// maintenance switches maintenance mode with ?on=true|false.
+func (a *adminAPI) maintenance(w http.ResponseWriter, r *http.Request) {
+	on, err := strconv.ParseBool(r.URL.Query().Get("on"))
+	if err != nil {
+		http.Error(w, "on must be true or false", http.StatusBadRequest)
+		return
+	}
+	if on {
+		a.maint.enable()
+	} else if err := a.maint.disable(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// logLevel sets the log level with ?subsystem=<name>&level=<level>, like
+// the debug command does. The subsystem defaults to globaldb and "*"
+// changes every subsystem.
+func (a *adminAPI) logLevel(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	subsystem := q.Get("subsystem")
+	if subsystem == "" {
+		subsystem = "globaldb"
+	}
+	if err := logging.SetLogLevel(subsystem, q.Get("level")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// headsDB returns the database of ?db=, the default one when unset.
+func (a *adminAPI) headsDB(r *http.Request) (*db, error) {
+	name := r.URL.Query().Get("db")
+	if name == "" {
+		name = defaultDB
+	}
+	return a.dbs.get(name)
+}
+
+// heads lists the heads of a database, like debug heads.
+func (a *adminAPI) heads(w http.ResponseWriter, r *http.Request) {
+	d, err := a.headsDB(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	heads, err := listHeads(r.Context(), a.store, d, offlineDAG(a.bs), a.sources)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, heads)
+}
+
+// changeHead pins or drops the head ?cid=, like debug head pin|drop. It
+// answers with the warning of headWarning unless ?force=true is given.
+func (a *adminAPI) changeHead(op string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		c, err := cid.Decode(q.Get("cid"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d, err := a.headsDB(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if force, _ := strconv.ParseBool(q.Get("force")); !force {
+			http.Error(w, headWarning+"\n\nSend force=true to go ahead.", http.StatusPreconditionRequired)
+			return
+		}
+		if op == "pin" {
+			_, err = pinHead(r.Context(), a.store, d, offlineDAG(a.bs), c)
+		} else {
+			err = dropHead(r.Context(), a.store, d, c)
+		}
+		switch {
+		case errors.Is(err, ErrNotAHead):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			logger.Warnf("admin: head %s %s, applied on restart", c, op)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// reloadConfig applies configuration changes that do not need a restart.
+func (a *adminAPI) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if err := a.reload.reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// shutdown stops the node, and starts it again when restart is set. The
+// response is sent before shutting down.
+func (a *adminAPI) shutdown(restart bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.stop == nil {
+			http.Error(w, "only a node running in daemon mode can be stopped remotely", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		a.stop(restart)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// serveAdmin exposes the admin API on addr until the server fails.
+func serveAdmin(addr string, a *adminAPI) {
+	if err := http.ListenAndServe(addr, a.handler()); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Errorf("admin server: %s", err)
+	}
+}
+
+// adminPost calls an admin endpoint of the daemon whose admin API listens
+// on addr, such as "shutdown", "restart" or "reload".
+func adminPost(addr, token, action string) error {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(addr, "/")+"/admin/"+action, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// reexec replaces the process with a new one started with the same
+// arguments. It only returns on failure.
+func reexec() {
+	exe, err := os.Executable()
+	if err == nil {
+		err = syscall.Exec(exe, os.Args, os.Environ())
+	}
+	logger.Errorf("restarting: %s", err)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	crdt "github.com/ipfs/go-ds-crdt"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// The admission policies of -admission.
+const (
+	admitOpen    = "open"
+	admitPoW     = "pow"
+	admitWriters = "writers"
+)
+
+// writersNs holds one key per registered writer, named after its peer ID.
+// The keys are replicated like any other, so registering a writer on one
+// node admits it on all of them.
+var writersNs = systemNs.ChildString("writers")
+
+// stampMagic starts the head announcements stamped with a proof of work.
+// It is followed by the nonce and the time of the stamp in Unix
+// nanoseconds, both 8 bytes big-endian, and the announcement.
+var stampMagic = []byte("globaldb-pow/2\n")
+
+// stampHeader is the size of the stamp ahead of an announcement.
+var stampHeader = len(stampMagic) + 16
+
+// maxPoWBits bounds -pow-bits: stamps are searched for on the broadcast
+// path, and each bit doubles the search.
+const maxPoWBits = 24
+
+// stampWindow is how far the time of a stamp may be from the clock of the
+// node checking it. Stamps are accepted once within it, so that a stamp
+// cannot be sent again under another message.
+const stampWindow = 2 * time.Minute
+
+// maxStamps bounds the stamps remembered within the window. Once it is
+// reached, new stamps are ignored until old ones expire.
+const maxStamps = 1 << 16
+
+// admission decides which peers may announce heads on the topic of the
+// database, which is what gets their writes merged. With the pow policy
+// every announcement must carry a proof of work, so that flooding the
+// topic costs CPU; with the writers policy only the peers given with
+// -writer and those registered under writersNs are heard. A nil admission
+// is the open policy: anyone is heard.
+type admission struct {
+	policy string
+	// bits is the difficulty of the proof of work: the leading zero bits
+	// of the stamp hash.
+	bits int
+	self peer.ID
+	// seed are the writers given with -writer. They are needed to sync
+	// the list of registered writers in the first place.
+	seed  map[peer.ID]bool
+	clock dkv.WallClock
+
+	mu sync.Mutex
+	// dbs are the databases by topic, each holding the writers registered
+	// on it, set as they are opened.
+	dbs map[string]*db
+	// stamps are the hashes of the stamps accepted within the window,
+	// with their time.
+	stamps map[[32]byte]time.Time
+}
+
+func newAdmission(policy string, difficulty int, writers []string, self peer.ID, clock dkv.WallClock) (*admission, error) {
+	switch policy {
+	case admitOpen:
+		return nil, nil
+	case admitPoW:
+		if difficulty < 1 || difficulty > maxPoWBits {
+			return nil, fmt.Errorf("-pow-bits must be between 1 and %d, not %d", maxPoWBits, difficulty)
+		}
+	case admitWriters:
+	default:
+		return nil, fmt.Errorf("unknown admission policy %q: use open, pow or writers", policy)
+	}
+	a := &admission{policy: policy, bits: difficulty, self: self, seed: make(map[peer.ID]bool), clock: clock, dbs: make(map[string]*db), stamps: make(map[[32]byte]time.Time)}
+	for _, s := range writers {
+		id, err := peer.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("-writer: invalid peer %q: %w", s, err)
+		}
+		a.seed[id] = true
+	}
+	return a, nil
+}
+
+// stampHash is the hash a proof of work is checked on. It covers the
+// author, so that a stamp cannot be reused by another peer, and the time
+// of the stamp, so that it expires.
+func stampHash(topic string, author peer.ID, nonce uint64, at int64, data []byte) [32]byte {
+	h := sha256.New()
+	h.Write(stampMagic)
+	h.Write([]byte(topic + "\n"))
+	h.Write([]byte(author))
+	binary.Write(h, binary.BigEndian, nonce)
+	binary.Write(h, binary.BigEndian, at)
+	h.Write(data)
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// leadingZeros counts the leading zero bits of a hash.
+func leadingZeros(sum [32]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// stamp finds a proof of work for an announcement of the node.
+func (a *admission) stamp(topic string, data []byte) []byte {
+	at := a.clock.Now().UnixNano()
+	nonce := uint64(0)
+	for leadingZeros(stampHash(topic, a.self, nonce, at, data)) < a.bits {
+		nonce++
+	}
+	out := append([]byte{}, stampMagic...)
+	out = binary.BigEndian.AppendUint64(out, nonce)
+	out = binary.BigEndian.AppendUint64(out, uint64(at))
+	return append(out, data...)
+}
+
+// unstamped returns an announcement without its proof of work, if any.
+func unstamped(data []byte) []byte {
+	if !bytes.HasPrefix(data, stampMagic) || len(data) < stampHeader {
+		return data
+	}
+	return data[stampHeader:]
+}
+
+// fresh records a stamp accepted at now, telling whether it was not
+// already.
+func (a *admission) fresh(sum [32]byte, at, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.stamps[sum]; ok {
+		return false
+	}
+	if len(a.stamps) >= maxStamps {
+		for s, t := range a.stamps {
+			if now.Sub(t) > stampWindow {
+				delete(a.stamps, s)
+			}
+		}
+		if len(a.stamps) >= maxStamps {
+			return false
+		}
+	}
+	a.stamps[sum] = at
+	return true
+}
+
+// validate checks the announcements on the topic of the database.
+// Unadmitted ones are rejected, which penalizes the peers relaying them.
+func (a *admission) validate(ctx context.Context, topic string, msg *pubsub.Message) pubsub.ValidationResult {
+	from := msg.GetFrom()
+	switch a.policy {
+	case admitPoW:
+		rest, ok := bytes.CutPrefix(msg.Data, stampMagic)
+		if !ok || len(rest) < 16 {
+			logger.Debugf("dropping heads on %s from %s: no proof of work", topic, from)
+			broadcastsRejected.WithLabelValues("pow").Inc()
+			return pubsub.ValidationReject
+		}
+		nonce := binary.BigEndian.Uint64(rest)
+		at := int64(binary.BigEndian.Uint64(rest[8:]))
+		sum := stampHash(topic, from, nonce, at, rest[16:])
+		if leadingZeros(sum) < a.bits {
+			logger.Debugf("dropping heads on %s from %s: proof of work under %d bits", topic, from, a.bits)
+			broadcastsRejected.WithLabelValues("pow").Inc()
+			return pubsub.ValidationReject
+		}
+		// Stale and reused stamps may be late copies relayed by honest
+		// peers, so they are ignored rather than rejected.
+		now, stamped := a.clock.Now(), time.Unix(0, at)
+		if d := now.Sub(stamped); d > stampWindow || d < -stampWindow || !a.fresh(sum, stamped, now) {
+			logger.Debugf("dropping heads on %s from %s: stale or reused proof of work", topic, from)
+			broadcastsRejected.WithLabelValues("pow").Inc()
+			return pubsub.ValidationIgnore
+		}
+	case admitWriters:
+		ok, err := a.isWriter(ctx, topic, from)
+		if err != nil {
+			logger.Warnf("checking writer %s: %s", from, err)
+			return pubsub.ValidationIgnore
+		}
+		if !ok {
+			logger.Debugf("dropping heads on %s from %s: not a registered writer", topic, from)
+			broadcastsRejected.WithLabelValues("writer").Inc()
+			return pubsub.ValidationReject
+		}
+	}
+	return pubsub.ValidationAccept
+}
+
+// admit makes d the database holding the writers of topic.
+func (a *admission) admit(topic string, d *db) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.dbs[topic] = d
+}
+
+// isWriter tells whether a peer may announce heads on topic under the
+// writers policy: it must be registered on the database of the topic. The
+// node itself always may.
+func (a *admission) isWriter(ctx context.Context, topic string, p peer.ID) (bool, error) {
+	if p == a.self || a.seed[p] {
+		return true, nil
+	}
+	a.mu.Lock()
+	kv := a.dbs[topic]
+	a.mu.Unlock()
+	if kv == nil {
+		return false, nil
+	}
+	return kv.crdt.Has(ctx, writersNs.ChildString(p.String()))
+}
+
+// wrap stamps the broadcasts made through b on topic with a proof of work
+// and strips the stamps of the ones it receives. It returns b itself
+// unless the policy is pow.
+func (a *admission) wrap(topic string, b crdt.Broadcaster) crdt.Broadcaster {
+	if a == nil || a.policy != admitPoW {
+		return b
+	}
+	return &stampedBroadcaster{Broadcaster: b, adm: a, topic: topic}
+}
+
+// stampedBroadcaster carries the broadcasts of a CRDT store with a proof
+// of work.
+type stampedBroadcaster struct {
+	crdt.Broadcaster
+
+	adm   *admission
+	topic string
+}
+
+func (b *stampedBroadcaster) Broadcast(data []byte) error {
+	start := b.adm.clock.Now()
+	stamped := b.adm.stamp(b.topic, data)
+	logger.Debugf("proof of work for %s took %s", b.topic, b.adm.clock.Now().Sub(start))
+	return b.Broadcaster.Broadcast(stamped)
+}
+
+func (b *stampedBroadcaster) Next() ([]byte, error) {
+	data, err := b.Broadcaster.Next()
+	if err != nil {
+		return nil, err
+	}
+	return unstamped(data), nil
+}
+
+// RegisterWriter admits a peer under the writers policy on every node.
+func (d *db) RegisterWriter(ctx context.Context, p peer.ID) error {
+	return d.Put(ctx, writersNs.ChildString(p.String()), []byte(d.now().UTC().Format(time.RFC3339)))
+}
+
+// UnregisterWriter stops admitting a registered peer. Peers given with
+// -writer stay admitted by the nodes they were given to.
+func (d *db) UnregisterWriter(ctx context.Context, p peer.ID) error {
+	return d.Delete(ctx, writersNs.ChildString(p.String()))
+}
+
+// Writers lists the registered writers.
+func (d *db) Writers(ctx context.Context) ([]peer.ID, error) {
+	results, err := d.Query(ctx, query.Query{Prefix: writersNs.String(), KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	var list []peer.ID
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		id, err := peer.Decode(ds.RawKey(r.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+		list = append(list, id)
+	}
+	return list, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+)
+
+// alertRule is an alert condition along with what to do when it starts
+// and stops being met.
+type alertRule struct {
+	Name string `json:"name"`
+	// Condition compares a gauge against a threshold, e.g. "peers < 2".
+	Condition string `json:"condition"`
+	// For is how long the condition must hold before the alert fires.
+	For string `json:"for,omitempty"`
+	// Webhook receives a JSON POST when the alert fires and resolves.
+	Webhook string `json:"webhook,omitempty"`
+	// Exec is run through sh -c when the alert fires and resolves, with
+	// ALERT_NAME, ALERT_STATE and ALERT_VALUE set.
+	Exec string `json:"exec,omitempty"`
+}
+
+// alertCondition is a parsed alert condition.
+type alertCondition struct {
+	gauge     string
+	op        string
+	threshold float64
+}
+
+func parseCondition(s string) (alertCondition, error) {
+	f := strings.Fields(s)
+	if len(f) != 3 {
+		return alertCondition{}, fmt.Errorf("condition %q is not of the form \"<gauge> <op> <number>\"", s)
+	}
+	switch f[1] {
+	case "<", "<=", ">", ">=":
+	default:
+		return alertCondition{}, fmt.Errorf("condition %q: unknown operator %s", s, f[1])
+	}
+	n, err := strconv.ParseFloat(f[2], 64)
+	if err != nil {
+		return alertCondition{}, fmt.Errorf("condition %q: %w", s, err)
+	}
+	return alertCondition{gauge: f[0], op: f[1], threshold: n}, nil
+}
+
+func (c alertCondition) met(v float64) bool {
+	switch c.op {
+	case "<":
+		return v < c.threshold
+	case "<=":
+		return v <= c.threshold
+	case ">":
+		return v > c.threshold
+	default:
+		return v >= c.threshold
+	}
+}
+
+// gaugeFunc reads the current value of a gauge. It returns false when
+// there is no value, in which case conditions on it are left as they are.
+type gaugeFunc func() (float64, bool)
+
+// alert is a rule ready to be evaluated, along with its state.
+type alert struct {
+	alertRule
+	cond alertCondition
+	hold time.Duration
+
+	pendingSince time.Time
+	firing       bool
+}
+
+// alerter evaluates alert rules loaded from a JSON file of the form
+//
+//	{"alerts": [{"name": "few-peers", "condition": "peers < 2", "for": "5m",
+//	             "webhook": "https://example.com/hook"}]}
+//
+// against the gauges it was given.
+type alerter struct {
+	path   string
+	gauges map[string]gaugeFunc
+	client *http.Client
+	clock  dkv.WallClock
+
+	mu     sync.Mutex
+	alerts []*alert
+}
+
+func newAlerter(path string, gauges map[string]gaugeFunc, clock dkv.WallClock) (*alerter, error) {
+	a := &alerter{
+		path:   path,
+		gauges: gauges,
+		clock:  clock,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	return a, a.reload()
+}
+
+// reload reads the rules again. Alerts that keep their name keep their
+// state, so reloading does not fire them again.
+func (a *alerter) reload() error {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Alerts []alertRule `json:"alerts"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parsing %s: %w", a.path, err)
+	}
+
+	alerts := make([]*alert, 0, len(file.Alerts))
+	for _, r := range file.Alerts {
+		cond, err := parseCondition(r.Condition)
+		if err != nil {
+			return fmt.Errorf("alert %q: %w", r.Name, err)
+		}
+		if _, ok := a.gauges[cond.gauge]; !ok {
+			return fmt.Errorf("alert %q: unknown gauge %q (known: %s)", r.Name, cond.gauge, strings.Join(a.gaugeNames(), ", "))
+		}
+		al := &alert{alertRule: r, cond: cond}
+		if r.For != "" {
+			al.hold, err = time.ParseDuration(r.For)
+			if err != nil {
+				return fmt.Errorf("alert %q: %w", r.Name, err)
+			}
+		}
+		alerts = append(alerts, al)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, al := range alerts {
+		for _, old := range a.alerts {
+			if old.Name == al.Name {
+				al.pendingSince, al.firing = old.pendingSince, old.firing
+			}
+		}
+	}
+	a.alerts = alerts
+	return nil
+}
+
+func (a *alerter) gaugeNames() []string {
+	names := make([]string, 0, len(a.gauges))
+	for n := range a.gauges {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// check evaluates every alert once and notifies the state changes. The
+// alerts job runs it.
+func (a *alerter) check(ctx context.Context) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.clock.Now()
+	for _, al := range a.alerts {
+		v, ok := a.gauges[al.cond.gauge]()
+		if !ok {
+			continue
+		}
+		if !al.cond.met(v) {
+			al.pendingSince = time.Time{}
+			if al.firing {
+				al.firing = false
+				go a.notify(ctx, al.alertRule, "resolved", v)
+			}
+			continue
+		}
+		if al.pendingSince.IsZero() {
+			al.pendingSince = now
+		}
+		if !al.firing && now.Sub(al.pendingSince) >= al.hold {
+			al.firing = true
+			go a.notify(ctx, al.alertRule, "firing", v)
+		}
+	}
+}
+
+// notify calls the webhook and runs the command of a rule.
+func (a *alerter) notify(ctx context.Context, r alertRule, state string, value float64) {
+	logger.Warnf("alert %s %s: %s (value %g)", r.Name, state, r.Condition, value)
+	if r.Webhook != "" {
+		body, _ := json.Marshal(map[string]interface{}{
+			"alert":     r.Name,
+			"state":     state,
+			"condition": r.Condition,
+			"value":     value,
+			"time":      a.clock.Now().UTC(),
+		})
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.Webhook, bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			var resp *http.Response
+			resp, err = a.client.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode/100 != 2 {
+					err = fmt.Errorf("webhook returned %s", resp.Status)
+				}
+			}
+		}
+		if err != nil {
+			logger.Errorf("alert %s: %s", r.Name, err)
+		}
+	}
+	if r.Exec != "" {
+		cmd := exec.CommandContext(ctx, "sh", "-c", r.Exec)
+		cmd.Env = append(os.Environ(),
+			"ALERT_NAME="+r.Name,
+			"ALERT_STATE="+state,
+			"ALERT_VALUE="+strconv.FormatFloat(value, 'g', -1, 64),
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			logger.Errorf("alert %s: %s: %s", r.Name, err, bytes.TrimSpace(out))
+		}
+	}
+}
+
+// diskUsage returns the percentage of the filesystem holding path that is
+// in use.
+func diskUsage(path string) (float64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil || st.Blocks == 0 {
+		return 0, false
+	}
+	return 100 * float64(st.Blocks-st.Bavail) / float64(st.Blocks), true
+}
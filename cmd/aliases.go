@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// aliasesNs is the namespace in the local datastore where peer aliases
+// are kept. Aliases are not replicated: each node names peers as it
+// likes.
+var aliasesNs = ds.NewKey("/aliases")
+
+// aliases maps peer IDs to human-friendly names. It is safe to use a nil
+// *aliases, which knows no names.
+type aliases struct {
+	store ds.Datastore
+
+	mu    sync.RWMutex
+	names map[peer.ID]string
+}
+
+// loadAliases reads the aliases kept in the local datastore.
+func loadAliases(ctx context.Context, store ds.Datastore) (*aliases, error) {
+	al := &aliases{store: store, names: make(map[peer.ID]string)}
+	results, err := store.Query(ctx, query.Query{Prefix: aliasesNs.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		id, err := peer.Decode(ds.RawKey(r.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+		al.names[id] = string(r.Value)
+	}
+	return al, nil
+}
+
+// set names a peer.
+func (al *aliases) set(ctx context.Context, id peer.ID, name string) error {
+	if err := al.store.Put(ctx, aliasesNs.ChildString(id.String()), []byte(name)); err != nil {
+		return err
+	}
+	al.mu.Lock()
+	al.names[id] = name
+	al.mu.Unlock()
+	return nil
+}
+
+// remove forgets the name of a peer.
+func (al *aliases) remove(ctx context.Context, id peer.ID) error {
+	if err := al.store.Delete(ctx, aliasesNs.ChildString(id.String())); err != nil {
+		return err
+	}
+	al.mu.Lock()
+	delete(al.names, id)
+	al.mu.Unlock()
+	return nil
+}
+
+// name returns how a peer should be shown: its alias followed by its
+// ID, or just its ID when it has no alias.
+func (al *aliases) name(id peer.ID) string {
+	if al == nil {
+		return id.String()
+	}
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+	if n, ok := al.names[id]; ok {
+		return fmt.Sprintf("%s (%s)", n, id)
+	}
+	return id.String()
+}
+
+// resolve accepts either a peer ID or an alias.
+func (al *aliases) resolve(s string) (peer.ID, error) {
+	al.mu.RLock()
+	for id, n := range al.names {
+		if n == s {
+			al.mu.RUnlock()
+			return id, nil
+		}
+	}
+	al.mu.RUnlock()
+	return peer.Decode(s)
+}
+
+func (al *aliases) print() {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+	ids := make([]peer.ID, 0, len(al.names))
+	for id := range al.names {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return al.names[ids[i]] < al.names[ids[j]] })
+	for _, id := range ids {
+		fmt.Printf("%-20s %s\n", al.names[id], id)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Verbs a token can be granted on a prefix.
+const (
+	verbRead  = "read"
+	verbWrite = "write"
+)
+
+// ErrUnauthorized is returned when a request carries no valid token.
+var ErrUnauthorized = errors.New("missing or invalid API token")
+
+// grant allows some verbs on every key under a prefix.
+type grant struct {
+	Prefix string   `json:"prefix"`
+	Verbs  []string `json:"verbs"`
+}
+
+// apiToken is a bearer token along with what it may do.
+type apiToken struct {
+	Name   string  `json:"name"`
+	Token  string  `json:"token"`
+	Grants []grant `json:"grants"`
+}
+
+// allows tells whether the token may use verb on k.
+func (t *apiToken) allows(verb string, k ds.Key) bool {
+	for _, g := range t.Grants {
+		p := ds.NewKey(g.Prefix)
+		if !p.Equal(k) && !p.IsAncestorOf(k) {
+			continue
+		}
+		for _, v := range g.Verbs {
+			if v == verb {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authorizer checks the bearer tokens of API requests. A nil authorizer
+// lets every request through, which is what happens when no tokens are
+// configured.
+type authorizer struct {
+	path string
+
+	mu     sync.RWMutex
+	tokens []apiToken
+}
+
+// loadTokens reads a JSON file of the form
+//
+//	{"tokens": [{"name": "sensors", "token": "...",
+//	  "grants": [{"prefix": "/public", "verbs": ["read"]},
+//	             {"prefix": "/sensors/abc", "verbs": ["read", "write"]}]}]}
+func loadTokens(path string) (*authorizer, error) {
+	tokens, err := readTokens(path)
+	if err != nil {
+		return nil, err
+	}
+	return &authorizer{path: path, tokens: tokens}, nil
+}
+
+// reload reads the tokens file again. The current tokens stay in place
+// when the file is invalid.
+func (a *authorizer) reload() error {
+	tokens, err := readTokens(a.path)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.tokens = tokens
+	a.mu.Unlock()
+	return nil
+}
+
+func readTokens(path string) ([]apiToken, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Tokens []apiToken `json:"tokens"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, t := range file.Tokens {
+		if t.Token == "" {
+			return nil, fmt.Errorf("token %q in %s is empty", t.Name, path)
+		}
+		for _, g := range t.Grants {
+			for _, v := range g.Verbs {
+				if v != verbRead && v != verbWrite {
+					return nil, fmt.Errorf("token %q in %s: unknown verb %q", t.Name, path, v)
+				}
+			}
+		}
+	}
+	return file.Tokens, nil
+}
+
+// authenticate returns the token presented by the request. It returns a
+// nil token when authorization is disabled.
+func (a *authorizer) authenticate(r *http.Request) (*apiToken, error) {
+	return a.authenticateHeader(r.Header.Get("Authorization"))
+}
+
+// authenticateHeader is authenticate for the value of an Authorization
+// header received some other way, e.g. as gRPC metadata.
+func (a *authorizer) authenticateHeader(header string) (*apiToken, error) {
+	if a == nil {
+		return nil, nil
+	}
+	bearer, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return nil, ErrUnauthorized
+	}
+	// The slice is replaced, never modified, on reload.
+	a.mu.RLock()
+	tokens := a.tokens
+	a.mu.RUnlock()
+	for i := range tokens {
+		if subtle.ConstantTimeCompare([]byte(tokens[i].Token), []byte(bearer)) == 1 {
+			return &tokens[i], nil
+		}
+	}
+	return nil, ErrUnauthorized
+}
+
+// has tells whether token is one of the configured tokens.
+func (a *authorizer) has(token string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, t := range a.tokens {
+		if token != "" && t.Token == token {
+			return true
+		}
+	}
+	return false
+}
+
+// permitted reports whether a token returned by authenticate may use verb
+// on k. A nil token means authorization is disabled.
+func permitted(t *apiToken, verb string, k ds.Key) bool {
+	return t == nil || t.allows(verb, k)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-datastore/query"
+	badger "github.com/ipfs/go-ds-badger2"
+)
+
+// Entries of a backup file.
+const (
+	// backupStore is the Badger backup of the datastore.
+	backupStore = "datastore.badger"
+	// backupCold holds the packs of the cold tier, as cold/pack-N.dat.
+	backupCold = "cold/"
+)
+
+// runBackup runs
+//
+//	globaldb backup <file>
+//	globaldb restore <file>
+//
+// Backup writes a snapshot of the datastore of a stopped node to a tar
+// file: the CRDT heads and values, the DAG blocks, the peerstore and
+// every other key, along with the packs of the cold tier. Restore loads
+// one into the empty data folder of a new node, which then starts from
+// where the backed up node was instead of fetching the whole DAG from its
+// peers. The key of the node is not part of the backup: the restored
+// node keeps its own identity.
+func runBackup(args []string, data string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s <file>", args[0])
+	}
+	if err := os.MkdirAll(data, 0755); err != nil {
+		return err
+	}
+	lock, err := lockInstance(data)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if args[0] == "restore" {
+		return restoreBackup(args[1], data)
+	}
+	store, err := openStore(data, &badger.DefaultOptions)
+	if err != nil {
+		return err
+	}
+	defer closeStore(data, store)
+	return writeBackup(args[1], data, store)
+}
+
+// writeBackup writes a backup of store, the datastore in the data folder
+// data, to path. Badger backups are consistent snapshots, so this also
+// works on the store of a running node: the cold packs are only appended
+// to, and are copied after the snapshot is taken, so they hold every
+// value it refers to.
+func writeBackup(path, data string, store *badger.Datastore) error {
+	// The size of tar entries comes first, so the snapshot goes through a
+	// temporary file.
+	snap, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(snap.Name())
+	defer snap.Close()
+	if _, err := store.DB.Backup(snap, 0); err != nil {
+		return err
+	}
+	packs, err := filepath.Glob(filepath.Join(data, "cold", "pack-*.dat"))
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(f)
+	err = addBackupFile(tw, backupStore, snap)
+	for _, p := range packs {
+		if err != nil {
+			break
+		}
+		var pack *os.File
+		if pack, err = os.Open(p); err == nil {
+			err = addBackupFile(tw, backupCold+filepath.Base(p), pack)
+			pack.Close()
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	st, _ := os.Stat(path)
+	fmt.Printf("backed up %s to %s (%d cold packs, %d bytes)\n", data, path, len(packs), st.Size())
+	return nil
+}
+
+// rotateBackup writes a backup of the running node to dir, named after
+// the time it is taken, and deletes the oldest backups there beyond keep.
+// The backup job runs it.
+func rotateBackup(dir string, keep int, data string, store *badger.Datastore) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	name := "backup-" + time.Now().UTC().Format("20060102T150405.000Z") + ".tar"
+	if err := writeBackup(filepath.Join(dir, name), data, store); err != nil {
+		return err
+	}
+	// The names sort in the order the backups were taken.
+	backups, err := filepath.Glob(filepath.Join(dir, "backup-*.tar"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(backups)
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// addBackupFile adds the content of f, from its start, to a backup.
+func addBackupFile(tw *tar.Writer, name string, f *os.File) error {
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: name, Mode: 0o600, Size: st.Size(), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, st.Size())
+	return err
+}
+
+// restoreBackup loads a backup into the data folder data, whose datastore
+// must be empty.
+func restoreBackup(path, data string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	store, err := openStore(data, &badger.DefaultOptions)
+	if err != nil {
+		return err
+	}
+	defer closeStore(data, store)
+	if err := checkEmptyStore(store); err != nil {
+		return fmt.Errorf("%s: %w, restore into an empty -data-dir or -name", data, err)
+	}
+
+	var restored bool
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch name := hdr.Name; {
+		case name == backupStore:
+			if err := store.DB.Load(tr, 256); err != nil {
+				return fmt.Errorf("loading the datastore: %w", err)
+			}
+			restored = true
+		case strings.HasPrefix(name, backupCold):
+			pack := filepath.Base(name)
+			if ok, _ := filepath.Match("pack-*.dat", pack); !ok {
+				return fmt.Errorf("unexpected %s in %s", name, path)
+			}
+			if err := restoreFile(filepath.Join(data, "cold", pack), tr); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected %s in %s", name, path)
+		}
+	}
+	if !restored {
+		return fmt.Errorf("%s holds no datastore", path)
+	}
+	fmt.Printf("restored %s from %s\n", data, path)
+	return nil
+}
+
+// checkEmptyStore fails when a store holds any key.
+func checkEmptyStore(store *badger.Datastore) error {
+	results, err := store.Query(context.Background(), query.Query{KeysOnly: true, Limit: 1})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+	for r := range results.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		return errors.New("the datastore is not empty")
+	}
+	return nil
+}
+
+func restoreFile(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// blocklistNs is the namespace in the local datastore holding the banned
+// peers, under peers/<peer ID>, and networks, under nets/<ip>_<bits>.
+// Bans are not replicated: each node decides whom it talks to.
+var blocklistNs = ds.NewKey("/blocklist")
+
+// blocklist is the connection gater of the host. Banned peers and
+// addresses in banned networks can neither dial the node nor be dialed by
+// it, whatever the reason, bitswap and pubsub included.
+type blocklist struct {
+	store ds.Datastore
+	clock dkv.WallClock
+
+	mu    sync.RWMutex
+	peers map[peer.ID]bool
+	nets  map[string]*net.IPNet
+}
+
+// loadBlocklist reads the bans kept in the local datastore. Bans record
+// the time of clock.
+func loadBlocklist(ctx context.Context, store ds.Datastore, clock dkv.WallClock) (*blocklist, error) {
+	bl := &blocklist{store: store, clock: clock, peers: make(map[peer.ID]bool), nets: make(map[string]*net.IPNet)}
+	results, err := store.Query(ctx, query.Query{Prefix: blocklistNs.String(), KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		k := ds.RawKey(r.Key)
+		switch k.Parent().BaseNamespace() {
+		case "peers":
+			if id, err := peer.Decode(k.BaseNamespace()); err == nil {
+				bl.peers[id] = true
+			}
+		case "nets":
+			if _, n, err := net.ParseCIDR(strings.Replace(k.BaseNamespace(), "_", "/", 1)); err == nil {
+				bl.nets[n.String()] = n
+			}
+		}
+	}
+	return bl, nil
+}
+
+// parseBan reads a ban target: a CIDR range, an IP address, taken as a
+// single-address range, or a peer, by ID or alias.
+func parseBan(s string, al *aliases) (peer.ID, *net.IPNet, error) {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return "", n, nil
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return "", &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	id, err := al.resolve(s)
+	if err != nil {
+		return "", nil, fmt.Errorf("%q is neither a peer nor an IP range", s)
+	}
+	return id, nil, nil
+}
+
+func netKey(n *net.IPNet) ds.Key {
+	return blocklistNs.ChildString("nets").ChildString(strings.Replace(n.String(), "/", "_", 1))
+}
+
+func peerBanKey(id peer.ID) ds.Key {
+	return blocklistNs.ChildString("peers").ChildString(id.String())
+}
+
+// ban blocks a peer or a network and closes the connections already
+// open with them.
+func (bl *blocklist) ban(ctx context.Context, id peer.ID, n *net.IPNet, nw network.Network) error {
+	if id != "" && id == nw.LocalPeer() {
+		return fmt.Errorf("cannot ban this node")
+	}
+	k := peerBanKey(id)
+	if n != nil {
+		k = netKey(n)
+	}
+	if err := bl.store.Put(ctx, k, []byte(bl.clock.Now().UTC().Format(time.RFC3339))); err != nil {
+		return err
+	}
+	bl.mu.Lock()
+	if n != nil {
+		bl.nets[n.String()] = n
+	} else {
+		bl.peers[id] = true
+	}
+	bl.mu.Unlock()
+	for _, c := range nw.Conns() {
+		if c.RemotePeer() == id || (n != nil && bl.blockedAddr(c.RemoteMultiaddr())) {
+			c.Close()
+		}
+	}
+	return nil
+}
+
+// unban lifts the ban of a peer or a network.
+func (bl *blocklist) unban(ctx context.Context, id peer.ID, n *net.IPNet) error {
+	k := peerBanKey(id)
+	if n != nil {
+		k = netKey(n)
+	}
+	if err := bl.store.Delete(ctx, k); err != nil {
+		return err
+	}
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if n != nil {
+		delete(bl.nets, n.String())
+	} else {
+		delete(bl.peers, id)
+	}
+	return nil
+}
+
+// list returns the banned peers and networks.
+func (bl *blocklist) list() (peers []peer.ID, nets []string) {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	for id := range bl.peers {
+		peers = append(peers, id)
+	}
+	for n := range bl.nets {
+		nets = append(nets, n)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+	sort.Strings(nets)
+	return peers, nets
+}
+
+func (bl *blocklist) blockedPeer(id peer.ID) bool {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	return bl.peers[id]
+}
+
+func (bl *blocklist) blockedAddr(a multiaddr.Multiaddr) bool {
+	ip, err := manet.ToIP(a)
+	if err != nil {
+		return false
+	}
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	for _, n := range bl.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// blocked counts a refused connection.
+func blocked(reason string) bool {
+	connectionsBlocked.WithLabelValues(reason).Inc()
+	return false
+}
+
+func (bl *blocklist) InterceptPeerDial(p peer.ID) bool {
+	if bl.blockedPeer(p) {
+		return blocked("peer")
+	}
+	return true
+}
+
+func (bl *blocklist) InterceptAddrDial(p peer.ID, a multiaddr.Multiaddr) bool {
+	if bl.blockedAddr(a) {
+		return blocked("net")
+	}
+	return true
+}
+
+func (bl *blocklist) InterceptAccept(cm network.ConnMultiaddrs) bool {
+	if bl.blockedAddr(cm.RemoteMultiaddr()) {
+		return blocked("net")
+	}
+	return true
+}
+
+func (bl *blocklist) InterceptSecured(_ network.Direction, p peer.ID, _ network.ConnMultiaddrs) bool {
+	if bl.blockedPeer(p) {
+		return blocked("peer")
+	}
+	return true
+}
+
+func (bl *blocklist) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// bootstrapNs holds one key per node that offers itself as a bootstrap
+// node, named after its peer ID.
+var bootstrapNs = systemNs.ChildString("bootstrap")
+
+// bootstrapRecord lists the addresses a node can be dialed on. It is
+// signed by the node so that nobody else can redirect its entry.
+type bootstrapRecord struct {
+	Addrs     []string  `json:"addrs"`
+	Expires   time.Time `json:"expires"`
+	Signature []byte    `json:"signature"`
+}
+
+func (r *bootstrapRecord) signedData(id peer.ID) []byte {
+	buf := []byte("globaldb-bootstrap:" + id.String() + "\n" + strings.Join(r.Addrs, "\n") + "\n")
+	return binary.BigEndian.AppendUint64(buf, uint64(r.Expires.UnixNano()))
+}
+
+// verify checks that the record is signed by id and has not expired at
+// now.
+func (r *bootstrapRecord) verify(id peer.ID, now time.Time) error {
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return err
+	}
+	ok, err := pub.Verify(r.signedData(id), r.Signature)
+	if err != nil || !ok {
+		return errors.New("invalid signature")
+	}
+	if now.After(r.Expires) {
+		return errors.New("expired")
+	}
+	return nil
+}
+
+// publishBootstrap writes a record of the host's dialable addresses,
+// valid for ttl. Loopback addresses are left out unless there is nothing
+// else.
+func publishBootstrap(ctx context.Context, kv *db, h host.Host, priv crypto.PrivKey, ttl time.Duration) error {
+	var addrs []string
+	for _, a := range h.Addrs() {
+		if !manet.IsIPLoopback(a) {
+			addrs = append(addrs, a.String())
+		}
+	}
+	if len(addrs) == 0 {
+		for _, a := range h.Addrs() {
+			addrs = append(addrs, a.String())
+		}
+	}
+	rec := bootstrapRecord{Addrs: addrs, Expires: kv.now().Add(ttl).UTC()}
+	sig, err := priv.Sign(rec.signedData(h.ID()))
+	if err != nil {
+		return err
+	}
+	rec.Signature = sig
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return kv.Put(ctx, bootstrapNs.ChildString(h.ID().String()), data)
+}
+
+// bootstrapPeers returns the peers with a valid record in the registry.
+func bootstrapPeers(ctx context.Context, kv *db) ([]peer.AddrInfo, error) {
+	results, err := kv.Query(ctx, query.Query{Prefix: bootstrapNs.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	var infos []peer.AddrInfo
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		id, err := peer.Decode(ds.RawKey(r.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+		var rec bootstrapRecord
+		if err := json.Unmarshal(r.Value, &rec); err != nil {
+			continue
+		}
+		if err := rec.verify(id, kv.now()); err != nil {
+			logger.Debugf("ignoring bootstrap record of %s: %s", id, err)
+			continue
+		}
+		info := peer.AddrInfo{ID: id}
+		for _, s := range rec.Addrs {
+			if a, err := multiaddr.NewMultiaddr(s); err == nil {
+				info.Addrs = append(info.Addrs, a)
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// dialBootstrapPeers adds the peers found in the registry to the
+// peerstore and dials those we are not connected to. The registry job
+// runs it, first after a while so that the registry has had a chance to
+// sync; the advertise job keeps the record of the node fresh.
+func dialBootstrapPeers(ctx context.Context, kv *db, h host.Host) error {
+	infos, err := bootstrapPeers(ctx, kv)
+	if err != nil {
+		return fmt.Errorf("reading bootstrap registry: %w", err)
+	}
+	for _, info := range infos {
+		if info.ID == h.ID() {
+			continue
+		}
+		h.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.AddressTTL)
+		if h.Network().Connectedness(info.ID) != network.Connected {
+			go func(info peer.AddrInfo) {
+				if err := h.Connect(ctx, info); err != nil {
+					logger.Debugf("dialing bootstrap peer %s: %s", info.ID, err)
+				}
+			}(info)
+		}
+	}
+	return nil
+}
+
+func printBootstrapPeers(infos []peer.AddrInfo) {
+	if len(infos) == 0 {
+		fmt.Println("no bootstrap peers registered")
+		return
+	}
+	for _, info := range infos {
+		fmt.Println(info.ID)
+		for _, a := range info.Addrs {
+			fmt.Printf("  %s\n", a)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// bulkDelete holds the options of del --prefix.
+type bulkDelete struct {
+	prefix ds.Key
+	// rate is how many keys are deleted per second at most.
+	rate float64
+	// batch is how many keys go in each delta.
+	batch int
+}
+
+// parseBulkDelete parses
+//
+//	del --prefix <prefix> [--rate N/s] [--batch N]
+//
+// The rate is a number of keys per second, or per minute with /m.
+func parseBulkDelete(args []string) (bulkDelete, error) {
+	var bd bulkDelete
+	fs := flag.NewFlagSet("del", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "prefix to delete the keys under")
+	rate := fs.String("rate", "1000/s", "most keys deleted per second (N/s) or minute (N/m)")
+	fs.IntVar(&bd.batch, "batch", 100, "keys deleted in each delta")
+	if err := fs.Parse(args); err != nil {
+		return bd, err
+	}
+	if *prefix == "" || fs.NArg() > 0 {
+		return bd, errors.New("usage: del --prefix <prefix> [--rate N/s] [--batch N]")
+	}
+	if bd.batch <= 0 {
+		return bd, fmt.Errorf("invalid batch %d", bd.batch)
+	}
+	bd.prefix = ds.NewKey(*prefix)
+	n, unit, _ := strings.Cut(*rate, "/")
+	r, err := strconv.ParseFloat(n, 64)
+	if err != nil || r <= 0 {
+		return bd, fmt.Errorf("invalid rate %q", *rate)
+	}
+	switch unit {
+	case "", "s":
+	case "m":
+		r /= 60
+	default:
+		return bd, fmt.Errorf("invalid rate %q, want N/s or N/m", *rate)
+	}
+	bd.rate = r
+	return bd, nil
+}
+
+// replBulkDelete deletes the keys under a prefix in batches of one delta
+// each, spaced so as not to exceed the rate, printing its progress. A
+// single delta removing a large prefix is one huge DAG node every peer
+// must fetch at once; spreading the deletion keeps the mesh usable.
+//
+// Entering a line stops it. Deleted keys are gone, so running the same
+// command again resumes where it stopped, here or on another node. It
+// returns false when the REPL should stop, because stdin was closed or
+// the process was interrupted.
+func replBulkDelete(ctx context.Context, kv *db, bd bulkDelete, lines <-chan string, signals <-chan os.Signal) bool {
+	total, err := countKeys(ctx, kv, bd.prefix)
+	if err != nil {
+		printErr(err)
+		return true
+	}
+	fmt.Printf("Deleting %d keys under %s at %g keys/s, press Enter to stop\n", total, bd.prefix, bd.rate)
+	start := kv.now()
+	var deleted int
+	for {
+		n, err := kv.DeletePrefixBatch(ctx, bd.prefix, bd.batch)
+		deleted += n
+		if err != nil {
+			printErr(fmt.Errorf("after %d keys: %w", deleted, err))
+			return true
+		}
+		if n == 0 {
+			break
+		}
+		if deleted > total {
+			// Keys were written under the prefix meanwhile.
+			total = deleted
+		}
+		fmt.Printf("deleted %d/%d keys (%d%%)\n", deleted, total, deleted*100/total)
+
+		next := start.Add(time.Duration(float64(deleted) / bd.rate * float64(time.Second)))
+		select {
+		case <-kv.clock.Wall.After(next.Sub(kv.now())):
+		case _, ok := <-lines:
+			fmt.Printf("Stopped after %d keys, run the command again to resume\n", deleted)
+			return ok
+		case <-signals:
+			fmt.Println()
+			return false
+		}
+	}
+	fmt.Printf("Deleted %d keys in %s\n", deleted, kv.now().Sub(start).Round(time.Millisecond))
+	return true
+}
+
+// countKeys counts the keys under a prefix that DeletePrefix removes.
+func countKeys(ctx context.Context, kv *db, prefix ds.Key) (int, error) {
+	results, err := kv.Query(ctx, query.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer results.Close()
+	var n int
+	for r := range results.Next() {
+		if r.Error != nil {
+			return 0, r.Error
+		}
+		k := ds.NewKey(r.Key)
+		if systemNs.IsAncestorOf(k) && !prefix.Equal(systemNs) && !systemNs.IsAncestorOf(prefix) {
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// catalogNs holds the catalog: one entry per advertised database, keyed
+// by its topic. It lives in the default database, so every node of the
+// topic can browse the databases advertised there and join them.
+var catalogNs = systemNs.ChildString("catalog")
+
+// catalogEntry advertises a database.
+type catalogEntry struct {
+	Name  string `json:"name"`
+	Topic string `json:"topic"`
+	// Description tells what the database holds.
+	Description string `json:"description,omitempty"`
+	// Schema links to the description of the keys and values.
+	Schema string `json:"schema,omitempty"`
+	// Access tells who may write: open, pow, writers or acl, as the
+	// publishing node enforces it.
+	Access    string    `json:"access"`
+	Publisher string    `json:"publisher"`
+	Updated   time.Time `json:"updated"`
+}
+
+func catalogKey(topic string) ds.Key {
+	return catalogNs.Child(ds.NewKey(topic))
+}
+
+// accessMode is the access of the database of the topic on this node.
+// Named databases are not restricted by -acl or -admission.
+func accessMode(named bool, acl *peerACL) string {
+	switch {
+	case named:
+		return admitOpen
+	case acl != nil:
+		return "acl"
+	}
+	return admissionPolicy
+}
+
+// Advertise writes the catalog entry of a database.
+func (d *db) Advertise(ctx context.Context, e catalogEntry) error {
+	e.Updated = d.now().UTC()
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return d.Put(ctx, catalogKey(e.Topic), v)
+}
+
+// Unadvertise removes the catalog entry of a topic.
+func (d *db) Unadvertise(ctx context.Context, topic string) error {
+	return d.Delete(ctx, catalogKey(topic))
+}
+
+// Catalog lists the advertised databases by topic. Entries that cannot
+// be read are skipped.
+func (d *db) Catalog(ctx context.Context) ([]catalogEntry, error) {
+	results, err := d.Query(ctx, query.Query{Prefix: catalogNs.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	entries := []catalogEntry{}
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		var e catalogEntry
+		if err := json.Unmarshal(r.Value, &e); err != nil || e.Topic == "" {
+			logger.Debugf("ignoring catalog entry %s: not an entry", r.Key)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Topic < entries[j].Topic })
+	return entries, nil
+}
+
+// parseCatalogPublish parses the arguments of
+//
+//	catalog publish [--schema <url>] <description>
+func parseCatalogPublish(args []string) (schema, description string, err error) {
+	if len(args) >= 2 && args[0] == "--schema" {
+		schema, args = args[1], args[2:]
+	}
+	if len(args) == 0 {
+		return "", "", fmt.Errorf("usage: catalog publish [--schema <url>] <description>")
+	}
+	return schema, strings.Join(args, " "), nil
+}
+
+// formatCatalogEntry renders an entry for the REPL and globaldb discover.
+func formatCatalogEntry(e catalogEntry) string {
+	s := fmt.Sprintf("%s  (topic %s, %s)", e.Name, e.Topic, e.Access)
+	if e.Description != "" {
+		s += "\n  " + e.Description
+	}
+	if e.Schema != "" {
+		s += "\n  schema: " + e.Schema
+	}
+	return s + fmt.Sprintf("\n  by %s, %s", e.Publisher, e.Updated.Format(time.RFC3339))
+}
+
+// catalog serves GET /v1/catalog.
+func (a *restAPI) catalog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := a.authorize(w, r, verbRead, catalogNs); !ok {
+		return
+	}
+	entries, err := a.kv.Catalog(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entries)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+)
+
+// The challenges of -write-challenge.
+const (
+	challengeNone = "none"
+	// challengeToken requires a fresh challenge from GET /v1/challenge
+	// per write, which ties writes to the rate at which challenges are
+	// handed out.
+	challengeToken = "token"
+	// challengePoW requires a proof of work on a fresh challenge.
+	challengePoW = "pow"
+	// challengeVerify hands the answer of a CAPTCHA to an external
+	// verifier, with the siteverify API of hCaptcha, reCAPTCHA and
+	// Turnstile.
+	challengeVerify = "verify"
+)
+
+// challengeHeader carries the answer to the challenge: the challenge for
+// token, <challenge>:<solution> for pow and the CAPTCHA response for
+// verify.
+const challengeHeader = "X-Globaldb-Challenge"
+
+// challengeTTL is how long a challenge may be answered.
+const challengeTTL = 5 * time.Minute
+
+// ErrChallenge is returned when an anonymous write does not answer the
+// challenge.
+var ErrChallenge = errors.New("write challenge not met")
+
+// writeChallenge guards the writes made through the HTTP API without an
+// API token, so that a public gateway does not write whatever anyone
+// sends at whatever rate. Each anonymous write must answer a challenge.
+// They are rate limited per client address: with token and pow through
+// the challenges handed out, which allow a single write each, otherwise
+// write by write. The rate may change on reload. Challenges are signed
+// rather than stored, and each is spent by the write answering it.
+type writeChallenge struct {
+	mode   string
+	bits   int
+	verify string
+	secret string
+	client *http.Client
+	// key signs the challenges. It is drawn at startup: challenges do not
+	// outlive the node.
+	key   []byte
+	limit *tokenBuckets
+	clock dkv.WallClock
+
+	mu    sync.Mutex
+	spent map[string]time.Time
+}
+
+func newWriteChallenge(mode string, bits int, verifyURL, secret string, rate float64, burst int, clock dkv.WallClock) (*writeChallenge, error) {
+	switch mode {
+	case challengeNone, challengeToken:
+	case challengePoW:
+		if bits < 1 || bits > 32 {
+			return nil, fmt.Errorf("-challenge-bits must be between 1 and 32, not %d", bits)
+		}
+	case challengeVerify:
+		if verifyURL == "" {
+			return nil, errors.New("-write-challenge verify needs -challenge-verify-url")
+		}
+	default:
+		return nil, fmt.Errorf("unknown write challenge %q: use none, token, pow or verify", mode)
+	}
+	c := &writeChallenge{
+		mode:   mode,
+		bits:   bits,
+		verify: verifyURL,
+		secret: secret,
+		client: &http.Client{Timeout: 10 * time.Second},
+		key:    make([]byte, 32),
+		spent:  make(map[string]time.Time),
+		limit:  newTokenBuckets(rate, burst, clock),
+		clock:  clock,
+	}
+	if _, err := rand.Read(c.key); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// clientAddr is the address anonymous writes are rate limited by.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (c *writeChallenge) sign(payload []byte) []byte {
+	m := hmac.New(sha256.New, c.key)
+	m.Write(payload)
+	return m.Sum(nil)[:16]
+}
+
+// issue hands out a challenge: its expiry and a random nonce, signed.
+func (c *writeChallenge) issue() (string, time.Time, error) {
+	expires := c.clock.Now().Add(challengeTTL).Truncate(time.Second)
+	payload := binary.BigEndian.AppendUint64(nil, uint64(expires.Unix()))
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", time.Time{}, err
+	}
+	payload = append(payload, nonce...)
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(c.sign(payload)), expires, nil
+}
+
+// redeem checks that a challenge was issued by the node, has not expired
+// and was not answered before, and spends it.
+func (c *writeChallenge) redeem(challenge string) error {
+	enc := base64.RawURLEncoding
+	p, s, ok := strings.Cut(challenge, ".")
+	payload, err1 := enc.DecodeString(p)
+	sig, err2 := enc.DecodeString(s)
+	if !ok || err1 != nil || err2 != nil || len(payload) != 24 || !hmac.Equal(sig, c.sign(payload)) {
+		return fmt.Errorf("%w: invalid challenge", ErrChallenge)
+	}
+	now := c.clock.Now()
+	expires := time.Unix(int64(binary.BigEndian.Uint64(payload)), 0)
+	if now.After(expires) {
+		return fmt.Errorf("%w: challenge expired", ErrChallenge)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.spent[challenge]; ok {
+		return fmt.Errorf("%w: challenge already answered", ErrChallenge)
+	}
+	for ch, exp := range c.spent {
+		if now.After(exp) {
+			delete(c.spent, ch)
+		}
+	}
+	c.spent[challenge] = expires
+	return nil
+}
+
+// powHash is the hash a solution to a pow challenge is checked on.
+func powHash(challenge, solution string) [32]byte {
+	return sha256.Sum256([]byte(challenge + ":" + solution))
+}
+
+// check verifies the answer of a request to the challenge.
+func (c *writeChallenge) check(r *http.Request) error {
+	answer := r.Header.Get(challengeHeader)
+	if answer == "" {
+		if c.mode == challengeVerify {
+			return fmt.Errorf("%w: send the CAPTCHA response in %s", ErrChallenge, challengeHeader)
+		}
+		return fmt.Errorf("%w: GET /v1/challenge and answer it in %s", ErrChallenge, challengeHeader)
+	}
+	switch c.mode {
+	case challengeToken:
+		return c.redeem(answer)
+	case challengePoW:
+		challenge, solution, ok := strings.Cut(answer, ":")
+		if !ok || leadingZeros(powHash(challenge, solution)) < c.bits {
+			return fmt.Errorf("%w: proof of work under %d bits", ErrChallenge, c.bits)
+		}
+		return c.redeem(challenge)
+	case challengeVerify:
+		return c.siteverify(r, answer)
+	}
+	return nil
+}
+
+// siteverify asks the external verifier whether a CAPTCHA response is
+// valid.
+func (c *writeChallenge) siteverify(r *http.Request, response string) error {
+	form := url.Values{"secret": {c.secret}, "response": {response}, "remoteip": {clientAddr(r)}}
+	resp, err := c.client.PostForm(c.verify, form)
+	if err != nil {
+		return fmt.Errorf("verifying the challenge: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("verifying the challenge: %s answered %s", c.verify, resp.Status)
+	}
+	var res struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("verifying the challenge: %w", err)
+	}
+	if !res.Success {
+		return fmt.Errorf("%w: rejected by the verifier", ErrChallenge)
+	}
+	return nil
+}
+
+// throttle takes a token from the bucket of the client of the request. It
+// answers the request and returns false when there is none left.
+func (c *writeChallenge) throttle(w http.ResponseWriter, r *http.Request) bool {
+	if c.limit.take(clientAddr(r)) {
+		return true
+	}
+	anonymousWritesRefused.WithLabelValues("rate").Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(c.limit.retryAfter().Seconds())+1))
+	http.Error(w, "too many anonymous writes, slow down", http.StatusTooManyRequests)
+	return false
+}
+
+// admit lets a write through when it was made with an API token, or when
+// it is within the rate limit and answers the challenge. It answers the
+// request and returns false when not.
+func (c *writeChallenge) admit(w http.ResponseWriter, r *http.Request, token *apiToken) bool {
+	if c == nil || token != nil {
+		return true
+	}
+	// Challenges of the node are rate limited as they are handed out,
+	// and each allows a single write.
+	if (c.mode == challengeNone || c.mode == challengeVerify) && !c.throttle(w, r) {
+		return false
+	}
+	if c.mode == challengeNone {
+		return true
+	}
+	if err := c.check(r); err != nil {
+		status := http.StatusForbidden
+		if !errors.Is(err, ErrChallenge) {
+			status = http.StatusBadGateway
+		}
+		anonymousWritesRefused.WithLabelValues("challenge").Inc()
+		http.Error(w, err.Error(), status)
+		return false
+	}
+	return true
+}
+
+// challengeResponse is the answer of GET /v1/challenge.
+type challengeResponse struct {
+	Mode      string     `json:"mode"`
+	Challenge string     `json:"challenge,omitempty"`
+	Bits      int        `json:"bits,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+}
+
+// challenge serves GET /v1/challenge. Challenges count against the rate
+// limit of the client like writes do.
+func (a *restAPI) challenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c := a.challenges
+	if c == nil || c.mode == challengeNone {
+		http.Error(w, "anonymous writes need no challenge", http.StatusNotFound)
+		return
+	}
+	resp := challengeResponse{Mode: c.mode}
+	if c.mode != challengeVerify {
+		if !c.throttle(w, r) {
+			return
+		}
+		challenge, expires, err := c.issue()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.Challenge, resp.Expires = challenge, &expires
+		if c.mode == challengePoW {
+			resp.Bits = c.bits
+		}
+	}
+	writeJSON(w, resp)
+}
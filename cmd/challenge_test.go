@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+)
+
+func TestWriteChallengeRedeem(t *testing.T) {
+	tests := []struct {
+		name string
+		wait time.Duration
+		// twice redeems the challenge a second time.
+		twice bool
+		ok    bool
+	}{
+		{"fresh", time.Minute, false, true},
+		{"expired", challengeTTL + time.Second, false, false},
+		{"answered twice", 0, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := dkv.NewManualClock(time.Unix(1000, 0))
+			c, err := newWriteChallenge(challengeToken, 0, "", "", 0, 1, clock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ch, _, err := c.issue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			clock.Advance(tt.wait)
+			err = c.redeem(ch)
+			if tt.twice && err == nil {
+				err = c.redeem(ch)
+			}
+			if got := err == nil; got != tt.ok {
+				t.Fatalf("redeem: %v", err)
+			}
+			if err != nil && !errors.Is(err, ErrChallenge) {
+				t.Errorf("redeem: %v is not ErrChallenge", err)
+			}
+		})
+	}
+}
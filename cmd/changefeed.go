@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// change is a single entry of the change feed.
+type change struct {
+	Seq   uint64 `json:"seq"`
+	Op    string `json:"op"` // "put" or "delete"
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	// Time is when the change was applied locally.
+	Time time.Time `json:"time"`
+	// Decoded is the value rendered by the codec of its prefix, when
+	// asked for with decode=1.
+	Decoded interface{} `json:"decoded,omitempty"`
+}
+
+// changesResponse is the body returned by the change feed endpoint.
+type changesResponse struct {
+	// Epoch identifies this run of the feed. Sequence numbers are only
+	// meaningful within an epoch.
+	Epoch string `json:"epoch"`
+	// Seq is the sequence number to ask for next time.
+	Seq uint64 `json:"seq"`
+	// Reset tells the client to drop everything it has: Changes holds
+	// a full snapshot.
+	Reset bool `json:"reset,omitempty"`
+	// Compacted tells a named consumer that the reset is because it fell
+	// behind what the feed retains, rather than because the feed
+	// restarted.
+	Compacted bool     `json:"compacted,omitempty"`
+	Changes   []change `json:"changes"`
+}
+
+// consumerTTL is how long a consumer that stopped polling is tracked.
+const consumerTTL = 24 * time.Hour
+
+// feedRetention bounds what the change feed keeps. Zero fields do not
+// bound it.
+type feedRetention struct {
+	Count int
+	Bytes int64
+	Age   time.Duration
+}
+
+// feedConsumer is the position of a named client of the feed.
+type feedConsumer struct {
+	// Seq is the last change the consumer has.
+	Seq  uint64
+	Seen time.Time
+	// Behind is set once changes it did not get were dropped.
+	Behind bool
+}
+
+// changeFeed keeps the most recent changes applied to the store so that
+// clients can follow them over HTTP. Clients that fall behind the
+// retained window get a full snapshot instead.
+//
+// Clients naming themselves with consumer=<name> are tracked: their lag
+// is exported as a metric, and dropping changes they did not get yet is
+// logged and tells them so, rather than silently sending a snapshot.
+type changeFeed struct {
+	epoch     string
+	retention feedRetention
+	clock     dkv.WallClock
+
+	mu        sync.Mutex
+	seq       uint64
+	buf       []change
+	bytes     int64
+	consumers map[string]*feedConsumer
+	updated   chan struct{} // closed and replaced on every change
+}
+
+func newChangeFeed(retention feedRetention, clock dkv.WallClock) *changeFeed {
+	epoch := make([]byte, 8)
+	rand.Read(epoch)
+	return &changeFeed{
+		epoch:     hex.EncodeToString(epoch),
+		retention: retention,
+		clock:     clock,
+		consumers: make(map[string]*feedConsumer),
+		updated:   make(chan struct{}),
+	}
+}
+
+// changeSize is what a change counts for in the retention bytes.
+func changeSize(c change) int64 {
+	return int64(len(c.Key) + len(c.Value))
+}
+
+// record appends a change to the feed. It is called from the CRDT hooks.
+func (f *changeFeed) record(op string, k ds.Key, v []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	c := change{Seq: f.seq, Op: op, Key: k.String(), Value: v, Time: f.clock.Now()}
+	f.buf = append(f.buf, c)
+	f.bytes += changeSize(c)
+	f.compact(c.Time)
+	close(f.updated)
+	f.updated = make(chan struct{})
+}
+
+// compact drops the oldest changes beyond the retention, always keeping
+// the last one.
+func (f *changeFeed) compact(now time.Time) {
+	r := f.retention
+	var drop int
+	for drop < len(f.buf)-1 {
+		c := f.buf[drop]
+		if !(r.Count > 0 && len(f.buf)-drop > r.Count) &&
+			!(r.Bytes > 0 && f.bytes > r.Bytes) &&
+			!(r.Age > 0 && now.Sub(c.Time) > r.Age) {
+			break
+		}
+		f.bytes -= changeSize(c)
+		drop++
+	}
+	if drop == 0 {
+		return
+	}
+	f.buf = append(f.buf[:0:0], f.buf[drop:]...)
+	first := f.buf[0].Seq
+	for name, c := range f.consumers {
+		if c.Seq+1 < first && !c.Behind {
+			c.Behind = true
+			feedConsumerResets.WithLabelValues(name).Inc()
+			logger.Warnf("change feed consumer %s fell behind what the feed retains (it has change %d, the oldest kept is %d), it will get a full snapshot; raise -feed-retain* if that keeps happening", name, c.Seq, first)
+		}
+	}
+}
+
+// ack records that a consumer has every change up to seq, and tells
+// whether it fell behind the retained changes since it was last acked.
+func (f *changeFeed) ack(name string, seq uint64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.clock.Now()
+	for n, c := range f.consumers {
+		if now.Sub(c.Seen) > consumerTTL {
+			delete(f.consumers, n)
+			feedConsumerLag.DeleteLabelValues(n)
+		}
+	}
+	c, ok := f.consumers[name]
+	if !ok {
+		c = &feedConsumer{}
+		f.consumers[name] = c
+	}
+	behind := c.Behind
+	c.Seq, c.Seen, c.Behind = min(seq, f.seq), now, false
+	feedConsumerLag.WithLabelValues(name).Set(float64(f.seq - c.Seq))
+	return behind
+}
+
+// consumerStatus is a consumer of the feed, as listed by /consumers.
+type consumerStatus struct {
+	Name   string    `json:"name"`
+	Seq    uint64    `json:"seq"`
+	Lag    uint64    `json:"lag"`
+	Seen   time.Time `json:"seen"`
+	Behind bool      `json:"behind"`
+}
+
+// listConsumers returns the tracked consumers by name.
+func (f *changeFeed) listConsumers() []consumerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list := make([]consumerStatus, 0, len(f.consumers))
+	for n, c := range f.consumers {
+		list = append(list, consumerStatus{Name: n, Seq: c.Seq, Lag: f.seq - c.Seq, Seen: c.Seen, Behind: c.Behind})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// since returns the changes after seq. It returns false when those are
+// no longer retained.
+func (f *changeFeed) since(seq uint64) ([]change, uint64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if seq > f.seq {
+		return nil, f.seq, false
+	}
+	if seq == f.seq {
+		return nil, f.seq, true
+	}
+	if len(f.buf) == 0 || f.buf[0].Seq > seq+1 {
+		return nil, f.seq, false
+	}
+	changes := make([]change, f.seq-seq)
+	copy(changes, f.buf[len(f.buf)-len(changes):])
+	return changes, f.seq, true
+}
+
+// head returns the sequence number of the last change.
+func (f *changeFeed) head() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.seq
+}
+
+// recent returns the retained changes applied after the given time.
+func (f *changeFeed) recent(after time.Time) []change {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	i := sort.Search(len(f.buf), func(i int) bool { return f.buf[i].Time.After(after) })
+	return append([]change(nil), f.buf[i:]...)
+}
+
+// wait blocks until there are changes after seq or the context is done.
+func (f *changeFeed) wait(ctx context.Context, seq uint64) {
+	f.mu.Lock()
+	if f.seq > seq {
+		f.mu.Unlock()
+		return
+	}
+	updated := f.updated
+	f.mu.Unlock()
+	select {
+	case <-ctx.Done():
+	case <-updated:
+	}
+}
+
+// snapshot returns every entry in the store as a put, along with the
+// sequence number to continue from. Changes recorded while the snapshot
+// is taken are delivered again afterwards, which is harmless since
+// applying them is idempotent.
+func (f *changeFeed) snapshot(ctx context.Context, kv *db) ([]change, uint64, error) {
+	f.mu.Lock()
+	seq := f.seq
+	f.mu.Unlock()
+
+	results, err := kv.Query(ctx, query.Query{})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer results.Close()
+	var changes []change
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, 0, r.Error
+		}
+		changes = append(changes, change{Op: "put", Key: r.Key, Value: r.Value})
+	}
+	return changes, seq, nil
+}
+
+// handler serves GET /changes?epoch=<epoch>&since=<seq>&wait=<duration>.
+// When there are no new changes it waits up to the given duration for
+// some before answering. Clients only see the keys their token may read.
+// With decode=1, values under a prefix with a codec are also returned
+// decoded. With consumer=<name> the client is tracked, and GET
+// /consumers lists the tracked clients. The full-text search of idx is
+// served along with it.
+func (f *changeFeed) handler(kv *db, auth *authorizer, cs *codecs, idx *searchIndex) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/v1/search", idx.handler(auth))
+	mux.Handle("/consumers", instrument("consumers", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if _, err := auth.authenticate(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, f.listConsumers())
+	})))
+	mux.Handle("/changes", instrument("changes", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token, err := auth.authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+		since, _ := strconv.ParseUint(q.Get("since"), 10, 64)
+		wait, _ := time.ParseDuration(q.Get("wait"))
+		if wait > time.Minute {
+			wait = time.Minute
+		}
+
+		resp := changesResponse{Epoch: f.epoch}
+		ok := q.Get("epoch") == f.epoch
+		consumer := q.Get("consumer")
+		if ok && consumer != "" {
+			resp.Compacted = f.ack(consumer, since)
+		}
+		if ok {
+			if wait > 0 {
+				ctx, cancel := context.WithTimeout(r.Context(), wait)
+				f.wait(ctx, since)
+				cancel()
+			}
+			resp.Changes, resp.Seq, ok = f.since(since)
+		}
+		if !ok {
+			resp.Reset = true
+			resp.Changes, resp.Seq, err = f.snapshot(r.Context(), kv)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if consumer != "" {
+			// Count what is sent as delivered, so that only changes the
+			// consumer never got make it fall behind.
+			f.ack(consumer, resp.Seq)
+		}
+
+		decode := q.Get("decode") == "1"
+		visible := resp.Changes[:0]
+		for _, c := range resp.Changes {
+			k := ds.NewKey(c.Key)
+			if !permitted(token, verbRead, k) {
+				continue
+			}
+			if decode && c.Op == "put" {
+				if v, ok, err := cs.decode(r.Context(), k, c.Value); ok && err == nil {
+					c.Decoded = v
+				}
+			}
+			visible = append(visible, c)
+		}
+		resp.Changes = visible
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})))
+	return mux
+}
+
+// serveChangeFeed exposes the change feed on addr until the server fails.
+func serveChangeFeed(addr string, f *changeFeed, kv *db, auth *authorizer, cs *codecs, idx *searchIndex) {
+	if err := http.ListenAndServe(addr, f.handler(kv, auth, cs, idx)); err != nil {
+		logger.Errorf("change feed server: %s", err)
+	}
+}
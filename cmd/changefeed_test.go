@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestChangeFeedRetention(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention feedRetention
+		// waits are the times between the changes recorded.
+		waits []time.Duration
+		kept  int
+	}{
+		{"unbounded", feedRetention{}, []time.Duration{0, time.Hour, time.Hour}, 3},
+		{"count", feedRetention{Count: 2}, []time.Duration{0, 0, 0}, 2},
+		{"age", feedRetention{Age: time.Hour}, []time.Duration{0, 30 * time.Minute, time.Hour}, 2},
+		{"keeps the last", feedRetention{Age: time.Minute}, []time.Duration{0, time.Hour}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := dkv.NewManualClock(time.Unix(0, 0))
+			f := newChangeFeed(tt.retention, clock)
+			for _, wait := range tt.waits {
+				clock.Advance(wait)
+				f.record("put", ds.NewKey("/k"), []byte("v"))
+			}
+			if got := len(f.recent(time.Time{})); got != tt.kept {
+				t.Errorf("kept %d changes, want %d", got, tt.kept)
+			}
+			if _, _, ok := f.since(uint64(len(tt.waits) - tt.kept)); !ok {
+				t.Errorf("the kept changes are not available")
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	ds "github.com/ipfs/go-datastore"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// codec turns stored values into something that can be rendered as JSON.
+type codec interface {
+	name() string
+	decode(v []byte) (interface{}, error)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) name() string { return "json" }
+
+func (jsonCodec) decode(v []byte) (interface{}, error) {
+	if !json.Valid(v) {
+		return nil, errors.New("value is not valid JSON")
+	}
+	return json.RawMessage(v), nil
+}
+
+// cborDecMode decodes maps with string keys so that they render as JSON
+// objects.
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+}.DecMode()
+
+type cborCodec struct{}
+
+func (cborCodec) name() string { return "cbor" }
+
+func (cborCodec) decode(v []byte) (interface{}, error) {
+	var out interface{}
+	if err := cborDecMode.Unmarshal(v, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// protoCodec decodes values holding a protobuf message whose descriptor
+// comes from a FileDescriptorSet, as written by protoc --descriptor_set_out.
+type protoCodec struct {
+	msg protoreflect.MessageDescriptor
+}
+
+func newProtoCodec(descFile, msgName string) (*protoCodec, error) {
+	data, err := os.ReadFile(descFile)
+	if err != nil {
+		return nil, err
+	}
+	c, err := protoCodecFromSet(data, msgName)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", descFile, err)
+	}
+	return c, nil
+}
+
+// protoCodecFromSet is newProtoCodec for a FileDescriptorSet that has
+// already been read.
+func protoCodecFromSet(data []byte, msgName string) (*protoCodec, error) {
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, err
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(msgName))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", msgName, err)
+	}
+	msg, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a message", msgName)
+	}
+	return &protoCodec{msg: msg}, nil
+}
+
+func (c *protoCodec) name() string { return "protobuf:" + string(c.msg.FullName()) }
+
+func (c *protoCodec) decode(v []byte) (interface{}, error) {
+	m := dynamicpb.NewMessage(c.msg)
+	if err := proto.Unmarshal(v, m); err != nil {
+		return nil, err
+	}
+	out, err := protojson.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(out), nil
+}
+
+// parseCodec parses a codec spec: "json", "cbor" or
+// "protobuf:<descriptor set file>:<message name>".
+func parseCodec(spec string) (codec, error) {
+	switch {
+	case spec == "json":
+		return jsonCodec{}, nil
+	case spec == "cbor":
+		return cborCodec{}, nil
+	case strings.HasPrefix(spec, "protobuf:"):
+		file, msg, ok := strings.Cut(strings.TrimPrefix(spec, "protobuf:"), ":")
+		if !ok || file == "" || msg == "" {
+			return nil, fmt.Errorf("codec %q is not of the form protobuf:<descriptor set file>:<message name>", spec)
+		}
+		return newProtoCodec(file, msg)
+	default:
+		return nil, fmt.Errorf("unknown codec %q (known: json, cbor, protobuf:<file>:<message>)", spec)
+	}
+}
+
+// codecs maps key prefixes to the codec of the values under them.
+type codecs struct {
+	prefixes []ds.Key // longest first
+	byPrefix map[ds.Key]codec
+	// fallback, when set, gives the codec of keys under no prefix
+	// configured locally, e.g. from the schema registry.
+	fallback func(ctx context.Context, k ds.Key) codec
+}
+
+// newCodecs parses prefix=spec pairs, as given with -codec.
+func newCodecs(specs map[string]string) (*codecs, error) {
+	c := &codecs{byPrefix: make(map[ds.Key]codec, len(specs))}
+	for p, spec := range specs {
+		cd, err := parseCodec(spec)
+		if err != nil {
+			return nil, fmt.Errorf("codec for %s: %w", p, err)
+		}
+		k := ds.NewKey(p)
+		c.prefixes = append(c.prefixes, k)
+		c.byPrefix[k] = cd
+	}
+	sort.Slice(c.prefixes, func(i, j int) bool {
+		return len(c.prefixes[i].String()) > len(c.prefixes[j].String())
+	})
+	return c, nil
+}
+
+// lookup returns the codec registered for the longest prefix of k, or nil.
+func (c *codecs) lookup(ctx context.Context, k ds.Key) codec {
+	if c == nil {
+		return nil
+	}
+	for _, p := range c.prefixes {
+		if p.Equal(k) || p.IsAncestorOf(k) || p.String() == "/" {
+			return c.byPrefix[p]
+		}
+	}
+	if c.fallback != nil {
+		return c.fallback(ctx, k)
+	}
+	return nil
+}
+
+// decode decodes the value of k with its codec. It returns false when no
+// codec is registered for k.
+func (c *codecs) decode(ctx context.Context, k ds.Key, v []byte) (interface{}, bool, error) {
+	cd := c.lookup(ctx, k)
+	if cd == nil {
+		return nil, false, nil
+	}
+	out, err := cd.decode(v)
+	if err != nil {
+		return nil, true, fmt.Errorf("decoding %s as %s: %w", k, cd.name(), err)
+	}
+	return out, true, nil
+}
+
+// prettyValue renders the value of k indented when a codec is registered
+// for it, and as a plain string otherwise.
+func (c *codecs) prettyValue(ctx context.Context, k ds.Key, v []byte) (string, error) {
+	out, ok, err := c.decode(ctx, k, v)
+	if err != nil || !ok {
+		return string(v), err
+	}
+	pretty, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(pretty), nil
+}
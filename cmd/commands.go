@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/arcinston/dkv/pkg/control"
+	"github.com/arcinston/dkv/pkg/dkv"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// nodeCommand is what runNode runs: the REPL, daemon mode or a subcommand
+// working on the data folder, with the options of the subcommand.
+type nodeCommand struct {
+	name string
+	args []string
+	// restart is stop --restart.
+	restart bool
+	migrate migrateConfig
+	imp     importConfig
+	export  exportConfig
+	replica replicaConfig
+
+	// clock and rng are the clock the node runs by and the source of its
+	// random choices, the system clock and a source seeded with -seed
+	// when nil. Harnesses running nodes in process set them to run
+	// deterministically and fast-forward time.
+	clock dkv.WallClock
+	rng   *rand.Rand
+}
+
+// cliFlags are the flags of the command being run once cobra parsed them:
+// the global flags registered on the flag package, and its own.
+var cliFlags = pflag.NewFlagSet("globaldb", pflag.ContinueOnError)
+
+// clientToken is the API token of the client subcommands.
+var clientToken string
+
+func newRootCmd() *cobra.Command {
+	root := &cobra.Command{
+		Use:   "globaldb",
+		Short: "Join a global permissionless CRDT-based key-value database",
+		Long: `globaldb joins a global permissionless database replicated with CRDTs
+over IPFS. Without a subcommand it starts a node and its REPL, like
+globaldb repl. Run globaldb init once to tell the node how to join.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		PersistentPreRun: func(c *cobra.Command, _ []string) {
+			cliFlags = c.Flags()
+		},
+		Run: func(*cobra.Command, []string) {
+			if err := runNode(nodeCommand{name: "repl"}); err != nil {
+				logger.Fatal(err)
+			}
+		},
+	}
+	root.PersistentFlags().AddGoFlagSet(flag.CommandLine)
+
+	var nc nodeCommand
+	node := func(c *cobra.Command) *cobra.Command {
+		c.Run = func(c *cobra.Command, args []string) {
+			nc.name, nc.args = c.Name(), args
+			if err := runNode(nc); err != nil {
+				logger.Fatal(err)
+			}
+		}
+		return c
+	}
+	root.AddCommand(
+		initCmd(),
+		node(&cobra.Command{
+			Use:   "repl",
+			Short: "Start a node and its REPL",
+			Args:  cobra.NoArgs,
+		}),
+		node(&cobra.Command{
+			Use:   "daemon",
+			Short: "Start a node in the background, controlled through its control API",
+			Long: `daemon starts a node without a REPL. It serves the control API on
+<data-dir>/<name>/control.sock unless --control is given, which the put,
+get, list, del, peers, status and discover subcommands and the dkv client use.`,
+			Args: cobra.NoArgs,
+		}),
+	)
+
+	export := node(&cobra.Command{
+		Use:   "export",
+		Short: "Dump the keys of the local store as JSON or CSV",
+		Args:  cobra.ArbitraryArgs,
+		PreRunE: func(_ *cobra.Command, args []string) error {
+			return nc.export.check(args)
+		},
+	})
+	export.Flags().AddGoFlagSet(exportFlags(&nc.export))
+	imp := node(&cobra.Command{
+		Use:   "import [<dump>]",
+		Short: "Copy keys from redis://, etcd:// or a dump file",
+		Args:  cobra.MaximumNArgs(1),
+		PreRunE: func(_ *cobra.Command, args []string) error {
+			return nc.imp.check(args)
+		},
+	})
+	imp.Flags().AddGoFlagSet(importFlags(&nc.imp))
+	migrate := node(&cobra.Command{
+		Use:   "migrate",
+		Short: "Copy the keys of the database of a topic into another one",
+		Args:  cobra.NoArgs,
+		PreRunE: func(*cobra.Command, []string) error {
+			return nc.migrate.check()
+		},
+	})
+	migrate.Flags().AddGoFlagSet(migrateFlags(&nc.migrate))
+	replica := node(&cobra.Command{
+		Use:   "replica",
+		Short: "Follow the change feed of a gateway over HTTP into a read-only copy",
+		Args:  cobra.NoArgs,
+		PreRunE: func(*cobra.Command, []string) error {
+			return nc.replica.check()
+		},
+	})
+	replica.Flags().AddGoFlagSet(replicaFlags(&nc.replica))
+	stop := node(&cobra.Command{
+		Use:   "stop",
+		Short: "Stop the daemon behind --admin-addr",
+		Args:  cobra.NoArgs,
+	})
+	stop.Flags().BoolVar(&nc.restart, "restart", false, "start the daemon again after it stops")
+	root.AddCommand(export, imp, migrate, replica, stop,
+		node(&cobra.Command{
+			Use:   "reload",
+			Short: "Make the daemon behind --admin-addr re-read its configuration",
+			Args:  cobra.NoArgs,
+		}),
+		node(&cobra.Command{
+			Use:   "identity export|import <bundle.tar>",
+			Short: "Move the identity and known peers of a stopped node to another machine",
+			Args:  cobra.ExactArgs(2),
+		}),
+		node(&cobra.Command{
+			Use:   "backup <file>",
+			Short: "Write a snapshot of the datastore of a stopped node",
+			Args:  cobra.ExactArgs(1),
+		}),
+		node(&cobra.Command{
+			Use:   "restore <file>",
+			Short: "Load a backup into the empty data folder of a new node",
+			Args:  cobra.ExactArgs(1),
+		}),
+		node(&cobra.Command{
+			Use:   "doctor",
+			Short: "Check the data folder, ports and network of the node",
+			Args:  cobra.NoArgs,
+		}),
+		&cobra.Command{
+			Use:   "keygen swarm [<file>]",
+			Short: "Write a new swarm key for a private network",
+			Args:  cobra.RangeArgs(1, 2),
+			Run: func(_ *cobra.Command, args []string) {
+				exitOn(runKeygen(args))
+			},
+		},
+		&cobra.Command{
+			Use:   "gen-vectors [<dir>]",
+			Short: "Write the test vectors of the CRDT encoding",
+			Args:  cobra.MaximumNArgs(1),
+			Run: func(_ *cobra.Command, args []string) {
+				exitOn(runGenVectors(args))
+			},
+		},
+	)
+	root.AddCommand(clientCmds()...)
+	return root
+}
+
+// initCmd writes the config file of the data folder, with how the node
+// joins the network, and creates the identity of the node.
+func initCmd() *cobra.Command {
+	var force bool
+	c := &cobra.Command{
+		Use:   "init",
+		Short: "Set up the data folder: how the node joins and its identity",
+		Long: `init writes <data-dir>/config.yaml, or --config, with how the node joins
+the network, and creates the key of the node in <data-dir>/<name>:
+
+  globaldb init --bootstrap                  the node is a bootstrap node
+  globaldb init --bootstrap-addr <multiaddr> it joins through this one
+  globaldb init --rendezvous                 it finds its peers on the DHT
+
+--topic and --swarm-key are saved as well when given.`,
+		Args: cobra.NoArgs,
+		Run: func(*cobra.Command, []string) {
+			exitOn(runInit(force))
+		},
+	}
+	c.Flags().BoolVar(&force, "force", false, "overwrite an existing config file")
+	return c
+}
+
+func runInit(force bool) error {
+	if !isSet("bootstrap", "GLOBALDB_BOOTSTRAP") && bootstrapNodeAddr == "" && !rendezvous {
+		return errors.New("init needs --bootstrap, --bootstrap-addr or --rendezvous")
+	}
+	if dataDir == "" {
+		dataDir = defaultDataDir()
+	}
+	path := configPath
+	if path == "" {
+		if path = findConfigFile(dataDir); path == "" {
+			path = filepath.Join(dataDir, configFileNames[0])
+		}
+	}
+	if strings.HasSuffix(path, ".toml") {
+		return fmt.Errorf("%s: init only writes YAML config files", path)
+	}
+	if _, err := os.Stat(path); err == nil && !force {
+		return fmt.Errorf("%s already exists, use --force to overwrite it", path)
+	}
+	values := map[string]interface{}{"bootstrap": bootstrapNode}
+	if bootstrapNodeAddr != "" {
+		values["bootstrap-addr"] = bootstrapNodeAddr
+	}
+	if rendezvous {
+		values["rendezvous"] = true
+	}
+	if isSet("topic", "GLOBALDB_TOPIC") {
+		values["topic"] = topicName
+	}
+	if swarmKeyPath != "" {
+		abs, err := filepath.Abs(swarmKeyPath)
+		if err != nil {
+			return err
+		}
+		values["swarm-key"] = abs
+	}
+	out, err := yaml.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	data := filepath.Join(dataDir, instanceName)
+	if err := os.MkdirAll(data, 0755); err != nil {
+		return err
+	}
+	lock, err := lockInstance(data)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	priv, err := dkv.LoadKey(filepath.Join(data, "key"))
+	if err != nil {
+		return err
+	}
+	pid, err := peer.IDFromPublicKey(priv.GetPublic())
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, out, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\nPeer ID: %s\nData Folder: %s\n", path, pid, data)
+	return nil
+}
+
+// clientCmds are the subcommands working on the store of a running
+// daemon through its control API, like the dkv client.
+func clientCmds() []*cobra.Command {
+	ctx := context.Background()
+	var limit int
+	cmds := []*cobra.Command{
+		{
+			Use:   "put <key> <value>",
+			Short: "Store a value on a key of the running daemon",
+			Args:  cobra.MinimumNArgs(2),
+			Run: func(_ *cobra.Command, args []string) {
+				exitOn(controlClient().Put(ctx, args[0], []byte(strings.Join(args[1:], " "))))
+			},
+		},
+		{
+			Use:   "get <key>",
+			Short: "Print the value of a key of the running daemon",
+			Args:  cobra.ExactArgs(1),
+			Run: func(_ *cobra.Command, args []string) {
+				v, err := controlClient().Get(ctx, args[0])
+				exitOn(err)
+				fmt.Println(string(v))
+			},
+		},
+		{
+			Use:   "list [<prefix>]",
+			Short: "List the keys under a prefix of the running daemon with their values",
+			Args:  cobra.MaximumNArgs(1),
+			Run: func(_ *cobra.Command, args []string) {
+				prefix := "/"
+				if len(args) > 0 {
+					prefix = args[0]
+				}
+				entries, err := controlClient().List(ctx, prefix, limit)
+				exitOn(err)
+				for _, e := range entries {
+					fmt.Printf("[%s] -> %s\n", e.Key, string(e.Value))
+				}
+			},
+		},
+		{
+			Use:   "del <key>",
+			Short: "Delete a key of the running daemon",
+			Args:  cobra.ExactArgs(1),
+			Run: func(_ *cobra.Command, args []string) {
+				exitOn(controlClient().Delete(ctx, args[0]))
+			},
+		},
+		{
+			Use:   "peers",
+			Short: "List the peers the running daemon is connected to",
+			Args:  cobra.NoArgs,
+			Run: func(*cobra.Command, []string) {
+				peers, err := controlClient().Peers(ctx)
+				exitOn(err)
+				for _, p := range peers {
+					fmt.Println(p.ID, p.Addr)
+				}
+			},
+		},
+		{
+			Use:   "status",
+			Short: "Show the state of the running daemon",
+			Args:  cobra.NoArgs,
+			Run: func(*cobra.Command, []string) {
+				status, err := controlClient().Status(ctx)
+				exitOn(err)
+				keys := make([]string, 0, len(status))
+				for k := range status {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				for _, k := range keys {
+					fmt.Printf("%s: %v\n", k, status[k])
+				}
+			},
+		},
+		{
+			Use:   "discover",
+			Short: "List the databases advertised in the catalog of the running daemon",
+			Args:  cobra.NoArgs,
+			Run: func(*cobra.Command, []string) {
+				entries, err := controlClient().Catalog(ctx)
+				exitOn(err)
+				for _, e := range entries {
+					fmt.Println(formatCatalogEntry(catalogEntry(e)))
+				}
+			},
+		},
+	}
+	for _, c := range cmds {
+		c.Flags().StringVar(&clientToken, "token", os.Getenv("GLOBALDB_TOKEN"), "API token, only needed when --control is a TCP address (env GLOBALDB_TOKEN)")
+	}
+	cmds[2].Flags().IntVar(&limit, "limit", 0, "most keys listed (0 for no limit)")
+	return cmds
+}
+
+// controlClient returns a client of the daemon listening on --control, or
+// else on the control socket of the node folder.
+func controlClient() *control.Client {
+	addr := controlAddr
+	if addr == "" {
+		if dataDir == "" {
+			dataDir = defaultDataDir()
+		}
+		addr = filepath.Join(dataDir, instanceName, control.Socket)
+	}
+	return control.New(addr, clientToken)
+}
+
+// defaultDataDir is the data folder when -data-dir is not given.
+func defaultDataDir() string {
+	dir, err := homedir.Dir()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	return filepath.Join(dir, config)
+}
+
+// exitOn exits with status 1 on errors of a command that was understood.
+// Errors cobra returns, about the flags and arguments, exit with status 2.
+func exitOn(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// longFlags rewrites the single-dash long flags globaldb has always taken,
+// such as -data-dir, into the --data-dir form of cobra. Only the names of
+// known flags are rewritten, so values starting with a dash are left
+// alone, and nothing after --.
+func longFlags(root *cobra.Command, args []string) []string {
+	names := make(map[string]bool)
+	var walk func(c *cobra.Command)
+	walk = func(c *cobra.Command) {
+		add := func(f *pflag.Flag) { names[f.Name] = true }
+		c.PersistentFlags().VisitAll(add)
+		c.Flags().VisitAll(add)
+		for _, sub := range c.Commands() {
+			walk(sub)
+		}
+	}
+	walk(root)
+	out := make([]string, len(args))
+	for i, a := range args {
+		if a == "--" {
+			copy(out[i:], args[i:])
+			break
+		}
+		name, _, _ := strings.Cut(strings.TrimPrefix(a, "-"), "=")
+		if strings.HasPrefix(a, "-") && !strings.HasPrefix(a, "--") && len(name) > 1 && names[name] {
+			a = "-" + a
+		}
+		out[i] = a
+	}
+	return out
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// configFileNames are the files looked for in the data folder when -config
+// is not given.
+var configFileNames = []string{"config.yaml", "config.yml", "config.toml"}
+
+// findConfigFile returns the config file of the data folder, or "" when
+// there is none.
+func findConfigFile(dir string) string {
+	for _, name := range configFileNames {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// readConfigFile parses a YAML or TOML config file, depending on its
+// extension.
+func readConfigFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{})
+	if strings.HasSuffix(path, ".toml") {
+		err = toml.Unmarshal(data, &values)
+	} else {
+		err = yaml.Unmarshal(data, &values)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return values, nil
+}
+
+// flagEnvRe finds the environment variable of a flag in its usage.
+var flagEnvRe = regexp.MustCompile(`\(env (\w+)\)`)
+
+// applyConfigFile sets the flags named in a config file, e.g.
+//
+//	listen: /ip4/0.0.0.0/tcp/4001
+//	bootstrap-addr: /dnsaddr/bootstrap.example.com
+//	topic: my-db
+//	rebroadcast-interval: 10s
+//	log-level: info,globaldb=debug
+//	label:
+//	  region: eu
+//	pin-prefix: [/images, /docs]
+//
+// Flags given on the command line or through their environment variable
+// win over the file. Repeatable flags take lists, and key=value ones maps.
+func applyConfigFile(path string) error {
+	values, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	cmdLineFlags = make(map[string]bool)
+	cliFlags.Visit(func(f *pflag.Flag) { cmdLineFlags[f.Name] = true })
+	configSettings = make(map[string]string)
+	return applyConfig(path, values, nil)
+}
+
+// reloadConfigFile applies the config file again, for the settings in
+// live: the settings the node applies while it runs. A live setting no
+// longer in the file goes back to its default. It returns the other
+// settings that changed since the file was applied, which need a
+// restart.
+func reloadConfigFile(path string, live map[string]bool) ([]string, error) {
+	values, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var restart []string
+	seen := make(map[string]bool)
+	for name, v := range values {
+		seen[name] = true
+		if !live[name] && !givenElsewhere(name) && configSettings[name] != fmt.Sprint(configValues(v)) {
+			restart = append(restart, name)
+		}
+	}
+	for name := range configSettings {
+		if seen[name] {
+			continue
+		}
+		if live[name] {
+			resetFlag(flag.Lookup(name))
+			delete(configSettings, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+	sort.Strings(restart)
+	return restart, applyConfig(path, values, live)
+}
+
+var (
+	// cmdLineFlags are the flags given on the command line, which win
+	// over the config file.
+	cmdLineFlags map[string]bool
+	// configSettings are the values of the flags set from the config
+	// file, as last applied.
+	configSettings map[string]string
+)
+
+// applyConfig sets the flags to the values of the config file, only those
+// in only when it is not nil.
+func applyConfig(path string, values map[string]interface{}, only map[string]bool) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		f := flag.Lookup(name)
+		if f == nil {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %q", path, name))
+			continue
+		}
+		if givenElsewhere(name) || (only != nil && !only[name]) {
+			continue
+		}
+		vs := configValues(values[name])
+		prev := f.Value.String()
+		resetFlag(f)
+		configSettings[name] = fmt.Sprint(vs)
+		for _, v := range vs {
+			// Set marks the flag as given, like on the command line.
+			if err := cliFlags.Set(name, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s: %w", path, name, err))
+				// A single value that does not parse leaves the flag as it
+				// was.
+				if len(vs) == 1 {
+					f.Value.Set(prev)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// givenElsewhere tells whether a flag was given on the command line or
+// through its environment variable, which win over the config file.
+func givenElsewhere(name string) bool {
+	if cmdLineFlags == nil {
+		// Without a config file, every flag set was given on the command
+		// line.
+		if f := cliFlags.Lookup(name); f != nil && f.Changed {
+			return true
+		}
+	} else if cmdLineFlags[name] {
+		return true
+	}
+	f := flag.Lookup(name)
+	if f == nil {
+		return false
+	}
+	if m := flagEnvRe.FindStringSubmatch(f.Usage); m != nil {
+		if _, ok := os.LookupEnv(m[1]); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// resetFlag sets a flag back to its default, emptying repeatable ones so
+// that the values of the config file replace theirs rather than adding to
+// them.
+func resetFlag(f *flag.Flag) {
+	if r, ok := f.Value.(interface{ reset() }); ok {
+		r.reset()
+		return
+	}
+	f.Value.Set(f.DefValue)
+}
+
+// configValues turns a config file value into flag values: one per list
+// item and one key=value pair per map entry.
+func configValues(v interface{}) []string {
+	switch v := v.(type) {
+	case []interface{}:
+		var out []string
+		for _, item := range v {
+			out = append(out, configValues(item)...)
+		}
+		return out
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := make([]string, 0, len(v))
+		for _, k := range keys {
+			out = append(out, fmt.Sprintf("%s=%v", k, v[k]))
+		}
+		return out
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// listenControl opens the listener of the control API: a Unix socket at a
+// path, or a TCP address on the loopback interface such as
+// 127.0.0.1:5001 on systems without Unix sockets. It tells whether the
+// listener is a Unix socket, whose file permissions restrict who may use
+// it instead of the API tokens.
+func listenControl(addr string) (net.Listener, bool, error) {
+	if host, _, err := net.SplitHostPort(addr); err == nil && !strings.Contains(addr, "/") {
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, false, fmt.Errorf("-control %s: only loopback addresses may be used", addr)
+		}
+		l, err := net.Listen("tcp", addr)
+		return l, false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(addr), 0700); err != nil {
+		return nil, false, err
+	}
+	// A socket left by a node that crashed is removed, one still answered
+	// belongs to a running node.
+	if c, err := net.DialTimeout("unix", addr, time.Second); err == nil {
+		c.Close()
+		return nil, false, fmt.Errorf("-control %s: another node is listening there", addr)
+	}
+	if err := os.Remove(addr); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, false, err
+	}
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := os.Chmod(addr, 0600); err != nil {
+		l.Close()
+		return nil, false, err
+	}
+	return l, true, nil
+}
+
+// serveControl serves the HTTP API on the control listener until it is
+// closed, which is how the dkv client talks to a daemon. Over a Unix
+// socket no token is needed: whoever may open the socket owns the node.
+func serveControl(l net.Listener, unix bool, a restAPI) {
+	if unix {
+		a.auth = nil
+	}
+	if err := http.Serve(l, a.handler()); err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Errorf("control API: %s", err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/arcinston/dkv/lightclient"
+	"github.com/arcinston/dkv/pkg/dkv"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-ds-crdt/pb"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// dagNode is a node of the DAG as drawn by dag dot and dag json.
+type dagNode struct {
+	Cid    string `json:"cid"`
+	Height uint64 `json:"height"`
+	// Author is the peer that signed the values of the node, or else the
+	// one that announced it when it is a recent head. It is empty when
+	// neither is known.
+	Author  string   `json:"author,omitempty"`
+	Puts    int      `json:"puts"`
+	Deletes int      `json:"deletes"`
+	Links   []string `json:"links,omitempty"`
+	Head    bool     `json:"head,omitempty"`
+	// Missing is set for nodes whose block is not stored locally.
+	Missing bool `json:"missing,omitempty"`
+}
+
+// dagGraph is the recent part of the DAG, from the heads down to a depth.
+type dagGraph struct {
+	Heads []string   `json:"heads"`
+	Depth int        `json:"depth"`
+	Nodes []*dagNode `json:"nodes"`
+}
+
+// dagArgs parses
+//
+//	dag dot|json [--depth N] [<file>]
+type dagArgs struct {
+	format string
+	depth  int
+	file   string
+}
+
+func parseDagArgs(args []string) (dagArgs, error) {
+	var da dagArgs
+	usage := fmt.Errorf("usage: dag dot|json [--depth N] [<file>]")
+	if len(args) == 0 || (args[0] != "dot" && args[0] != "json") {
+		return da, usage
+	}
+	da.format = args[0]
+	fs := flag.NewFlagSet("dag", flag.ContinueOnError)
+	fs.IntVar(&da.depth, "depth", 20, "levels drawn below the heads")
+	if err := fs.Parse(args[1:]); err != nil {
+		return da, err
+	}
+	if fs.NArg() > 1 || da.depth <= 0 {
+		return da, usage
+	}
+	da.file = fs.Arg(0)
+	return da, nil
+}
+
+// dagAuthor finds out who wrote a delta: the signer of its values, with
+// plain mapping the keys of the delta back to the keys that were signed.
+func dagAuthor(delta *pb.Delta, plain func(ds.Key) ds.Key) (peer.ID, bool) {
+	for _, e := range delta.GetElements() {
+		meta, payload := dkv.DecodeValue(e.GetValue())
+		pub, err := dkv.Signer(plain(ds.NewKey(e.GetKey())), meta, payload)
+		if err != nil {
+			continue
+		}
+		if id, err := peer.IDFromPublicKey(pub); err == nil {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// walkDAG collects the nodes within depth levels of the heads, from the
+// local blocks only. Nodes reached through several paths are drawn once,
+// at the first level they are reached.
+func walkDAG(ctx context.Context, dag ipld.DAGService, heads []cid.Cid, depth int, plain func(ds.Key) ds.Key, sources *headSources) *dagGraph {
+	g := &dagGraph{Depth: depth}
+	seen := cid.NewSet()
+	level := heads
+	for _, h := range heads {
+		g.Heads = append(g.Heads, h.String())
+		seen.Add(h)
+	}
+	for d := 0; d < depth && len(level) > 0; d++ {
+		var next []cid.Cid
+		for _, c := range level {
+			n := &dagNode{Cid: c.String(), Head: d == 0}
+			g.Nodes = append(g.Nodes, n)
+			if p, ok := sources.source(c); ok {
+				n.Author = p.String()
+			}
+			nd, err := dag.Get(ctx, c)
+			if err != nil {
+				n.Missing = true
+				continue
+			}
+			delta, err := lightclient.NodeDelta(nd)
+			if err != nil {
+				n.Missing = true
+				continue
+			}
+			n.Height = delta.GetPriority()
+			n.Puts, n.Deletes = len(delta.GetElements()), len(delta.GetTombstones())
+			if id, ok := dagAuthor(delta, plain); ok {
+				n.Author = id.String()
+			}
+			for _, l := range nd.Links() {
+				n.Links = append(n.Links, l.Cid.String())
+				if seen.Visit(l.Cid) {
+					next = append(next, l.Cid)
+				}
+			}
+		}
+		level = next
+	}
+	return g
+}
+
+// writeDagDot renders the graph for Graphviz, e.g. with dot -Tsvg. Heads
+// are drawn at the top and nodes of a same height side by side, so the
+// branches left by partitions stand out.
+func writeDagDot(w io.Writer, g *dagGraph, al *aliases) error {
+	var b strings.Builder
+	b.WriteString("digraph dag {\n\trankdir=TB;\n\tnode [shape=box, fontname=monospace];\n")
+	byHeight := make(map[uint64][]string)
+	drawn := make(map[string]bool)
+	for _, n := range g.Nodes {
+		drawn[n.Cid] = true
+		label := fmt.Sprintf("%s\\nheight %d", shortCid(n.Cid), n.Height)
+		attrs := ""
+		switch {
+		case n.Missing:
+			label = shortCid(n.Cid) + "\\nnot stored locally"
+			attrs = ", style=dashed"
+		default:
+			byHeight[n.Height] = append(byHeight[n.Height], n.Cid)
+			label += fmt.Sprintf("\\n+%d -%d", n.Puts, n.Deletes)
+		}
+		if n.Author != "" {
+			author := n.Author
+			if id, err := peer.Decode(n.Author); err == nil {
+				author = al.name(id)
+			}
+			label += "\\n" + strings.ReplaceAll(author, `"`, `\"`)
+		}
+		if n.Head {
+			attrs += ", penwidth=2"
+		}
+		// Labels are quoted by hand, %q would escape their line breaks.
+		fmt.Fprintf(&b, "\t%q [label=\"%s\"%s];\n", n.Cid, label, attrs)
+	}
+	for _, n := range g.Nodes {
+		for _, l := range n.Links {
+			if drawn[l] {
+				fmt.Fprintf(&b, "\t%q -> %q;\n", n.Cid, l)
+			} else {
+				// Below the depth: show that the DAG goes on.
+				fmt.Fprintf(&b, "\t%q -> %q [style=dotted];\n\t%q [label=\"...\", shape=plaintext];\n", n.Cid, l, l)
+			}
+		}
+	}
+	heights := make([]uint64, 0, len(byHeight))
+	for h := range byHeight {
+		heights = append(heights, h)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] > heights[j] })
+	for _, h := range heights {
+		if cids := byHeight[h]; len(cids) > 1 {
+			fmt.Fprintf(&b, "\t{ rank=same; %s }\n", quoteAll(cids))
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeDagJSON(w io.Writer, g *dagGraph) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
+
+// shortCid keeps the end of a CID, which is what differs between them.
+func shortCid(c string) string {
+	if len(c) > 12 {
+		return ".." + c[len(c)-12:]
+	}
+	return c
+}
+
+func quoteAll(ss []string) string {
+	q := make([]string, len(ss))
+	for i, s := range ss {
+		q[i] = fmt.Sprintf("%q;", s)
+	}
+	return strings.Join(q, " ")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	crdt "github.com/ipfs/go-ds-crdt"
+	ipld "github.com/ipfs/go-ipld-format"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// defaultDB is the name of the database of -topic, which every node
+// holds.
+const defaultDB = "default"
+
+// dbNameRe are the valid names of the databases given with -db.
+var dbNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// databases are the databases a node holds: the default one, and those
+// named with -db. Each named database is replicated on its own topic,
+// <topic>/<name>, and kept under /db/<name> in the datastore.
+//
+// Only the default database feeds the APIs, the change feed, the search
+// index and tiering; named databases pin the content their values
+// reference on their own, and are reached from the REPL with use.
+type databases struct {
+	byName map[string]*db
+}
+
+// dbTopic is the pubsub topic of a named database.
+func dbTopic(topic, name string) string {
+	return topic + "/" + name
+}
+
+// checkDBNames validates the names given with -db.
+func checkDBNames(names []string) error {
+	seen := make(map[string]bool)
+	for _, n := range names {
+		if n == defaultDB || !dbNameRe.MatchString(n) {
+			return fmt.Errorf("-db %q: names are made of lowercase letters, digits, - and _, and %q is taken", n, defaultDB)
+		}
+		if seen[n] {
+			return fmt.Errorf("-db %q given twice", n)
+		}
+		seen[n] = true
+	}
+	return nil
+}
+
+// openNamedDB joins a named database and returns it along with a
+// function to leave it. It shares the clock, value pipelines, key
+// encryption, ACL and admission policy of the default database base, and
+// uses opts for everything but the hooks, which hooks installs.
+func openNamedDB(ctx context.Context, name, topic string, base *db, store ds.Batching, dag ipld.DAGService, psub *pubsub.PubSub, guard *headGuard, adm *admission, hooks *applyHooks, opts crdt.Options) (*db, func(), error) {
+	bctx, cancel := context.WithCancel(ctx)
+	bcast, err := crdt.NewPubSubBroadcaster(bctx, psub, dbTopic(topic, name))
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	ns := ds.NewKey("/db").ChildString(name)
+	d := &db{
+		ns:        ns,
+		store:     store,
+		clock:     base.clock,
+		pipelines: base.pipelines,
+		keys:      base.keys,
+		acl:       base.acl,
+		slowGet:   base.slowGet,
+	}
+	// The pins of the database are kept apart from those of the others,
+	// which may use the same keys.
+	pins := newPinPolicy(namespace.Wrap(store, ns), pinPrefixes)
+	hooks.install(&opts, name, d, applySinks{pins: pins})
+	c, err := crdt.New(store, ns, dag, muted(guard.wrap(dbTopic(topic, name), adm.wrap(dbTopic(topic, name), bcast))), &opts)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	d.crdt = c
+	if readOnly {
+		d.fence.seal()
+	}
+	return d, func() {
+		cancel()
+		c.Close()
+	}, nil
+}
+
+// get returns a database by name.
+func (dbs *databases) get(name string) (*db, error) {
+	d, ok := dbs.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("no database %q, the node holds %s", name, strings.Join(dbs.names(), ", "))
+	}
+	return d, nil
+}
+
+// names returns the names of the databases, the default one first.
+func (dbs *databases) names() []string {
+	names := make([]string, 0, len(dbs.byName))
+	for n := range dbs.byName {
+		if n != defaultDB {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{defaultDB}, names...)
+}
+
+// all returns the databases, the default one first.
+func (dbs *databases) all() []*db {
+	var all []*db
+	for _, n := range dbs.names() {
+		all = append(all, dbs.byName[n])
+	}
+	return all
+}
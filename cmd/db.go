@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	crdt "github.com/ipfs/go-ds-crdt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// db wraps the CRDT datastore so that every value carries metadata and
+// writes respect the write fence, frozen namespaces and schemas. It is what the
+// REPL reads from and writes to.
+type db struct {
+	crdt *crdt.Datastore
+	// ns is the namespace of the CRDT store in store.
+	ns    ds.Key
+	store ds.Datastore
+	clock *dkv.Clock
+	fence writeFence
+	// pipelines transform values before they are stored.
+	pipelines *dkv.Pipelines
+	// tier moves the values not read for a while out of Badger, nil when
+	// tiering is off.
+	tier *coldTier
+	// keys maps keys to the keys they are stored under.
+	keys keyMapper
+	// acl restricts the keys peers may write, nil when anyone may.
+	acl *peerACL
+	// schemas caches the compiled schemas of the registry.
+	schemas schemaCache
+	// slowGet is the duration above which reads are logged as slow.
+	slowGet time.Duration
+	// cas serializes the compare-and-swaps of the node.
+	cas sync.Mutex
+	// batchMu is held by the open batch of the database: go-ds-crdt
+	// builds a single delta for all the open batches of a store, so a
+	// commit would otherwise publish the writes of other batches.
+	batchMu sync.Mutex
+}
+
+// now is the time of the wall clock the node runs by.
+func (d *db) now() time.Time {
+	return d.clock.WallTime()
+}
+
+// Put stores a value stamped with the current HLC time.
+func (d *db) Put(ctx context.Context, k ds.Key, v []byte) (err error) {
+	ctx, span := startSpan(ctx, "db.Put", k.String())
+	defer func() { endSpan(span, err) }()
+	defer observeKV("put", k, time.Now())
+	release, err := d.fence.enter()
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := d.acl.mayWriteSelf(k); err != nil {
+		return err
+	}
+	if err := d.checkFrozen(ctx, k); err != nil {
+		return err
+	}
+	if err := d.checkSchema(ctx, k, v); err != nil {
+		return err
+	}
+	meta := dkv.Meta{HLC: d.clock.Now()}
+	span.SetAttributes(attribute.String("hlc", meta.HLC.String()))
+	enc, err := d.pipelines.Encode(k, meta, v)
+	if err != nil {
+		return err
+	}
+	if err := d.crdt.Put(ctx, d.keys.stored(k), dkv.EncodeValue(meta, enc)); err != nil {
+		return err
+	}
+	kvBytesWritten.WithLabelValues(kvNamespaces.label(k)).Add(float64(len(v)))
+	return nil
+}
+
+// batchOp is a write of a batch, checked and encoded, on a stored key.
+type batchOp struct {
+	k ds.Key
+	// v is nil for deletes.
+	v []byte
+	// label and size are counted in kvBytesWritten once committed.
+	label string
+	size  int
+}
+
+// applyOps writes ops in a single delta. go-ds-crdt builds one delta for
+// all the open batches of a store and cannot take writes back out of it,
+// so the ops are only added once all of them are checked and encoded, and
+// the caller holds batchMu.
+func (d *db) applyOps(ctx context.Context, ops []batchOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	b, err := d.crdt.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.v == nil {
+			err = b.Delete(ctx, op.k)
+		} else {
+			err = b.Put(ctx, op.k, op.v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := b.Commit(ctx); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.v != nil {
+			kvBytesWritten.WithLabelValues(op.label).Add(float64(op.size))
+		}
+	}
+	return nil
+}
+
+// dbBatch groups writes into a single delta, with the checks of Put and
+// Delete made as they are added. The writes reach the CRDT store on
+// Commit, so that a failed check leaves nothing behind. A batch is open
+// until it is committed or discarded, which must be done: it holds the
+// write fence, and other batches of the database wait for it.
+type dbBatch struct {
+	d       *db
+	ops     []batchOp
+	release func()
+}
+
+// Batch starts a batch of writes.
+func (d *db) Batch(ctx context.Context) (*dbBatch, error) {
+	release, err := d.fence.enter()
+	if err != nil {
+		return nil, err
+	}
+	d.batchMu.Lock()
+	return &dbBatch{d: d, release: release}, nil
+}
+
+// Put adds the put of a value to the batch.
+func (b *dbBatch) Put(ctx context.Context, k ds.Key, v []byte) error {
+	d := b.d
+	if err := d.acl.mayWriteSelf(k); err != nil {
+		return err
+	}
+	if err := d.checkFrozen(ctx, k); err != nil {
+		return err
+	}
+	if err := d.checkSchema(ctx, k, v); err != nil {
+		return err
+	}
+	meta := dkv.Meta{HLC: d.clock.Now()}
+	enc, err := d.pipelines.Encode(k, meta, v)
+	if err != nil {
+		return err
+	}
+	b.ops = append(b.ops, batchOp{k: d.keys.stored(k), v: dkv.EncodeValue(meta, enc), label: kvNamespaces.label(k), size: len(v)})
+	return nil
+}
+
+// Delete adds the removal of a key to the batch.
+func (b *dbBatch) Delete(ctx context.Context, k ds.Key) error {
+	if err := b.d.acl.mayWriteSelf(k); err != nil {
+		return err
+	}
+	if err := b.d.checkFrozen(ctx, k); err != nil {
+		return err
+	}
+	ops, err := b.d.deleteOps(ctx, k)
+	if err != nil {
+		return err
+	}
+	b.ops = append(b.ops, ops...)
+	return nil
+}
+
+// Commit applies the batch as a single delta and closes it.
+func (b *dbBatch) Commit(ctx context.Context) error {
+	if b.release == nil {
+		return errors.New("the batch is closed")
+	}
+	defer b.Discard()
+	return b.d.applyOps(ctx, b.ops)
+}
+
+// Discard closes the batch, dropping its writes, if it is still open.
+func (b *dbBatch) Discard() {
+	if b.release == nil {
+		return
+	}
+	b.release()
+	b.release = nil
+	b.ops = nil
+	b.d.batchMu.Unlock()
+}
+
+// Get returns the payload stored on a key.
+func (d *db) Get(ctx context.Context, k ds.Key) ([]byte, error) {
+	v, _, err := d.GetWithMeta(ctx, k)
+	return v, err
+}
+
+// GetWithMeta returns the payload stored on a key along with its
+// metadata.
+func (d *db) GetWithMeta(ctx context.Context, k ds.Key) ([]byte, dkv.Meta, error) {
+	defer logSlow("get", d.slowGet, time.Now(), "key", k)
+	defer observeKV("get", k, time.Now())
+	ctx, span := startSpan(ctx, "db.Get", k.String())
+	v, err := d.getStored(ctx, k)
+	endSpan(span, err)
+	if err != nil {
+		return nil, dkv.Meta{}, err
+	}
+	return d.decode(k, v)
+}
+
+// getStored returns the value stored on a key as it was replicated, with
+// its metadata and transforms. The store of the CRDT database moves
+// values read from the cold tier back to Badger.
+func (d *db) getStored(ctx context.Context, k ds.Key) ([]byte, error) {
+	sk := d.keys.stored(k)
+	v, err := d.crdt.Get(ctx, sk)
+	if err != nil {
+		return nil, err
+	}
+	d.tier.touch(sk)
+	return v, nil
+}
+
+// Author returns the peer that signed the value of a key, after checking
+// the signature, along with the metadata of the value.
+func (d *db) Author(ctx context.Context, k ds.Key) (peer.ID, dkv.Meta, error) {
+	v, err := d.getStored(ctx, k)
+	if err != nil {
+		return "", dkv.Meta{}, err
+	}
+	meta, payload := dkv.DecodeValue(v)
+	pub, err := dkv.Signer(k, meta, payload)
+	if err != nil {
+		return "", meta, fmt.Errorf("%s: %w", k, err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	return id, meta, err
+}
+
+// decode splits a stored value into its payload and metadata, reading it
+// from the cold tier if needed and undoing the transforms the value went
+// through.
+func (d *db) decode(k ds.Key, v []byte) ([]byte, dkv.Meta, error) {
+	meta, payload := dkv.DecodeValue(v)
+	if isColdStub(payload) {
+		var err error
+		if payload, err = d.tier.read(payload); err != nil {
+			return nil, meta, fmt.Errorf("%s: %w", k, err)
+		}
+	}
+	payload, err := d.pipelines.Decode(k, meta, payload)
+	if err != nil {
+		return nil, meta, fmt.Errorf("%s: %w", k, err)
+	}
+	return payload, meta, nil
+}
+
+// Delete removes a key.
+func (d *db) Delete(ctx context.Context, k ds.Key) (err error) {
+	ctx, span := startSpan(ctx, "db.Delete", k.String())
+	defer func() { endSpan(span, err) }()
+	defer observeKV("delete", k, time.Now())
+	release, err := d.fence.enter()
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := d.acl.mayWriteSelf(k); err != nil {
+		return err
+	}
+	if err := d.checkFrozen(ctx, k); err != nil {
+		return err
+	}
+	sk := d.keys.stored(k)
+	if !d.pipelines.SignaturesRequired() {
+		return d.crdt.Delete(ctx, sk)
+	}
+	// Like the CRDT store, nothing is written for keys that do not exist.
+	if ok, err := d.crdt.Has(ctx, sk); err != nil || !ok {
+		return err
+	}
+	ops, err := d.deleteOps(ctx, k)
+	if err != nil {
+		return err
+	}
+	d.batchMu.Lock()
+	defer d.batchMu.Unlock()
+	return d.applyOps(ctx, ops)
+}
+
+// CompareAndSwap stores v on a key if it holds old, or does not exist
+// when old is nil, and tells whether it did. It is only serialized with
+// the other compare-and-swaps of this node: nodes swapping the same key
+// concurrently may both succeed, and the last write wins.
+func (d *db) CompareAndSwap(ctx context.Context, k ds.Key, old, v []byte) (bool, error) {
+	d.cas.Lock()
+	defer d.cas.Unlock()
+	cur, err := d.Get(ctx, k)
+	switch {
+	case errors.Is(err, ds.ErrNotFound):
+		if old != nil {
+			return false, nil
+		}
+	case err != nil:
+		return false, err
+	case old == nil || !bytes.Equal(cur, old):
+		return false, nil
+	}
+	return true, d.Put(ctx, k, v)
+}
+
+// DeletePrefix removes every key under a prefix in a single delta and
+// returns how many there were. System keys are left alone unless the
+// prefix is itself under the system namespace.
+func (d *db) DeletePrefix(ctx context.Context, prefix ds.Key) (int, error) {
+	return d.DeletePrefixBatch(ctx, prefix, 0)
+}
+
+// DeletePrefixBatch is DeletePrefix for at most limit keys, or every key
+// when limit is 0. Calling it until it returns 0 deletes a large prefix
+// in several smaller deltas.
+func (d *db) DeletePrefixBatch(ctx context.Context, prefix ds.Key, limit int) (n int, err error) {
+	ctx, span := startSpan(ctx, "db.DeletePrefix", prefix.String())
+	defer func() { endSpan(span, err) }()
+	defer observeKV("delete", prefix, time.Now())
+	release, err := d.fence.enter()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	results, err := d.crdt.Query(ctx, query.Query{Prefix: d.keys.stored(prefix).String(), KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	var keys []ds.Key
+	for r := range results.Next() {
+		if r.Error != nil {
+			results.Close()
+			return 0, r.Error
+		}
+		k := d.keys.plain(ds.NewKey(r.Key))
+		if systemNs.IsAncestorOf(k) && !prefix.Equal(systemNs) && !systemNs.IsAncestorOf(prefix) {
+			continue
+		}
+		keys = append(keys, k)
+		if len(keys) == limit {
+			break
+		}
+	}
+	results.Close()
+	if err := d.deleteKeys(ctx, keys); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// deleteKeys removes keys in a single delta, or none of them when one may
+// not be deleted. The caller must have entered the write fence.
+func (d *db) deleteKeys(ctx context.Context, keys []ds.Key) error {
+	var ops []batchOp
+	for _, k := range keys {
+		if err := d.acl.mayWriteSelf(k); err != nil {
+			return err
+		}
+		if err := d.checkFrozen(ctx, k); err != nil {
+			return err
+		}
+		kops, err := d.deleteOps(ctx, k)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, kops...)
+	}
+	d.batchMu.Lock()
+	defer d.batchMu.Unlock()
+	return d.applyOps(ctx, ops)
+}
+
+// Query runs a query and decodes the returned values.
+// Filters and orders that look at values see the encoded values, unless
+// keys are encrypted: the query then runs on the decrypted keys and
+// decoded values, in memory. Values rejected by -signed-writes are left
+// out, as if they were not stored.
+func (d *db) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	defer observeKV("query", ds.NewKey(q.Prefix), time.Now())
+	ctx, span := startSpan(ctx, "db.Query", q.Prefix)
+	inner := q
+	if d.keys.c != nil {
+		inner = query.Query{Prefix: d.keys.stored(ds.NewKey(q.Prefix)).String(), KeysOnly: q.KeysOnly, ReturnsSizes: q.ReturnsSizes}
+	}
+	results, err := d.crdt.Query(ctx, inner)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	decoded := query.ResultsFromIterator(inner, query.Iterator{
+		Next: func() (query.Result, bool) {
+			for {
+				r, ok := results.NextSync()
+				if ok && r.Error == nil {
+					k := d.keys.plain(ds.RawKey(r.Key))
+					r.Key = k.String()
+					if r.Value != nil {
+						r.Value, _, r.Error = d.decode(k, r.Value)
+					}
+				}
+				if ok && rejected(r.Error) {
+					continue
+				}
+				return r, ok
+			}
+		},
+		Close: results.Close,
+	})
+	if d.keys.c != nil {
+		return query.NaiveQueryApply(q, decoded), nil
+	}
+	return decoded, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/arcinston/dkv/lightclient"
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	crdt "github.com/ipfs/go-ds-crdt"
+	"github.com/ipfs/go-ds-crdt/pb"
+	ipld "github.com/ipfs/go-ipld-format"
+	"google.golang.org/protobuf/proto"
+)
+
+// deltaMagic starts every delta file. It is followed by the height range,
+// the heads of the range and then the DAG blocks, all length-prefixed.
+var deltaMagic = []byte("GDBDELTA\x01")
+
+// exportDelta writes the DAG nodes whose height lies between from and to
+// (inclusive) to w. Only local blocks are used. It returns the number of
+// nodes written.
+func exportDelta(ctx context.Context, w io.Writer, dag ipld.DAGService, heads []cid.Cid, from, to uint64) (int, error) {
+	var nodes []ipld.Node
+	linked := cid.NewSet()
+	visited := cid.NewSet()
+
+	var walk func(c cid.Cid) error
+	walk = func(c cid.Cid) error {
+		if !visited.Visit(c) {
+			return nil
+		}
+		nd, err := dag.Get(ctx, c)
+		if err != nil {
+			return fmt.Errorf("getting %s: %w", c, err)
+		}
+		delta, err := lightclient.NodeDelta(nd)
+		if err != nil {
+			return fmt.Errorf("decoding %s: %w", c, err)
+		}
+		// Heights only decrease towards the leaves.
+		if delta.GetPriority() < from {
+			return nil
+		}
+		if delta.GetPriority() <= to {
+			nodes = append(nodes, nd)
+			for _, l := range nd.Links() {
+				linked.Add(l.Cid)
+			}
+		}
+		for _, l := range nd.Links() {
+			if err := walk(l.Cid); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, h := range heads {
+		if err := walk(h); err != nil {
+			return 0, err
+		}
+	}
+
+	// The heads of the range are the nodes no other node in the range
+	// links to.
+	var rangeHeads []cid.Cid
+	for _, nd := range nodes {
+		if !linked.Has(nd.Cid()) {
+			rangeHeads = append(rangeHeads, nd.Cid())
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.Write(deltaMagic)
+	writeUvarint(bw, from)
+	writeUvarint(bw, to)
+	writeUvarint(bw, uint64(len(rangeHeads)))
+	for _, h := range rangeHeads {
+		writeBytes(bw, h.Bytes())
+	}
+	for _, nd := range nodes {
+		writeBytes(bw, nd.Cid().Bytes())
+		writeBytes(bw, nd.RawData())
+	}
+	return len(nodes), bw.Flush()
+}
+
+// importDelta reads a delta file, stores its blocks and returns the heads
+// of the range so that they can be announced to the CRDT store.
+func importDelta(ctx context.Context, r io.Reader, bs blockstore.Blockstore) ([]cid.Cid, int, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, deltaMagic) {
+		return nil, 0, errors.New("not a delta file")
+	}
+	if _, err := binary.ReadUvarint(br); err != nil { // from
+		return nil, 0, err
+	}
+	if _, err := binary.ReadUvarint(br); err != nil { // to
+		return nil, 0, err
+	}
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, 0, err
+	}
+	heads := make([]cid.Cid, 0, n)
+	for i := uint64(0); i < n; i++ {
+		c, err := readCid(br)
+		if err != nil {
+			return nil, 0, err
+		}
+		heads = append(heads, c)
+	}
+
+	var count int
+	for {
+		c, err := readCid(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, count, err
+		}
+		data, err := readBytes(br)
+		if err != nil {
+			return nil, count, err
+		}
+		// Verifies that the data matches the CID.
+		blk, err := blocks.NewBlockWithCid(data, c)
+		if err != nil {
+			return nil, count, err
+		}
+		if err := bs.Put(ctx, blk); err != nil {
+			return nil, count, err
+		}
+		count++
+	}
+	return heads, count, nil
+}
+
+func writeUvarint(w *bufio.Writer, v uint64) {
+	w.Write(binary.AppendUvarint(nil, v))
+}
+
+func writeBytes(w *bufio.Writer, b []byte) {
+	writeUvarint(w, uint64(len(b)))
+	w.Write(b)
+}
+
+func readBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func readCid(r *bufio.Reader) (cid.Cid, error) {
+	b, err := readBytes(r)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.Cast(b)
+}
+
+// localBroadcaster lets the node feed head announcements to its own CRDT
+// store as if they had been received from the network, which is how
+// imported DAG nodes get merged.
+type localBroadcaster struct {
+	crdt.Broadcaster
+
+	ctx    context.Context
+	local  chan []byte
+	remote chan broadcastResult
+	once   sync.Once
+}
+
+type broadcastResult struct {
+	data []byte
+	err  error
+}
+
+func newLocalBroadcaster(ctx context.Context, b crdt.Broadcaster) *localBroadcaster {
+	return &localBroadcaster{
+		Broadcaster: b,
+		ctx:         ctx,
+		local:       make(chan []byte),
+		remote:      make(chan broadcastResult),
+	}
+}
+
+// Next returns the next payload, either received from the network or
+// announced locally.
+func (b *localBroadcaster) Next() ([]byte, error) {
+	b.once.Do(func() {
+		go func() {
+			for {
+				data, err := b.Broadcaster.Next()
+				select {
+				case b.remote <- broadcastResult{data, err}:
+				case <-b.ctx.Done():
+					return
+				}
+				if err == crdt.ErrNoMoreBroadcast {
+					return
+				}
+			}
+		}()
+	})
+
+	select {
+	case data := <-b.local:
+		return data, nil
+	case r := <-b.remote:
+		return r.data, r.err
+	case <-b.ctx.Done():
+		return nil, crdt.ErrNoMoreBroadcast
+	}
+}
+
+// announce hands the given heads to the local CRDT store.
+func (b *localBroadcaster) announce(heads []cid.Cid) error {
+	bcast := &pb.CRDTBroadcast{}
+	for _, h := range heads {
+		bcast.Heads = append(bcast.Heads, &pb.Head{Cid: h.Bytes()})
+	}
+	data, err := proto.Marshal(bcast)
+	if err != nil {
+		return err
+	}
+	select {
+	case b.local <- data:
+		return nil
+	case <-b.ctx.Done():
+		return b.ctx.Err()
+	}
+}
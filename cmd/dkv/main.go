@@ -0,0 +1,170 @@
+// Command dkv is a thin client for a globaldb daemon. It talks to the
+// control API the daemon serves on a Unix socket, so scripts and shells
+// can use the store of a running node:
+//
+//	globaldb daemon &
+//	dkv put /greeting hello
+//	dkv get /greeting
+//	dkv list /
+//	dkv del /greeting
+//	dkv peers
+//	dkv status
+//	dkv discover
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/arcinston/dkv/pkg/control"
+)
+
+const usage = `usage: dkv [-control <socket>] <command> [args]
+
+Commands:
+  put <key> <value>           store a value on a key
+  get <key>                   print the value of a key
+  list [<prefix>] [-limit N]  list the keys under a prefix with their values
+  del <key>                   delete a key
+  peers                       list the connected peers
+  status                      show the state of the node
+  discover                    list the databases advertised in the catalog
+`
+
+func run(c *control.Client, args []string) error {
+	ctx := context.Background()
+	switch cmd := args[0]; cmd {
+	case "put":
+		if len(args) < 3 {
+			return errUsage
+		}
+		return c.Put(ctx, args[1], []byte(strings.Join(args[2:], " ")))
+	case "get":
+		if len(args) != 2 {
+			return errUsage
+		}
+		v, err := c.Get(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(v))
+		return nil
+	case "del":
+		if len(args) != 2 {
+			return errUsage
+		}
+		return c.Delete(ctx, args[1])
+	case "list":
+		fs := flag.NewFlagSet("list", flag.ContinueOnError)
+		limit := fs.Int("limit", 0, "most keys listed")
+		prefix := "/"
+		rest := args[1:]
+		if len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+			prefix, rest = rest[0], rest[1:]
+		}
+		if err := fs.Parse(rest); err != nil || fs.NArg() > 0 {
+			return errUsage
+		}
+		entries, err := c.List(ctx, prefix, *limit)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			fmt.Printf("[%s] -> %s\n", e.Key, string(e.Value))
+		}
+		return nil
+	case "peers":
+		peers, err := c.Peers(ctx)
+		if err != nil {
+			return err
+		}
+		for _, p := range peers {
+			fmt.Println(p.ID, p.Addr)
+		}
+		return nil
+	case "status":
+		status, err := c.Status(ctx)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(status))
+		for k := range status {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if jobs, ok := status[k].([]interface{}); ok && k == "jobs" {
+				fmt.Println("jobs:")
+				for _, j := range jobs {
+					printJob(j)
+				}
+				continue
+			}
+			fmt.Printf("%s: %v\n", k, status[k])
+		}
+		return nil
+	case "discover":
+		entries, err := c.Catalog(ctx)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			fmt.Printf("%s  (topic %s, %s)\n", e.Name, e.Topic, e.Access)
+			if e.Description != "" {
+				fmt.Printf("  %s\n", e.Description)
+			}
+			if e.Schema != "" {
+				fmt.Printf("  schema: %s\n", e.Schema)
+			}
+		}
+		return nil
+	default:
+		fmt.Fprintf(os.Stderr, "dkv: unknown command %q\n\n", cmd)
+		return errUsage
+	}
+}
+
+// printJob prints a maintenance job of the status, as decoded from JSON.
+func printJob(j interface{}) {
+	m, ok := j.(map[string]interface{})
+	if !ok {
+		return
+	}
+	fmt.Printf("  %v (%v): %v runs, %v failed", m["name"], m["schedule"], m["runs"], m["failures"])
+	if last, ok := m["last_run"]; ok {
+		fmt.Printf(", last %v", last)
+	}
+	if err, ok := m["error"]; ok {
+		fmt.Printf(": %v", err)
+	}
+	fmt.Println()
+}
+
+var errUsage = errors.New(usage)
+
+func main() {
+	addr := flag.String("control", control.DefaultAddr(), "Unix socket or loopback host:port of the daemon control API (env GLOBALDB_CONTROL)")
+	token := flag.String("token", os.Getenv("GLOBALDB_TOKEN"), "API token, only needed over TCP (env GLOBALDB_TOKEN)")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage, "\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(control.New(*addr, *token), flag.Args()); err != nil {
+		if errors.Is(err, errUsage) {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		fmt.Fprintln(os.Stderr, "dkv:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// dnsaddrRecords returns the zone file lines that advertise the node's
+// addresses under _dnsaddr.<name>. Other nodes can then bootstrap from
+// /dnsaddr/<name>. Only public addresses are used, unless the node has
+// none, in which case every address is listed and the second return value
+// is false.
+func dnsaddrRecords(name string, id peer.ID, addrs []multiaddr.Multiaddr) ([]string, bool) {
+	var public []multiaddr.Multiaddr
+	for _, a := range addrs {
+		if manet.IsPublicAddr(a) {
+			public = append(public, a)
+		}
+	}
+	ok := len(public) > 0
+	if ok {
+		addrs = public
+	}
+
+	p2p, _ := multiaddr.NewComponent("p2p", id.String())
+	fqdn := "_dnsaddr." + strings.TrimSuffix(name, ".") + "."
+	var records []string
+	for _, a := range addrs {
+		records = append(records, fmt.Sprintf("%s 300 IN TXT \"dnsaddr=%s\"", fqdn, a.Encapsulate(p2p)))
+	}
+	return records, ok
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ipfslite "github.com/hsanjuan/ipfs-lite"
+	ds "github.com/ipfs/go-datastore"
+	badger "github.com/ipfs/go-ds-badger2"
+	libp2p "github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// maxClockSkew is the default for how far clocks may drift, either from
+// NTP in doctor or from other peers' presence messages.
+const maxClockSkew = 2 * time.Second
+
+// checkStatus is the outcome of a single doctor check.
+type checkStatus string
+
+const (
+	checkOK   checkStatus = "OK"
+	checkWarn checkStatus = "WARN"
+	checkFail checkStatus = "FAIL"
+)
+
+// checkResult describes the outcome of a doctor check and, when it did
+// not pass, how to fix the problem.
+type checkResult struct {
+	Name   string
+	Status checkStatus
+	Detail string
+	Fix    string
+}
+
+// runDoctor runs all preflight checks, prints their results and returns
+// false if any of them failed.
+func runDoctor(ctx context.Context, root string, listen []multiaddr.Multiaddr) bool {
+	checks := []func(context.Context) checkResult{
+		func(ctx context.Context) checkResult { return checkDatastore(ctx, root) },
+		func(ctx context.Context) checkResult { return checkKeyFiles(root) },
+		func(ctx context.Context) checkResult { return checkPort(listen) },
+		func(ctx context.Context) checkResult { return checkReachability() },
+		func(ctx context.Context) checkResult { return checkClock() },
+		checkBootstrap,
+	}
+
+	ok := true
+	for _, check := range checks {
+		res := check(ctx)
+		fmt.Printf("[%-4s] %s: %s\n", res.Status, res.Name, res.Detail)
+		if res.Status != checkOK && res.Fix != "" {
+			fmt.Printf("       fix: %s\n", res.Fix)
+		}
+		if res.Status == checkFail {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// checkDatastore opens a scratch Badger datastore next to the real ones
+// and performs a write, read and delete.
+func checkDatastore(ctx context.Context, root string) checkResult {
+	res := checkResult{Name: "datastore"}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		res.Status = checkFail
+		res.Detail = err.Error()
+		res.Fix = fmt.Sprintf("make sure %s is writable by this user", root)
+		return res
+	}
+	path, err := os.MkdirTemp(root, "doctor-")
+	if err != nil {
+		res.Status = checkFail
+		res.Detail = err.Error()
+		res.Fix = fmt.Sprintf("make sure %s is writable by this user", root)
+		return res
+	}
+	defer os.RemoveAll(path)
+
+	store, err := badger.NewDatastore(path, &badger.DefaultOptions)
+	if err != nil {
+		res.Status = checkFail
+		res.Detail = err.Error()
+		res.Fix = "check free disk space and that no other process holds the datastore lock"
+		return res
+	}
+	defer store.Close()
+
+	k := ds.NewKey("doctor")
+	if err := store.Put(ctx, k, []byte("ok")); err != nil {
+		res.Status = checkFail
+		res.Detail = "write failed: " + err.Error()
+		res.Fix = "check free disk space"
+		return res
+	}
+	if _, err := store.Get(ctx, k); err != nil {
+		res.Status = checkFail
+		res.Detail = "read failed: " + err.Error()
+		return res
+	}
+	if err := store.Delete(ctx, k); err != nil {
+		res.Status = checkFail
+		res.Detail = "delete failed: " + err.Error()
+		return res
+	}
+	res.Status = checkOK
+	res.Detail = "read/write works in " + root
+	return res
+}
+
+// checkKeyFiles verifies that private key files are not readable by
+// other users.
+func checkKeyFiles(root string) checkResult {
+	res := checkResult{Name: "key files"}
+	keys, _ := filepath.Glob(filepath.Join(root, "*", "key"))
+	var exposed []string
+	for _, k := range keys {
+		fi, err := os.Stat(k)
+		if err != nil {
+			continue
+		}
+		if fi.Mode().Perm()&0077 != 0 {
+			exposed = append(exposed, k)
+		}
+	}
+	if len(exposed) > 0 {
+		res.Status = checkFail
+		res.Detail = fmt.Sprintf("%d key file(s) readable by other users, e.g. %s", len(exposed), exposed[0])
+		res.Fix = "chmod 0400 the listed key files"
+		return res
+	}
+	res.Status = checkOK
+	res.Detail = fmt.Sprintf("%d key file(s) with safe permissions", len(keys))
+	return res
+}
+
+// checkPort verifies that the listen addresses can be bound.
+func checkPort(listen []multiaddr.Multiaddr) checkResult {
+	res := checkResult{Name: "listen port"}
+	var bound []string
+	for _, ma := range listen {
+		// Bind the TCP or UDP port the transport runs over.
+		ip, rest := multiaddr.SplitFirst(ma)
+		port, _ := multiaddr.SplitFirst(rest)
+		if ip == nil || port == nil {
+			res.Status = checkFail
+			res.Detail = ma.String() + " has no port"
+			return res
+		}
+		base := multiaddr.Join(ip, port)
+		var err error
+		if port.Protocol().Code == multiaddr.P_UDP {
+			var l net.PacketConn
+			if l, err = manet.ListenPacket(base); err == nil {
+				l.Close()
+			}
+		} else {
+			var l manet.Listener
+			if l, err = manet.Listen(base); err == nil {
+				l.Close()
+			}
+		}
+		if err != nil {
+			res.Status = checkFail
+			res.Detail = err.Error()
+			res.Fix = "pick a different port or stop the process using it"
+			return res
+		}
+		bound = append(bound, ma.String())
+	}
+	res.Status = checkOK
+	res.Detail = strings.Join(bound, ", ") + " can be bound"
+	return res
+}
+
+// checkReachability looks for a public address on the local interfaces.
+// Without one the node sits behind NAT and can only be dialed if port
+// mapping or hole punching succeeds.
+func checkReachability() checkResult {
+	res := checkResult{Name: "NAT reachability"}
+	addrs, err := manet.InterfaceMultiaddrs()
+	if err != nil {
+		res.Status = checkWarn
+		res.Detail = err.Error()
+		return res
+	}
+	for _, a := range addrs {
+		if manet.IsPublicAddr(a) {
+			res.Status = checkOK
+			res.Detail = "public address " + a.String()
+			return res
+		}
+	}
+	res.Status = checkWarn
+	res.Detail = "no public address on any interface, the node is behind NAT"
+	res.Fix = "enable UPnP on the router or forward the listen port to this machine"
+	return res
+}
+
+// checkClock compares the local clock against NTP.
+func checkClock() checkResult {
+	res := checkResult{Name: "clock skew"}
+	offset, err := ntpOffset("pool.ntp.org", 3*time.Second)
+	if err != nil {
+		res.Status = checkWarn
+		res.Detail = "could not query NTP: " + err.Error()
+		res.Fix = "allow outgoing UDP port 123 or check the clock manually"
+		return res
+	}
+	if absDuration(offset) > maxClockSkew {
+		res.Status = checkFail
+		res.Detail = fmt.Sprintf("local clock is off by %s", offset.Round(time.Millisecond))
+		res.Fix = "enable time synchronization (e.g. systemd-timesyncd, chrony or ntpd)"
+		return res
+	}
+	res.Status = checkOK
+	res.Detail = fmt.Sprintf("local clock is off by %s", offset.Round(time.Millisecond))
+	return res
+}
+
+// checkBootstrap tries to dial the default bootstrap peers from a
+// throwaway host.
+func checkBootstrap(ctx context.Context) checkResult {
+	res := checkResult{Name: "bootstrap peers"}
+	h, err := libp2p.New(libp2p.NoListenAddrs)
+	if err != nil {
+		res.Status = checkFail
+		res.Detail = err.Error()
+		return res
+	}
+	defer h.Close()
+
+	peers := ipfslite.DefaultBootstrapPeers()
+	var wg sync.WaitGroup
+	var reached atomic.Int32
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p peer.AddrInfo) {
+			defer wg.Done()
+			dctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			if err := h.Connect(dctx, p); err == nil {
+				reached.Add(1)
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	n := int(reached.Load())
+	switch {
+	case n == 0:
+		res.Status = checkFail
+		res.Fix = "check outgoing connectivity and firewall rules for TCP/UDP port 4001"
+	case n < len(peers)/2:
+		res.Status = checkWarn
+		res.Fix = "connectivity is partial, check firewall rules"
+	default:
+		res.Status = checkOK
+	}
+	res.Detail = fmt.Sprintf("%d of %d reachable", n, len(peers))
+	return res
+}
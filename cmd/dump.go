@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// Dump formats. JSON dumps are an array of kvEntry, as GET /v1/kv
+// returns, and keep values byte for byte. CSV dumps have a key,value
+// header and hold values as text, which suits hand-written seed data.
+const (
+	dumpJSON = "json"
+	dumpCSV  = "csv"
+)
+
+// dumpStdout is where dumps to - are written. The export subcommand
+// points os.Stdout at standard error for everything else.
+var dumpStdout io.Writer = os.Stdout
+
+// exportConfig holds the options of the export subcommand and REPL
+// command.
+type exportConfig struct {
+	Format string
+	Prefix string
+	// Output is the file written, - for standard output.
+	Output string
+}
+
+// exportFlags returns the flags of export, which fill cfg.
+func exportFlags(cfg *exportConfig) *flag.FlagSet {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.StringVar(&cfg.Format, "format", dumpJSON, "dump format: json or csv")
+	fs.StringVar(&cfg.Prefix, "prefix", "/", "only export the keys under this prefix")
+	fs.StringVar(&cfg.Output, "o", "-", "file to write the dump to, - for standard output")
+	return fs
+}
+
+// check validates the options once the flags are parsed, with args the
+// arguments left.
+func (cfg *exportConfig) check(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected %q", args[0])
+	}
+	if cfg.Format != dumpJSON && cfg.Format != dumpCSV {
+		return fmt.Errorf("-format must be %s or %s, not %q", dumpJSON, dumpCSV, cfg.Format)
+	}
+	return nil
+}
+
+func parseExportFlags(args []string) (exportConfig, error) {
+	var cfg exportConfig
+	fs := exportFlags(&cfg)
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.check(fs.Args())
+}
+
+// runExport writes the keys under cfg.Prefix to cfg.Output and returns
+// how many were written. Files are written next to their path and renamed
+// over it, so a failed export leaves no partial dump behind. System keys
+// are not exported.
+func runExport(ctx context.Context, kv *db, cfg exportConfig) (int, error) {
+	if cfg.Output == "-" {
+		return writeDump(ctx, kv, dumpStdout, cfg.Format, ds.NewKey(cfg.Prefix))
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(cfg.Output), "."+filepath.Base(cfg.Output)+"-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := writeDump(ctx, kv, tmp, cfg.Format, ds.NewKey(cfg.Prefix))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, os.Rename(tmp.Name(), cfg.Output)
+}
+
+func writeDump(ctx context.Context, kv *db, w io.Writer, format string, prefix ds.Key) (int, error) {
+	results, err := kv.Query(ctx, query.Query{Prefix: prefix.String(), Orders: []query.Order{query.OrderByKey{}}})
+	if err != nil {
+		return 0, err
+	}
+	defer results.Close()
+
+	bw := bufio.NewWriter(w)
+	var put func(k string, v []byte) error
+	var done func() error
+	switch format {
+	case dumpCSV:
+		cw := csv.NewWriter(bw)
+		if err := cw.Write([]string{"key", "value"}); err != nil {
+			return 0, err
+		}
+		put = func(k string, v []byte) error {
+			return cw.Write([]string{k, string(v)})
+		}
+		done = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		// Entries are written one by one rather than marshalled as a
+		// whole, to export keyspaces that do not fit in memory.
+		bw.WriteString("[")
+		first := true
+		put = func(k string, v []byte) error {
+			line, err := json.Marshal(kvEntry{Key: k, Value: v})
+			if err != nil {
+				return err
+			}
+			if !first {
+				bw.WriteString(",")
+			}
+			first = false
+			bw.WriteString("\n  ")
+			_, err = bw.Write(line)
+			return err
+		}
+		done = func() error {
+			_, err := bw.WriteString("\n]\n")
+			return err
+		}
+	}
+
+	var n int
+	for r := range results.Next() {
+		if r.Error != nil {
+			return 0, r.Error
+		}
+		k := ds.NewKey(r.Key)
+		if systemNs.Equal(k) || systemNs.IsAncestorOf(k) {
+			continue
+		}
+		if err := put(r.Key, r.Value); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if err := done(); err != nil {
+		return 0, err
+	}
+	return n, bw.Flush()
+}
+
+// fileSource imports a dump written by export. The format is told by the
+// extension: .csv files are CSV, anything else JSON.
+type fileSource struct {
+	path  string
+	strip string
+}
+
+func (s *fileSource) copy(ctx context.Context, follow bool, put func(string, []byte) error, del func(string) error) error {
+	if follow {
+		return errors.New("files cannot be followed")
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	each := func(k string, v []byte) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !strings.HasPrefix(k, s.strip) {
+			return nil
+		}
+		return put(k, v)
+	}
+	if strings.EqualFold(filepath.Ext(s.path), ".csv") {
+		return readCSVDump(br, each)
+	}
+	return readJSONDump(br, each)
+}
+
+// readJSONDump decodes the entries of a JSON dump one at a time.
+func readJSONDump(r io.Reader, each func(string, []byte) error) error {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return errors.New("a JSON dump must be an array of {\"key\", \"value\"} objects")
+	}
+	for dec.More() {
+		var e kvEntry
+		if err := dec.Decode(&e); err != nil {
+			return err
+		}
+		if e.Key == "" {
+			return errors.New("dump entry without a key")
+		}
+		if err := each(e.Key, e.Value); err != nil {
+			return err
+		}
+	}
+	_, err := dec.Token()
+	return err
+}
+
+// readCSVDump reads a CSV dump, whose first record must be the key,value
+// header.
+func readCSVDump(r io.Reader, each func(string, []byte) error) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	if header[0] != "key" || header[1] != "value" {
+		return errors.New("a CSV dump must start with a key,value header")
+	}
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := each(rec[0], []byte(rec[1])); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// loadPassphrase derives the encryption keys of the database from the
+// passphrase in a file. Nodes need the same passphrase and topic to read
+// each other's values.
+func loadPassphrase(path, topic string) (dkv.PassphraseKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return dkv.PassphraseKeys{}, err
+	}
+	keys, err := dkv.DerivePassphraseKeys(strings.TrimRight(string(data), "\r\n"), topic)
+	if err != nil {
+		return dkv.PassphraseKeys{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// keyMapper maps keys to the keys they are stored under, encrypting them
+// with -encrypt-keys. System keys are read by every node and stay in the
+// clear, as do keys written by nodes without the passphrase.
+type keyMapper struct {
+	c *dkv.KeyCipher
+}
+
+func (m keyMapper) clear(k ds.Key) bool {
+	return m.c == nil || k.String() == "/" || systemNs.Equal(k) || systemNs.IsAncestorOf(k)
+}
+
+// stored returns the key k is stored under.
+func (m keyMapper) stored(k ds.Key) ds.Key {
+	if m.clear(k) {
+		return k
+	}
+	return m.c.Encrypt(k)
+}
+
+// plain returns the key a stored key stands for.
+func (m keyMapper) plain(k ds.Key) ds.Key {
+	if m.clear(k) {
+		return k
+	}
+	if pk, err := m.c.Decrypt(k); err == nil {
+		return pk
+	}
+	return k
+}
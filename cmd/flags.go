@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// mapFlag collects repeated key=value flags, such as -label.
+type mapFlag map[string]string
+
+func (l mapFlag) String() string {
+	return formatLabels(l)
+}
+
+// Type names the values of the flag in the help of cobra.
+func (l mapFlag) Type() string { return "key=value" }
+
+func (l mapFlag) reset() {
+	for k := range l {
+		delete(l, k)
+	}
+}
+
+func (l mapFlag) Set(v string) error {
+	k, val, ok := strings.Cut(v, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("%q is not in key=value form", v)
+	}
+	l[k] = val
+	return nil
+}
+
+// listFlag collects repeated string flags.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Type() string { return "string" }
+
+func (l *listFlag) reset() { *l = nil }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// envOr returns the value of the environment variable name, or def when it
+// is not set. It gives flags a default taken from the environment.
+func envOr(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
+
+// envBool is envOr for boolean flags.
+func envBool(name string, def bool) bool {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %q is not a boolean\n", name, v)
+		os.Exit(2)
+	}
+	return b
+}
+
+// isSet tells whether a flag was given on the command line or through its
+// environment variable.
+func isSet(name, env string) bool {
+	if _, ok := os.LookupEnv(env); ok {
+		return true
+	}
+	f := cliFlags.Lookup(name)
+	return f != nil && f.Changed
+}
+
+// setLogLevels applies a -log-level value: the level of every logger,
+// optionally followed by subsystem=level overrides. Nothing changes when
+// a part of the value is invalid.
+func setLogLevels(spec string) error {
+	var subsystems, levels []string
+	for i, part := range strings.Split(spec, ",") {
+		subsystem, level, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			if i > 0 {
+				return fmt.Errorf("-log-level: %q is not in subsystem=level form", part)
+			}
+			subsystem, level = "*", subsystem
+		}
+		if _, err := logging.LevelFromString(level); err != nil {
+			return fmt.Errorf("-log-level: %s: %w", part, err)
+		}
+		subsystems, levels = append(subsystems, subsystem), append(levels, level)
+	}
+	for i, subsystem := range subsystems {
+		if err := logging.SetLogLevel(subsystem, levels[i]); err != nil {
+			return fmt.Errorf("-log-level: %s: %w", subsystem, err)
+		}
+	}
+	return nil
+}
+
+// nodeLogLevels is the -log-level value to apply. Daemons log what the
+// REPL prints, which needs the info level unless -log-level says
+// otherwise.
+func nodeLogLevels(daemon bool) string {
+	if _, fromFile := configSettings["log-level"]; daemon && !fromFile && !givenElsewhere("log-level") {
+		return logLevels + ",globaldb=info"
+	}
+	return logLevels
+}
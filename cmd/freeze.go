@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// systemNs holds keys used by globaldb itself rather than by users.
+var systemNs = ds.NewKey("/_system")
+
+// frozenNs holds one key per frozen namespace. Since these keys are
+// replicated like any other, freezing a namespace on one node makes
+// every writer reject writes to it.
+var frozenNs = systemNs.ChildString("frozen")
+
+// ErrFrozen is returned by writes to a frozen namespace.
+var ErrFrozen = errors.New("namespace is frozen")
+
+// checkFrozen returns ErrFrozen when the key lives in a frozen
+// namespace. System keys are never frozen so that namespaces can always
+// be thawed.
+func (d *db) checkFrozen(ctx context.Context, k ds.Key) error {
+	if k.Equal(systemNs) || systemNs.IsAncestorOf(k) {
+		return nil
+	}
+	ns := ds.RawKey("/")
+	for _, part := range k.List() {
+		ns = ns.ChildString(part)
+		frozen, err := d.crdt.Has(ctx, frozenNs.Child(ns))
+		if err != nil {
+			return err
+		}
+		if frozen {
+			return fmt.Errorf("%w: %s", ErrFrozen, ns)
+		}
+	}
+	return nil
+}
+
+// Freeze makes the whole cluster reject writes under the namespace.
+func (d *db) Freeze(ctx context.Context, ns ds.Key) error {
+	return d.Put(ctx, frozenNs.Child(ns), []byte(d.now().UTC().Format(time.RFC3339)))
+}
+
+// Thaw lets writes under the namespace through again.
+func (d *db) Thaw(ctx context.Context, ns ds.Key) error {
+	return d.Delete(ctx, frozenNs.Child(ns))
+}
+
+// Frozen lists the frozen namespaces.
+func (d *db) Frozen(ctx context.Context) ([]ds.Key, error) {
+	results, err := d.crdt.Query(ctx, query.Query{Prefix: frozenNs.String(), KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	var list []ds.Key
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		list = append(list, ds.NewKey(strings.TrimPrefix(r.Key, frozenNs.String())))
+	}
+	return list, nil
+}
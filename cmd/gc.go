@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/boxo/blockservice"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// gcNs is the namespace in the local datastore where the garbage
+// collector remembers since when a block has been unreferenced.
+var gcNs = ds.NewKey("/gc")
+
+// offlineDAG returns a DAG service that only looks at local blocks.
+func offlineDAG(bs blockstore.Blockstore) ipld.DAGService {
+	return merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+}
+
+// gcResult summarizes a garbage collection run.
+type gcResult struct {
+	Live       int
+	Candidates int
+	Removed    int
+}
+
+// collectGarbage deletes blocks that are not reachable from the CRDT
+// heads of the databases, from pinned content nor from their current
+// values. A block is only
+// deleted once it has been found unreferenced for longer than the grace
+// period, which protects blocks written or fetched while the collector
+// was walking the DAGs.
+func collectGarbage(ctx context.Context, store ds.Datastore, bs blockstore.Blockstore, dbs []*db, pins *pinPolicy, grace time.Duration) (gcResult, error) {
+	var res gcResult
+	dag := offlineDAG(bs)
+
+	// Blockstore keys are multihashes, so track liveness by multihash.
+	live := make(map[string]struct{})
+	walk := func(root cid.Cid) error {
+		return merkledag.Walk(ctx, merkledag.GetLinksDirect(dag), root, func(c cid.Cid) bool {
+			if _, ok := live[string(c.Hash())]; ok {
+				return false
+			}
+			live[string(c.Hash())] = struct{}{}
+			return true
+		})
+	}
+
+	// A missing block in the CRDT DAG means our view of what is live is
+	// incomplete, so abort rather than risk deleting history.
+	for _, kv := range dbs {
+		for _, head := range kv.crdt.InternalStats().Heads {
+			if err := walk(head); err != nil {
+				return res, fmt.Errorf("walking CRDT DAG from %s: %w", head, err)
+			}
+		}
+	}
+
+	// Referenced content may legitimately be missing locally.
+	pinned, err := pins.pins(ctx)
+	if err != nil {
+		return res, err
+	}
+	for _, c := range pinned {
+		if err := walk(c); err != nil && !ipld.IsNotFound(err) {
+			return res, err
+		}
+	}
+	for _, kv := range dbs {
+		if err := walkValues(ctx, kv, walk); err != nil {
+			return res, err
+		}
+	}
+	res.Live = len(live)
+
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return res, err
+	}
+	// The databases share the clock of the node, the default one first.
+	now := dbs[0].now()
+	for c := range keys {
+		candKey := gcNs.ChildString(c.Hash().B58String())
+		if _, ok := live[string(c.Hash())]; ok {
+			if err := store.Delete(ctx, candKey); err != nil {
+				return res, err
+			}
+			continue
+		}
+
+		res.Candidates++
+		since, err := store.Get(ctx, candKey)
+		if err == ds.ErrNotFound {
+			buf := binary.AppendVarint(nil, now.Unix())
+			if err := store.Put(ctx, candKey, buf); err != nil {
+				return res, err
+			}
+			continue
+		}
+		if err != nil {
+			return res, err
+		}
+		first, _ := binary.Varint(since)
+		if now.Sub(time.Unix(first, 0)) < grace {
+			continue
+		}
+		if err := bs.DeleteBlock(ctx, c); err != nil {
+			return res, err
+		}
+		if err := store.Delete(ctx, candKey); err != nil {
+			return res, err
+		}
+		res.Removed++
+	}
+	return res, ctx.Err()
+}
+
+// walkValues walks the content referenced by the current values of a
+// database.
+func walkValues(ctx context.Context, kv *db, walk func(cid.Cid) error) error {
+	results, err := kv.crdt.Query(ctx, query.Query{})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+	for r := range results.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		// A value we cannot read may reference blocks, so abort too.
+		v, _, err := kv.decode(kv.keys.plain(ds.RawKey(r.Key)), r.Value)
+		if err != nil {
+			return err
+		}
+		if c, ok := referencedCID(v); ok {
+			if err := walk(c); err != nil && !ipld.IsNotFound(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
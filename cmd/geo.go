@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// geoNs holds location-tagged entries. Every entry is stored under the
+// geohash of its location, one key component per character, as in
+// geoNs/cells/u/0/9/t/.../<id>, so that the entries of an area are found
+// with a prefix query. geoNs/ids/<id> holds the geohash of an entry so
+// that moving or removing it drops the old one.
+var (
+	geoNs      = ds.NewKey("/geo")
+	geoCellsNs = geoNs.ChildString("cells")
+	geoIDsNs   = geoNs.ChildString("ids")
+)
+
+// geoPrecision is the length of the geohashes entries are stored under,
+// cells of a few centimeters.
+const geoPrecision = 12
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohash encodes a location with the given number of characters.
+func geohash(lat, lon float64, precision int) string {
+	latRange, lonRange := [2]float64{-90, 90}, [2]float64{-180, 180}
+	var b strings.Builder
+	bit, ch, even := 0, 0, true
+	for b.Len() < precision {
+		r, v := &latRange, lat
+		if even {
+			r, v = &lonRange, lon
+		}
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+		if bit++; bit == 5 {
+			b.WriteByte(geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return b.String()
+}
+
+// geohashCell returns the size in degrees of the cells of a precision.
+func geohashCell(precision int) (latDeg, lonDeg float64) {
+	bits := 5 * precision
+	return 180 / math.Pow(2, float64(bits/2)), 360 / math.Pow(2, float64(bits-bits/2))
+}
+
+const earthRadius = 6371008.8 // meters
+
+// distance is the great-circle distance between two locations in meters.
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// geoCellKey is the key of a geohash under geoCellsNs.
+func geoCellKey(hash string) ds.Key {
+	return geoCellsNs.Child(ds.KeyWithNamespaces(strings.Split(hash, "")))
+}
+
+// geoCells returns the geohash prefixes to scan for the entries within
+// radius meters of a location: the cell of the location and its
+// neighbors, at the finest precision whose cells are at least radius
+// wide. It returns nil when the whole keyspace must be scanned.
+func geoCells(lat, lon, radius float64) []string {
+	precision := 0
+	for p := geoPrecision; p > 0; p-- {
+		latDeg, lonDeg := geohashCell(p)
+		height := latDeg * math.Pi / 180 * earthRadius
+		width := lonDeg * math.Pi / 180 * earthRadius * math.Cos(lat*math.Pi/180)
+		if height >= radius && width >= radius {
+			precision = p
+			break
+		}
+	}
+	if precision == 0 {
+		return nil
+	}
+	latDeg, lonDeg := geohashCell(precision)
+	seen := make(map[string]bool)
+	var cells []string
+	for _, dLat := range []float64{-latDeg, 0, latDeg} {
+		for _, dLon := range []float64{-lonDeg, 0, lonDeg} {
+			nLat := math.Max(-90, math.Min(90, lat+dLat))
+			nLon := math.Mod(lon+dLon+540, 360) - 180
+			c := geohash(nLat, nLon, precision)
+			if !seen[c] {
+				seen[c] = true
+				cells = append(cells, c)
+			}
+		}
+	}
+	return cells
+}
+
+// geoEntry is what is stored for a location-tagged entry.
+type geoEntry struct {
+	Lat   float64 `json:"lat"`
+	Lon   float64 `json:"lon"`
+	Value string  `json:"value,omitempty"`
+}
+
+// geoHit is an entry found near a location.
+type geoHit struct {
+	ID       string
+	Entry    geoEntry
+	Distance float64
+}
+
+func parseLatLon(latS, lonS string) (float64, float64, error) {
+	lat, err := strconv.ParseFloat(latS, 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0, fmt.Errorf("invalid latitude %q", latS)
+	}
+	lon, err := strconv.ParseFloat(lonS, 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return 0, 0, fmt.Errorf("invalid longitude %q", lonS)
+	}
+	return lat, lon, nil
+}
+
+// parseRadius parses a distance in meters, or with an m or km suffix.
+func parseRadius(s string) (float64, error) {
+	mult := 1.0
+	switch {
+	case strings.HasSuffix(s, "km"):
+		s, mult = strings.TrimSuffix(s, "km"), 1000
+	case strings.HasSuffix(s, "m"):
+		s = strings.TrimSuffix(s, "m")
+	}
+	r, err := strconv.ParseFloat(s, 64)
+	if err != nil || r < 0 {
+		return 0, fmt.Errorf("invalid radius %q", s)
+	}
+	return r * mult, nil
+}
+
+// geoPut stores an entry at a location, replacing its previous location.
+func geoPut(ctx context.Context, kv *db, id string, e geoEntry) error {
+	if id == "" || strings.Contains(id, "/") {
+		return fmt.Errorf("invalid id %q", id)
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	cell := geohash(e.Lat, e.Lon, geoPrecision)
+	prev, err := kv.Get(ctx, geoIDsNs.ChildString(id))
+	if err != nil && !errors.Is(err, ds.ErrNotFound) {
+		return err
+	}
+	if err := kv.Put(ctx, geoCellKey(cell).ChildString(id), data); err != nil {
+		return err
+	}
+	if err := kv.Put(ctx, geoIDsNs.ChildString(id), []byte(cell)); err != nil {
+		return err
+	}
+	if len(prev) > 0 && string(prev) != cell {
+		return kv.Delete(ctx, geoCellKey(string(prev)).ChildString(id))
+	}
+	return nil
+}
+
+// geoDelete removes an entry.
+func geoDelete(ctx context.Context, kv *db, id string) error {
+	cell, err := kv.Get(ctx, geoIDsNs.ChildString(id))
+	if err != nil {
+		return err
+	}
+	if err := kv.Delete(ctx, geoCellKey(string(cell)).ChildString(id)); err != nil {
+		return err
+	}
+	return kv.Delete(ctx, geoIDsNs.ChildString(id))
+}
+
+// geoNear returns the entries within radius meters of a location, closest
+// first.
+func geoNear(ctx context.Context, kv *db, lat, lon, radius float64) ([]geoHit, error) {
+	prefixes := []ds.Key{geoCellsNs}
+	if cells := geoCells(lat, lon, radius); cells != nil {
+		prefixes = prefixes[:0]
+		for _, c := range cells {
+			prefixes = append(prefixes, geoCellKey(c))
+		}
+	}
+	var hits []geoHit
+	for _, p := range prefixes {
+		results, err := kv.Query(ctx, query.Query{Prefix: p.String()})
+		if err != nil {
+			return nil, err
+		}
+		for r := range results.Next() {
+			if r.Error != nil {
+				results.Close()
+				return nil, r.Error
+			}
+			var e geoEntry
+			if err := json.Unmarshal(r.Value, &e); err != nil {
+				continue
+			}
+			if d := distance(lat, lon, e.Lat, e.Lon); d <= radius {
+				hits = append(hits, geoHit{ID: ds.RawKey(r.Key).Name(), Entry: e, Distance: d})
+			}
+		}
+		results.Close()
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Distance < hits[j].Distance })
+	return hits, nil
+}
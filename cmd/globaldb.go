@@ -6,38 +6,141 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/arcinston/dkv/lightclient"
+	"github.com/arcinston/dkv/pkg/control"
+	"github.com/arcinston/dkv/pkg/dkv"
 	ds "github.com/ipfs/go-datastore"
-	"github.com/ipfs/go-datastore/query"
 	badger "github.com/ipfs/go-ds-badger2"
 	crdt "github.com/ipfs/go-ds-crdt"
+	ipld "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log/v2"
 
+	libp2p "github.com/libp2p/go-libp2p"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	crypto "github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
 
 	ipfslite "github.com/hsanjuan/ipfs-lite"
-	"github.com/mitchellh/go-homedir"
 
 	multiaddr "github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
 	logger            = logging.Logger("globaldb")
 	bootstrapNode     bool
 	bootstrapNodeAddr string
-	listen            multiaddr.Multiaddr
+	rendezvous        bool
+	swarmKeyPath      string
+	passphraseFile    string
+	encryptKeys       bool
+	signedWrites      bool
+	signedHeads       bool
+	readOnly          bool
+	allowPeers        listFlag
+	admissionPolicy   string
+	powBits           int
+	writerPeers       listFlag
+	servePolicy       string
+	dbNames           listFlag
+	httpFallback      listFlag
+	httpFallbackAfter time.Duration
+	serveQuota        int64
+	serveWindow       time.Duration
+	aclPath           string
+	listen            []multiaddr.Multiaddr
+	listenAddrs       listFlag
+	announceAddrs     listFlag
+	nat               natConfig
+	dataDir           string
+	persist           bool
+	ephemeral         bool
+	instanceName      string
+	portOffset        int
+	mirrors           listFlag
+	outboxes          listFlag
+	profileName       string
+	labels            = mapFlag{}
+	gossip            gossipConfig
+	topicSizes        = mapFlag{}
+	peerRate          float64
+	peerBurst         int
+	prefetch          bool
+	pinPrefixes       listFlag
+	searchPrefixes    listFlag
+	gcGrace           time.Duration
+	maxSkew           time.Duration
+	metricsAddr       string
+	otlpEndpoint      string
+	usageAccounting   bool
+	traceSample       float64
+	feedAddr          string
+	feedRetain        feedRetention
+	httpAddr          string
+	grpcAddr          string
+	slow              slowThresholds
+	logRequests       bool
+	apiTokensFile     string
+	idempotencyTTL    time.Duration
+	adminAddr         string
+	controlAddr       string
+	adminToken        string
+	advertise         bool
+	advertiseTTL      time.Duration
+	description       string
+	schemaURL         string
+	probeInterval     time.Duration
+	alertsFile        string
+	metricsNsDepth    int
+	metricsNsMax      int
+	codecSpecs        = mapFlag{}
+	pipelineSpecs     = mapFlag{}
+	sqliteExport      string
+	tsRet             tsRetention
+	tierAfter         time.Duration
+	sqliteExportEvery time.Duration
+
+	writeChallengeMode string
+	challengeBits      int
+	challengeVerifyURL string
+	challengeSecret    string
+	anonWriteRate      float64
+	anonWriteBurst     int
+
+	jobSpecs   = mapFlag{}
+	backupDir  string
+	backupKeep int
+
+	configPath          string
+	logLevels           string
+	logFormat           string
+	logFile             string
+	logMaxSize          int
+	logKeep             int
+	seed                int64
+	rebroadcastInterval time.Duration
+	badgerSyncWrites    bool
+	badgerGCInterval    time.Duration
 
 	topicName = "globaldb-example"
 	netTopic  = "globaldb-example-net"
@@ -45,182 +148,969 @@ var (
 )
 
 func main() {
-	fmt.Println("Is this a bootstrap node? (y/n): ")
-	var isBootstrap string
-	fmt.Scanln(&isBootstrap)
-	if isBootstrap == "y" {
-		bootstrapNode = true
-	} else {
-		bootstrapNode = false
+	registerFlags()
+	root := newRootCmd()
+	root.SetArgs(longFlags(root, os.Args[1:]))
+	if err := root.Execute(); err != nil {
+		os.Exit(2)
+	}
+}
+
+// registerFlags registers the global flags, which every subcommand takes.
+func registerFlags() {
+	flag.BoolVar(&bootstrapNode, "bootstrap", envBool("GLOBALDB_BOOTSTRAP", false), "run as a bootstrap node (env GLOBALDB_BOOTSTRAP)")
+	flag.StringVar(&swarmKeyPath, "swarm-key", os.Getenv("GLOBALDB_SWARM_KEY"), "join the private network of this swarm key file; only nodes holding it can connect (env GLOBALDB_SWARM_KEY)")
+	flag.StringVar(&passphraseFile, "passphrase-file", os.Getenv("GLOBALDB_PASSPHRASE_FILE"), "encrypt values with a key derived from the passphrase in this file and the topic; nodes need both to read them (env GLOBALDB_PASSPHRASE_FILE)")
+	flag.BoolVar(&encryptKeys, "encrypt-keys", envBool("GLOBALDB_ENCRYPT_KEYS", false), "encrypt keys too, except system ones; needs -passphrase-file (env GLOBALDB_ENCRYPT_KEYS)")
+	flag.BoolVar(&signedWrites, "signed-writes", envBool("GLOBALDB_SIGNED_WRITES", false), "sign every value with the node key and reject the values that are not signed (env GLOBALDB_SIGNED_WRITES)")
+	flag.BoolVar(&signedHeads, "signed-heads", envBool("GLOBALDB_SIGNED_HEADS", false), "sign head announcements and drop the unsigned, forged or replayed ones; every node of the topic must agree, so embedded pkg/dkv nodes, which do not sign them, cannot join (env GLOBALDB_SIGNED_HEADS)")
+	flag.BoolVar(&readOnly, "read-only", envBool("GLOBALDB_READ_ONLY", false), "replicate and serve the database without ever writing to it or broadcasting, for mirrors and public gateways (env GLOBALDB_READ_ONLY)")
+	flag.Var(&dbNames, "db", "also hold this named database, replicated on the <topic>/<name> topic; switch to it in the REPL with use (repeatable)")
+	flag.Var(&httpFallback, "http-fallback", "HTTP gateway to fetch DAG blocks from when bitswap cannot, such as https://ipfs.io or the -http address of another node (repeatable)")
+	flag.DurationVar(&httpFallbackAfter, "http-fallback-after", 30*time.Second, "how long bitswap gets to fetch a block before the -http-fallback gateways are tried")
+	flag.StringVar(&servePolicy, "serve", envOr("GLOBALDB_SERVE", serveAll), "blocks served to other peers over bitswap: all, dag for the CRDT DAG only, or none (env GLOBALDB_SERVE)")
+	flag.Int64Var(&serveQuota, "serve-quota", 0, "most bytes of blocks served to a peer every -serve-window (0 for no limit)")
+	flag.DurationVar(&serveWindow, "serve-window", time.Hour, "window of -serve-quota")
+	flag.Var(&allowPeers, "allow-peer", "only accept values signed by this peer and heads announced by it, implies -signed-writes (repeatable)")
+	flag.StringVar(&admissionPolicy, "admission", envOr("GLOBALDB_ADMISSION", admitOpen), "who may announce heads on the topics of the databases: open for anyone, pow for peers paying a proof of work per announcement, writers for the -writer and registered peers; every node of the topic must agree (env GLOBALDB_ADMISSION)")
+	flag.IntVar(&powBits, "pow-bits", 18, "difficulty of the proof of work of -admission pow, in leading zero bits up to 24; each bit doubles the work")
+	flag.Var(&writerPeers, "writer", "peer admitted by -admission writers besides the ones registered in the database (repeatable)")
+	flag.StringVar(&aclPath, "acl", os.Getenv("GLOBALDB_ACL"), "only accept values signed by the peers this file allows on their prefix, implies -signed-writes (env GLOBALDB_ACL)")
+	flag.StringVar(&bootstrapNodeAddr, "bootstrap-addr", os.Getenv("GLOBALDB_BOOTSTRAP_ADDR"), "address of the bootstrap node to join through (env GLOBALDB_BOOTSTRAP_ADDR)")
+	flag.BoolVar(&rendezvous, "rendezvous", envBool("GLOBALDB_RENDEZVOUS", false), "find the other nodes of the topic on the public DHT, so that no bootstrap node is needed; -bootstrap-addr is joined when the DHT cannot be reached (env GLOBALDB_RENDEZVOUS)")
+	flag.Var(&listenAddrs, "listen", "multiaddr to listen on over tcp, ws, quic-v1 or webtransport, a random port on 127.0.0.1 over TCP when unset (repeatable, env GLOBALDB_LISTEN as a comma-separated list)")
+	flag.Var(&announceAddrs, "announce", "multiaddr to advertise instead of the listen addresses, for nodes with a known public address (repeatable)")
+	flag.BoolVar(&nat.AutoNAT, "autonat", envBool("GLOBALDB_AUTONAT", true), "tell other peers whether they can be dialed (env GLOBALDB_AUTONAT)")
+	flag.BoolVar(&nat.Relay, "relay", envBool("GLOBALDB_RELAY", true), "be reachable through public circuit relays when behind a NAT (env GLOBALDB_RELAY)")
+	flag.BoolVar(&nat.HolePunch, "hole-punch", envBool("GLOBALDB_HOLE_PUNCH", true), "turn relayed connections into direct ones by hole punching (env GLOBALDB_HOLE_PUNCH)")
+	flag.StringVar(&dataDir, "data-dir", os.Getenv("GLOBALDB_DATA_DIR"), "folder holding the node data, ~/"+config+" when unset (env GLOBALDB_DATA_DIR)")
+	flag.BoolVar(&persist, "persist", envBool("GLOBALDB_PERSIST", true), "keep the datastore in <data-dir>/<name> across restarts; -persist=false is the same as -ephemeral (env GLOBALDB_PERSIST)")
+	flag.BoolVar(&ephemeral, "ephemeral", envBool("GLOBALDB_EPHEMERAL", false), "run a throwaway node for demos and CI: data goes to a temporary folder removed on exit and the identity is never saved (env GLOBALDB_EPHEMERAL)")
+	flag.StringVar(&instanceName, "name", envOr("GLOBALDB_NAME", "node"), "name of this node, picking its folder under -data-dir and so its identity (env GLOBALDB_NAME)")
+	flag.StringVar(&instanceName, "instance", envOr("GLOBALDB_NAME", "node"), "same as -name; a number N also shifts every port by N unless -port-offset is given")
+	flag.IntVar(&portOffset, "port-offset", 0, "add this to the port of -listen and of every API address, to run several nodes on one machine")
+	flag.Var(&mirrors, "mirror", "keep an external store updated with the database: postgres://...?table=t, sqlite:///file.db?table=t or redis://host/db?prefix=p (repeatable)")
+	flag.Var(&outboxes, "outbox", "publish the events written with emit or POST /v1/outbox on this node: https://host/hook or redis://host/db?stream=s (repeatable)")
+	flag.StringVar(&profileName, "profile", "default", "tuning profile: "+strings.Join(profileNames(), ", "))
+	flag.Var(labels, "label", "node label in key=value form, e.g. region=eu (repeatable)")
+	flag.IntVar(&gossip.MaxMessageSize, "gossip-max-msg-size", 0, "largest pubsub message accepted, in bytes (0 for the gossipsub default)")
+	flag.DurationVar(&gossip.SeenTTL, "gossip-seen-ttl", 0, "how long pubsub message IDs are remembered (0 for the gossipsub default)")
+	flag.DurationVar(&gossip.Heartbeat, "gossip-heartbeat", 0, "gossipsub heartbeat interval (0 for the profile default)")
+	flag.Float64Var(&peerRate, "peer-rate", 10, "head announcements per second each peer may make on the topics of the databases; more are ignored (0 for no limit)")
+	flag.IntVar(&peerBurst, "peer-burst", 50, "head announcements a peer may make at once before -peer-rate applies")
+	flag.Var(topicSizes, "topic-max-size", "per-topic message size cap in topic=bytes form (repeatable)")
+	flag.BoolVar(&prefetch, "prefetch", false, "fetch content referenced by values (CIDs) in the background as keys change")
+	flag.Var(&pinPrefixes, "pin-prefix", "fetch and keep locally the content referenced by keys under this prefix (repeatable)")
+	flag.Var(&searchPrefixes, "search-prefix", "keep a full-text index of the values under this prefix for search (repeatable)")
+	flag.DurationVar(&gcGrace, "gc-grace", time.Hour, "how long a block must stay unreferenced before gc deletes it")
+	flag.DurationVar(&maxSkew, "max-clock-skew", maxClockSkew, "warn when a peer's clock differs from ours by more than this")
+	flag.BoolVar(&usageAccounting, "usage-accounting", false, "count reads, writes and bytes by API token and by peer, for quotas or billing; see GET /admin/usage and the globaldb_usage_* metrics")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", os.Getenv("GLOBALDB_OTLP_ENDPOINT"), "export traces of writes, reads and replication to this OTLP/HTTP collector, e.g. http://localhost:4318 (env GLOBALDB_OTLP_ENDPOINT)")
+	flag.Float64Var(&traceSample, "trace-sample", 1, "ratio of the traces started on this node that -otlp-endpoint exports; traces continued from API requests follow their caller")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "serve Prometheus metrics on this address, e.g. 127.0.0.1:9090")
+	flag.StringVar(&httpAddr, "http", os.Getenv("GLOBALDB_HTTP"), "serve the key-value HTTP API on this address, e.g. :8080 (env GLOBALDB_HTTP)")
+	flag.StringVar(&grpcAddr, "grpc", os.Getenv("GLOBALDB_GRPC"), "serve the gRPC API of pkg/dkvpb/dkv.proto on this address, e.g. :9090 (env GLOBALDB_GRPC)")
+	flag.StringVar(&feedAddr, "feed-addr", "", "serve the HTTP change feed for replicas on this address, e.g. :8081")
+	flag.IntVar(&feedRetain.Count, "feed-retain", 10000, "most changes the change feed keeps for consumers to catch up (0 for no limit)")
+	flag.Int64Var(&feedRetain.Bytes, "feed-retain-bytes", 0, "most bytes of keys and values the change feed keeps (0 for no limit)")
+	flag.DurationVar(&feedRetain.Age, "feed-retain-age", 0, "how long the change feed keeps changes (0 for no limit)")
+	flag.DurationVar(&slow.Get, "slow-get", 100*time.Millisecond, "log reads slower than this (0 to disable)")
+	flag.DurationVar(&slow.Node, "slow-node", time.Second, "log DAG nodes slower than this to fetch (0 to disable)")
+	flag.DurationVar(&slow.Hook, "slow-hook", 100*time.Millisecond, "log put and delete hooks slower than this (0 to disable)")
+	flag.BoolVar(&logRequests, "log-requests", false, "log every API request")
+	flag.StringVar(&apiTokensFile, "api-tokens", "", "JSON file of API tokens and the prefixes they may read or write (API is open when unset)")
+	flag.StringVar(&writeChallengeMode, "write-challenge", envOr("GLOBALDB_WRITE_CHALLENGE", challengeNone), "what HTTP writes made without an API token must answer: none, token for a fresh challenge from GET /v1/challenge, pow for a proof of work on one, or verify for a CAPTCHA checked by -challenge-verify-url (env GLOBALDB_WRITE_CHALLENGE)")
+	flag.IntVar(&challengeBits, "challenge-bits", 20, "difficulty of the proof of work of -write-challenge pow, in leading zero bits")
+	flag.StringVar(&challengeVerifyURL, "challenge-verify-url", "", "siteverify endpoint checking the CAPTCHA responses of -write-challenge verify, e.g. https://hcaptcha.com/siteverify")
+	flag.StringVar(&challengeSecret, "challenge-secret", os.Getenv("GLOBALDB_CHALLENGE_SECRET"), "secret sent to -challenge-verify-url (env GLOBALDB_CHALLENGE_SECRET)")
+	flag.Float64Var(&anonWriteRate, "anon-write-rate", 0, "HTTP writes without an API token, or challenges handed out, per second and client address (0 for no limit)")
+	flag.IntVar(&anonWriteBurst, "anon-write-burst", 10, "HTTP writes without an API token a client address may make at once before -anon-write-rate applies")
+	flag.DurationVar(&idempotencyTTL, "idempotency-ttl", 10*time.Minute, "how long API writes sent with an idempotency key are remembered, so that retries are not written twice (0 to disable)")
+	flag.StringVar(&controlAddr, "control", os.Getenv("GLOBALDB_CONTROL"), "serve the control API of the dkv client on this Unix socket, or loopback host:port; daemon mode uses <data-dir>/<name>/"+control.Socket+" when unset (env GLOBALDB_CONTROL)")
+	flag.StringVar(&adminAddr, "admin-addr", "", "serve the admin API on this address, e.g. 127.0.0.1:8082 (needs -admin-token)")
+	flag.StringVar(&adminToken, "admin-token", "", "bearer token required by the admin API")
+	flag.BoolVar(&advertise, "advertise", false, "publish this node's addresses in the bootstrap registry stored in the database")
+	flag.DurationVar(&advertiseTTL, "advertise-ttl", 24*time.Hour, "how long a bootstrap registry entry stays valid")
+	flag.StringVar(&description, "describe", os.Getenv("GLOBALDB_DESCRIBE"), "advertise the database of the topic in the catalog with this description, for globaldb discover (env GLOBALDB_DESCRIBE)")
+	flag.StringVar(&schemaURL, "schema-url", "", "link to the description of the keys and values of the database, advertised with -describe")
+	flag.DurationVar(&probeInterval, "probe-interval", 0, "write a probe key this often so that members can measure replication latency (0 to disable)")
+	flag.StringVar(&alertsFile, "alerts", "", "JSON file of alert rules firing webhooks or commands")
+	flag.IntVar(&metricsNsDepth, "metrics-ns-depth", 1, "number of key components making the namespace label of kv metrics")
+	flag.IntVar(&metricsNsMax, "metrics-ns-max", 100, "most namespace labels in kv metrics, further namespaces count as \"other\"")
+	flag.Var(pipelineSpecs, "pipeline", "transforms of the values under a prefix in prefix=gzip,aes-gcm:<key file>,sign form, applied in that order (repeatable)")
+	flag.Var(codecSpecs, "codec", "codec of the values under a prefix in prefix=codec form: json, cbor or protobuf:<descriptor set>:<message> (repeatable)")
+	flag.StringVar(&sqliteExport, "sqlite-export", "", "export the keyspace to this SQLite file periodically, for running SQL over it")
+	flag.DurationVar(&sqliteExportEvery, "sqlite-export-interval", 5*time.Minute, "how often -sqlite-export is refreshed")
+	flag.DurationVar(&tsRet.Raw, "ts-retention", 0, "roll up time series samples older than this and delete them (0 keeps them; one node is enough)")
+	flag.DurationVar(&tsRet.Rollup, "ts-rollup", time.Hour, "width of the buckets time series samples are rolled up into")
+	flag.DurationVar(&tsRet.Rollups, "ts-rollup-retention", 0, "delete time series rollups older than this (0 keeps them)")
+	flag.Var(jobSpecs, "job", "schedule of a maintenance job in name=schedule form, the schedule being a duration, @every <duration>, @hourly, @daily, @weekly, @monthly, a crontab line or off; jobs are probe, ts-compaction, tiering, sqlite-export, gc, backup, usage-flush, heartbeat, alerts, advertise, registry, proximity and rendezvous (repeatable)")
+	flag.StringVar(&backupDir, "backup-dir", "", "folder the backup job writes a backup to, daily unless -job backup=<schedule> says otherwise")
+	flag.IntVar(&backupKeep, "backup-keep", 7, "number of backups the backup job keeps in -backup-dir")
+	flag.DurationVar(&tierAfter, "tier-after", 0, "move the values not read for this long out of Badger into pack files in the data folder (0 disables)")
+	flag.StringVar(&configPath, "config", os.Getenv("GLOBALDB_CONFIG"), "YAML or TOML file of flag values, <data-dir>/config.yaml, .yml or .toml when unset (env GLOBALDB_CONFIG)")
+	flag.StringVar(&topicName, "topic", envOr("GLOBALDB_TOPIC", topicName), "pubsub topic of the database, nodes on different topics hold different databases (env GLOBALDB_TOPIC)")
+	flag.StringVar(&logLevels, "log-level", envOr("GLOBALDB_LOG_LEVEL", "error"), "log level, followed by comma-separated subsystem=level overrides, e.g. info,globaldb=debug (env GLOBALDB_LOG_LEVEL)")
+	flag.StringVar(&logFormat, "log-format", os.Getenv("GLOBALDB_LOG_FORMAT"), "log format: text, color or json, color on terminals and text elsewhere when unset (env GLOBALDB_LOG_FORMAT)")
+	flag.StringVar(&logFile, "log-file", os.Getenv("GLOBALDB_LOG_FILE"), "write logs to this file instead of stderr, rotated once it reaches -log-max-size (env GLOBALDB_LOG_FILE)")
+	flag.IntVar(&logMaxSize, "log-max-size", 100, "size in MB at which -log-file is rotated")
+	flag.IntVar(&logKeep, "log-keep", 5, "number of rotated -log-file files kept, as <file>.1 (newest) to <file>.N")
+	flag.Int64Var(&seed, "seed", 0, "seed of the random choices of the node, such as its default port, to reproduce a run (0 draws one, logged at debug level)")
+	flag.DurationVar(&rebroadcastInterval, "rebroadcast-interval", 0, "how often the CRDT heads are rebroadcast (0 for the profile default)")
+	flag.BoolVar(&badgerSyncWrites, "badger-sync-writes", badger.DefaultOptions.SyncWrites, "fsync every datastore write")
+	flag.DurationVar(&badgerGCInterval, "badger-gc-interval", badger.DefaultOptions.GcInterval, "how often the datastore value log is garbage collected (0 to disable)")
+}
+
+// runNode runs the REPL, daemon mode or a subcommand working on the data
+// folder, once cobra parsed the flags. Errors are returned rather than
+// fatal so that the deferred cleanups run, closing the store cleanly.
+func runNode(nc nodeCommand) error {
+	if dataDir == "" {
+		dataDir = defaultDataDir()
+	}
+	if configPath == "" {
+		configPath = findConfigFile(dataDir)
+	}
+	if configPath != "" {
+		if err := applyConfigFile(configPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	if v := os.Getenv("GLOBALDB_LISTEN"); len(listenAddrs) == 0 && v != "" {
+		listenAddrs = strings.Split(v, ",")
+	}
+	netTopic = topicName + "-net"
+	if !persist {
+		ephemeral = true
+	}
+	if n, err := strconv.Atoi(instanceName); err == nil && !isSet("port-offset", "") {
+		portOffset = n
+	}
+	if err := applyPortOffset(portOffset); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// Registered first so that it runs after every other deferred
+	// cleanup.
+	var restart bool
+	defer func() {
+		if restart {
+			logger.Info("restarting")
+			reexec()
+		}
+	}()
+
+	prof, err := getProfile(profileName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if gossip.Heartbeat == 0 {
+		gossip.Heartbeat = prof.GossipHeartbeat
+	}
+	if rebroadcastInterval > 0 {
+		prof.RebroadcastInterval = rebroadcastInterval
+	}
+	if err := setupLogging(logFormat, logFile, logMaxSize, logKeep); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := setLogLevels(nodeLogLevels(nc.name == "daemon")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if nc.clock == nil {
+		nc.clock = dkv.SystemClock
+	}
+	if nc.rng == nil {
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		logger.Debugf("random seed %d", seed)
+		nc.rng = rand.New(rand.NewSource(seed))
+	}
+	gossip.TopicMaxSize, err = parseTopicSizes(topicSizes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if metricsNsDepth < 1 {
+		fmt.Fprintln(os.Stderr, "-metrics-ns-depth must be at least 1")
+		os.Exit(2)
+	}
+	kvNamespaces = newNamespaceBuckets(metricsNsDepth, metricsNsMax)
+	valueCodecs, err := newCodecs(codecSpecs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if encryptKeys && passphraseFile == "" {
+		fmt.Fprintln(os.Stderr, "-encrypt-keys needs -passphrase-file")
+		os.Exit(2)
+	}
+	if err := checkDBNames(dbNames); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if nat.Announce, err = parseAnnounce(announceAddrs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	serving, err := newServingPolicy(servePolicy, serveQuota, serveWindow, nc.clock)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if readOnly {
+		if err := checkReadOnly(nc); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	challenges, err := newWriteChallenge(writeChallengeMode, challengeBits, challengeVerifyURL, challengeSecret, anonWriteRate, anonWriteBurst, nc.clock)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	jobs, err := newScheduler(jobSpecs, nc.clock)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if backupKeep < 1 {
+		fmt.Fprintln(os.Stderr, "-backup-keep must be at least 1")
+		os.Exit(2)
+	}
+	if adminAddr != "" && adminToken == "" {
+		fmt.Fprintln(os.Stderr, "-admin-addr needs -admin-token")
+		os.Exit(2)
+	}
+	var auth *authorizer
+	if apiTokensFile != "" {
+		auth, err = loadTokens(apiTokensFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if auth.has(adminToken) {
+			fmt.Fprintln(os.Stderr, "the admin token must not also be an API token")
+			os.Exit(2)
+		}
+	}
+
+	var swarmKey pnet.PSK
+	if swarmKeyPath != "" {
+		swarmKey, err = loadSwarmKey(swarmKeyPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	if nc.name == "stop" || nc.name == "reload" {
+		action := nc.name
+		if action == "stop" {
+			action = "shutdown"
+			if nc.restart {
+				action = "restart"
+			}
+		}
+		if adminAddr == "" {
+			fmt.Fprintf(os.Stderr, "%s needs --admin-addr and --admin-token\n", nc.name)
+			os.Exit(2)
+		}
+		if err := adminPost(adminAddr, adminToken, action); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return nil
+	}
+
+	if len(listenAddrs) == 0 {
+		listenAddrs = defaultListenAddrs(nc.rng)
+	}
+	listen, err = parseListenAddrs(listenAddrs, swarmKey != nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if instanceName == "" || instanceName != filepath.Base(instanceName) || instanceName == ".." {
+		fmt.Fprintf(os.Stderr, "-name %q must be a plain folder name\n", instanceName)
+		os.Exit(2)
+	}
+	if nc.name == "identity" {
+		if err := runIdentity(nc.args, filepath.Join(dataDir, instanceName), configPath, dataDir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return nil
+	}
+	if nc.name == "backup" || nc.name == "restore" {
+		if err := runBackup(append([]string{nc.name}, nc.args...), filepath.Join(dataDir, instanceName)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return nil
+	}
+	if nc.name == "doctor" {
+		if !runDoctor(context.Background(), dataDir, listen) {
+			os.Exit(1)
+		}
+		return nil
 	}
 
-	port := 4000 + rand.Intn(1000)
+	if nc.name == "replica" {
+		if nc.replica.Data == "" {
+			nc.replica.Data = filepath.Join(dataDir, "replica")
+		}
+		if err := runReplica(context.Background(), nc.replica, nc.clock); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if nc.name == "export" {
+		// Only the dump goes to standard output: the banner and the
+		// hooks print to standard error.
+		dumpStdout, os.Stdout = os.Stdout, os.Stderr
+	}
 
-	listen, _ = multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/" + strconv.Itoa(port))
+	// The node must be told how to join, by globaldb init or the flags.
+	if !isSet("bootstrap", "GLOBALDB_BOOTSTRAP") && bootstrapNodeAddr == "" && !rendezvous {
+		fmt.Fprintln(os.Stderr, "this node does not know how to join the network: run globaldb init, or give --bootstrap, --bootstrap-addr or --rendezvous")
+		os.Exit(2)
+	}
 
 	// Bootstrappers are using 1024 keys. See:
 	// https://github.com/ipfs/infra/issues/378
 	crypto.MinRsaKeyBits = 1024
 
-	logging.SetLogLevel("*", "error")
+	if logRequests {
+		enableRequestLog()
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	// Jobs start as they are added, so that those of the network also
+	// run for migrate, import and export.
+	jobs.run(ctx)
 
-	dir, err := homedir.Dir()
-	if err != nil {
-		logger.Fatal(err)
+	if metricsAddr != "" {
+		go serveMetrics(metricsAddr)
 	}
-	uniqueID := fmt.Sprintf("instance-%d", time.Now().UnixNano())
-	// make folder in dir if not exists
-	err = os.MkdirAll(filepath.Join(dir, config), 0755)
 
-	data := filepath.Join(dir, config, uniqueID)
+	// A persistent node always uses the folder of its name, so that it
+	// keeps its identity and its copy of the database across restarts.
+	// An ephemeral node gets a temporary folder, removed on exit, and a
+	// new identity every run.
+	var data string
+	if ephemeral {
+		data, err = os.MkdirTemp("", "globaldb-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(data)
+	} else {
+		data = filepath.Join(dataDir, instanceName)
+		if err := os.MkdirAll(data, 0755); err != nil {
+			return err
+		}
+		lock, err := lockInstance(data)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer lock.Close()
+	}
 	dsopts := badger.DefaultOptions
-	dsopts.WithInMemory(true)
-	store, err := badger.NewDatastore(data, &dsopts)
+	prof.applyBadger(&dsopts)
+	dsopts.SyncWrites = badgerSyncWrites
+	dsopts.GcInterval = badgerGCInterval
+	store, err := openStore(data, &dsopts)
+	if err != nil {
+		return err
+	}
+	defer closeStore(data, store)
+	bans, err := loadBlocklist(ctx, store, nc.clock)
 	if err != nil {
-		logger.Fatal(err)
+		return err
+	}
+	var usage *usageMeter
+	if usageAccounting {
+		if usage, err = loadUsage(ctx, store, nc.clock); err != nil {
+			return err
+		}
+		prometheus.MustRegister(usage)
+		defer func() {
+			if err := usage.flush(context.Background()); err != nil {
+				logger.Warnf("saving usage: %s", err)
+			}
+		}()
+		serving.usage = usage
+	}
+	var tier *coldTier
+	if tierAfter > 0 {
+		tier, err = newColdTier(store, filepath.Join(data, "cold"), tierAfter, nc.clock)
+		if err != nil {
+			return err
+		}
+		defer tier.Close()
 	}
-	defer store.Close()
 
-	keyPath := filepath.Join(data, "key")
 	var priv crypto.PrivKey
-	_, err = os.Stat(keyPath)
-	if os.IsNotExist(err) {
+	if ephemeral {
 		priv, _, err = crypto.GenerateKeyPair(crypto.Ed25519, 1)
+	} else {
+		priv, err = dkv.LoadKey(filepath.Join(data, "key"))
+	}
+	if err != nil {
+		return err
+	}
+	pid, err := peer.IDFromPublicKey(priv.GetPublic())
+	if err != nil {
+		return err
+	}
+	if otlpEndpoint != "" {
+		shutdown, err := setupTracing(otlpEndpoint, traceSample, pid)
 		if err != nil {
-			logger.Fatal(err)
+			return err
 		}
-		data, err := crypto.MarshalPrivateKey(priv)
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(ctx); err != nil {
+				logger.Warnf("flushing spans: %s", err)
+			}
+		}()
+	}
+	var (
+		encrypt dkv.Transform
+		keys    keyMapper
+	)
+	if passphraseFile != "" {
+		pk, err := loadPassphrase(passphraseFile, topicName)
 		if err != nil {
-			logger.Fatal(err)
+			return err
 		}
-		err = os.WriteFile(keyPath, data, 0400)
-		if err != nil {
-			logger.Fatal(err)
+		if encrypt, err = dkv.AESGCM(pk.Values); err != nil {
+			return err
 		}
-	} else if err != nil {
-		logger.Fatal(err)
-	} else {
-		key, err := os.ReadFile(keyPath)
-		if err != nil {
-			logger.Fatal(err)
+		if encryptKeys {
+			if keys.c, err = dkv.NewKeyCipher(pk.Keys); err != nil {
+				return err
+			}
+		}
+	}
+	var acl *peerACL
+	if len(allowPeers) > 0 || aclPath != "" {
+		if acl, err = loadACL(aclPath, allowPeers, pid); err != nil {
+			return err
 		}
-		priv, err = crypto.UnmarshalPrivateKey(key)
+		signedWrites = true
+	}
+	adm, err := newAdmission(admissionPolicy, powBits, writerPeers, pid, nc.clock)
+	if err != nil {
+		return err
+	}
+	var required []dkv.Transform
+	if encrypt != nil {
+		required = append(required, encrypt)
+	}
+	if signedWrites {
+		sign, err := dkv.Sign(priv)
 		if err != nil {
-			logger.Fatal(err)
+			return err
 		}
-
+		required = append(required, sign)
 	}
-	pid, err := peer.IDFromPublicKey(priv.GetPublic())
+	pipelines, err := newPipelines(pipelineSpecs, priv, required...)
+	if err != nil {
+		return err
+	}
+	if signedWrites {
+		pipelines.RequireSigned()
+	}
+	if acl != nil {
+		pipelines.Authorize(acl.authorize)
+	}
+
+	cm, err := connmgr.NewConnManager(prof.ConnLow, prof.ConnHigh, connmgr.WithGracePeriod(time.Minute))
 	if err != nil {
-		logger.Fatal(err)
+		return err
 	}
 
-	h, dht, err := ipfslite.SetupLibp2p(
+	h, dht, err := setupHost(
 		ctx,
 		priv,
-		nil,
-		[]multiaddr.Multiaddr{listen},
-		nil,
-		ipfslite.Libp2pOptionsExtra...,
+		swarmKey,
+		listen,
+		prof.DHTClient,
+		append(nat.options(), libp2p.ConnectionManager(cm), libp2p.ConnectionGater(bans))...,
 	)
 
 	if err != nil {
-		logger.Fatal(err)
+		return err
+	}
+	nat.setHost(h)
+	if err := logReachability(ctx, h.EventBus()); err != nil {
+		return err
 	}
 	defer h.Close()
 	defer dht.Close()
 
-	psub, err := pubsub.NewGossipSub(ctx, h)
+	peerAliases, err := loadAliases(ctx, store)
+	if err != nil {
+		return err
+	}
+	if err := loadPeerstore(ctx, store, h); err != nil {
+		logger.Warnf("loading known peers: %s", err)
+	}
+	defer func() {
+		if err := savePeerstore(ctx, store, h); err != nil {
+			logger.Warnf("saving known peers: %s", err)
+		}
+	}()
+	mems, err := newMembers(h.EventBus(), 3*prof.PresenceInterval, nc.clock)
+	if err != nil {
+		return err
+	}
+	go mems.expire(ctx)
+	if err := logMembership(ctx, h.EventBus(), peerAliases); err != nil {
+		return err
+	}
+	maint := &maintenance{}
+	px := newProximity(h, mems, labels)
+	events := newPeerEvents(1000, nc.clock)
+	h.Network().Notify(events.notifiee())
+	sources := newHeadSources(topicName, 1024)
+	dbTopics := []string{topicName}
+	for _, name := range dbNames {
+		dbTopics = append(dbTopics, dbTopic(topicName, name))
+	}
+	// The ACL and the admission policy cover the databases of the node,
+	// not those being migrated.
+	admitted := dbTopics
+	if nc.name == "migrate" {
+		dbTopics = append(slices.Clip(dbTopics), nc.migrate.From, nc.migrate.To)
+	}
+	psubOpts := append(px.gossipOptions(), gossip.options()...)
+	psubOpts = append(psubOpts, pubsub.WithRawTracer(sources), pubsub.WithRawTracer(events))
+	if usage != nil {
+		psubOpts = append(psubOpts, pubsub.WithRawTracer(newUsageTracer(usage, dbTopics)))
+	}
+	psub, err := pubsub.NewGossipSub(ctx, h, psubOpts...)
 	if err != nil {
-		logger.Fatal(err)
+		return err
+	}
+	var guard *headGuard
+	if signedHeads {
+		if guard, err = newHeadGuard(ctx, store, priv, dbTopics, nc.clock); err != nil {
+			return err
+		}
+	}
+	lim := newPeerLimiter(peerRate, peerBurst, h.ID(), dbTopics, nc.clock)
+	if err := gossip.registerValidators(psub, admitted, acl, adm, lim, guard); err != nil {
+		return err
 	}
 
 	topic, err := psub.Join(netTopic)
 	if err != nil {
-		logger.Fatal(err)
+		return err
 	}
 
 	netSubs, err := topic.Subscribe()
 	if err != nil {
-		logger.Fatal(err)
+		return err
 	}
 
 	// Use a special pubsub topic to avoid disconnecting
-	// from globaldb peers.
-	go func() {
-		for {
-			msg, err := netSubs.Next(ctx)
-			if err != nil {
-				fmt.Println(err)
-				break
+	// from globaldb peers and to learn about their labels.
+	go handlePresence(ctx, h, netSubs, mems, peerAliases, maxSkew)
+	// The CRDT store is created later on, and only then are there heads
+	// to announce.
+	var crdtStore atomic.Pointer[crdt.Datastore]
+	go publishPresence(ctx, h, topic, func() presence {
+		p := presence{Labels: labels, Maintenance: maint.enabled()}
+		if s := crdtStore.Load(); s != nil {
+			for _, c := range s.InternalStats().Heads {
+				p.Heads = append(p.Heads, c.String())
 			}
-			h.ConnManager().TagPeer(msg.ReceivedFrom, "keep", 100)
 		}
-	}()
+		return p
+	}, prof.PresenceInterval, nc.clock)
+	jobs.add(jobProximity, everySpec(prof.PresenceInterval), true, px.refresh)
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				topic.Publish(ctx, []byte("hi!"))
-				time.Sleep(20 * time.Second)
+	ipfs, err := newIPFS(ctx, store, h, dht, &ipfslite.Config{
+		ReprovideInterval:  prof.ReprovideInterval,
+		UncachedBlockstore: prof.UncachedBlockstore,
+	}, serving)
+	if err != nil {
+		return err
+	}
+
+	// With -rendezvous the public DHT replaces the bootstrap node, unless
+	// it cannot be reached.
+	joined := false
+	if rendezvous && bootstrapNodeAddr == "" {
+		if swarmKey == nil {
+			ipfs.Bootstrap(ipfslite.DefaultBootstrapPeers())
+		}
+		if !bootstrapNode {
+			joined = waitDHT(ctx, dht, rendezvousWait, nc.clock)
+			if !joined {
+				logger.Warn("the DHT cannot be reached")
 			}
 		}
-	}()
+	}
 
-	ipfs, err := ipfslite.New(ctx, store, nil, h, dht, nil)
-	if err != nil {
-		logger.Fatal(err)
+	if !bootstrapNode && !joined {
+		if bootstrapNodeAddr == "" {
+			return errors.New("the DHT cannot be reached and no --bootstrap-addr is given")
+		}
+		logger.Infow("bootstrapping", "addr", bootstrapNodeAddr)
+		// pass bootstrap node address via command line
+
+		infos, err := dkv.ResolveBootstrap(ctx, bootstrapNodeAddr)
+		if err != nil {
+			return err
+		}
+		// The public bootstrap peers are not on a private network.
+		list := infos
+		if swarmKey == nil {
+			list = append(ipfslite.DefaultBootstrapPeers(), infos...)
+		}
+		ipfs.Bootstrap(list)
+		for _, inf := range infos {
+			h.ConnManager().TagPeer(inf.ID, "keep", 100)
+		}
+	}
+
+	if rendezvous {
+		jobs.add(jobRendezvous, everySpec(rendezvousInterval), true, startRendezvous(ctx, h, dht, topicName))
+	}
+
+	if nc.name == "migrate" {
+		opts := crdt.DefaultOptions()
+		opts.Logger = logger
+		opts.RebroadcastInterval = prof.RebroadcastInterval
+		opts.NumWorkers = prof.DAGWorkers
+		base := &db{clock: &dkv.Clock{Wall: nc.clock}, pipelines: pipelines, keys: keys, acl: acl, slowGet: slow.Get}
+		dag := &verifiedDAG{DAGService: ipfs, pipelines: pipelines, keys: keys, acl: acl}
+		if err := runMigrate(ctx, nc.migrate, psub, guard, store, dag, base, opts); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	pf := newPrefetcher(ipfs)
+	if prefetch || len(pinPrefixes) > 0 {
+		pf.run(ctx, prof.DAGWorkers)
 	}
+	pins := newPinPolicy(store, pinPrefixes)
+	index := newSearchIndex(searchPrefixes, valueCodecs)
+	watch := newWatchHub()
+	feed := newChangeFeed(feedRetain, nc.clock)
 
 	psubCtx, psubCancel := context.WithCancel(ctx)
 	pubsubBC, err := crdt.NewPubSubBroadcaster(psubCtx, psub, topicName)
 	if err != nil {
-		logger.Fatal(err)
+		psubCancel()
+		return err
 	}
 
+	local := newLocalBroadcaster(psubCtx, muted(traceBroadcasts(topicName, guard.wrap(topicName, adm.wrap(topicName, pubsubBC)))))
+	maint.bcast = &pausableBroadcaster{Broadcaster: local}
+
 	opts := crdt.DefaultOptions()
 	opts.Logger = logger
-	opts.RebroadcastInterval = 5 * time.Second
-	opts.PutHook = func(k ds.Key, v []byte) {
-		fmt.Printf("Added: [%s] -> %s\n", k, string(v))
+	opts.RebroadcastInterval = prof.RebroadcastInterval
+	opts.NumWorkers = prof.DAGWorkers
+	clock := &dkv.Clock{Wall: nc.clock}
+	probes := newProbeStats(pid, nc.clock)
+	hooks := &applyHooks{ctx: ctx, daemon: nc.name == "daemon", maint: maint, slow: slow.Hook, pf: pf, prefetch: prefetch}
+	crdtNs := ds.NewKey("crdt")
+	kv := &db{ns: crdtNs, store: store, clock: clock, pipelines: pipelines, tier: tier, keys: keys, acl: acl, slowGet: slow.Get}
+	hooks.install(opts, "", kv, applySinks{feed: feed, index: index, watch: watch, pins: pins, probes: probes})
 
+	var dagService ipld.DAGService = ipfs
+	if len(httpFallback) > 0 {
+		dagService = newHTTPFallbackDAG(ipfs, ipfs.BlockStore(), httpFallback, httpFallbackAfter)
 	}
-	opts.DeleteHook = func(k ds.Key) {
-		fmt.Printf("Removed: [%s]\n", k)
+	dag := &verifiedDAG{
+		DAGService: &slowDAG{DAGService: dagService, threshold: slow.Node, sources: sources, aliases: peerAliases},
+		pipelines:  pipelines,
+		keys:       keys,
+		acl:        acl,
 	}
-
-	crdt, err := crdt.New(store, ds.NewKey("crdt"), ipfs, pubsubBC, opts)
+	crdt, err := crdt.New(tier.wrap(store), crdtNs, dag, maint.bcast, opts)
 	if err != nil {
-		logger.Fatal(err)
+		psubCancel()
+		return err
 	}
 	defer crdt.Close()
 	defer psubCancel()
+	crdtStore.Store(crdt)
+	kv.crdt = crdt
+	valueCodecs.fallback = kv.schemaCodec
+	if readOnly {
+		kv.fence.seal()
+	}
+	adm.admit(topicName, kv)
+	// Stop accepting writes before anything is closed.
+	defer kv.fence.raise("shutting down")
+	dbs := &databases{byName: map[string]*db{defaultDB: kv}}
+	for _, name := range dbNames {
+		d, leave, err := openNamedDB(ctx, name, topicName, kv, store, dag, psub, guard, adm, hooks, *opts)
+		if err != nil {
+			return fmt.Errorf("joining database %s: %w", name, err)
+		}
+		defer leave()
+		defer d.fence.raise("shutting down")
+		dbs.byName[name] = d
+		adm.admit(dbTopic(topicName, name), d)
+	}
+	refOpts := *opts
+	refOpts.PutHook, refOpts.DeleteHook = nil, nil
+	refs := &resolver{base: kv, dbs: dbs, topic: topicName, psub: psub, store: store, dag: dag, opts: refOpts}
+	if len(searchPrefixes) > 0 {
+		if err := index.build(ctx, kv); err != nil {
+			return fmt.Errorf("building the search index: %w", err)
+		}
+	}
 
-	// if not bootstrapping, ask for bootstrap node address
-	if !bootstrapNode {
-		fmt.Println("Enter the bootstrap node address:")
-		fmt.Scanln(&bootstrapNodeAddr)
-		fmt.Println("Bootstrapping...")
-		// pass bootstrap node address via command line
+	if feedAddr != "" {
+		go serveChangeFeed(feedAddr, feed, kv, auth, valueCodecs, index)
+	}
+	for _, m := range mirrors {
+		t, err := newMirrorTarget(m)
+		if err != nil {
+			return fmt.Errorf("mirror %s: %w", m, err)
+		}
+		go runMirror(ctx, m, t, feed, kv)
+	}
+	relays := newOutboxRelays(ctx, feed, kv, pid.String())
+	if err := relays.apply(outboxes); err != nil {
+		return err
+	}
+	if nc.name == "import" {
+		// Without -follow the node stops once the keys are imported. Its
+		// peers get them when it is next online.
+		if !nc.imp.Follow {
+			n, err := runImport(ctx, kv, nc.imp)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Imported %d keys from %s\n", n, nc.imp.From)
+			return nil
+		}
+		go func() {
+			if _, err := runImport(ctx, kv, nc.imp); err != nil {
+				logger.Errorf("import from %s: %s", nc.imp.From, err)
+			}
+		}()
+	}
+	if nc.name == "export" {
+		// The dump holds what the node has locally: peers are not waited
+		// for.
+		n, err := runExport(ctx, kv, nc.export)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Exported %d keys\n", n)
+		return nil
+	}
+	if advertise {
+		jobs.add(jobAdvertise, everySpec(advertiseTTL/2), true, func(ctx context.Context) error {
+			return publishBootstrap(ctx, kv, h, priv, advertiseTTL)
+		})
+	}
+	jobs.add(jobRegistry, everySpec(30*time.Second), false, func(ctx context.Context) error {
+		return dialBootstrapPeers(ctx, kv, h)
+	})
+	if description != "" {
+		e := catalogEntry{Name: topicName, Topic: topicName, Description: description, Schema: schemaURL, Access: accessMode(false, acl), Publisher: pid.String()}
+		if err := kv.Advertise(ctx, e); err != nil {
+			logger.Warnf("advertising the database in the catalog: %s", err)
+		}
+	}
+	// The jobs without a default schedule only run when -job gives them
+	// one, and those needing a flag only exist with it.
+	jobs.add(jobProbe, everySpec(probeInterval), true, func(ctx context.Context) error {
+		return writeProbe(ctx, kv, pid)
+	})
+	var tsEvery time.Duration
+	if tsRet.Raw > 0 {
+		tsEvery = min(tsRet.Rollup, 5*time.Minute)
+	}
+	jobs.add(jobTSCompaction, everySpec(tsEvery), true, func(ctx context.Context) error {
+		return compactAllSeries(ctx, kv, tsRet, nc.clock.Now())
+	})
+	if tier != nil {
+		jobs.add(jobTiering, everySpec(min(tierAfter, time.Hour)), false, func(ctx context.Context) error {
+			return moveCold(ctx, tier)
+		})
+	}
+	if sqliteExport != "" {
+		jobs.add(jobSQLiteExport, everySpec(sqliteExportEvery), true, func(ctx context.Context) error {
+			return refreshSQLiteExport(ctx, kv, valueCodecs, sqliteExport)
+		})
+	}
+	jobs.add(jobGC, "", false, func(ctx context.Context) error {
+		res, err := collectGarbage(ctx, store, ipfs.BlockStore(), dbs.all(), pins, gcGrace)
+		if err != nil {
+			return err
+		}
+		logger.Infof("gc: %d live blocks, %d unreferenced, %d removed", res.Live, res.Candidates, res.Removed)
+		return nil
+	})
+	if backupDir != "" {
+		jobs.add(jobBackup, "@daily", false, func(ctx context.Context) error {
+			return rotateBackup(backupDir, backupKeep, data, store)
+		})
+	}
+	if usage != nil {
+		jobs.add(jobUsageFlush, everySpec(usageFlushInterval), false, usage.flush)
+	}
+	if nc.name == "daemon" {
+		jobs.add(jobHeartbeat, everySpec(prof.StatusInterval), false, func(context.Context) error {
+			logger.Infow("status", "peers", len(connectedPeers(h)), "members", len(mems.Membership()))
+			return nil
+		})
+	}
 
-		bstr, _ := multiaddr.NewMultiaddr(bootstrapNodeAddr)
+	reload := &reloader{config: configPath}
+	reload.register("log levels", func() error {
+		return setLogLevels(nodeLogLevels(nc.name == "daemon"))
+	}, "log-level")
+	reload.register("rate limits", func() error {
+		lim.setLimit(peerRate, peerBurst)
+		challenges.limit.setLimit(anonWriteRate, anonWriteBurst)
+		return nil
+	}, "peer-rate", "peer-burst", "anon-write-rate", "anon-write-burst")
+	reload.register("outboxes", func() error {
+		return relays.apply(outboxes)
+	}, "outbox")
+	if acl != nil {
+		reload.register("ACL", func() error {
+			return acl.reload(aclPath, allowPeers)
+		}, "acl", "allow-peer")
+	}
+	if auth != nil {
+		reload.register("API tokens", auth.reload)
+	}
+	if alertsFile != "" {
+		alerts, err := newAlerter(alertsFile, map[string]gaugeFunc{
+			"peers": func() (float64, bool) {
+				return float64(len(connectedPeers(h))), true
+			},
+			"members": func() (float64, bool) {
+				return float64(len(mems.Membership())), true
+			},
+			"replication_lag": func() (float64, bool) {
+				lag, ok := probes.maxLatency(10 * time.Minute)
+				return lag.Seconds(), ok
+			},
+			"disk": func() (float64, bool) {
+				return diskUsage(data)
+			},
+		}, nc.clock)
+		if err != nil {
+			return err
+		}
+		jobs.add(jobAlerts, everySpec(15*time.Second), false, func(ctx context.Context) error {
+			alerts.check(ctx)
+			return nil
+		})
+		reload.register("alerts", alerts.reload)
+	}
+	jobs.warnUnused()
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			reload.reload()
+		}
+	}()
 
-		inf, _ := peer.AddrInfoFromP2pAddr(bstr)
-		list := append(ipfslite.DefaultBootstrapPeers(), *inf)
-		ipfs.Bootstrap(list)
-		h.ConnManager().TagPeer(inf.ID, "keep", 100)
+	stopChan := make(chan bool, 1)
+	var stop func(restart bool)
+	if nc.name == "daemon" {
+		stop = func(restart bool) {
+			select {
+			case stopChan <- restart:
+			default:
+			}
+		}
+	}
+	if adminAddr != "" {
+		go serveAdmin(adminAddr, &adminAPI{
+			token:   adminToken,
+			h:       h,
+			store:   store,
+			bs:      ipfs.BlockStore(),
+			dbs:     dbs,
+			pins:    pins,
+			grace:   gcGrace,
+			maint:   maint,
+			stop:    stop,
+			reload:  reload,
+			events:  events,
+			mems:    mems,
+			sources: sources,
+
+			usageMeter: usage,
+		})
+	}
+
+	idem := newIdempotencyTable(idempotencyTTL, nc.clock)
+	api := &restAPI{
+		kv:      kv,
+		crdt:    crdt,
+		h:       h,
+		auth:    auth,
+		index:   index,
+		mems:    mems,
+		bs:      ipfs.BlockStore(),
+		serving: serving,
+		idem:    idem,
+		topic:   topicName,
+		clock:   nc.clock,
+		start:   nc.clock.Now(),
+
+		challenges: challenges,
+		usage:      usage,
+		jobs:       jobs,
+	}
+	if httpAddr != "" {
+		go serveREST(httpAddr, api)
+	}
+	if controlAddr == "" && nc.name == "daemon" {
+		controlAddr = filepath.Join(data, control.Socket)
+	}
+	if controlAddr != "" {
+		l, unix, err := listenControl(controlAddr)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		go serveControl(l, unix, *api)
+	}
+
+	if grpcAddr != "" {
+		go serveGRPC(grpcAddr, &grpcAPI{kv: kv, auth: auth, watch: watch, idem: idem, usage: usage})
 	}
 
-	myNodeAddr := listen.String() + "/ipfs/" + pid.String()
+	myNodeAddr := listen[0].String() + "/ipfs/" + pid.String()
+	logger.Infow("ready", "peer_id", pid, "profile", prof.Name, "labels", formatLabels(labels), "listen", listenAddrs.String(), "topic", topicName, "data", data, "addr", myNodeAddr)
 
-	fmt.Printf(`
+	// Daemons have their logs, and no REPL to tell the commands of.
+	if nc.name != "daemon" {
+		fmt.Printf(`
 Peer ID: %s
-Listen address: %s
+Profile: %s
+Labels: %s
+Listen addresses: %s
 Topic: %s
 Data Folder: %s
 Node Address: %s
@@ -228,39 +1118,119 @@ Ready!
 
 Commands:
 
-> list               -> list items in the store
-> get <key>          -> get value for a key
-> put <key> <value>  -> store value on a key
-> exit               -> quit
+> list [<prefix>] [flags]          -> list items in the store (--limit N, --sort key|asc|desc, --keys-only)
+> get [--decode] <key>             -> get value for a key (--decode renders it with the prefix codec)
+> put <key> <value>                -> store value on a key
+> mput <key>=<value> ...           -> store several values in a single delta
+> emit <topic> <json> [k=v ...]    -> write values and an event for -outbox in a single delta
+> outbox                           -> list the events of this node waiting to be published
+> cas <key> <old> <new>            -> store new on a key only if it holds old
+> del <key>                        -> delete a key
+> del-prefix <prefix>              -> delete every key under a prefix
+> del --prefix <prefix> [flags]    -> delete a large prefix in rate-limited batches (--rate N/s, --batch N)
+> search <query>                   -> full-text search the values under -search-prefix
+> ts.add <series> <value>          -> add a sample to a time series now
+> ts.get <series> [duration]       -> show the samples and rollups of a series (default last 1h)
+> ts.ls                            -> list time series
+> geo put <id> <lat> <lon> [val]   -> store an entry at a location
+> geo near <lat> <lon> <radius>    -> list entries within a radius (meters, or with m/km)
+> geo rm <id>                      -> remove a located entry
+> lock <key> [flags]               -> lease a key to tell others you are editing it (--ttl 1m, --as <name>)
+> unlock <key> [--force]           -> release a lease, --force for one held by someone else
+> locks                            -> list the leased keys and who holds them
+> resolve <key|ref> [--timeout d]  -> fetch the entry a key references in another database (dkv://topic/<topic>/<key> or dkv://snapshot/<cid>/<key>)
+> whoput <key>                     -> show which peer signed the value of a key
+> catalog                          -> list the databases advertised in the catalog
+> catalog publish <description>    -> advertise the current database (--schema <url> first to link its schema)
+> catalog rm <topic>               -> remove a database from the catalog
+> use [<db>]                       -> work on a database given with -db, or list them
+> watch <prefix>                   -> stream the changes under a prefix until Enter
+> meta <key>                       -> show the value and write metadata for a key
+> addfile <key> <path>             -> add a file and store its CID on a key
+> catfile <key>                    -> print the file referenced by a key
+> pins                             -> list content pinned locally
+> gc                               -> delete blocks no longer referenced
+> maintenance <on/off>             -> hold back broadcasts and hooks while doing maintenance
+> freeze <namespace>               -> reject writes under a namespace on every node
+> thaw <namespace>                 -> accept writes under a namespace again
+> frozen                           -> list frozen namespaces
+> ban <peer|cidr>                  -> refuse connections from and to a peer or an IP range
+> unban <peer|cidr>                -> lift a ban
+> bans                             -> list banned peers and IP ranges
+> jobs [run <job>]                 -> list the maintenance jobs and their last run, or run one now
+> writers [add|rm <peer>]          -> list, register or unregister the writers of the current database under -admission writers
+> schema <namespace> <file>        -> require values under a namespace to match a schema (JSON Schema file or protobuf:<set>:<message>)
+> schema rm <namespace>            -> drop the schema of a namespace
+> schemas                          -> list namespaces with a schema
+> import -from <url> [flags]       -> copy keys from redis:// or etcd:// (-prefix, -strip, -follow)
+> import <dump> [flags]            -> restore keys from a JSON or CSV dump (-prefix, -strip)
+> export [flags]                   -> dump keys as JSON or CSV (-format json|csv, -prefix, -o <file>)
+> backup <file>                    -> write a snapshot of the datastore to restore a node from (globaldb restore <file>)
+> export-sqlite <file>             -> write the keyspace to a SQLite file to query with SQL
+> export-delta <from> <to> <file>  -> write the operations between two DAG heights to a file
+> import-delta <file>              -> merge operations from a delta file
+> dag dot|json [--depth N] [file]  -> draw the recent DAG for Graphviz, or as JSON (heights, authors)
+> proof <key> [file]               -> write a signed inclusion proof for a key
+> verify-proof <file> [trusted]... -> check that a trusted peer or head vouches for a past value
+> stats [--top N] [--depth N]      -> show the largest key prefixes and their churn
+> debug heads                      -> list the heads of the database, with the changes waiting for a restart
+> debug head pin|drop <cid>        -> make a block a head, or drop a head, from the next start (recovery only)
+> reload                           -> re-read configuration that can change without a restart
+> peers [ls|events]                -> list connected peers or recent peer events
+> peers alias <peer> <name>        -> name a peer in listings and logs (unalias to remove)
+> peers aliases                    -> list peer aliases
+> publish-dns <name>               -> print the DNS records advertising this node under a name
+> bootstrap-peers                  -> list the nodes in the bootstrap registry
+> members                          -> list nodes seen on the network and their labels
+> exit                             -> quit
 
 
 `,
-		pid, listen, topicName, data, myNodeAddr,
+			pid, prof.Name, formatLabels(labels), listenAddrs.String(), topicName, data, myNodeAddr,
+		)
+	}
+
+	// Both modes return on SIGINT and SIGTERM so that the datastore is
+	// closed cleanly and can be reopened on the next start.
+	signalChan := make(chan os.Signal, 20)
+	signal.Notify(
+		signalChan,
+		syscall.SIGINT,
+		syscall.SIGTERM,
 	)
 
-	if len(os.Args) > 1 && os.Args[1] == "daemon" {
-		fmt.Println("Running in daemon mode")
-		go func() {
-			for {
-				fmt.Printf("%s - %d connected peers\n", time.Now().Format(time.Stamp), len(connectedPeers(h)))
-				time.Sleep(10 * time.Second)
-			}
-		}()
-		signalChan := make(chan os.Signal, 20)
-		signal.Notify(
-			signalChan,
-			syscall.SIGINT,
-			syscall.SIGTERM,
-			syscall.SIGHUP,
-		)
-		<-signalChan
-		return
+	if nc.name == "daemon" {
+		logger.Infow("running in daemon mode", "control", controlAddr)
+		select {
+		case <-signalChan:
+		case restart = <-stopChan:
+		}
+		return nil
 	}
 
+	// cur is the database the REPL works on, switched with use.
+	cur := kv
 	fmt.Printf("> ")
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		text := scanner.Text()
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	for {
+		var text string
+		select {
+		case <-signalChan:
+			fmt.Println()
+			return nil
+		case l, ok := <-lines:
+			if !ok {
+				return nil
+			}
+			text = l
+		}
 		fields := strings.Fields(text)
 		if len(fields) == 0 {
 			fmt.Printf("> ")
@@ -271,10 +1241,13 @@ Commands:
 
 		switch cmd {
 		case "exit", "quit":
-			return
+			return nil
 		case "debug":
 			if len(fields) < 2 {
-				fmt.Println("debug <on/off/peers>")
+				fmt.Println("debug <on/off/peers/heads>")
+				fmt.Println("debug head pin|drop <cid> [--force]")
+				fmt.Println("> ")
+				continue
 			}
 			st := fields[1]
 			switch st {
@@ -293,33 +1266,886 @@ Commands:
 						fmt.Println(a)
 					}
 				}
-			}
-		case "list":
-			q := query.Query{}
-			results, err := crdt.Query(ctx, q)
-			if err != nil {
-				printErr(err)
-			}
-			for r := range results.Next() {
-				if r.Error != nil {
+			case "heads":
+				heads, err := listHeads(ctx, store, cur, offlineDAG(ipfs.BlockStore()), sources)
+				if err != nil {
 					printErr(err)
 					continue
 				}
-				fmt.Printf("[%s] -> %s\n", r.Key, string(r.Value))
-			}
+				for _, hi := range heads {
+					fmt.Println(formatHead(hi, peerAliases))
+				}
+			case "head":
+				op, c, force, err := parseHeadArgs(fields[2:])
+				if err != nil {
+					printErr(err)
+					continue
+				}
+				if !force {
+					fmt.Println(headWarning)
+					fmt.Printf("\nRun debug head %s %s --force to go ahead.\n", op, c)
+					break
+				}
+				if op == "pin" {
+					height, err := pinHead(ctx, store, cur, offlineDAG(ipfs.BlockStore()), c)
+					if err != nil {
+						printErr(err)
+						continue
+					}
+					fmt.Printf("Pinned %s at height %d, restart the node to apply\n", c, height)
+				} else {
+					if err := dropHead(ctx, store, cur, c); err != nil {
+						printErr(err)
+						continue
+					}
+					fmt.Printf("Dropped %s, restart the node to apply\n", c)
+				}
+			}
+		case "addfile":
+			if len(fields) < 3 {
+				fmt.Println("addfile <key> <path>")
+				fmt.Println("> ")
+				continue
+			}
+			f, err := os.Open(fields[2])
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			nd, err := ipfs.AddFile(ctx, f, nil)
+			f.Close()
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			err = cur.Put(ctx, ds.NewKey(fields[1]), []byte(nd.Cid().String()))
+			if err != nil {
+				printErr(err)
+				continue
+			}
+		case "catfile":
+			if len(fields) < 2 {
+				fmt.Println("catfile <key>")
+				fmt.Println("> ")
+				continue
+			}
+			k := ds.NewKey(fields[1])
+			v, err := cur.Get(ctx, k)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			c, ok := referencedCID(v)
+			if !ok {
+				printErr(fmt.Errorf("%s does not reference a CID", k))
+				continue
+			}
+			f, err := ipfs.GetFile(ctx, c)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			_, err = io.Copy(os.Stdout, f)
+			f.Close()
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			fmt.Println()
+		case "pins":
+			list, err := pins.pins(ctx)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			for k, c := range list {
+				fmt.Printf("[%s] -> %s\n", k, c)
+			}
+		case "gc":
+			res, err := collectGarbage(ctx, store, ipfs.BlockStore(), dbs.all(), pins, gcGrace)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			fmt.Printf("%d live blocks, %d unreferenced, %d removed (grace period %s)\n", res.Live, res.Candidates, res.Removed, gcGrace)
+		case "maintenance":
+			if len(fields) < 2 {
+				fmt.Printf("maintenance mode: %t\n", maint.enabled())
+				break
+			}
+			switch fields[1] {
+			case "on":
+				maint.enable()
+			case "off":
+				if err := maint.disable(); err != nil {
+					printErr(err)
+					continue
+				}
+			default:
+				fmt.Println("maintenance <on/off>")
+			}
+		case "freeze", "thaw":
+			if len(fields) < 2 {
+				fmt.Printf("%s <namespace>\n", cmd)
+				fmt.Println("> ")
+				continue
+			}
+			ns := ds.NewKey(fields[1])
+			var err error
+			if cmd == "freeze" {
+				err = cur.Freeze(ctx, ns)
+			} else {
+				err = cur.Thaw(ctx, ns)
+			}
+			if err != nil {
+				printErr(err)
+				continue
+			}
+		case "frozen":
+			list, err := cur.Frozen(ctx)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			for _, ns := range list {
+				fmt.Println(ns)
+			}
+		case "ban", "unban":
+			if len(fields) != 2 {
+				fmt.Printf("%s <peer|cidr>\n", fields[0])
+				fmt.Println("> ")
+				continue
+			}
+			id, n, err := parseBan(fields[1], peerAliases)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			if fields[0] == "ban" {
+				err = bans.ban(ctx, id, n, h.Network())
+			} else {
+				err = bans.unban(ctx, id, n)
+			}
+			if err != nil {
+				printErr(err)
+				continue
+			}
+		case "bans":
+			peers, nets := bans.list()
+			for _, id := range peers {
+				fmt.Println(peerAliases.name(id))
+			}
+			for _, n := range nets {
+				fmt.Println(n)
+			}
+		case "jobs":
+			if len(fields) == 3 && fields[1] == "run" {
+				if err := jobs.runNow(ctx, fields[2]); err != nil {
+					printErr(err)
+					continue
+				}
+				fmt.Println("done")
+				break
+			}
+			if len(fields) != 1 {
+				fmt.Println("jobs [run <job>]")
+				fmt.Println("> ")
+				continue
+			}
+			for _, st := range jobs.status() {
+				fmt.Println(formatJobStatus(st))
+			}
+		case "writers":
+			if len(fields) == 1 {
+				list, err := cur.Writers(ctx)
+				if err != nil {
+					printErr(err)
+					continue
+				}
+				for _, id := range list {
+					fmt.Println(peerAliases.name(id))
+				}
+				break
+			}
+			if len(fields) != 3 || (fields[1] != "add" && fields[1] != "rm") {
+				fmt.Println("writers [add|rm <peer>]")
+				fmt.Println("> ")
+				continue
+			}
+			id, err := peerAliases.resolve(fields[2])
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			if fields[1] == "add" {
+				err = cur.RegisterWriter(ctx, id)
+			} else {
+				err = cur.UnregisterWriter(ctx, id)
+			}
+			if err != nil {
+				printErr(err)
+				continue
+			}
+		case "schema":
+			if len(fields) < 3 {
+				fmt.Println("schema <namespace> <file>")
+				fmt.Println("schema rm <namespace>")
+				fmt.Println("> ")
+				continue
+			}
+			var err error
+			if fields[1] == "rm" {
+				err = cur.DeleteSchema(ctx, ds.NewKey(fields[2]))
+			} else {
+				var r schemaRecord
+				r, err = readSchema(fields[2])
+				if err == nil {
+					err = cur.PutSchema(ctx, ds.NewKey(fields[1]), r)
+				}
+			}
+			if err != nil {
+				printErr(err)
+				continue
+			}
+		case "schemas":
+			list, err := cur.Schemas(ctx)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			namespaces := make([]ds.Key, 0, len(list))
+			for ns := range list {
+				namespaces = append(namespaces, ns)
+			}
+			sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Less(namespaces[j]) })
+			for _, ns := range namespaces {
+				fmt.Printf("%s: %s\n", ns, list[ns])
+			}
+		case "import":
+			cfg, err := parseImportFlags(fields[1:])
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			if cfg.Follow {
+				go func() {
+					if _, err := runImport(ctx, cur, cfg); err != nil {
+						logger.Errorf("import from %s: %s", cfg.From, err)
+					}
+				}()
+				break
+			}
+			n, err := runImport(ctx, cur, cfg)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			fmt.Printf("Imported %d keys from %s\n", n, cfg.From)
+		case "export":
+			cfg, err := parseExportFlags(fields[1:])
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			n, err := runExport(ctx, cur, cfg)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			if cfg.Output != "-" {
+				fmt.Printf("exported %d keys to %s\n", n, cfg.Output)
+			}
+		case "backup":
+			if len(fields) < 2 {
+				fmt.Println("backup <file>")
+				fmt.Println("> ")
+				continue
+			}
+			if err := writeBackup(fields[1], data, store); err != nil {
+				printErr(err)
+				continue
+			}
+		case "export-sqlite":
+			if len(fields) < 2 {
+				fmt.Println("export-sqlite <file>")
+				fmt.Println("> ")
+				continue
+			}
+			n, err := exportSQLite(ctx, cur, valueCodecs, fields[1])
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			fmt.Printf("Exported %d keys to %s\n", n, fields[1])
+		case "export-delta":
+			if len(fields) < 4 {
+				fmt.Println("export-delta <from> <to> <file>")
+				fmt.Printf("current height: %d\n", cur.crdt.InternalStats().MaxHeight)
+				fmt.Println("> ")
+				continue
+			}
+			from, err1 := strconv.ParseUint(fields[1], 10, 64)
+			to, err2 := strconv.ParseUint(fields[2], 10, 64)
+			if err1 != nil || err2 != nil || from > to {
+				printErr(fmt.Errorf("invalid height range %s-%s", fields[1], fields[2]))
+				continue
+			}
+			f, err := os.Create(fields[3])
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			n, err := exportDelta(ctx, f, offlineDAG(ipfs.BlockStore()), cur.crdt.InternalStats().Heads, from, to)
+			f.Close()
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			fmt.Printf("exported %d operations to %s\n", n, fields[3])
+		case "dag":
+			da, err := parseDagArgs(fields[1:])
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			g := walkDAG(ctx, offlineDAG(ipfs.BlockStore()), cur.crdt.InternalStats().Heads, da.depth, cur.keys.plain, sources)
+			var out io.Writer = os.Stdout
+			var f *os.File
+			if da.file != "" {
+				if f, err = os.Create(da.file); err != nil {
+					printErr(err)
+					continue
+				}
+				out = f
+			}
+			if da.format == "dot" {
+				err = writeDagDot(out, g, peerAliases)
+			} else {
+				err = writeDagJSON(out, g)
+			}
+			if f != nil {
+				if cerr := f.Close(); err == nil {
+					err = cerr
+				}
+			}
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			if f != nil {
+				fmt.Printf("wrote %d DAG nodes to %s\n", len(g.Nodes), da.file)
+			}
+		case "import-delta":
+			if len(fields) < 2 {
+				fmt.Println("import-delta <file>")
+				fmt.Println("> ")
+				continue
+			}
+			f, err := os.Open(fields[1])
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			heads, n, err := importDelta(ctx, f, ipfs.BlockStore())
+			f.Close()
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			if err := local.announce(heads); err != nil {
+				printErr(err)
+				continue
+			}
+			fmt.Printf("imported %d operations\n", n)
+		case "proof":
+			if len(fields) < 2 {
+				fmt.Println("proof <key> [file]")
+				fmt.Println("> ")
+				continue
+			}
+			k := ds.NewKey(fields[1])
+			v, err := cur.getStored(ctx, k)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			p, err := buildProof(ctx, offlineDAG(ipfs.BlockStore()), cur.crdt.InternalStats().Heads, cur.keys.stored(k), v, priv, cur.now())
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			out, err := json.MarshalIndent(p, "", "  ")
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			if len(fields) < 3 {
+				fmt.Println(string(out))
+				break
+			}
+			if err := os.WriteFile(fields[2], out, 0644); err != nil {
+				printErr(err)
+				continue
+			}
+			fmt.Printf("wrote proof with a path of %d blocks to %s\n", len(p.Path), fields[2])
+		case "verify-proof":
+			if len(fields) < 2 {
+				fmt.Println("verify-proof <file> [trusted peer or head]...")
+				fmt.Println("> ")
+				continue
+			}
+			// The node trusts itself and its heads unless told otherwise.
+			trust := lightclient.Trust{Signers: []peer.ID{h.ID()}, Heads: cur.crdt.InternalStats().Heads}
+			if len(fields) > 2 {
+				if trust, err = parseTrust(fields[2:]); err != nil {
+					printErr(err)
+					continue
+				}
+			}
+			data, err := os.ReadFile(fields[1])
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			var p lightclient.Proof
+			if err := json.Unmarshal(data, &p); err != nil {
+				printErr(err)
+				continue
+			}
+			if err := p.VerifyTrusted(trust); err != nil {
+				printErr(err)
+				continue
+			}
+			_, payload := dkv.DecodeValue(p.Value)
+			fmt.Printf("valid: [%s] was set to %s under head %s, signed by %s at %s; it may have changed since\n", p.Key, string(payload), p.Head, p.Signer, p.Signed.Format(time.RFC3339))
+		case "stats":
+			// Only the default database has a change feed.
+			var churn *changeFeed
+			if cur == kv {
+				churn = feed
+			}
+			if err := runStats(ctx, fields[1:], cur, churn); err != nil {
+				printErr(err)
+				continue
+			}
+		case "reload":
+			if err := reload.reload(); err != nil {
+				printErr(err)
+				continue
+			}
+		case "peers":
+			sub := "ls"
+			if len(fields) > 1 {
+				sub = fields[1]
+			}
+			switch sub {
+			case "ls":
+				for _, p := range connectedPeers(h) {
+					fmt.Println(peerAliases.name(p.ID), p.Addrs[0])
+				}
+			case "events":
+				printPeerEvents(events.list(), peerAliases)
+			case "aliases":
+				peerAliases.print()
+			case "alias", "unalias":
+				if (sub == "alias" && len(fields) < 4) || len(fields) < 3 {
+					fmt.Println("peers alias <peer> <name> | peers unalias <peer>")
+					fmt.Println("> ")
+					continue
+				}
+				id, err := peerAliases.resolve(fields[2])
+				if err != nil {
+					printErr(err)
+					continue
+				}
+				if sub == "alias" {
+					err = peerAliases.set(ctx, id, fields[3])
+				} else {
+					err = peerAliases.remove(ctx, id)
+				}
+				if err != nil {
+					printErr(err)
+					continue
+				}
+			default:
+				fmt.Println("peers [ls|events|aliases|alias <peer> <name>|unalias <peer>]")
+			}
+		case "publish-dns":
+			if len(fields) < 2 {
+				fmt.Println("publish-dns <name>")
+				fmt.Println("> ")
+				continue
+			}
+			records, public := dnsaddrRecords(fields[1], pid, h.Addrs())
+			if !public {
+				fmt.Println("warning: this node has no public addresses, other nodes may not reach these")
+			}
+			fmt.Printf("Add these records to the zone, then bootstrap other nodes from /dnsaddr/%s:\n\n", strings.TrimSuffix(fields[1], "."))
+			for _, r := range records {
+				fmt.Println(r)
+			}
+		case "bootstrap-peers":
+			infos, err := bootstrapPeers(ctx, kv)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			printBootstrapPeers(infos)
+		case "members":
+			printMembers(mems.Membership(), peerAliases, nc.clock.Now())
+		case "list":
+			if err := runList(ctx, fields[1:], cur); err != nil {
+				printErr(err)
+				continue
+			}
 		case "get":
+			decode := len(fields) > 1 && fields[1] == "--decode"
+			if decode {
+				fields = append(fields[:1], fields[2:]...)
+			}
 			if len(fields) < 2 {
-				fmt.Println("get <key>")
+				fmt.Println("get [--decode] <key>")
 				fmt.Println("> ")
 				continue
 			}
 			k := ds.NewKey(fields[1])
-			v, err := crdt.Get(ctx, k)
+			v, err := cur.Get(ctx, k)
 			if err != nil {
 				printErr(err)
 				continue
 			}
+			if decode {
+				pretty, err := valueCodecs.prettyValue(ctx, k, v)
+				if err != nil {
+					printErr(err)
+					continue
+				}
+				fmt.Printf("[%s] ->\n%s\n", k, pretty)
+				break
+			}
 			fmt.Printf("[%s] -> %s\n", k, string(v))
+			if l, err := cur.LockOf(ctx, k); err == nil && l != nil {
+				fmt.Printf("(%s)\n", l.describe(peerAliases))
+			}
+		case "lock", "unlock":
+			la, err := parseLockArgs(fields[0], fields[1:])
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			if fields[0] == "unlock" {
+				if err := cur.Unlock(ctx, la.key, pid.String(), la.holder, la.force); err != nil {
+					printErr(err)
+					continue
+				}
+				fmt.Printf("unlocked %s\n", la.key)
+				break
+			}
+			l, err := cur.Lock(ctx, la.key, pid.String(), la.holder, la.ttl)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			fmt.Printf("locked %s, %s\n", la.key, l)
+		case "locks":
+			locks, err := cur.Locks(ctx)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			keys := make([]ds.Key, 0, len(locks))
+			for k := range locks {
+				keys = append(keys, k)
+			}
+			sort.Slice(keys, func(i, j int) bool { return keys[i].Less(keys[j]) })
+			for _, k := range keys {
+				fmt.Printf("%s: %s\n", k, locks[k].describe(peerAliases))
+			}
+		case "search":
+			if len(fields) < 2 {
+				fmt.Println("search <query>")
+				fmt.Println("> ")
+				continue
+			}
+			if len(searchPrefixes) == 0 {
+				printErr(errors.New("search is not enabled, start the node with -search-prefix"))
+				continue
+			}
+			if cur != kv {
+				printErr(errors.New("search only indexes the default database"))
+				continue
+			}
+			for _, hit := range index.search(strings.Join(fields[1:], " "), 20) {
+				v, err := cur.Get(ctx, ds.NewKey(hit.Key))
+				if err != nil {
+					continue // deleted since
+				}
+				fmt.Printf("[%s] (%.2f) -> %s\n", hit.Key, hit.Score, string(v))
+			}
+		case "ts.add":
+			if len(fields) < 3 {
+				fmt.Println("ts.add <series> <value>")
+				fmt.Println("> ")
+				continue
+			}
+			v, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			if err := tsAdd(ctx, cur, fields[1], nc.clock.Now(), v); err != nil {
+				printErr(err)
+				continue
+			}
+		case "ts.get":
+			if len(fields) < 2 {
+				fmt.Println("ts.get <series> [duration]")
+				fmt.Println("> ")
+				continue
+			}
+			window := time.Hour
+			if len(fields) > 2 {
+				if window, err = time.ParseDuration(fields[2]); err != nil {
+					printErr(err)
+					continue
+				}
+			}
+			since := nc.clock.Now().Add(-window)
+			rollups, err := tsRollups(ctx, cur, fields[1], tsRet.Rollup, since)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			var starts []time.Time
+			for t := range rollups {
+				starts = append(starts, t)
+			}
+			sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+			for _, t := range starts {
+				r := rollups[t]
+				fmt.Printf("%s +%s count=%d avg=%g min=%g max=%g\n", t.Format(time.RFC3339), tsRet.Rollup, r.Count, r.Sum/float64(r.Count), r.Min, r.Max)
+			}
+			samples, err := tsRaw(ctx, cur, fields[1], since)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			for _, s := range samples {
+				fmt.Printf("%s %g\n", s.Time.Format(time.RFC3339Nano), s.Value)
+			}
+		case "ts.ls":
+			series, err := tsSeries(ctx, cur)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			for _, s := range series {
+				fmt.Println(s)
+			}
+		case "geo":
+			switch {
+			case len(fields) >= 5 && fields[1] == "put":
+				lat, lon, err := parseLatLon(fields[3], fields[4])
+				if err != nil {
+					printErr(err)
+					continue
+				}
+				e := geoEntry{Lat: lat, Lon: lon, Value: strings.Join(fields[5:], " ")}
+				if err := geoPut(ctx, cur, fields[2], e); err != nil {
+					printErr(err)
+					continue
+				}
+			case len(fields) == 5 && fields[1] == "near":
+				lat, lon, err := parseLatLon(fields[2], fields[3])
+				if err != nil {
+					printErr(err)
+					continue
+				}
+				radius, err := parseRadius(fields[4])
+				if err != nil {
+					printErr(err)
+					continue
+				}
+				hits, err := geoNear(ctx, cur, lat, lon, radius)
+				if err != nil {
+					printErr(err)
+					continue
+				}
+				for _, h := range hits {
+					fmt.Printf("%s (%.0fm) %g,%g -> %s\n", h.ID, h.Distance, h.Entry.Lat, h.Entry.Lon, h.Entry.Value)
+				}
+			case len(fields) == 3 && fields[1] == "rm":
+				if err := geoDelete(ctx, cur, fields[2]); err != nil {
+					printErr(err)
+					continue
+				}
+			default:
+				fmt.Println("geo put <id> <lat> <lon> [value] | geo near <lat> <lon> <radius> | geo rm <id>")
+				fmt.Println("> ")
+				continue
+			}
+		case "resolve":
+			target, timeout, err := parseResolveArgs(fields[1:])
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			if !strings.HasPrefix(target, refScheme) {
+				v, err := cur.Get(ctx, ds.NewKey(target))
+				if err != nil {
+					printErr(err)
+					continue
+				}
+				target = string(v)
+			}
+			ref, err := parseRef(target)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			v, err := refs.resolve(ctx, ref, timeout)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			fmt.Printf("[%s] -> %s\n", ref, string(v))
+		case "whoput":
+			if len(fields) < 2 {
+				fmt.Println("whoput <key>")
+				fmt.Println("> ")
+				continue
+			}
+			k := ds.NewKey(fields[1])
+			author, meta, err := cur.Author(ctx, k)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			fmt.Printf("[%s] written by %s at %s\n", k, peerAliases.name(author), meta.HLC)
+		case "catalog":
+			if len(fields) == 1 {
+				entries, err := kv.Catalog(ctx)
+				if err != nil {
+					printErr(err)
+					continue
+				}
+				for _, e := range entries {
+					fmt.Println(formatCatalogEntry(e))
+				}
+				break
+			}
+			switch fields[1] {
+			case "publish":
+				schema, desc, err := parseCatalogPublish(fields[2:])
+				if err != nil {
+					printErr(err)
+					continue
+				}
+				name, t := topicName, topicName
+				for n, d := range dbs.byName {
+					if d == cur && n != defaultDB {
+						name, t = n, dbTopic(topicName, n)
+					}
+				}
+				e := catalogEntry{Name: name, Topic: t, Description: desc, Schema: schema, Access: accessMode(cur != kv, acl), Publisher: pid.String()}
+				if err := kv.Advertise(ctx, e); err != nil {
+					printErr(err)
+					continue
+				}
+			case "rm":
+				if len(fields) != 3 {
+					fmt.Println("catalog rm <topic>")
+					fmt.Println("> ")
+					continue
+				}
+				if err := kv.Unadvertise(ctx, fields[2]); err != nil {
+					printErr(err)
+					continue
+				}
+			default:
+				fmt.Println("catalog [publish [--schema <url>] <description> | rm <topic>]")
+			}
+		case "use":
+			if len(fields) < 2 {
+				for _, n := range dbs.names() {
+					mark := " "
+					if dbs.byName[n] == cur {
+						mark = "*"
+					}
+					fmt.Printf("%s %s\n", mark, n)
+				}
+				break
+			}
+			d, err := dbs.get(fields[1])
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			cur = d
+			fmt.Printf("using %s\n", fields[1])
+		case "watch":
+			if len(fields) < 2 {
+				fmt.Println("watch <prefix>")
+				fmt.Println("> ")
+				continue
+			}
+			if !replWatch(watch, ds.NewKey(fields[1]), lines, signalChan) {
+				return nil
+			}
+		case "meta":
+			if len(fields) < 2 {
+				fmt.Println("meta <key>")
+				fmt.Println("> ")
+				continue
+			}
+			k := ds.NewKey(fields[1])
+			v, meta, err := cur.GetWithMeta(ctx, k)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			fmt.Printf("[%s] -> %s\n", k, string(v))
+			fmt.Printf("hlc: %s\n", meta.HLC)
+		case "mput":
+			if len(fields) < 2 {
+				fmt.Println("mput <key>=<value> ...")
+				fmt.Println("> ")
+				continue
+			}
+			if err := mput(ctx, cur, fields[1:]); err != nil {
+				printErr(err)
+				continue
+			}
+			fmt.Printf("Added %d keys in one delta\n", len(fields)-1)
+		case "emit":
+			if len(fields) < 3 {
+				fmt.Println("emit <topic> <json payload> [<key>=<value> ...]")
+				fmt.Println("> ")
+				continue
+			}
+			w, err := parseEmit(fields[1], fields[2], fields[3:])
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			ev, err := cur.WriteWithEvent(ctx, pid.String(), w)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			fmt.Printf("Wrote %d keys with event %s\n", len(w.Puts), ev.ID)
+		case "outbox":
+			events, err := pendingEvents(ctx, cur, pid.String())
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			if len(events) == 0 {
+				fmt.Println("No events waiting to be published")
+			}
+			for _, ev := range events {
+				fmt.Println(formatEvent(ev))
+			}
 		case "put":
 			if len(fields) < 3 {
 				fmt.Println("put <key> <value>")
@@ -328,11 +2154,59 @@ Commands:
 			}
 			k := ds.NewKey(fields[1])
 			v := strings.Join(fields[2:], " ")
-			err := crdt.Put(ctx, k, []byte(v))
+			err := cur.Put(ctx, k, []byte(v))
+			if err != nil {
+				printErr(err)
+				continue
+			}
+		case "cas":
+			if len(fields) != 4 {
+				fmt.Println("cas <key> <old> <new>")
+				fmt.Println("> ")
+				continue
+			}
+			k := ds.NewKey(fields[1])
+			ok, err := cur.CompareAndSwap(ctx, k, []byte(fields[2]), []byte(fields[3]))
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			if !ok {
+				fmt.Printf("Not swapped: [%s] does not hold %s\n", k, fields[2])
+			}
+		case "del":
+			if len(fields) < 2 {
+				fmt.Println("del <key>")
+				fmt.Println("> ")
+				continue
+			}
+			if strings.HasPrefix(fields[1], "-") {
+				bd, err := parseBulkDelete(fields[1:])
+				if err != nil {
+					printErr(err)
+					continue
+				}
+				if !replBulkDelete(ctx, cur, bd, lines, signalChan) {
+					return nil
+				}
+				break
+			}
+			if err := cur.Delete(ctx, ds.NewKey(fields[1])); err != nil {
+				printErr(err)
+				continue
+			}
+		case "del-prefix":
+			if len(fields) < 2 {
+				fmt.Println("del-prefix <prefix>")
+				fmt.Println("> ")
+				continue
+			}
+			n, err := cur.DeletePrefix(ctx, ds.NewKey(fields[1]))
 			if err != nil {
 				printErr(err)
 				continue
 			}
+			fmt.Printf("Deleted %d keys\n", n)
 		}
 		fmt.Printf("> ")
 	}
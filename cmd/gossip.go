@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// gossipConfig holds the gossipsub router settings along with the
+// per-topic message size caps. Gossipsub applies the seen-messages TTL
+// and the heartbeat to the whole router, so only the size cap can differ
+// between topics.
+type gossipConfig struct {
+	// MaxMessageSize is the largest message the router accepts. It is
+	// raised automatically to fit the largest per-topic cap.
+	MaxMessageSize int
+	// SeenTTL is how long message IDs are remembered for deduplication.
+	SeenTTL time.Duration
+	// Heartbeat is the gossipsub heartbeat interval.
+	Heartbeat time.Duration
+	// TopicMaxSize caps the size of messages accepted on a topic.
+	TopicMaxSize map[string]int
+}
+
+// parseTopicSizes converts topic=bytes flag values into size caps.
+func parseTopicSizes(m map[string]string) (map[string]int, error) {
+	sizes := make(map[string]int, len(m))
+	for topic, v := range m {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid max size %q for topic %s", v, topic)
+		}
+		sizes[topic] = n
+	}
+	return sizes, nil
+}
+
+// options returns the pubsub options for the router-wide settings.
+func (gc gossipConfig) options() []pubsub.Option {
+	var opts []pubsub.Option
+
+	maxSize := gc.MaxMessageSize
+	for _, n := range gc.TopicMaxSize {
+		if n > maxSize {
+			maxSize = n
+		}
+	}
+	if maxSize > 0 {
+		opts = append(opts, pubsub.WithMaxMessageSize(maxSize))
+	}
+	if gc.SeenTTL > 0 {
+		opts = append(opts, pubsub.WithSeenMessagesTTL(gc.SeenTTL))
+	}
+	if gc.Heartbeat > 0 {
+		params := pubsub.DefaultGossipSubParams()
+		params.HeartbeatInterval = gc.Heartbeat
+		opts = append(opts, pubsub.WithGossipSubParams(params))
+	}
+	return opts
+}
+
+// registerValidators installs the per-topic size caps, the ACL and the
+// admission policy on the topics of the databases, the per-peer rate limit
+// on the topics it limits and the head guard on the topics it guards. It
+// must be called before joining the topics.
+func (gc gossipConfig) registerValidators(psub *pubsub.PubSub, dbTopics []string, acl *peerACL, adm *admission, lim *peerLimiter, guard *headGuard) error {
+	topics := make(map[string]bool)
+	for topic := range gc.TopicMaxSize {
+		topics[topic] = true
+	}
+	isDB := make(map[string]bool)
+	for _, topic := range dbTopics {
+		isDB[topic] = true
+		if acl != nil || adm != nil {
+			topics[topic] = true
+		}
+	}
+	for topic := range lim.topics {
+		topics[topic] = true
+	}
+	if guard != nil {
+		for topic := range guard.topics {
+			topics[topic] = true
+		}
+	}
+	for topic := range topics {
+		topic := topic
+		maxSize, capped := gc.TopicMaxSize[topic]
+		err := psub.RegisterTopicValidator(topic, func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+			if capped && len(msg.Data) > maxSize {
+				logger.Debugf("dropping %d byte message on %s from %s: larger than %d", len(msg.Data), topic, from, maxSize)
+				return pubsub.ValidationReject
+			}
+			if isDB[topic] && !acl.mayAnnounce(msg.GetFrom()) {
+				logger.Debugf("dropping heads announced on %s by %s: not in the ACL", topic, msg.GetFrom())
+				return pubsub.ValidationReject
+			}
+			if lim.topics[topic] && !lim.allow(msg.GetFrom()) {
+				logger.Debugf("ignoring heads announced on %s by %s: over -peer-rate", topic, msg.GetFrom())
+				broadcastsRejected.WithLabelValues("rate").Inc()
+				return pubsub.ValidationIgnore
+			}
+			if isDB[topic] && adm != nil {
+				if res := adm.validate(ctx, topic, msg); res != pubsub.ValidationAccept {
+					return res
+				}
+			}
+			if guard != nil && guard.topics[topic] {
+				return guard.validate(topic, msg)
+			}
+			return pubsub.ValidationAccept
+		}, pubsub.WithValidatorInline(true))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/arcinston/dkv/pkg/dkvpb"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// watchBuffer is how many events a watcher may fall behind before it is
+// disconnected.
+const watchBuffer = 1024
+
+// watcher receives the changes under a prefix.
+type watcher struct {
+	prefix ds.Key
+	events chan *dkvpb.Event
+	// lagged is closed when the watcher fell too far behind.
+	lagged chan struct{}
+}
+
+// watchHub fans the changes seen by the put and delete hooks out to the
+// Watch streams.
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: make(map[*watcher]struct{})}
+}
+
+func (wh *watchHub) subscribe(prefix ds.Key) *watcher {
+	w := &watcher{
+		prefix: prefix,
+		events: make(chan *dkvpb.Event, watchBuffer),
+		lagged: make(chan struct{}),
+	}
+	wh.mu.Lock()
+	wh.watchers[w] = struct{}{}
+	wh.mu.Unlock()
+	return w
+}
+
+func (wh *watchHub) unsubscribe(w *watcher) {
+	wh.mu.Lock()
+	delete(wh.watchers, w)
+	wh.mu.Unlock()
+}
+
+// notify delivers a change to the watchers of its key. Watchers too far
+// behind are dropped rather than slowing down the hooks.
+func (wh *watchHub) notify(op dkvpb.Event_Op, k ds.Key, v []byte) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	for w := range wh.watchers {
+		if !w.prefix.Equal(k) && !w.prefix.IsAncestorOf(k) && w.prefix.String() != "/" {
+			continue
+		}
+		select {
+		case w.events <- &dkvpb.Event{Op: op, Key: k.String(), Value: v}:
+		default:
+			delete(wh.watchers, w)
+			close(w.lagged)
+		}
+	}
+}
+
+// grpcAPI implements the KV service of pkg/dkvpb/dkv.proto. Requests are
+// checked against the API tokens, sent as "authorization: Bearer <token>"
+// metadata. Writes sent with idempotency-key metadata are only made once.
+type grpcAPI struct {
+	dkvpb.UnimplementedKVServer
+	kv    *db
+	auth  *authorizer
+	watch *watchHub
+	idem  *idempotencyTable
+	usage *usageMeter
+}
+
+// idempotencyKey returns the idempotency-key metadata of a call.
+func idempotencyKey(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("idempotency-key"); len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+// authorize checks that the token of the call may use verb on k.
+func (a *grpcAPI) authorize(ctx context.Context, verb string, k ds.Key) (*apiToken, error) {
+	var header string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("authorization"); len(v) > 0 {
+			header = v[0]
+		}
+	}
+	token, err := a.auth.authenticateHeader(header)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if !permitted(token, verb, k) {
+		return nil, status.Errorf(codes.PermissionDenied, "token may not %s %s", verb, k)
+	}
+	return token, nil
+}
+
+// kvStatus turns a store error into a gRPC status.
+func kvStatus(err error) error {
+	switch {
+	case errors.Is(err, ds.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrFrozen):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrSchema):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrFenced):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, ErrDenied), errors.Is(err, ErrReadOnly):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, ErrIdempotencyReuse):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func (a *grpcAPI) Put(ctx context.Context, req *dkvpb.PutRequest) (*dkvpb.PutResponse, error) {
+	k := ds.NewKey(req.Key)
+	token, err := a.authorize(ctx, verbWrite, k)
+	if err != nil {
+		return nil, err
+	}
+	_, err = a.idem.do(idempotencyScope(token), idempotencyKey(ctx), writeFingerprint("put", k, req.Value), func() error {
+		return a.kv.Put(ctx, k, req.Value)
+	})
+	if err != nil {
+		return nil, kvStatus(err)
+	}
+	a.usage.write(usageToken, tokenAccount(token), len(req.Value))
+	return &dkvpb.PutResponse{}, nil
+}
+
+func (a *grpcAPI) Get(ctx context.Context, req *dkvpb.GetRequest) (*dkvpb.GetResponse, error) {
+	k := ds.NewKey(req.Key)
+	token, err := a.authorize(ctx, verbRead, k)
+	if err != nil {
+		return nil, err
+	}
+	v, meta, err := a.kv.GetWithMeta(ctx, k)
+	if err != nil {
+		return nil, kvStatus(err)
+	}
+	a.usage.read(usageToken, tokenAccount(token), len(v))
+	return &dkvpb.GetResponse{Value: v, Hlc: meta.HLC.String()}, nil
+}
+
+func (a *grpcAPI) Delete(ctx context.Context, req *dkvpb.DeleteRequest) (*dkvpb.DeleteResponse, error) {
+	k := ds.NewKey(req.Key)
+	token, err := a.authorize(ctx, verbWrite, k)
+	if err != nil {
+		return nil, err
+	}
+	_, err = a.idem.do(idempotencyScope(token), idempotencyKey(ctx), writeFingerprint("delete", k, nil), func() error {
+		return a.kv.Delete(ctx, k)
+	})
+	if err != nil {
+		return nil, kvStatus(err)
+	}
+	a.usage.write(usageToken, tokenAccount(token), 0)
+	return &dkvpb.DeleteResponse{}, nil
+}
+
+// List skips the keys the token may not read.
+func (a *grpcAPI) List(req *dkvpb.ListRequest, stream dkvpb.KV_ListServer) error {
+	ctx := stream.Context()
+	token, err := a.authorize(ctx, verbRead, ds.NewKey("/"))
+	if status.Code(err) == codes.Unauthenticated {
+		return err
+	}
+	prefix := ds.NewKey(req.Prefix)
+	results, err := a.kv.Query(ctx, query.Query{Prefix: prefix.String(), Orders: []query.Order{query.OrderByKey{}}})
+	if err != nil {
+		return kvStatus(err)
+	}
+	defer results.Close()
+	var sent uint32
+	size := 0
+	defer func() { a.usage.read(usageToken, tokenAccount(token), size) }()
+	for r := range results.Next() {
+		if r.Error != nil {
+			return kvStatus(r.Error)
+		}
+		if !permitted(token, verbRead, ds.NewKey(r.Key)) {
+			continue
+		}
+		if err := stream.Send(&dkvpb.KeyValue{Key: r.Key, Value: r.Value}); err != nil {
+			return err
+		}
+		size += len(r.Value)
+		if sent++; req.Limit > 0 && sent == req.Limit {
+			break
+		}
+	}
+	return nil
+}
+
+// Watch only sends the changes the token may read.
+func (a *grpcAPI) Watch(req *dkvpb.WatchRequest, stream dkvpb.KV_WatchServer) error {
+	ctx := stream.Context()
+	token, err := a.authorize(ctx, verbRead, ds.NewKey("/"))
+	if status.Code(err) == codes.Unauthenticated {
+		return err
+	}
+	w := a.watch.subscribe(ds.NewKey(req.Prefix))
+	defer a.watch.unsubscribe(w)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-w.lagged:
+			return status.Error(codes.ResourceExhausted, "watcher fell too far behind, watch again")
+		case e := <-w.events:
+			if !permitted(token, verbRead, ds.NewKey(e.Key)) {
+				continue
+			}
+			if err := stream.Send(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// serveGRPC exposes the gRPC API on addr until the server fails.
+func serveGRPC(addr string, a *grpcAPI) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Errorf("gRPC server: %s", err)
+		return
+	}
+	s := grpc.NewServer()
+	dkvpb.RegisterKVServer(s, a)
+	if err := s.Serve(l); err != nil {
+		logger.Errorf("gRPC server: %s", err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/arcinston/dkv/lightclient"
+	dshelp "github.com/ipfs/boxo/datastore/dshelp"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// headWarning is shown before the heads of a database are changed by
+// hand.
+const headWarning = `WARNING: changing the heads by hand is meant for recovery, when a
+corrupted or malicious head must be removed or a lost one restored. A
+dropped head is no longer merged from, so the writes only reachable
+from it are lost on this node until a peer announces them again, and
+new writes stop building on them. Back up the node first. The change
+is written to the datastore and applies when the node restarts.`
+
+// ErrNotAHead is returned when dropping a CID that is not a head.
+var ErrNotAHead = errors.New("not a head")
+
+// headInfo describes a head of a database.
+type headInfo struct {
+	Cid    string `json:"cid"`
+	Height uint64 `json:"height"`
+	// Source is the peer that announced the head, when it is recent.
+	Source string `json:"source,omitempty"`
+	// Missing is set when the block of the head is not stored locally.
+	Missing bool `json:"missing,omitempty"`
+	// Pending tells what happens to the head on restart: "pin" when it
+	// was pinned, "drop" when it was dropped.
+	Pending string `json:"pending,omitempty"`
+}
+
+// headsKey is where go-ds-crdt keeps the heads of the store of namespace
+// ns, as <ns>/h/<multihash> -> height.
+func headsKey(ns ds.Key) ds.Key {
+	return ns.ChildString("h")
+}
+
+// storedHeads reads the heads the CRDT store will start from.
+func storedHeads(ctx context.Context, store ds.Datastore, ns ds.Key) (map[cid.Cid]uint64, error) {
+	results, err := store.Query(ctx, query.Query{Prefix: headsKey(ns).String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	heads := make(map[cid.Cid]uint64)
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		c, err := dshelp.DsKeyToCidV1(ds.NewKey(ds.NewKey(r.Key).BaseNamespace()), cid.DagProtobuf)
+		if err != nil {
+			return nil, err
+		}
+		height, n := binary.Uvarint(r.Value)
+		if n <= 0 {
+			return nil, fmt.Errorf("head %s: bad height", c)
+		}
+		heads[c] = height
+	}
+	return heads, nil
+}
+
+// listHeads describes the heads d is working from along with the changes
+// made by hand that are waiting for a restart.
+func listHeads(ctx context.Context, store ds.Datastore, d *db, dag ipld.DAGService, sources *headSources) ([]headInfo, error) {
+	stored, err := storedHeads(ctx, store, d.ns)
+	if err != nil {
+		return nil, err
+	}
+	stats := d.crdt.InternalStats()
+	current := make(map[cid.Cid]bool)
+	var heads []headInfo
+	add := func(c cid.Cid, pending string) {
+		hi := headInfo{Cid: c.String(), Pending: pending}
+		if p, ok := sources.source(c); ok {
+			hi.Source = p.String()
+		}
+		if height, ok := stored[c]; ok {
+			hi.Height = height
+		}
+		nd, err := dag.Get(ctx, c)
+		if err != nil {
+			hi.Missing = true
+		} else if delta, err := lightclient.NodeDelta(nd); err == nil {
+			hi.Height = delta.GetPriority()
+		}
+		heads = append(heads, hi)
+	}
+	for _, c := range stats.Heads {
+		current[c] = true
+		pending := ""
+		if _, ok := stored[c]; !ok {
+			pending = "drop"
+		}
+		add(c, pending)
+	}
+	for c := range stored {
+		if !current[c] {
+			add(c, "pin")
+		}
+	}
+	sort.Slice(heads, func(i, j int) bool {
+		if heads[i].Height != heads[j].Height {
+			return heads[i].Height > heads[j].Height
+		}
+		return heads[i].Cid < heads[j].Cid
+	})
+	return heads, nil
+}
+
+// pinHead makes c a head of the store of d from the next start, at the
+// height of its delta. Its block must be stored locally.
+func pinHead(ctx context.Context, store ds.Datastore, d *db, dag ipld.DAGService, c cid.Cid) (uint64, error) {
+	nd, err := dag.Get(ctx, c)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not stored locally: %w", c, err)
+	}
+	delta, err := lightclient.NodeDelta(nd)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a DAG node: %w", c, err)
+	}
+	height := delta.GetPriority()
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, height)
+	return height, store.Put(ctx, headsKey(d.ns).Child(dshelp.MultihashToDsKey(c.Hash())), buf[:n])
+}
+
+// dropHead removes c from the heads of the store of d from the next
+// start.
+func dropHead(ctx context.Context, store ds.Datastore, d *db, c cid.Cid) error {
+	stored, err := storedHeads(ctx, store, d.ns)
+	if err != nil {
+		return err
+	}
+	if _, ok := stored[c]; !ok {
+		return fmt.Errorf("%s: %w", c, ErrNotAHead)
+	}
+	return store.Delete(ctx, headsKey(d.ns).Child(dshelp.MultihashToDsKey(c.Hash())))
+}
+
+// parseHeadArgs parses the arguments of
+//
+//	debug head pin|drop <cid> [--force]
+func parseHeadArgs(args []string) (op string, c cid.Cid, force bool, err error) {
+	usage := errors.New("usage: debug head pin|drop <cid> [--force]")
+	if len(args) == 3 && args[2] == "--force" {
+		force, args = true, args[:2]
+	}
+	if len(args) != 2 || (args[0] != "pin" && args[0] != "drop") {
+		return "", cid.Undef, false, usage
+	}
+	c, err = cid.Decode(args[1])
+	if err != nil {
+		return "", cid.Undef, false, err
+	}
+	return args[0], c, force, nil
+}
+
+// formatHead renders a head for the REPL.
+func formatHead(hi headInfo, al *aliases) string {
+	s := fmt.Sprintf("%s  height %d", hi.Cid, hi.Height)
+	if hi.Source != "" {
+		if id, err := peer.Decode(hi.Source); err == nil {
+			s += "  from " + al.name(id)
+		}
+	}
+	if hi.Missing {
+		s += "  (not stored locally)"
+	}
+	switch hi.Pending {
+	case "pin":
+		s += "  (pinned, head after restart)"
+	case "drop":
+		s += "  (dropped, gone after restart)"
+	}
+	return s
+}
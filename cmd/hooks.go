@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	"github.com/arcinston/dkv/pkg/dkvpb"
+	ds "github.com/ipfs/go-datastore"
+	crdt "github.com/ipfs/go-ds-crdt"
+)
+
+// applyHooks are what the databases of a node do with the changes they
+// apply, their own and those of their peers: advance the clock, decode the
+// value, count and trace the change, show it in the REPL or log it in
+// daemon mode, and hand it to the sinks of the database.
+type applyHooks struct {
+	ctx    context.Context
+	daemon bool
+	maint  *maintenance
+	// slow is the duration above which hooks are logged as slow.
+	slow time.Duration
+	pf   *prefetcher
+	// prefetch fetches the content referenced by every value, pinned or
+	// not.
+	prefetch bool
+}
+
+// applySinks are what the changes of a database feed. Only the default
+// database has a change feed, a search index, watches and probes, since
+// the APIs serving them only reach it; nil sinks are skipped.
+type applySinks struct {
+	feed   *changeFeed
+	index  *searchIndex
+	watch  *watchHub
+	pins   *pinPolicy
+	probes *probeStats
+}
+
+// install sets the put and delete hooks of the database d in opts. name
+// prefixes what the REPL shows of named databases, and is empty for the
+// default one. The hooks only use the clock, pipelines, keys and tier of
+// d, so they may be installed before its CRDT store is open.
+func (h *applyHooks) install(opts *crdt.Options, name string, d *db, sinks applySinks) {
+	prefix := ""
+	if name != "" {
+		prefix = name + ": "
+	}
+	opts.PutHook = func(k ds.Key, v []byte) {
+		defer logSlow("put hook", h.slow, time.Now(), "key", k)
+		d.tier.stored(h.ctx, k, v)
+		k = d.keys.plain(k)
+		meta, v := dkv.DecodeValue(v)
+		defer traceApply("put", k, &meta, d.now()).End()
+		if !d.clock.Update(meta.HLC) {
+			logger.Warnf("%s%s: timestamp %s is more than %s ahead of the clock", prefix, k, meta.HLC, dkv.MaxDrift)
+		}
+		v, err := d.pipelines.Decode(k, meta, v)
+		if err != nil {
+			logger.Warnf("%s%s: %s", prefix, k, err)
+			return
+		}
+		if sinks.probes != nil {
+			sinks.probes.observe(k, v)
+		}
+		kvChanges.WithLabelValues("put", kvNamespaces.label(k)).Inc()
+		h.maint.deliver(func() {
+			// Probes are too frequent to be worth showing, and the records
+			// of deletes come along with the deletes.
+			switch {
+			case isProbeKey(k), deletesNs.IsAncestorOf(k):
+			case h.daemon:
+				logger.Debugw("put", "db", dbLabel(name), "key", k, "size", len(v))
+			case !replWatching.Load():
+				fmt.Printf("%sAdded: [%s] -> %s\n", prefix, k, string(v))
+			}
+			if sinks.feed != nil {
+				sinks.feed.record("put", k, v)
+			}
+			if sinks.index != nil {
+				sinks.index.update(h.ctx, k, v)
+			}
+			if sinks.watch != nil {
+				sinks.watch.notify(dkvpb.Event_OP_PUT, k, v)
+			}
+			if (sinks.pins != nil && sinks.pins.update(h.ctx, k, v)) || h.prefetch {
+				h.pf.enqueue(v)
+			}
+		})
+	}
+	opts.DeleteHook = func(k ds.Key) {
+		defer logSlow("delete hook", h.slow, time.Now(), "key", k)
+		// The cold tier knows keys as they are stored.
+		d.tier.forget(h.ctx, k)
+		k = d.keys.plain(k)
+		kvChanges.WithLabelValues("delete", kvNamespaces.label(k)).Inc()
+		defer traceApply("delete", k, nil, d.now()).End()
+		h.maint.deliver(func() {
+			if h.daemon {
+				logger.Debugw("delete", "db", dbLabel(name), "key", k)
+			} else if !replWatching.Load() {
+				fmt.Printf("%sRemoved: [%s]\n", prefix, k)
+			}
+			if sinks.feed != nil {
+				sinks.feed.record("delete", k, nil)
+			}
+			if sinks.index != nil {
+				sinks.index.remove(k)
+			}
+			if sinks.watch != nil {
+				sinks.watch.notify(dkvpb.Event_OP_DELETE, k, nil)
+			}
+			if sinks.pins != nil {
+				sinks.pins.unpin(h.ctx, k)
+			}
+		})
+	}
+}
+
+// dbLabel is the name of a database in logs, defaultDB for the default
+// one.
+func dbLabel(name string) string {
+	if name == "" {
+		return defaultDB
+	}
+	return name
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+
+	ipns "github.com/ipfs/boxo/ipns"
+	libp2p "github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	dualdht "github.com/libp2p/go-libp2p-kad-dht/dual"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// setupHost builds the libp2p host and the DHT of the node, like
+// ipfslite.SetupLibp2p, except that the profile picks the mode of the
+// DHT: client-only nodes query it but neither store nor serve records for
+// others.
+func setupHost(ctx context.Context, priv crypto.PrivKey, psk pnet.PSK, listen []multiaddr.Multiaddr, dhtClient bool, opts ...libp2p.Option) (host.Host, *dualdht.DHT, error) {
+	mode := dht.ModeAuto
+	if dhtClient {
+		mode = dht.ModeClient
+	}
+	transports := libp2p.DefaultTransports
+	// The QUIC handshake cannot be wrapped in the swarm key.
+	if psk != nil {
+		transports = libp2p.ChainOptions(
+			libp2p.NoTransports,
+			libp2p.Transport(tcp.NewTCPTransport),
+			libp2p.Transport(websocket.New),
+		)
+	}
+	var ddht *dualdht.DHT
+	h, err := libp2p.New(append([]libp2p.Option{
+		libp2p.Identity(priv),
+		libp2p.ListenAddrs(listen...),
+		libp2p.PrivateNetwork(psk),
+		transports,
+		libp2p.Routing(func(h host.Host) (routing.PeerRouting, error) {
+			var err error
+			ddht, err = dualdht.New(ctx, h,
+				dualdht.DHTOption(dht.NamespacedValidator("pk", record.PublicKeyValidator{})),
+				dualdht.DHTOption(dht.NamespacedValidator("ipns", ipns.Validator{KeyBook: h.Peerstore()})),
+				dualdht.DHTOption(dht.Concurrency(10)),
+				dualdht.DHTOption(dht.Mode(mode)),
+			)
+			return ddht, err
+		}),
+	}, opts...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, ddht, nil
+}
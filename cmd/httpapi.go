@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	"github.com/ipfs/boxo/blockstore"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	crdt "github.com/ipfs/go-ds-crdt"
+	"github.com/libp2p/go-libp2p/core/host"
+)
+
+// maxValueSize is the largest value the HTTP API accepts.
+const maxValueSize = 16 << 20
+
+// restAPI exposes the key-value store over HTTP for services that are not
+// written in Go, or for curl. Requests are checked against the API tokens
+// like those of the change feed.
+type restAPI struct {
+	kv    *db
+	crdt  *crdt.Datastore
+	h     host.Host
+	auth  *authorizer
+	index *searchIndex
+	mems  *members
+	// bs and serving back the block endpoint.
+	bs      blockstore.Blockstore
+	serving *servingPolicy
+	idem    *idempotencyTable
+	// challenges guards the writes made without a token.
+	challenges *writeChallenge
+	usage      *usageMeter
+	jobs       *scheduler
+	topic      string
+	// clock tells the uptime, from start.
+	clock dkv.WallClock
+	start time.Time
+}
+
+func (a *restAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/v1/kv", instrument("kv_list", http.HandlerFunc(a.list)))
+	mux.Handle("/v1/kv/", instrument("kv", http.HandlerFunc(a.key)))
+	mux.Handle("/v1/outbox", instrument("outbox", http.HandlerFunc(a.outbox)))
+	mux.Handle("/v1/peers", instrument("peers", http.HandlerFunc(a.peers)))
+	mux.Handle("/v1/status", instrument("status", http.HandlerFunc(a.status)))
+	mux.Handle("/v1/catalog", instrument("catalog", http.HandlerFunc(a.catalog)))
+	mux.Handle("/v1/challenge", instrument("challenge", http.HandlerFunc(a.challenge)))
+	mux.Handle("/v1/search", a.index.handler(a.auth))
+	mux.Handle("/ipfs/", instrument("block", http.HandlerFunc(a.block)))
+	return mux
+}
+
+// authorize authenticates the request and checks that its token may use
+// verb on k. It answers the request and returns false when not.
+func (a *restAPI) authorize(w http.ResponseWriter, r *http.Request, verb string, k ds.Key) (*apiToken, bool) {
+	token, err := a.auth.authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	if !permitted(token, verb, k) {
+		http.Error(w, "token may not "+verb+" "+k.String(), http.StatusForbidden)
+		return nil, false
+	}
+	return token, true
+}
+
+// key serves GET, PUT and DELETE /v1/kv/{key}. Values are sent and
+// returned as the raw request and response bodies. Writes sent with an
+// Idempotency-Key header are only made once; replays are answered with an
+// Idempotent-Replayed: true header.
+func (a *restAPI) key(w http.ResponseWriter, r *http.Request) {
+	k := ds.NewKey(strings.TrimPrefix(r.URL.Path, "/v1/kv"))
+	if k.String() == "/" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		token, ok := a.authorize(w, r, verbRead, k)
+		if !ok {
+			return
+		}
+		v, meta, err := a.kv.GetWithMeta(r.Context(), k)
+		if err != nil {
+			writeKVError(w, err)
+			return
+		}
+		a.usage.read(usageToken, tokenAccount(token), len(v))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Globaldb-Hlc", meta.HLC.String())
+		w.Write(v)
+	case http.MethodPut:
+		token, ok := a.authorize(w, r, verbWrite, k)
+		if !ok || !a.challenges.admit(w, r, token) {
+			return
+		}
+		v, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		replayed, err := a.idem.do(idempotencyScope(token), r.Header.Get(idempotencyHeader), writeFingerprint("put", k, v), func() error {
+			return a.kv.Put(r.Context(), k, v)
+		})
+		if err != nil {
+			writeKVError(w, err)
+			return
+		}
+		a.usage.write(usageToken, tokenAccount(token), len(v))
+		writeReplayed(w, replayed)
+	case http.MethodDelete:
+		token, ok := a.authorize(w, r, verbWrite, k)
+		if !ok || !a.challenges.admit(w, r, token) {
+			return
+		}
+		replayed, err := a.idem.do(idempotencyScope(token), r.Header.Get(idempotencyHeader), writeFingerprint("delete", k, nil), func() error {
+			return a.kv.Delete(r.Context(), k)
+		})
+		if err != nil {
+			writeKVError(w, err)
+			return
+		}
+		a.usage.write(usageToken, tokenAccount(token), 0)
+		writeReplayed(w, replayed)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// outbox serves POST /v1/outbox: the body is an outboxWrite, whose keys
+// and event are written in a single delta. The event is answered back.
+// The token must be allowed to write every key, or the outbox when there
+// are none.
+func (a *restAPI) outbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var ow outboxWrite
+	if err := json.Unmarshal(body, &ow); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	keys := []ds.Key{outboxNs}
+	if n := len(ow.Puts) + len(ow.Deletes); n > 0 {
+		keys = make([]ds.Key, 0, n)
+		for _, e := range ow.Puts {
+			keys = append(keys, ds.NewKey(e.Key))
+		}
+		for _, k := range ow.Deletes {
+			keys = append(keys, ds.NewKey(k))
+		}
+	}
+	token, err := a.auth.authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	for _, k := range keys {
+		if !permitted(token, verbWrite, k) {
+			http.Error(w, "token may not "+verbWrite+" "+k.String(), http.StatusForbidden)
+			return
+		}
+	}
+	if !a.challenges.admit(w, r, token) {
+		return
+	}
+	var ev *outboxEvent
+	replayed, err := a.idem.do(idempotencyScope(token), r.Header.Get(idempotencyHeader), writeFingerprint("outbox", outboxNs, body), func() error {
+		var err error
+		ev, err = a.kv.WriteWithEvent(r.Context(), a.h.ID().String(), ow)
+		return err
+	})
+	if err != nil {
+		writeKVError(w, err)
+		return
+	}
+	a.usage.write(usageToken, tokenAccount(token), len(body))
+	if replayed {
+		writeReplayed(w, replayed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ev)
+}
+
+// writeReplayed answers a successful write.
+func writeReplayed(w http.ResponseWriter, replayed bool) {
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// kvEntry is a key and its value in listings. Values are base64 in JSON.
+type kvEntry struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// list serves GET /v1/kv?prefix=<prefix>&limit=<n>, skipping the keys the
+// token may not read.
+func (a *restAPI) list(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, err := a.auth.authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	prefix := "/"
+	if p := q.Get("prefix"); p != "" {
+		prefix = ds.NewKey(p).String()
+	}
+	results, err := a.kv.Query(r.Context(), query.Query{Prefix: prefix, Orders: []query.Order{query.OrderByKey{}}})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer results.Close()
+	entries := []kvEntry{}
+	size := 0
+	defer func() { a.usage.read(usageToken, tokenAccount(token), size) }()
+	for res := range results.Next() {
+		if res.Error != nil {
+			http.Error(w, res.Error.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !permitted(token, verbRead, ds.NewKey(res.Key)) {
+			continue
+		}
+		entries = append(entries, kvEntry{Key: res.Key, Value: res.Value})
+		size += len(res.Value)
+		if limit > 0 && len(entries) == limit {
+			break
+		}
+	}
+	writeJSON(w, entries)
+}
+
+// peerEntry is a connected peer.
+type peerEntry struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// peers serves GET /v1/peers.
+func (a *restAPI) peers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := a.auth.authenticate(r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	peers := []peerEntry{}
+	for _, p := range connectedPeers(a.h) {
+		peers = append(peers, peerEntry{ID: p.ID.String(), Addr: p.Addrs[0].String()})
+	}
+	writeJSON(w, peers)
+}
+
+// status serves GET /v1/status.
+func (a *restAPI) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := a.auth.authenticate(r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	stats := a.crdt.InternalStats()
+	heads := make([]string, 0, len(stats.Heads))
+	for _, c := range stats.Heads {
+		heads = append(heads, c.String())
+	}
+	var addrs []string
+	for _, addr := range a.h.Addrs() {
+		addrs = append(addrs, addr.String())
+	}
+	writeJSON(w, map[string]interface{}{
+		"peer_id":     a.h.ID().String(),
+		"addresses":   addrs,
+		"topic":       a.topic,
+		"peers":       len(connectedPeers(a.h)),
+		"members":     len(a.mems.Membership()),
+		"heads":       heads,
+		"max_height":  stats.MaxHeight,
+		"queued_jobs": stats.QueuedJobs,
+		"jobs":        a.jobs.status(),
+		"uptime":      a.clock.Now().Sub(a.start).Round(time.Second).String(),
+	})
+}
+
+// writeKVError answers with the status matching a store error.
+func writeKVError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ds.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrFrozen):
+		status = http.StatusConflict
+	case errors.Is(err, ErrSchema):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, ErrFenced):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, ErrDenied), errors.Is(err, ErrReadOnly):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrIdempotencyReuse):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, ErrInvalidEvent):
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// serveREST exposes the HTTP API on addr until the server fails.
+func serveREST(addr string, a *restAPI) {
+	if err := http.ListenAndServe(addr, a.handler()); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Errorf("HTTP API server: %s", err)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// maxBlockSize is the largest block fetched from an HTTP gateway, the
+// bitswap limit.
+const maxBlockSize = 2 << 20
+
+// httpFallbackDAG fetches the blocks bitswap could not get within a delay
+// from HTTP gateways: public IPFS gateways, or the HTTP API of other
+// nodes, which serves blocks under /ipfs/<cid>. Blocks are asked for in
+// the raw format of the trustless gateway specification and checked
+// against their CID before being stored.
+type httpFallbackDAG struct {
+	ipld.DAGService
+	bs       blockstore.Blockstore
+	gateways []string
+	after    time.Duration
+	client   *http.Client
+}
+
+func newHTTPFallbackDAG(dag ipld.DAGService, bs blockstore.Blockstore, gateways []string, after time.Duration) *httpFallbackDAG {
+	for i, g := range gateways {
+		gateways[i] = strings.TrimSuffix(g, "/")
+	}
+	return &httpFallbackDAG{
+		DAGService: dag,
+		bs:         bs,
+		gateways:   gateways,
+		after:      after,
+		client:     &http.Client{Timeout: time.Minute},
+	}
+}
+
+func (d *httpFallbackDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	tctx, cancel := context.WithTimeout(ctx, d.after)
+	nd, err := d.DAGService.Get(tctx, c)
+	cancel()
+	if err == nil || ctx.Err() != nil {
+		return nd, err
+	}
+	return d.fetch(ctx, c, err)
+}
+
+func (d *httpFallbackDAG) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	go func() {
+		defer close(out)
+		tctx, cancel := context.WithTimeout(ctx, d.after)
+		defer cancel()
+		missing := make(map[cid.Cid]bool, len(cids))
+		for _, c := range cids {
+			missing[c] = true
+		}
+		for opt := range d.DAGService.GetMany(tctx, cids) {
+			if opt.Err != nil {
+				continue
+			}
+			delete(missing, opt.Node.Cid())
+			out <- opt
+		}
+		for c := range missing {
+			if ctx.Err() != nil {
+				out <- &ipld.NodeOption{Err: ctx.Err()}
+				return
+			}
+			nd, err := d.fetch(ctx, c, errors.New("not found over bitswap"))
+			out <- &ipld.NodeOption{Node: nd, Err: err}
+		}
+	}()
+	return out
+}
+
+// fetch gets a block from the first gateway that has it and returns its
+// node, read back through the DAG service now that the block is local.
+// bitswapErr is what bitswap failed with.
+func (d *httpFallbackDAG) fetch(ctx context.Context, c cid.Cid, bitswapErr error) (ipld.Node, error) {
+	errs := []error{bitswapErr}
+	for _, g := range d.gateways {
+		data, err := d.fetchFrom(ctx, g, c)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", g, err))
+			continue
+		}
+		blk, err := blocks.NewBlockWithCid(data, c)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.bs.Put(ctx, blk); err != nil {
+			return nil, err
+		}
+		httpFallbackBlocks.WithLabelValues(g).Inc()
+		logger.Debugf("fetched %s from %s", c, g)
+		return d.DAGService.Get(ctx, c)
+	}
+	return nil, fmt.Errorf("fetching %s: %w", c, errors.Join(errs...))
+}
+
+func (d *httpFallbackDAG) fetchFrom(ctx context.Context, gateway string, c cid.Cid) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gateway+"/ipfs/"+c.String()+"?format=raw", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.raw")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBlockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBlockSize {
+		return nil, fmt.Errorf("block larger than %d bytes", maxBlockSize)
+	}
+	got, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !got.Equals(c) {
+		return nil, fmt.Errorf("got %s instead", got)
+	}
+	return data, nil
+}
+
+// block serves GET /ipfs/{cid}: the raw blocks the serving policy allows,
+// so that other nodes can use this one as an HTTP fallback. The bitswap
+// quotas do not apply: the API tokens control who gets blocks.
+func (a *restAPI) block(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := a.authorize(w, r, verbRead, ds.NewKey("/")); !ok {
+		return
+	}
+	c, err := cid.Decode(strings.TrimPrefix(r.URL.Path, "/ipfs/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	blk, err := a.bs.Get(r.Context(), c)
+	if ipld.IsNotFound(err) || (err == nil && !a.serving.serves(c)) {
+		http.Error(w, "block not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.ipld.raw")
+	w.Header().Set("Cache-Control", "public, max-age=29030400, immutable")
+	w.Write(blk.RawData())
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// idempotencyHeader carries the idempotency key of a write over HTTP. Over
+// gRPC it is sent as idempotency-key metadata.
+const idempotencyHeader = "Idempotency-Key"
+
+// maxIdempotencyKey is the longest idempotency key accepted.
+const maxIdempotencyKey = 255
+
+// ErrIdempotencyReuse is returned when an idempotency key comes back with
+// a different write than the one it was first used for.
+var ErrIdempotencyReuse = errors.New("idempotency key already used for a different write")
+
+// idempotencyTable remembers the writes made through the APIs with an
+// idempotency key for a while, so that a client retrying a write it did
+// not hear back about does not make it twice: the retry gets the answer
+// of the first attempt without writing again, and so without firing the
+// hooks on other nodes again.
+//
+// Keys are scoped to the API token and only remembered by the node the
+// write went through. Failed writes are forgotten, so that they can be
+// retried.
+type idempotencyTable struct {
+	ttl   time.Duration
+	clock dkv.WallClock
+
+	mu  sync.Mutex
+	ops map[string]*idempotentOp
+	// swept is when expired entries were last dropped.
+	swept time.Time
+}
+
+type idempotentOp struct {
+	fingerprint [sha256.Size]byte
+	// done is closed once the write returned.
+	done    chan struct{}
+	err     error
+	expires time.Time
+}
+
+func newIdempotencyTable(ttl time.Duration, clock dkv.WallClock) *idempotencyTable {
+	return &idempotencyTable{ttl: ttl, clock: clock, ops: make(map[string]*idempotentOp)}
+}
+
+// writeFingerprint identifies a write, to tell retries from reuses of a
+// key.
+func writeFingerprint(op string, k ds.Key, v []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(op))
+	h.Write([]byte{0})
+	h.Write([]byte(k.String()))
+	h.Write([]byte{0})
+	h.Write(v)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// do runs write unless the same write was made under key and scope within
+// the TTL, and tells whether it was a replay. Retries arriving while the
+// first attempt is running wait for it. Writes without a key, or when the
+// table is disabled, always run.
+func (t *idempotencyTable) do(scope, key string, fingerprint [sha256.Size]byte, write func() error) (bool, error) {
+	if t == nil || t.ttl <= 0 || key == "" {
+		return false, write()
+	}
+	if len(key) > maxIdempotencyKey {
+		return false, errors.New("idempotency key too long")
+	}
+	id := scope + "\x00" + key
+
+	t.mu.Lock()
+	now := t.clock.Now()
+	if now.Sub(t.swept) > t.ttl {
+		for k, op := range t.ops {
+			if isClosed(op.done) && now.After(op.expires) {
+				delete(t.ops, k)
+			}
+		}
+		t.swept = now
+	}
+	op, ok := t.ops[id]
+	if ok && isClosed(op.done) && now.After(op.expires) {
+		ok = false
+	}
+	if ok {
+		t.mu.Unlock()
+		if op.fingerprint != fingerprint {
+			return false, ErrIdempotencyReuse
+		}
+		<-op.done
+		if op.err != nil {
+			// The first attempt failed and was forgotten: try again.
+			return t.do(scope, key, fingerprint, write)
+		}
+		idempotentReplays.Inc()
+		return true, nil
+	}
+	op = &idempotentOp{fingerprint: fingerprint, done: make(chan struct{})}
+	t.ops[id] = op
+	t.mu.Unlock()
+
+	err := write()
+
+	t.mu.Lock()
+	op.err = err
+	op.expires = t.clock.Now().Add(t.ttl)
+	if err != nil && t.ops[id] == op {
+		delete(t.ops, id)
+	}
+	close(op.done)
+	t.mu.Unlock()
+	return false, err
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// idempotencyScope is the scope of the idempotency keys sent with a token.
+func idempotencyScope(token *apiToken) string {
+	if token == nil {
+		return ""
+	}
+	return token.Name
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	ds "github.com/ipfs/go-datastore"
+)
+
+func TestIdempotencyTable(t *testing.T) {
+	put := writeFingerprint("put", ds.NewKey("/a"), []byte("1"))
+	other := writeFingerprint("put", ds.NewKey("/a"), []byte("2"))
+	tests := []struct {
+		name string
+		// first fails when set.
+		first  error
+		wait   time.Duration
+		second [32]byte
+		replay bool
+		writes int
+		err    error
+	}{
+		{"retry", nil, time.Minute, put, true, 1, nil},
+		{"expired", nil, time.Hour + time.Second, put, false, 2, nil},
+		{"reused", nil, time.Minute, other, false, 1, ErrIdempotencyReuse},
+		{"failed first", errors.New("boom"), time.Minute, put, false, 2, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := dkv.NewManualClock(time.Unix(0, 0))
+			table := newIdempotencyTable(time.Hour, clock)
+			var writes int
+			if _, err := table.do("token", "key", put, func() error {
+				writes++
+				return tt.first
+			}); err != tt.first {
+				t.Fatalf("first write: %v", err)
+			}
+			clock.Advance(tt.wait)
+			replay, err := table.do("token", "key", tt.second, func() error {
+				writes++
+				return nil
+			})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("second write: %v, want %v", err, tt.err)
+			}
+			if replay != tt.replay || writes != tt.writes {
+				t.Errorf("replay %t after %d writes, want %t after %d", replay, writes, tt.replay, tt.writes)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	badger "github.com/ipfs/go-ds-badger2"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// peerstoreNs is the namespace of the local datastore where the addresses
+// of the known peers are saved on shutdown, as peerstoreNs/<peer ID>.
+var peerstoreNs = ds.NewKey("/peerstore")
+
+// Files of an identity bundle.
+const (
+	bundleKey    = "key"
+	bundlePeers  = "peers.json"
+	bundleConfig = "config/"
+)
+
+// bundlePeer is a known peer, as saved in an identity bundle.
+type bundlePeer struct {
+	ID    peer.ID  `json:"id"`
+	Addrs []string `json:"addrs"`
+	Alias string   `json:"alias,omitempty"`
+}
+
+// savePeerstore saves the addresses of the peers the host knows, in place
+// of those saved before.
+func savePeerstore(ctx context.Context, store ds.Batching, h host.Host) error {
+	var peers []bundlePeer
+	for _, p := range h.Peerstore().PeersWithAddrs() {
+		if p == h.ID() {
+			continue
+		}
+		bp := bundlePeer{ID: p}
+		for _, a := range h.Peerstore().Addrs(p) {
+			bp.Addrs = append(bp.Addrs, a.String())
+		}
+		peers = append(peers, bp)
+	}
+	return writePeers(ctx, store, peers)
+}
+
+// writePeers replaces the saved peer addresses.
+func writePeers(ctx context.Context, store ds.Batching, peers []bundlePeer) error {
+	b, err := store.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	old, err := readPeers(ctx, store)
+	if err != nil {
+		return err
+	}
+	for _, p := range old {
+		if err := b.Delete(ctx, peerstoreNs.ChildString(p.ID.String())); err != nil {
+			return err
+		}
+	}
+	for _, p := range peers {
+		if len(p.Addrs) == 0 {
+			continue
+		}
+		if err := b.Put(ctx, peerstoreNs.ChildString(p.ID.String()), []byte(strings.Join(p.Addrs, "\n"))); err != nil {
+			return err
+		}
+	}
+	return b.Commit(ctx)
+}
+
+// readPeers returns the saved peer addresses.
+func readPeers(ctx context.Context, store ds.Datastore) ([]bundlePeer, error) {
+	results, err := store.Query(ctx, query.Query{Prefix: peerstoreNs.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	var peers []bundlePeer
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		id, err := peer.Decode(ds.RawKey(r.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+		peers = append(peers, bundlePeer{ID: id, Addrs: strings.Split(string(r.Value), "\n")})
+	}
+	return peers, nil
+}
+
+// loadPeerstore adds the saved peer addresses to the host, so that a
+// restarted node can dial the peers it knew.
+func loadPeerstore(ctx context.Context, store ds.Datastore, h host.Host) error {
+	peers, err := readPeers(ctx, store)
+	if err != nil {
+		return err
+	}
+	for _, p := range peers {
+		for _, s := range p.Addrs {
+			a, err := multiaddr.NewMultiaddr(s)
+			if err != nil {
+				continue
+			}
+			h.Peerstore().AddAddr(p.ID, a, peerstore.AddressTTL)
+		}
+	}
+	return nil
+}
+
+// runIdentity runs
+//
+//	globaldb identity export bundle.tar
+//	globaldb identity import bundle.tar
+//
+// Export writes the key of the node, the addresses and aliases of the
+// peers it knows and its config file to a tar file, and import sets up
+// the data folder of a new machine from one, so that a node moves without
+// changing its peer ID or forgetting its peers. The node must be stopped.
+// Import never overwrites a key: the folder of a node that already has
+// one is left alone.
+func runIdentity(args []string, data, configPath, configDir string) error {
+	if len(args) != 2 || (args[0] != "export" && args[0] != "import") {
+		return fmt.Errorf("usage: identity export|import <bundle.tar>")
+	}
+	if err := os.MkdirAll(data, 0755); err != nil {
+		return err
+	}
+	lock, err := lockInstance(data)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if args[0] == "export" {
+		return exportIdentity(args[1], data, configPath)
+	}
+	return importIdentity(args[1], data, configDir)
+}
+
+func exportIdentity(path, data, configPath string) error {
+	key, err := os.ReadFile(filepath.Join(data, "key"))
+	if err != nil {
+		return fmt.Errorf("%s has no identity to export: %w", data, err)
+	}
+	store, err := openStore(data, &badger.DefaultOptions)
+	if err != nil {
+		return err
+	}
+	defer closeStore(data, store)
+	ctx := context.Background()
+	peers, err := readPeers(ctx, store)
+	if err != nil {
+		return err
+	}
+	al, err := loadAliases(ctx, store)
+	if err != nil {
+		return err
+	}
+	byID := make(map[peer.ID]int)
+	for i, p := range peers {
+		byID[p.ID] = i
+	}
+	for id, name := range al.names {
+		i, ok := byID[id]
+		if !ok {
+			i = len(peers)
+			peers = append(peers, bundlePeer{ID: id})
+		}
+		peers[i].Alias = name
+	}
+	peersJSON, err := json.MarshalIndent(peers, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(f)
+	add := func(name string, mode int64, body []byte) error {
+		hdr := &tar.Header{Name: name, Mode: mode, Size: int64(len(body)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(body)
+		return err
+	}
+	err = add(bundleKey, 0o400, key)
+	if err == nil {
+		err = add(bundlePeers, 0o644, peersJSON)
+	}
+	if err == nil && configPath != "" {
+		var cfg []byte
+		if cfg, err = os.ReadFile(configPath); err == nil {
+			err = add(bundleConfig+filepath.Base(configPath), 0o644, cfg)
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	fmt.Printf("exported the identity of %s and %d peers to %s\n", data, len(peers), path)
+	return nil
+}
+
+func importIdentity(path, data, configDir string) error {
+	keyPath := filepath.Join(data, "key")
+	if _, err := os.Stat(keyPath); err == nil {
+		return fmt.Errorf("%s already has an identity, import into an empty -data-dir or -name", data)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var (
+		key, peersJSON []byte
+		cfgName        string
+		cfg            []byte
+	)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		switch {
+		case hdr.Name == bundleKey:
+			key = body
+		case hdr.Name == bundlePeers:
+			peersJSON = body
+		case strings.HasPrefix(hdr.Name, bundleConfig) && filepath.Base(hdr.Name) == strings.TrimPrefix(hdr.Name, bundleConfig):
+			cfgName, cfg = filepath.Base(hdr.Name), body
+		}
+	}
+	if key == nil {
+		return fmt.Errorf("%s holds no key", path)
+	}
+	var peers []bundlePeer
+	if peersJSON != nil {
+		if err := json.Unmarshal(peersJSON, &peers); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if cfg != nil {
+		if existing := findConfigFile(configDir); existing != "" {
+			fmt.Fprintf(os.Stderr, "keeping %s, the config in the bundle was not imported\n", existing)
+		} else if err := os.WriteFile(filepath.Join(configDir, cfgName), cfg, 0o644); err != nil {
+			return err
+		}
+	}
+	store, err := openStore(data, &badger.DefaultOptions)
+	if err != nil {
+		return err
+	}
+	defer closeStore(data, store)
+	ctx := context.Background()
+	if err := writePeers(ctx, store, peers); err != nil {
+		return err
+	}
+	al, err := loadAliases(ctx, store)
+	if err != nil {
+		return err
+	}
+	for _, p := range peers {
+		if p.Alias != "" {
+			if err := al.set(ctx, p.ID, p.Alias); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.WriteFile(keyPath, key, 0o400); err != nil {
+		return err
+	}
+	fmt.Printf("imported the identity and %d peers of %s into %s\n", len(peers), path, data)
+	return nil
+}
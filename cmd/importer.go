@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/redis/go-redis/v9"
+)
+
+// importConfig holds the options of the import subcommand and REPL
+// command.
+type importConfig struct {
+	From   string
+	Prefix string
+	Strip  string
+	Follow bool
+}
+
+// importFlags returns the flags of import, which fill cfg.
+func importFlags(cfg *importConfig) *flag.FlagSet {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.StringVar(&cfg.From, "from", "", "store to import from: redis://[user:pass@]host:port/db, etcd://[user:pass@]host:port (etcds:// for TLS) or a dump file written by export")
+	fs.StringVar(&cfg.Prefix, "prefix", "/", "namespace the imported keys are stored under")
+	fs.StringVar(&cfg.Strip, "strip", "", "only import source keys starting with this, and remove it from them")
+	fs.BoolVar(&cfg.Follow, "follow", false, "keep mirroring changes of the source after the initial import")
+	return fs
+}
+
+// check validates the options once the flags are parsed, with args the
+// arguments left.
+func (cfg *importConfig) check(args []string) error {
+	// A dump file may be given as the argument: import dump.json.
+	if cfg.From == "" && len(args) > 0 {
+		cfg.From, args = args[0], args[1:]
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected %q", args[0])
+	}
+	if cfg.From == "" {
+		return errors.New("import needs -from or a dump file")
+	}
+	return nil
+}
+
+func parseImportFlags(args []string) (importConfig, error) {
+	var cfg importConfig
+	fs := importFlags(&cfg)
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	// Flags may follow the dump file.
+	if cfg.From == "" && fs.NArg() > 0 {
+		cfg.From = fs.Arg(0)
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, cfg.check(fs.Args())
+}
+
+// importSource is a store keys are imported from.
+type importSource interface {
+	// copy calls put for every key. When follow is set it then calls put
+	// and del for every change until the context is cancelled. Changes
+	// made while copying are not missed.
+	copy(ctx context.Context, follow bool, put func(k string, v []byte) error, del func(k string) error) error
+}
+
+func newImportSource(from, strip string) (importSource, error) {
+	u, err := url.Parse(from)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "redis", "rediss":
+		opts, err := redis.ParseURL(from)
+		if err != nil {
+			return nil, err
+		}
+		return &redisSource{client: redis.NewClient(opts), db: opts.DB, strip: strip}, nil
+	case "etcd", "etcds":
+		return newEtcdSource(u, strip), nil
+	case "":
+		return &fileSource{path: from, strip: strip}, nil
+	case "file":
+		return &fileSource{path: u.Path, strip: strip}, nil
+	default:
+		return nil, fmt.Errorf("cannot import from %q, use redis://, rediss://, etcd://, etcds:// or a dump file", u.Scheme)
+	}
+}
+
+// runImport copies the keys of the source into kv. With cfg.Follow it
+// keeps going until the context is cancelled.
+func runImport(ctx context.Context, kv *db, cfg importConfig) (int, error) {
+	src, err := newImportSource(cfg.From, cfg.Strip)
+	if err != nil {
+		return 0, err
+	}
+	prefix := ds.NewKey(cfg.Prefix)
+	key := func(k string) ds.Key {
+		return prefix.Child(ds.NewKey(strings.TrimPrefix(k, cfg.Strip)))
+	}
+	var n int
+	err = src.copy(ctx, cfg.Follow,
+		func(k string, v []byte) error {
+			n++
+			return kv.Put(ctx, key(k), v)
+		},
+		func(k string) error {
+			n++
+			return kv.Delete(ctx, key(k))
+		},
+	)
+	if errors.Is(err, context.Canceled) {
+		err = nil
+	}
+	return n, err
+}
+
+// redisSource imports the string keys of a Redis database. Following
+// relies on keyspace notifications, which must be enabled on the server
+// (notify-keyspace-events "E$gx" or wider).
+type redisSource struct {
+	client *redis.Client
+	db     int
+	strip  string
+}
+
+func (s *redisSource) copy(ctx context.Context, follow bool, put func(string, []byte) error, del func(string) error) error {
+	defer s.client.Close()
+
+	// Subscribe first so that changes made during the scan are seen.
+	var sub *redis.PubSub
+	if follow {
+		if cfg, err := s.client.ConfigGet(ctx, "notify-keyspace-events").Result(); err == nil && cfg["notify-keyspace-events"] == "" {
+			logger.Warn("redis keyspace notifications are disabled, changes will not be followed")
+		}
+		sub = s.client.PSubscribe(ctx, fmt.Sprintf("__keyevent@%d__:*", s.db))
+		defer sub.Close()
+		if _, err := sub.Receive(ctx); err != nil {
+			return err
+		}
+	}
+
+	var skipped int
+	iter := s.client.Scan(ctx, 0, redisPattern(s.strip), 1000).Iterator()
+	for iter.Next(ctx) {
+		v, err := s.client.Get(ctx, iter.Val()).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue // deleted since the scan saw it
+		}
+		if err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE") {
+			skipped++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := put(iter.Val(), v); err != nil {
+			return err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if skipped > 0 {
+		logger.Warnf("skipped %d redis keys that do not hold strings", skipped)
+	}
+	if !follow {
+		return nil
+	}
+
+	for {
+		msg, err := sub.ReceiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+		k := msg.Payload
+		if !strings.HasPrefix(k, s.strip) {
+			continue
+		}
+		switch msg.Channel[strings.LastIndexByte(msg.Channel, ':')+1:] {
+		case "del", "expired", "evicted":
+			err = del(k)
+		case "set", "setrange", "append", "incrby", "incrbyfloat", "rename_to", "copy_to", "restore":
+			var v []byte
+			v, err = s.client.Get(ctx, k).Bytes()
+			if errors.Is(err, redis.Nil) {
+				err = del(k)
+			} else if err == nil {
+				err = put(k, v)
+			}
+		case "rename_from", "move_from":
+			err = del(k)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// redisPattern is the SCAN pattern matching keys that start with prefix.
+func redisPattern(prefix string) string {
+	var b strings.Builder
+	for _, r := range prefix {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('*')
+	return b.String()
+}
+
+// etcdSource imports the keys of an etcd cluster through its JSON gateway
+// (the /v3 HTTP endpoints every etcd member serves), which spares a gRPC
+// client.
+type etcdSource struct {
+	endpoint string
+	user     *url.Userinfo
+	strip    string
+	client   *http.Client
+	token    string
+}
+
+func newEtcdSource(u *url.URL, strip string) *etcdSource {
+	scheme := "http"
+	if u.Scheme == "etcds" {
+		scheme = "https"
+	}
+	return &etcdSource{
+		endpoint: scheme + "://" + u.Host,
+		user:     u.User,
+		strip:    strip,
+		client:   &http.Client{},
+	}
+}
+
+// etcdKV is a key-value pair of the JSON gateway. Keys and values are
+// base64 there, which is how encoding/json handles []byte anyway.
+type etcdKV struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdHeader struct {
+	Revision string `json:"revision"`
+}
+
+// call POSTs a JSON request to an etcd gateway endpoint.
+func (s *etcdSource) call(ctx context.Context, path string, req interface{}) (*http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if s.token != "" {
+		r.Header.Set("Authorization", s.token)
+	}
+	resp, err := s.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("etcd %s returned %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+func (s *etcdSource) authenticate(ctx context.Context) error {
+	if s.user == nil {
+		return nil
+	}
+	pass, _ := s.user.Password()
+	resp, err := s.call(ctx, "/v3/auth/authenticate", map[string]string{"name": s.user.Username(), "password": pass})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return err
+	}
+	s.token = auth.Token
+	return nil
+}
+
+// rangeStart is the start of the key range holding every key that starts
+// with prefix. etcd reads an empty key as no key at all, so every key is
+// the range from \x00.
+func rangeStart(prefix string) []byte {
+	if prefix == "" {
+		return []byte{0}
+	}
+	return []byte(prefix)
+}
+
+// rangeEnd is the end of the key range holding every key that starts
+// with prefix, as etcd expects it.
+func rangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0} // every key
+}
+
+func (s *etcdSource) copy(ctx context.Context, follow bool, put func(string, []byte) error, del func(string) error) error {
+	if err := s.authenticate(ctx); err != nil {
+		return err
+	}
+
+	// Every page is read at the revision of the first one, and following
+	// starts right after it, so nothing is missed or seen twice.
+	key, end := rangeStart(s.strip), rangeEnd(s.strip)
+	var rev int64
+	for {
+		req := map[string]interface{}{"key": key, "range_end": end, "limit": 1000}
+		if rev > 0 {
+			req["revision"] = rev
+		}
+		resp, err := s.call(ctx, "/v3/kv/range", req)
+		if err != nil {
+			return err
+		}
+		var page struct {
+			Header etcdHeader `json:"header"`
+			KVs    []etcdKV   `json:"kvs"`
+			More   bool       `json:"more"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if rev == 0 {
+			rev, _ = strconv.ParseInt(page.Header.Revision, 10, 64)
+		}
+		for _, kv := range page.KVs {
+			if err := put(string(kv.Key), kv.Value); err != nil {
+				return err
+			}
+		}
+		if !page.More || len(page.KVs) == 0 {
+			break
+		}
+		key = append(page.KVs[len(page.KVs)-1].Key, 0)
+	}
+	if !follow {
+		return nil
+	}
+
+	resp, err := s.call(ctx, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            rangeStart(s.strip),
+			"range_end":      end,
+			"start_revision": rev + 1,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var msg struct {
+			Result struct {
+				Events []struct {
+					Type string `json:"type"`
+					KV   etcdKV `json:"kv"`
+				} `json:"events"`
+				Canceled     bool   `json:"canceled"`
+				CancelReason string `json:"cancel_reason"`
+			} `json:"result"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if msg.Result.Canceled {
+			return fmt.Errorf("etcd watch cancelled: %s", msg.Result.CancelReason)
+		}
+		for _, e := range msg.Result.Events {
+			var err error
+			if e.Type == "DELETE" {
+				err = del(string(e.KV.Key))
+			} else {
+				err = put(string(e.KV.Key), e.KV.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
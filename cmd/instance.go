@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lockInstance takes the lock file of a data folder, so that two nodes
+// never share a datastore. The lock is released when the process exits.
+func lockInstance(data string) (*os.File, error) {
+	path := filepath.Join(data, "globaldb.lock")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		owner, _ := os.ReadFile(path)
+		f.Close()
+		if pid := strings.TrimSpace(string(owner)); pid != "" {
+			return nil, fmt.Errorf("%s is in use by another node (pid %s), give this one its own -name or -instance", data, pid)
+		}
+		return nil, fmt.Errorf("%s is in use by another node, give this one its own -name or -instance", data)
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return f, nil
+}
+
+// multiaddrPortRe finds the ports of a multiaddr.
+var multiaddrPortRe = regexp.MustCompile(`/(tcp|udp)/(\d+)`)
+
+// offsetMultiaddr shifts the ports of a multiaddr. Port 0, which picks a
+// free port, is left alone.
+func offsetMultiaddr(addr string, offset int) string {
+	if offset == 0 {
+		return addr
+	}
+	return multiaddrPortRe.ReplaceAllStringFunc(addr, func(m string) string {
+		parts := multiaddrPortRe.FindStringSubmatch(m)
+		port, _ := strconv.Atoi(parts[2])
+		if port == 0 {
+			return m
+		}
+		return fmt.Sprintf("/%s/%d", parts[1], port+offset)
+	})
+}
+
+// offsetHostPort shifts the port of a host:port address.
+func offsetHostPort(addr string, offset int) (string, error) {
+	if addr == "" || offset == 0 {
+		return addr, nil
+	}
+	host, portS, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.Atoi(portS)
+	if err != nil {
+		return "", fmt.Errorf("%s: invalid port", addr)
+	}
+	if port == 0 {
+		return addr, nil
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port+offset)), nil
+}
+
+// applyPortOffset shifts the ports of -listen and of every API address.
+func applyPortOffset(offset int) error {
+	for i, a := range listenAddrs {
+		listenAddrs[i] = offsetMultiaddr(a, offset)
+	}
+	for _, a := range []struct {
+		flag string
+		addr *string
+	}{
+		{"metrics-addr", &metricsAddr},
+		{"http", &httpAddr},
+		{"grpc", &grpcAddr},
+		{"feed-addr", &feedAddr},
+		{"admin-addr", &adminAddr},
+	} {
+		shifted, err := offsetHostPort(*a.addr, offset)
+		if err != nil {
+			return fmt.Errorf("-%s: %w", a.flag, err)
+		}
+		*a.addr = shifted
+	}
+	return nil
+}
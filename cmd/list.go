@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// runList handles the list command:
+//
+//	list [<prefix>] [--limit N] [--sort key|asc|desc] [--keys-only]
+//
+// Keys are listed in the order the store returns them unless sorted, key
+// and asc being the same order.
+func runList(ctx context.Context, args []string, kv *db) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	limit := fs.Int("limit", 0, "most entries to list (0 for all)")
+	order := fs.String("sort", "", "sort by key: key or asc, or desc")
+	keysOnly := fs.Bool("keys-only", false, "only list the keys")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	// The prefix may come before the flags.
+	prefix := "/"
+	if fs.NArg() > 0 {
+		prefix = ds.NewKey(fs.Arg(0)).String()
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() > 0 {
+			return fmt.Errorf("unexpected %q", fs.Arg(0))
+		}
+	}
+	if *limit < 0 {
+		return fmt.Errorf("invalid limit %d", *limit)
+	}
+	q := query.Query{Prefix: prefix, Limit: *limit, KeysOnly: *keysOnly}
+	switch *order {
+	case "":
+	case "key", "asc":
+		q.Orders = []query.Order{query.OrderByKey{}}
+	case "desc":
+		q.Orders = []query.Order{query.OrderByKeyDescending{}}
+	default:
+		return fmt.Errorf("invalid sort %q, want key, asc or desc", *order)
+	}
+
+	results, err := kv.Query(ctx, q)
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+	for r := range results.Next() {
+		if r.Error != nil {
+			printErr(r.Error)
+			continue
+		}
+		if *keysOnly {
+			fmt.Println(r.Key)
+			continue
+		}
+		fmt.Printf("[%s] -> %s\n", r.Key, string(r.Value))
+	}
+	return nil
+}
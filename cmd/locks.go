@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// locksNs holds the leases taken with lock, as locksNs/<key>.
+var locksNs = systemNs.ChildString("locks")
+
+// ErrLocked is returned when a key is leased to someone else.
+var ErrLocked = errors.New("key is locked")
+
+// lease is an advisory lock on a key: it tells the people and scripts
+// editing a shared database that someone is working on the key, until it
+// expires or is released. Writes are not blocked by it.
+//
+// Leases are replicated like any other key, so two nodes taking the same
+// lease within the time it takes to replicate both get it, until the
+// CRDT settles on one of them.
+type lease struct {
+	// Peer is the node the lease was taken on, Holder who took it there.
+	Peer     string    `json:"peer"`
+	Holder   string    `json:"holder"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+func (l *lease) heldBy(node, holder string) bool {
+	return l.Peer == node && l.Holder == holder
+}
+
+func (l *lease) String() string {
+	return fmt.Sprintf("held by %s until %s", l.Holder, l.Expires.Local().Format(time.TimeOnly))
+}
+
+// describe is String along with the node the lease was taken on.
+func (l *lease) describe(al *aliases) string {
+	name := l.Peer
+	if id, err := peer.Decode(l.Peer); err == nil {
+		name = al.name(id)
+	}
+	return fmt.Sprintf("held by %s on %s until %s", l.Holder, name, l.Expires.Local().Format(time.TimeOnly))
+}
+
+// LockOf returns the lease on a key, or nil when it is not locked.
+func (d *db) LockOf(ctx context.Context, k ds.Key) (*lease, error) {
+	v, err := d.Get(ctx, locksNs.Child(k))
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var l lease
+	if err := json.Unmarshal(v, &l); err != nil {
+		return nil, fmt.Errorf("lease of %s: %w", k, err)
+	}
+	if d.now().After(l.Expires) {
+		return nil, nil
+	}
+	return &l, nil
+}
+
+// Lock leases a key for ttl to holder on node, a peer ID. Taking a lease
+// again renews it.
+func (d *db) Lock(ctx context.Context, k ds.Key, node, holder string, ttl time.Duration) (*lease, error) {
+	cur, err := d.LockOf(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	if cur != nil && !cur.heldBy(node, holder) {
+		return nil, fmt.Errorf("%w: %s", ErrLocked, cur)
+	}
+	now := d.now().UTC()
+	l := &lease{Peer: node, Holder: holder, Acquired: now, Expires: now.Add(ttl)}
+	if cur != nil {
+		l.Acquired = cur.Acquired
+	}
+	v, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Put(ctx, locksNs.Child(k), v); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Unlock releases the lease on a key. Leases held by someone else are
+// only released with force.
+func (d *db) Unlock(ctx context.Context, k ds.Key, node, holder string, force bool) error {
+	cur, err := d.LockOf(ctx, k)
+	if err != nil {
+		return err
+	}
+	if cur != nil && !cur.heldBy(node, holder) && !force {
+		return fmt.Errorf("%w: %s, use --force to release it", ErrLocked, cur)
+	}
+	err = d.Delete(ctx, locksNs.Child(k))
+	if errors.Is(err, ds.ErrNotFound) {
+		err = nil
+	}
+	return err
+}
+
+// Locks lists the keys that are locked and their leases.
+func (d *db) Locks(ctx context.Context) (map[ds.Key]*lease, error) {
+	results, err := d.Query(ctx, query.Query{Prefix: locksNs.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	locks := make(map[ds.Key]*lease)
+	now := d.now()
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		var l lease
+		if err := json.Unmarshal(r.Value, &l); err != nil || now.After(l.Expires) {
+			continue
+		}
+		locks[ds.NewKey(strings.TrimPrefix(r.Key, locksNs.String()))] = &l
+	}
+	return locks, nil
+}
+
+// lockHolder is who takes the leases of the REPL by default: the user
+// running it.
+func lockHolder() string {
+	if u := os.Getenv("USER"); u != "" {
+		return u
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
+
+// lockArgs parses the arguments of lock and unlock:
+//
+//	lock <key> [--ttl 1m] [--as <holder>]
+//	unlock <key> [--force] [--as <holder>]
+type lockArgs struct {
+	key    ds.Key
+	ttl    time.Duration
+	holder string
+	force  bool
+}
+
+func parseLockArgs(cmd string, args []string) (lockArgs, error) {
+	var la lockArgs
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.StringVar(&la.holder, "as", lockHolder(), "name the lease is held under")
+	if cmd == "lock" {
+		fs.DurationVar(&la.ttl, "ttl", time.Minute, "how long the lease lasts")
+	} else {
+		fs.BoolVar(&la.force, "force", false, "release a lease held by someone else")
+	}
+	usage := fmt.Errorf("usage: %s <key> [--ttl 1m] [--as <holder>]", cmd)
+	if cmd == "unlock" {
+		usage = fmt.Errorf("usage: %s <key> [--force] [--as <holder>]", cmd)
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return la, usage
+	}
+	la.key = ds.NewKey(args[0])
+	if err := fs.Parse(args[1:]); err != nil {
+		return la, err
+	}
+	if fs.NArg() > 0 {
+		return la, usage
+	}
+	if la.ttl < 0 || (cmd == "lock" && la.ttl == 0) {
+		return la, fmt.Errorf("invalid ttl %s", la.ttl)
+	}
+	return la, nil
+}
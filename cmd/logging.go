@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	logging "github.com/ipfs/go-log/v2"
+	"go.uber.org/zap"
+)
+
+// logFileScheme is the scheme of the zap sink writing -log-file, which
+// go-log is given as a URL.
+const logFileScheme = "globaldb-rotate"
+
+// setupLogging applies -log-format and -log-file. It resets the levels of
+// every logger, so -log-level is applied after it.
+func setupLogging(format, file string, maxSizeMB, keep int) error {
+	cfg := logging.GetConfig()
+	switch format {
+	case "":
+		// go-log picks color on terminals and plain text elsewhere.
+	case "color":
+		cfg.Format = logging.ColorizedOutput
+	case "text":
+		cfg.Format = logging.PlaintextOutput
+	case "json":
+		cfg.Format = logging.JSONOutput
+	default:
+		return fmt.Errorf("-log-format: unknown format %q, use text, color or json", format)
+	}
+	if file != "" {
+		if maxSizeMB < 1 {
+			return fmt.Errorf("-log-max-size must be at least 1, not %d", maxSizeMB)
+		}
+		if keep < 0 {
+			return fmt.Errorf("-log-keep cannot be negative")
+		}
+		path, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		err = zap.RegisterSink(logFileScheme, func(u *url.URL) (zap.Sink, error) {
+			size, _ := strconv.ParseInt(u.Query().Get("max-size"), 10, 64)
+			keep, _ := strconv.Atoi(u.Query().Get("keep"))
+			return openRotatingFile(u.Path, size, keep)
+		})
+		if err != nil {
+			return err
+		}
+		u := url.URL{Scheme: logFileScheme, Path: path, RawQuery: url.Values{
+			"max-size": {strconv.FormatInt(int64(maxSizeMB)<<20, 10)},
+			"keep":     {strconv.Itoa(keep)},
+		}.Encode()}
+		// Logs go to the file alone, as colors would garble it.
+		cfg.URL, cfg.File, cfg.Stderr, cfg.Stdout = u.String(), "", false, false
+		if format == "" {
+			cfg.Format = logging.PlaintextOutput
+		}
+	}
+	logging.SetupLogging(cfg)
+	return nil
+}
+
+// rotatingFile is a log file that is renamed to <path>.1 once it outgrows
+// its maximum size, <path>.1 to <path>.2 and so on, keeping the newest
+// keep of the rotated files.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, keep int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, st.Size()
+	return nil
+}
+
+// rotate moves the current file out of the way and starts a new one.
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.keep))
+	for i := r.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	var err error
+	if r.keep > 0 {
+		err = os.Rename(r.path, r.path+".1")
+	} else {
+		err = os.Remove(r.path)
+	}
+	// The file is reopened either way, so that entries are not lost.
+	if oerr := r.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "rotating %s: %s\n", r.path, err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Sync()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
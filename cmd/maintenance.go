@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+
+	crdt "github.com/ipfs/go-ds-crdt"
+)
+
+// pausableBroadcaster wraps a crdt.Broadcaster so that outgoing
+// broadcasts can be held back. Incoming broadcasts are still received
+// and processed.
+type pausableBroadcaster struct {
+	crdt.Broadcaster
+
+	mu      sync.Mutex
+	paused  bool
+	pending []byte
+}
+
+// Broadcast sends the payload, or holds it while paused. Every broadcast
+// announces the current heads, so only the latest one needs keeping.
+func (b *pausableBroadcaster) Broadcast(data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.paused {
+		b.pending = data
+		return nil
+	}
+	return b.Broadcaster.Broadcast(data)
+}
+
+func (b *pausableBroadcaster) pause() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.paused = true
+}
+
+// resume sends the held broadcast, if any, and lets new ones through.
+func (b *pausableBroadcaster) resume() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.paused = false
+	if b.pending == nil {
+		return nil
+	}
+	data := b.pending
+	b.pending = nil
+	return b.Broadcaster.Broadcast(data)
+}
+
+// maintenance mode lets operators run compaction, backups or migrations
+// safely: broadcasts and hook deliveries are held back until it is turned
+// off, while data from other replicas keeps being merged.
+type maintenance struct {
+	bcast *pausableBroadcaster
+
+	mu   sync.Mutex
+	on   bool
+	held []func()
+}
+
+// deliver runs a hook, or queues it while maintenance mode is on. Hooks
+// run one at a time and in order.
+func (m *maintenance) deliver(hook func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.on {
+		m.held = append(m.held, hook)
+		return
+	}
+	hook()
+}
+
+func (m *maintenance) enable() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.on = true
+	m.bcast.pause()
+}
+
+// disable delivers the queued hooks and the held broadcast.
+func (m *maintenance) disable() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, hook := range m.held {
+		hook()
+	}
+	m.held = nil
+	m.on = false
+	return m.bcast.resume()
+}
+
+func (m *maintenance) enabled() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.on
+}
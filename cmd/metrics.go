@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are registered on the default Prometheus registry, which is
+// also where libp2p registers its own.
+var (
+	clockSkew = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "globaldb",
+		Name:      "peer_clock_skew_seconds",
+		Help:      "Absolute difference between the local clock and the timestamps in presence messages.",
+		Buckets:   []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60, 300},
+	})
+	clockSkewWarnings = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "globaldb",
+		Name:      "clock_skew_warnings_total",
+		Help:      "Number of times a peer's clock was found to exceed the allowed skew.",
+	})
+	broadcastsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "globaldb",
+		Name:      "head_announcements_dropped_total",
+		Help:      "Number of head announcements dropped by -signed-heads, -admission and -peer-rate, by reason: unsigned, malformed, signature, replay, authors, pow, writer or rate.",
+	}, []string{"reason"})
+	deltasRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "globaldb",
+		Name:      "deltas_rejected_total",
+		Help:      "Number of DAG nodes not merged because of -signed-writes, by reason: malformed, unsigned, signature, delete or acl.",
+	}, []string{"reason"})
+	connectionsBlocked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "globaldb",
+		Name:      "connections_blocked_total",
+		Help:      "Number of connections refused by the blocklist, by reason: peer or net.",
+	}, []string{"reason"})
+	anonymousWritesRefused = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "globaldb",
+		Name:      "anonymous_writes_refused_total",
+		Help:      "Number of HTTP writes without an API token refused by -write-challenge and -anon-write-rate, by reason: rate or challenge.",
+	}, []string{"reason"})
+	jobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "globaldb",
+		Name:      "job_runs_total",
+		Help:      "Number of runs of the maintenance jobs, by job and result: ok or error.",
+	}, []string{"job", "result"})
+	slowOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "globaldb",
+		Name:      "slow_operations_total",
+		Help:      "Number of operations that exceeded their slow threshold, by operation.",
+	}, []string{"op"})
+
+	replicationLatency = promauto.NewSummaryVec(prometheus.SummaryOpts{
+		Namespace:  "globaldb",
+		Name:       "replication_latency_seconds",
+		Help:       "Time between a member writing its probe key and the write arriving here, by member.",
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		MaxAge:     10 * time.Minute,
+	}, []string{"peer"})
+
+	kvOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "globaldb",
+		Name:      "kv_operations_total",
+		Help:      "Number of reads and writes made through this node, by operation and key namespace.",
+	}, []string{"op", "namespace"})
+	kvDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "globaldb",
+		Name:      "kv_operation_duration_seconds",
+		Help:      "Time taken by reads and writes made through this node, by operation and key namespace.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"op", "namespace"})
+	kvBytesWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "globaldb",
+		Name:      "kv_bytes_written_total",
+		Help:      "Bytes of values written through this node, by key namespace.",
+	}, []string{"namespace"})
+	kvChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "globaldb",
+		Name:      "kv_changes_total",
+		Help:      "Number of puts and deletes applied to the store, local or replicated, by key namespace.",
+	}, []string{"op", "namespace"})
+
+	blocksRefused = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "globaldb",
+		Name:      "bitswap_blocks_refused_total",
+		Help:      "Number of blocks peers asked for and were not served, by reason: the serving policy or their quota.",
+	}, []string{"reason"})
+
+	httpFallbackBlocks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "globaldb",
+		Name:      "http_fallback_blocks_total",
+		Help:      "Number of DAG blocks fetched from HTTP gateways after bitswap failed to, by gateway.",
+	}, []string{"gateway"})
+
+	feedConsumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "globaldb",
+		Name:      "feed_consumer_lag",
+		Help:      "Number of changes a change feed consumer has yet to get, as of its last poll, by consumer.",
+	}, []string{"consumer"})
+	feedConsumerResets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "globaldb",
+		Name:      "feed_consumer_resets_total",
+		Help:      "Number of times the change feed dropped changes a consumer had not got yet, by consumer.",
+	}, []string{"consumer"})
+	outboxPublished = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "globaldb",
+		Name:      "outbox_published_total",
+		Help:      "Number of outbox events published to -outbox systems.",
+	})
+
+	idempotentReplays = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "globaldb",
+		Name:      "idempotent_replays_total",
+		Help:      "Number of API writes not made again because their idempotency key was seen before.",
+	})
+
+	apiRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "globaldb",
+		Name:      "api_requests_total",
+		Help:      "Number of API requests, by API, endpoint and status code.",
+	}, []string{"api", "endpoint", "code"})
+	apiDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "globaldb",
+		Name:      "api_request_duration_seconds",
+		Help:      "Time taken to answer API requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"api", "endpoint"})
+	apiRequestSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "globaldb",
+		Name:      "api_request_size_bytes",
+		Help:      "Size of API request bodies.",
+		Buckets:   prometheus.ExponentialBuckets(64, 4, 8),
+	}, []string{"api", "endpoint"})
+	apiResponseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "globaldb",
+		Name:      "api_response_size_bytes",
+		Help:      "Size of API response bodies.",
+		Buckets:   prometheus.ExponentialBuckets(64, 4, 8),
+	}, []string{"api", "endpoint"})
+)
+
+// serveMetrics exposes the Prometheus metrics on addr until the server
+// fails.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Errorf("metrics server: %s", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// requestLogger writes one structured line per API request when request
+// logging is enabled.
+var requestLogger = logging.Logger("globaldb/requests")
+
+// enableRequestLog turns on the request logs, which are off at the
+// default log level.
+func enableRequestLog() {
+	logging.SetLogLevel("globaldb/requests", "info")
+}
+
+// statusRecorder captures what a handler writes.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrument wraps an HTTP handler so that every request is counted,
+// timed and sized under the given endpoint name, traced as part of the
+// trace given in its traceparent header, and logged when request logging
+// is enabled. Endpoint names are fixed at registration so that
+// arbitrary paths cannot blow up the metric cardinality.
+func instrument(endpoint string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx, span := startRequestSpan(r, endpoint)
+		defer span.End()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.status_code", rec.status))
+		took := time.Since(start)
+
+		apiRequests.WithLabelValues("http", endpoint, strconv.Itoa(rec.status)).Inc()
+		apiDuration.WithLabelValues("http", endpoint).Observe(took.Seconds())
+		if r.ContentLength > 0 {
+			apiRequestSize.WithLabelValues("http", endpoint).Observe(float64(r.ContentLength))
+		}
+		apiResponseSize.WithLabelValues("http", endpoint).Observe(float64(rec.size))
+
+		requestLogger.Infow("request",
+			"endpoint", endpoint,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"remote", r.RemoteAddr,
+			"status", rec.status,
+			"bytes", rec.size,
+			"took", took.String(),
+		)
+	})
+}
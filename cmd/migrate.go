@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	crdt "github.com/ipfs/go-ds-crdt"
+	ipld "github.com/ipfs/go-ipld-format"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"go.starlark.net/starlark"
+)
+
+// migrateNs is where the datastores of the databases joined by migrate
+// live, one namespace per topic.
+var migrateNs = ds.NewKey("/migrate")
+
+// migrateConfig holds the options of the migrate subcommand.
+type migrateConfig struct {
+	From      string
+	To        string
+	Transform string
+	Prefix    string
+	Wait      time.Duration
+}
+
+// migrateFlags returns the flags of migrate, which fill cfg.
+func migrateFlags(cfg *migrateConfig) *flag.FlagSet {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.StringVar(&cfg.From, "from", "", "topic of the database to read from")
+	fs.StringVar(&cfg.To, "to", "", "topic of the database to write to")
+	fs.StringVar(&cfg.Transform, "transform", "", "Starlark script defining transform(key, value)")
+	fs.StringVar(&cfg.Prefix, "prefix", "", "only migrate keys under this prefix")
+	fs.DurationVar(&cfg.Wait, "wait", 30*time.Second, "how long to sync the source database before migrating")
+	return fs
+}
+
+// check validates the options once the flags are parsed.
+func (cfg *migrateConfig) check() error {
+	if cfg.From == "" || cfg.To == "" {
+		return errors.New("migrate needs both -from and -to")
+	}
+	if cfg.From == cfg.To {
+		return errors.New("-from and -to must be different topics")
+	}
+	return nil
+}
+
+// transformFunc maps a key and value from the source database to the key
+// and value to write in the destination. It returns false to skip the
+// entry.
+type transformFunc func(k ds.Key, v []byte) (ds.Key, []byte, bool, error)
+
+func identityTransform(k ds.Key, v []byte) (ds.Key, []byte, bool, error) {
+	return k, v, true, nil
+}
+
+// loadTransform loads a Starlark script defining a function
+//
+//	def transform(key, value):
+//
+// which receives the key as a string and the value as bytes, and returns
+// None to skip the entry, a new value (string or bytes) to keep the key,
+// or a (key, value) tuple.
+func loadTransform(path string) (transformFunc, error) {
+	thread := &starlark.Thread{Name: "transform"}
+	globals, err := starlark.ExecFile(thread, path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := globals["transform"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s does not define a transform function", path)
+	}
+
+	toBytes := func(v starlark.Value) ([]byte, error) {
+		switch v := v.(type) {
+		case starlark.String:
+			return []byte(v), nil
+		case starlark.Bytes:
+			return []byte(v), nil
+		}
+		return nil, fmt.Errorf("transform returned a %s value, expected string or bytes", v.Type())
+	}
+
+	return func(k ds.Key, v []byte) (ds.Key, []byte, bool, error) {
+		res, err := starlark.Call(thread, fn, starlark.Tuple{starlark.String(k.String()), starlark.Bytes(v)}, nil)
+		if err != nil {
+			return k, nil, false, err
+		}
+		switch res := res.(type) {
+		case starlark.NoneType:
+			return k, nil, false, nil
+		case starlark.Tuple:
+			if len(res) != 2 {
+				return k, nil, false, fmt.Errorf("transform returned a tuple of %d elements, expected (key, value)", len(res))
+			}
+			newKey, ok := res[0].(starlark.String)
+			if !ok {
+				return k, nil, false, fmt.Errorf("transform returned a %s key, expected string", res[0].Type())
+			}
+			newValue, err := toBytes(res[1])
+			return ds.NewKey(string(newKey)), newValue, err == nil, err
+		default:
+			newValue, err := toBytes(res)
+			return k, newValue, err == nil, err
+		}
+	}, nil
+}
+
+// joinDB joins the database on the given topic and returns it along with
+// a function to leave it. The database shares the clock, value pipelines,
+// key encryption and ACL of base.
+func joinDB(ctx context.Context, psub *pubsub.PubSub, guard *headGuard, store ds.Datastore, dag ipld.DAGService, topic string, base *db, opts crdt.Options) (*db, func(), error) {
+	opts.PutHook = func(k ds.Key, v []byte) {
+		meta, _ := dkv.DecodeValue(v)
+		if !base.clock.Update(meta.HLC) {
+			logger.Warnf("%s: %s: timestamp %s is more than %s ahead of the clock", topic, base.keys.plain(k), meta.HLC, dkv.MaxDrift)
+		}
+	}
+	opts.DeleteHook = nil
+	bctx, cancel := context.WithCancel(ctx)
+	bcast, err := crdt.NewPubSubBroadcaster(bctx, psub, topic)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	ns := migrateNs.ChildString(topic)
+	store2, err := crdt.New(store, ns, dag, guard.wrap(topic, bcast), &opts)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	d := &db{
+		crdt:      store2,
+		ns:        ns,
+		store:     store,
+		clock:     base.clock,
+		pipelines: base.pipelines,
+		keys:      base.keys,
+		acl:       base.acl,
+		slowGet:   base.slowGet,
+	}
+	return d, func() {
+		cancel()
+		store2.Close()
+	}, nil
+}
+
+// runMigrate joins both databases, lets the source sync for a while and
+// then copies every entry through the transform into the destination.
+// Both databases share the clock, value pipelines, key encryption and ACL
+// of base, and wait on the wall clock of base.
+func runMigrate(ctx context.Context, cfg migrateConfig, psub *pubsub.PubSub, guard *headGuard, store ds.Datastore, dag ipld.DAGService, base *db, opts *crdt.Options) error {
+	transform := identityTransform
+	if cfg.Transform != "" {
+		var err error
+		transform, err = loadTransform(cfg.Transform)
+		if err != nil {
+			return err
+		}
+	}
+
+	src, leaveSrc, err := joinDB(ctx, psub, guard, store, dag, cfg.From, base, *opts)
+	if err != nil {
+		return err
+	}
+	defer leaveSrc()
+	dst, leaveDst, err := joinDB(ctx, psub, guard, store, dag, cfg.To, base, *opts)
+	if err != nil {
+		return err
+	}
+	defer leaveDst()
+
+	fmt.Printf("Syncing %s for %s...\n", cfg.From, cfg.Wait)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-base.clock.Wall.After(cfg.Wait):
+	}
+
+	results, err := src.Query(ctx, query.Query{Prefix: cfg.Prefix})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+
+	var migrated, skipped int
+	for r := range results.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		k, v, ok, err := transform(ds.NewKey(r.Key), r.Value)
+		if err != nil {
+			return fmt.Errorf("transforming %s: %w", r.Key, err)
+		}
+		if !ok {
+			skipped++
+			continue
+		}
+		if err := dst.Put(ctx, k, v); err != nil {
+			return fmt.Errorf("writing %s: %w", k, err)
+		}
+		migrated++
+	}
+	fmt.Printf("Migrated %d keys from %s to %s (%d skipped)\n", migrated, cfg.From, cfg.To, skipped)
+
+	// Give the destination a chance to announce the new heads.
+	fmt.Println("Waiting for the destination to broadcast...")
+	select {
+	case <-ctx.Done():
+	case <-base.clock.Wall.After(2 * opts.RebroadcastInterval):
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// mput stores key=value pairs in a single delta, or none of them when one
+// is rejected.
+func mput(ctx context.Context, kv *db, pairs []string) error {
+	keys := make([]ds.Key, len(pairs))
+	values := make([][]byte, len(pairs))
+	for i, p := range pairs {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("expected <key>=<value>, got %q", p)
+		}
+		keys[i], values[i] = ds.NewKey(k), []byte(v)
+	}
+	b, err := kv.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	defer b.Discard()
+	for i, k := range keys {
+		if err := b.Put(ctx, k, values[i]); err != nil {
+			return err
+		}
+	}
+	return b.Commit(ctx)
+}
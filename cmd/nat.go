@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// natConfig holds the options nodes behind a NAT are reached with.
+type natConfig struct {
+	// AutoNAT serves AutoNAT to other peers, telling them whether they
+	// can be dialed. Nodes always ask their peers the same about
+	// themselves.
+	AutoNAT bool
+	// Relay reserves a slot on public circuit relays when the node cannot
+	// be dialed, and advertises its relayed addresses.
+	Relay bool
+	// HolePunch upgrades relayed connections to direct ones with DCUtR.
+	HolePunch bool
+	// Announce replaces the addresses the node advertises, for nodes with
+	// known public addresses, such as behind a port forward.
+	Announce []multiaddr.Multiaddr
+
+	// host is set once the host is created, for the peer source of the
+	// relays.
+	host atomic.Pointer[host.Host]
+}
+
+// parseAnnounce parses the -announce addresses.
+func parseAnnounce(addrs []string) ([]multiaddr.Multiaddr, error) {
+	var mas []multiaddr.Multiaddr
+	for _, a := range addrs {
+		ma, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			return nil, fmt.Errorf("-announce %s: %w", a, err)
+		}
+		mas = append(mas, ma)
+	}
+	return mas, nil
+}
+
+// options returns the libp2p options of the configuration. setHost must
+// be called with the host created with them.
+func (n *natConfig) options() []libp2p.Option {
+	opts := []libp2p.Option{libp2p.NATPortMap()}
+	if n.AutoNAT {
+		opts = append(opts, libp2p.EnableNATService())
+	}
+	if n.Relay {
+		opts = append(opts, libp2p.EnableRelay(), libp2p.EnableAutoRelayWithPeerSource(n.relayCandidates))
+	}
+	if n.HolePunch {
+		opts = append(opts, libp2p.EnableHolePunching())
+	}
+	if len(n.Announce) > 0 {
+		announce := n.Announce
+		opts = append(opts, libp2p.AddrsFactory(func([]multiaddr.Multiaddr) []multiaddr.Multiaddr {
+			return announce
+		}))
+	}
+	return opts
+}
+
+func (n *natConfig) setHost(h host.Host) {
+	n.host.Store(&h)
+}
+
+// relayCandidates offers the connected peers as relays: the public nodes
+// the DHT bootstraps from run circuit relay v2, and nodes of the database
+// that are publicly reachable serve as relays for the others.
+func (n *natConfig) relayCandidates(ctx context.Context, num int) <-chan peer.AddrInfo {
+	out := make(chan peer.AddrInfo, num)
+	defer close(out)
+	hp := n.host.Load()
+	if hp == nil {
+		return out
+	}
+	h := *hp
+	for _, p := range h.Network().Peers() {
+		if len(out) == num {
+			break
+		}
+		addrs := h.Peerstore().Addrs(p)
+		if len(addrs) == 0 {
+			continue
+		}
+		out <- peer.AddrInfo{ID: p, Addrs: addrs}
+	}
+	return out
+}
+
+// logReachability logs what AutoNAT finds out about the reachability of
+// the node.
+func logReachability(ctx context.Context, bus event.Bus) error {
+	sub, err := bus.Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-sub.Out():
+				switch r := e.(event.EvtLocalReachabilityChanged).Reachability; r {
+				case network.ReachabilityPublic:
+					logger.Infof("reachability: public, peers can dial this node")
+				case network.ReachabilityPrivate:
+					logger.Infof("reachability: private, this node is behind a NAT or firewall")
+				default:
+					logger.Debugf("reachability: %s", r)
+				}
+			}
+		}
+	}()
+	return nil
+}
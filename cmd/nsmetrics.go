@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// otherNamespace is the label of the keys whose namespace did not fit in
+// the cardinality limit.
+const otherNamespace = "other"
+
+// namespaceBuckets maps keys to the namespace label of the kv metrics:
+// the first components of the key. Once the limit of distinct labels is
+// reached, keys in new namespaces are counted under "other" so that
+// tenants cannot blow up the number of series.
+type namespaceBuckets struct {
+	depth int
+	max   int
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func newNamespaceBuckets(depth, max int) *namespaceBuckets {
+	return &namespaceBuckets{depth: depth, max: max, seen: make(map[string]struct{})}
+}
+
+// label returns the namespace label of a key.
+func (nb *namespaceBuckets) label(k ds.Key) string {
+	ns := keyPrefix(k.String(), nb.depth)
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+	if _, ok := nb.seen[ns]; ok {
+		return ns
+	}
+	if len(nb.seen) >= nb.max {
+		return otherNamespace
+	}
+	nb.seen[ns] = struct{}{}
+	return ns
+}
+
+// kvNamespaces labels the kv metrics. It is configured from the flags.
+var kvNamespaces = newNamespaceBuckets(1, 100)
+
+// observeKV counts and times an operation on a key.
+func observeKV(op string, k ds.Key, start time.Time) {
+	ns := kvNamespaces.label(k)
+	kvOperations.WithLabelValues(op, ns).Inc()
+	kvDuration.WithLabelValues(op, ns).Observe(time.Since(start).Seconds())
+}
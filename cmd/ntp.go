@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// ntpEpochOffset is the number of seconds between the NTP epoch (1900)
+// and the Unix epoch (1970).
+const ntpEpochOffset = 2208988800
+
+// ntpOffset queries an NTP server with a single SNTP request and returns
+// how far the local clock is behind the server's (negative when the
+// local clock is ahead).
+func ntpOffset(server string, timeout time.Duration) (time.Duration, error) {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(server, "123"), timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	req := make([]byte, 48)
+	req[0] = 0x1b // no leap warning, version 3, client mode
+	t1 := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return 0, err
+	}
+	t4 := time.Now()
+	if n < 48 {
+		return 0, errors.New("short NTP response")
+	}
+
+	t2 := ntpTime(resp[32:40]) // server receive time
+	t3 := ntpTime(resp[40:48]) // server transmit time
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+func ntpTime(b []byte) time.Time {
+	sec := binary.BigEndian.Uint32(b[0:4])
+	frac := binary.BigEndian.Uint32(b[4:8])
+	nsec := (int64(frac) * 1e9) >> 32
+	return time.Unix(int64(sec)-ntpEpochOffset, nsec)
+}
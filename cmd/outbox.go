@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/redis/go-redis/v9"
+)
+
+// outboxNs holds the events written along with data and not published
+// yet, as outboxNs/<origin peer>/<event id>.
+var outboxNs = systemNs.ChildString("outbox")
+
+// ErrInvalidEvent is returned when an event cannot be written.
+var ErrInvalidEvent = errors.New("invalid event")
+
+// outboxEvent is an event for external systems, written in the same delta
+// as the data it is about.
+type outboxEvent struct {
+	// ID orders the events of the origin and lets subscribers drop the
+	// ones they get twice.
+	ID      string          `json:"id"`
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// Origin is the peer the event was written on, which publishes it.
+	Origin  string    `json:"origin"`
+	Created time.Time `json:"created"`
+}
+
+// outboxWrite is data to write along with an event. Values are base64 in
+// JSON.
+type outboxWrite struct {
+	Puts    []kvEntry `json:"puts,omitempty"`
+	Deletes []string  `json:"deletes,omitempty"`
+	Event   struct {
+		Topic   string          `json:"topic"`
+		Payload json.RawMessage `json:"payload,omitempty"`
+	} `json:"event"`
+}
+
+// parseEmit parses the arguments of emit: the topic, the JSON payload and
+// key=value pairs to write along with the event.
+func parseEmit(topic, payload string, pairs []string) (outboxWrite, error) {
+	var w outboxWrite
+	w.Event.Topic, w.Event.Payload = topic, json.RawMessage(payload)
+	for _, p := range pairs {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok || k == "" {
+			return w, fmt.Errorf("expected <key>=<value>, got %q", p)
+		}
+		w.Puts = append(w.Puts, kvEntry{Key: k, Value: []byte(v)})
+	}
+	return w, nil
+}
+
+// newEventID returns an ID that sorts after those taken before it.
+func newEventID(now time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%020d-%s", now.UnixNano(), hex.EncodeToString(suffix))
+}
+
+// WriteWithEvent applies the writes and records the event in a single
+// delta, so that the event exists if and only if the data does. The event
+// is published by the -outbox relay of node once the delta is applied.
+func (d *db) WriteWithEvent(ctx context.Context, node string, w outboxWrite) (*outboxEvent, error) {
+	if w.Event.Topic == "" {
+		return nil, fmt.Errorf("%w: it needs a topic", ErrInvalidEvent)
+	}
+	if len(w.Event.Payload) > 0 && !json.Valid(w.Event.Payload) {
+		return nil, fmt.Errorf("%w: the payload is not valid JSON", ErrInvalidEvent)
+	}
+	now := d.now().UTC()
+	ev := &outboxEvent{ID: newEventID(now), Topic: w.Event.Topic, Payload: w.Event.Payload, Origin: node, Created: now}
+	v, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	b, err := d.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Discard()
+	for _, e := range w.Puts {
+		if err := b.Put(ctx, ds.NewKey(e.Key), e.Value); err != nil {
+			return nil, err
+		}
+	}
+	for _, k := range w.Deletes {
+		if err := b.Delete(ctx, ds.NewKey(k)); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.Put(ctx, outboxNs.ChildString(node).ChildString(ev.ID), v); err != nil {
+		return nil, err
+	}
+	if err := b.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// pendingEvents returns the events of node not published yet, oldest
+// first.
+func pendingEvents(ctx context.Context, kv *db, node string) ([]*outboxEvent, error) {
+	results, err := kv.Query(ctx, query.Query{Prefix: outboxNs.ChildString(node).String(), Orders: []query.Order{query.OrderByKey{}}})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	var events []*outboxEvent
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		var ev outboxEvent
+		if err := json.Unmarshal(r.Value, &ev); err != nil {
+			logger.Warnf("outbox: skipping %s: %s", r.Key, err)
+			continue
+		}
+		events = append(events, &ev)
+	}
+	return events, nil
+}
+
+// outboxSink is the external system events are published to.
+type outboxSink interface {
+	publish(ctx context.Context, ev *outboxEvent) error
+	close() error
+}
+
+// newOutboxSink opens the system behind an -outbox URL:
+//
+//	https://example.com/hook         POST every event as JSON
+//	redis://host:6379/0?stream=name  XADD every event to a stream
+func newOutboxSink(rawURL string) (outboxSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &webhookSink{url: rawURL, client: &http.Client{Timeout: 30 * time.Second}}, nil
+	case "redis", "rediss":
+		q := u.Query()
+		stream := q.Get("stream")
+		if stream == "" {
+			stream = "globaldb-outbox"
+		}
+		q.Del("stream")
+		u.RawQuery = q.Encode()
+		opts, err := redis.ParseURL(u.String())
+		if err != nil {
+			return nil, err
+		}
+		return &redisSink{client: redis.NewClient(opts), stream: stream}, nil
+	default:
+		return nil, fmt.Errorf("cannot publish events to %q, use http://, https:// or redis://", u.Scheme)
+	}
+}
+
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) publish(ctx context.Context, ev *outboxEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s *webhookSink) close() error { return nil }
+
+type redisSink struct {
+	client *redis.Client
+	stream string
+}
+
+func (s *redisSink) publish(ctx context.Context, ev *outboxEvent) error {
+	return s.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: s.stream,
+		Values: map[string]interface{}{"id": ev.ID, "topic": ev.Topic, "payload": string(ev.Payload), "origin": ev.Origin},
+	}).Err()
+}
+
+func (s *redisSink) close() error { return s.client.Close() }
+
+// runOutbox publishes the events written on node to the sink, in order,
+// until the context is cancelled. Events are picked up from the change
+// feed, so only once their delta is applied to the local store, and
+// removed from the outbox once published. Delivery is at least once: an
+// event is published again when the node stops between publishing it and
+// removing it.
+func runOutbox(ctx context.Context, name string, s outboxSink, f *changeFeed, kv *db, node string) {
+	defer s.close()
+	prefix := outboxNs.ChildString(node)
+	var seq uint64
+	synced := false
+	for ctx.Err() == nil {
+		var (
+			events []*outboxEvent
+			next   uint64
+			err    error
+		)
+		ok := synced
+		if ok {
+			f.wait(ctx, seq)
+			var changes []change
+			changes, next, ok = f.since(seq)
+			for _, c := range changes {
+				if c.Op != "put" || !prefix.IsAncestorOf(ds.NewKey(c.Key)) {
+					continue
+				}
+				var ev outboxEvent
+				if err := json.Unmarshal(c.Value, &ev); err != nil {
+					logger.Warnf("outbox %s: skipping %s: %s", name, c.Key, err)
+					continue
+				}
+				events = append(events, &ev)
+			}
+		}
+		if !ok {
+			// Start over from what the store holds, to not miss events
+			// the feed dropped.
+			next = f.head()
+			events, err = pendingEvents(ctx, kv, node)
+		}
+		for len(events) > 0 && err == nil {
+			err = publishEvent(ctx, s, kv, prefix.ChildString(events[0].ID), events[0])
+			if err == nil {
+				events = events[1:]
+			}
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Errorf("outbox %s: %s", name, err)
+			}
+			synced = false
+			select {
+			case <-ctx.Done():
+			case <-kv.clock.Wall.After(5 * time.Second):
+			}
+			continue
+		}
+		seq, synced = next, true
+	}
+}
+
+// outboxRelays runs a relay for each -outbox URL, and starts or stops
+// relays as the URLs change on reload.
+type outboxRelays struct {
+	ctx  context.Context
+	feed *changeFeed
+	kv   *db
+	node string
+
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+}
+
+func newOutboxRelays(ctx context.Context, f *changeFeed, kv *db, node string) *outboxRelays {
+	return &outboxRelays{ctx: ctx, feed: f, kv: kv, node: node, running: make(map[string]context.CancelFunc)}
+}
+
+// apply starts the relays of urls that do not run yet and stops those of
+// the URLs no longer given. Nothing changes when a URL is invalid.
+func (r *outboxRelays) apply(urls []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sinks := make(map[string]outboxSink)
+	for _, u := range urls {
+		if _, ok := r.running[u]; ok {
+			continue
+		}
+		s, err := newOutboxSink(u)
+		if err != nil {
+			for _, s := range sinks {
+				s.close()
+			}
+			return fmt.Errorf("outbox %s: %w", u, err)
+		}
+		sinks[u] = s
+	}
+	keep := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		keep[u] = true
+	}
+	for u, cancel := range r.running {
+		if !keep[u] {
+			cancel()
+			delete(r.running, u)
+		}
+	}
+	for u, s := range sinks {
+		ctx, cancel := context.WithCancel(r.ctx)
+		r.running[u] = cancel
+		go runOutbox(ctx, u, s, r.feed, r.kv, r.node)
+	}
+	return nil
+}
+
+// publishEvent publishes an event still in the outbox at k, then removes
+// it from there.
+func publishEvent(ctx context.Context, s outboxSink, kv *db, k ds.Key, ev *outboxEvent) error {
+	// Events seen both when listing the outbox and in the feed are only
+	// published the first time.
+	if _, err := kv.Get(ctx, k); errors.Is(err, ds.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := s.publish(ctx, ev); err != nil {
+		return err
+	}
+	outboxPublished.Inc()
+	if err := kv.Delete(ctx, k); err != nil && !errors.Is(err, ds.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// formatEvent renders an event for the REPL.
+func formatEvent(ev *outboxEvent) string {
+	payload := strings.TrimSpace(string(ev.Payload))
+	if len(payload) > 60 {
+		payload = payload[:57] + "..."
+	}
+	return fmt.Sprintf("%s  %-20s %s", ev.Created.Local().Format(time.DateTime), ev.Topic, payload)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// noopTracer implements pubsub.RawTracer doing nothing, so that tracers
+// only need to implement the events they care about.
+type noopTracer struct{}
+
+func (noopTracer) AddPeer(p peer.ID, proto protocol.ID)             {}
+func (noopTracer) RemovePeer(p peer.ID)                             {}
+func (noopTracer) Join(topic string)                                {}
+func (noopTracer) Leave(topic string)                               {}
+func (noopTracer) Graft(p peer.ID, topic string)                    {}
+func (noopTracer) Prune(p peer.ID, topic string)                    {}
+func (noopTracer) ValidateMessage(msg *pubsub.Message)              {}
+func (noopTracer) DeliverMessage(msg *pubsub.Message)               {}
+func (noopTracer) RejectMessage(msg *pubsub.Message, reason string) {}
+func (noopTracer) DuplicateMessage(msg *pubsub.Message)             {}
+func (noopTracer) ThrottlePeer(p peer.ID)                           {}
+func (noopTracer) RecvRPC(rpc *pubsub.RPC)                          {}
+func (noopTracer) SendRPC(rpc *pubsub.RPC, p peer.ID)               {}
+func (noopTracer) DropRPC(rpc *pubsub.RPC, p peer.ID)               {}
+func (noopTracer) UndeliverableMessage(msg *pubsub.Message)         {}
+
+// Kinds of peer events.
+const (
+	peerConnected    = "connected"
+	peerDisconnected = "disconnected"
+	peerRejected     = "rejected"
+)
+
+// peerEvent is something that happened with a peer.
+type peerEvent struct {
+	Time   time.Time `json:"time"`
+	Peer   peer.ID   `json:"peer"`
+	Kind   string    `json:"kind"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// peerEvents keeps the most recent connections, disconnections and
+// rejected pubsub messages. It is installed both as a network notifiee
+// and as a pubsub tracer.
+type peerEvents struct {
+	noopTracer
+
+	size  int
+	clock dkv.WallClock
+
+	mu  sync.Mutex
+	buf []peerEvent
+}
+
+func newPeerEvents(size int, clock dkv.WallClock) *peerEvents {
+	return &peerEvents{size: size, clock: clock}
+}
+
+func (e *peerEvents) add(kind string, p peer.ID, detail string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.buf = append(e.buf, peerEvent{Time: e.clock.Now(), Peer: p, Kind: kind, Detail: detail})
+	if len(e.buf) > e.size {
+		e.buf = e.buf[len(e.buf)-e.size:]
+	}
+}
+
+// list returns the retained events, oldest first.
+func (e *peerEvents) list() []peerEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]peerEvent(nil), e.buf...)
+}
+
+// notifiee returns the network notifiee recording connections.
+func (e *peerEvents) notifiee() network.Notifiee {
+	return &network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			e.add(peerConnected, c.RemotePeer(), c.RemoteMultiaddr().String())
+		},
+		DisconnectedF: func(_ network.Network, c network.Conn) {
+			e.add(peerDisconnected, c.RemotePeer(), c.RemoteMultiaddr().String())
+		},
+	}
+}
+
+func (e *peerEvents) RejectMessage(msg *pubsub.Message, reason string) {
+	e.add(peerRejected, msg.ReceivedFrom, fmt.Sprintf("%s on %s", reason, msg.GetTopic()))
+}
+
+func printPeerEvents(list []peerEvent, al *aliases) {
+	if len(list) == 0 {
+		fmt.Println("no peer events yet")
+		return
+	}
+	for _, ev := range list {
+		fmt.Printf("%s  %-12s %s  %s\n", ev.Time.Format(time.Stamp), ev.Kind, al.name(ev.Peer), ev.Detail)
+	}
+}
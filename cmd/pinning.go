@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// pinsNs is the namespace in the local datastore where pin records are
+// kept. Records map a key to the CID its value references.
+var pinsNs = ds.NewKey("/pins")
+
+// pinPolicy decides which keys have their referenced content pinned,
+// that is, fetched eagerly and kept locally. Content referenced by any
+// other key is fetched on demand.
+type pinPolicy struct {
+	prefixes []ds.Key
+	store    ds.Datastore
+}
+
+func newPinPolicy(store ds.Datastore, prefixes []string) *pinPolicy {
+	pp := &pinPolicy{store: store}
+	for _, p := range prefixes {
+		pp.prefixes = append(pp.prefixes, ds.NewKey(p))
+	}
+	return pp
+}
+
+// matches returns true when the key falls under a pinned prefix.
+func (pp *pinPolicy) matches(k ds.Key) bool {
+	for _, p := range pp.prefixes {
+		if p.Equal(k) || p.IsAncestorOf(k) {
+			return true
+		}
+	}
+	return false
+}
+
+// update records or clears the pin for a key after its value changed. It
+// returns true when the value references content that should be fetched.
+func (pp *pinPolicy) update(ctx context.Context, k ds.Key, v []byte) bool {
+	if !pp.matches(k) {
+		return false
+	}
+	c, ok := referencedCID(v)
+	if !ok {
+		pp.unpin(ctx, k)
+		return false
+	}
+	if err := pp.store.Put(ctx, pinsNs.Child(k), c.Bytes()); err != nil {
+		logger.Errorf("pinning %s: %s", c, err)
+		return false
+	}
+	return true
+}
+
+// unpin drops the pin record for a key, if any.
+func (pp *pinPolicy) unpin(ctx context.Context, k ds.Key) {
+	if err := pp.store.Delete(ctx, pinsNs.Child(k)); err != nil {
+		logger.Errorf("unpinning %s: %s", k, err)
+	}
+}
+
+// pins returns all pinned CIDs indexed by the key referencing them.
+func (pp *pinPolicy) pins(ctx context.Context) (map[ds.Key]cid.Cid, error) {
+	results, err := pp.store.Query(ctx, query.Query{Prefix: pinsNs.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	pins := make(map[ds.Key]cid.Cid)
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		c, err := cid.Cast(r.Value)
+		if err != nil {
+			return nil, fmt.Errorf("bad pin record %s: %w", r.Key, err)
+		}
+		k := ds.RawKey(r.Key[len(pinsNs.String()):])
+		pins[k] = c
+	}
+	return pins, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// newPipelines parses prefix=spec pairs, as given with -pipeline. A spec
+// lists the transforms of the values under the prefix, separated by
+// commas and in the order they apply:
+//
+//	gzip                 compress
+//	aes-gcm:<key file>   encrypt with a 32-byte key, raw or hex-encoded
+//	sign                 sign with the node key
+//
+// The required transforms, such as the encryption of -passphrase-file or
+// the signature of -signed-writes, apply to every value: they are added
+// to the pipelines lacking their stage, and make up the pipeline of the
+// prefixes without one.
+func newPipelines(specs map[string]string, priv crypto.PrivKey, required ...dkv.Transform) (*dkv.Pipelines, error) {
+	p := dkv.NewPipelines()
+	if _, ok := specs["/"]; !ok && len(required) > 0 {
+		if err := p.Add(ds.NewKey("/"), withRequired(nil, required)); err != nil {
+			return nil, err
+		}
+	}
+	for prefix, spec := range specs {
+		var ts []dkv.Transform
+		for _, name := range strings.Split(spec, ",") {
+			t, err := parseTransform(strings.TrimSpace(name), priv)
+			if err != nil {
+				return nil, fmt.Errorf("pipeline for %s: %w", prefix, err)
+			}
+			ts = append(ts, t)
+		}
+		pl, err := dkv.NewPipeline(ts...)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline for %s: %w", prefix, err)
+		}
+		if err := p.Add(ds.NewKey(prefix), withRequired(pl, required)); err != nil {
+			return nil, fmt.Errorf("pipeline for %s: %w", prefix, err)
+		}
+	}
+	return p, nil
+}
+
+// withRequired adds the required transforms whose stage is missing from
+// a pipeline.
+func withRequired(pl dkv.Pipeline, required []dkv.Transform) dkv.Pipeline {
+	out := append(dkv.Pipeline{}, pl...)
+	for _, r := range required {
+		if !slices.ContainsFunc(pl, func(t dkv.Transform) bool { return t.Stage() == r.Stage() }) {
+			out = append(out, r)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Stage() < out[j].Stage() })
+	return out
+}
+
+func parseTransform(spec string, priv crypto.PrivKey) (dkv.Transform, error) {
+	name, arg, _ := strings.Cut(spec, ":")
+	switch name {
+	case "gzip":
+		return dkv.Gzip(), nil
+	case "aes-gcm":
+		if arg == "" {
+			return nil, fmt.Errorf("aes-gcm needs a key file, as in aes-gcm:<file>")
+		}
+		key, err := readKeyFile(arg)
+		if err != nil {
+			return nil, err
+		}
+		return dkv.AESGCM(key)
+	case "sign":
+		return dkv.Sign(priv)
+	default:
+		return nil, fmt.Errorf("unknown transform %q (want gzip, aes-gcm:<key file> or sign)", name)
+	}
+}
+
+// readKeyFile reads a symmetric key, stored raw or hex-encoded.
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		return key, nil
+	}
+	return data, nil
+}
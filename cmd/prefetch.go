@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// referencedCID returns the CID a value points to, if any. Values
+// referencing content hold either a bare CID or an /ipfs/<cid> path.
+func referencedCID(v []byte) (cid.Cid, bool) {
+	s := strings.TrimSpace(string(v))
+	s = strings.TrimPrefix(s, "/ipfs/")
+	if s == "" || strings.ContainsAny(s, " /") {
+		return cid.Undef, false
+	}
+	c, err := cid.Decode(s)
+	if err != nil {
+		return cid.Undef, false
+	}
+	return c, true
+}
+
+// prefetcher fetches the DAGs referenced by values in the background so
+// that reading them later does not wait on the network.
+type prefetcher struct {
+	dag     ipld.DAGService
+	queue   chan cid.Cid
+	timeout time.Duration
+}
+
+func newPrefetcher(dag ipld.DAGService) *prefetcher {
+	return &prefetcher{
+		dag:     dag,
+		queue:   make(chan cid.Cid, 256),
+		timeout: 10 * time.Minute,
+	}
+}
+
+// enqueue schedules the content referenced by a value for fetching. It
+// never blocks, since it is called from the CRDT hooks; when the queue
+// is full the value is skipped and fetched on demand instead.
+func (pf *prefetcher) enqueue(v []byte) {
+	c, ok := referencedCID(v)
+	if !ok {
+		return
+	}
+	select {
+	case pf.queue <- c:
+	default:
+		logger.Debugf("prefetch queue full, skipping %s", c)
+	}
+}
+
+// run fetches queued DAGs with the given number of workers until the
+// context is cancelled.
+func (pf *prefetcher) run(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case c := <-pf.queue:
+					fctx, cancel := context.WithTimeout(ctx, pf.timeout)
+					err := merkledag.FetchGraph(fctx, c, pf.dag)
+					cancel()
+					if err != nil {
+						logger.Warnf("prefetching %s: %s", c, err)
+						continue
+					}
+					logger.Debugf("prefetched %s", c)
+				}
+			}
+		}()
+	}
+}
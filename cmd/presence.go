@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// presence is the message every node periodically publishes on the
+// network topic. Besides keeping globaldb peers connected to each other,
+// it tells them about the labels attached to the node and its DAG heads.
+type presence struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	Time        time.Time         `json:"time"`
+	Maintenance bool              `json:"maintenance,omitempty"`
+	Heads       []string          `json:"heads,omitempty"`
+	// Addrs are the addresses the node listens on, so that members not
+	// connected to it can dial it even after they change.
+	Addrs []string `json:"addrs,omitempty"`
+}
+
+// decodePresence parses a presence message. Older nodes publish a plain
+// "hi!", which results in an empty presence.
+func decodePresence(data []byte) presence {
+	var p presence
+	if err := json.Unmarshal(data, &p); err != nil {
+		return presence{}
+	}
+	return p
+}
+
+// member is what we know about another node from its presence messages.
+type member struct {
+	ID       peer.ID           `json:"id"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	LastSeen time.Time         `json:"last_seen"`
+	// Heads are the DAG heads the member announced last.
+	Heads []string `json:"heads,omitempty"`
+	// Addrs are the addresses the member announced last.
+	Addrs []string `json:"addrs,omitempty"`
+	// Maintenance is set while the member is in maintenance mode.
+	Maintenance bool `json:"maintenance,omitempty"`
+	// Skew is how far the member's clock appeared to be behind ours
+	// when its last presence message arrived, including network delay.
+	Skew time.Duration `json:"skew"`
+}
+
+// EvtMemberJoined is emitted on the host event bus when a node starts
+// sending presence, or comes back after having left.
+type EvtMemberJoined struct {
+	Member member
+}
+
+// EvtMemberLeft is emitted on the host event bus when a node has not sent
+// presence for the membership TTL.
+type EvtMemberLeft struct {
+	Member member
+}
+
+// members keeps track of the nodes we have received presence from
+// recently. It is the membership of the replica set as seen by this node.
+type members struct {
+	ttl    time.Duration
+	clock  dkv.WallClock
+	joined event.Emitter
+	left   event.Emitter
+
+	mu sync.RWMutex
+	m  map[peer.ID]*member
+}
+
+// newMembers returns an empty membership where nodes leave after ttl
+// without presence, as told by clock. Join and leave events are emitted
+// on bus.
+func newMembers(bus event.Bus, ttl time.Duration, clock dkv.WallClock) (*members, error) {
+	joined, err := bus.Emitter(new(EvtMemberJoined))
+	if err != nil {
+		return nil, err
+	}
+	left, err := bus.Emitter(new(EvtMemberLeft))
+	if err != nil {
+		return nil, err
+	}
+	return &members{
+		ttl:    ttl,
+		clock:  clock,
+		joined: joined,
+		left:   left,
+		m:      make(map[peer.ID]*member),
+	}, nil
+}
+
+// update records a presence message received from the given peer and
+// returns what we knew about it before.
+func (ms *members) update(id peer.ID, p presence) (member, bool) {
+	now := ms.clock.Now()
+	m := &member{
+		ID:          id,
+		Labels:      p.Labels,
+		LastSeen:    now,
+		Heads:       p.Heads,
+		Addrs:       p.Addrs,
+		Maintenance: p.Maintenance,
+	}
+	if !p.Time.IsZero() {
+		m.Skew = now.Sub(p.Time)
+	}
+
+	ms.mu.Lock()
+	prev, ok := ms.m[id]
+	ms.m[id] = m
+	ms.mu.Unlock()
+	if !ok {
+		ms.joined.Emit(EvtMemberJoined{Member: *m})
+		return member{}, false
+	}
+	return *prev, true
+}
+
+// expire removes the members not seen for the TTL every so often, until
+// the context is cancelled.
+func (ms *members) expire(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ms.clock.After(ms.ttl / 2):
+		}
+		var gone []member
+		now := ms.clock.Now()
+		ms.mu.Lock()
+		for id, m := range ms.m {
+			if now.Sub(m.LastSeen) > ms.ttl {
+				gone = append(gone, *m)
+				delete(ms.m, id)
+			}
+		}
+		ms.mu.Unlock()
+		for _, m := range gone {
+			ms.left.Emit(EvtMemberLeft{Member: m})
+		}
+	}
+}
+
+// get returns what we know about the given peer.
+func (ms *members) get(id peer.ID) (member, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	m, ok := ms.m[id]
+	if !ok {
+		return member{}, false
+	}
+	return *m, true
+}
+
+// Membership returns the nodes seen within the TTL, sorted by peer ID.
+func (ms *members) Membership() []member {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	list := make([]member, 0, len(ms.m))
+	for _, m := range ms.m {
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// publishPresence announces this node on the network topic every
+// interval until the context is cancelled, and as soon as the addresses
+// of the host change, as after a DHCP renewal or once a relay is
+// acquired. The self function provides the current state of the node.
+func publishPresence(ctx context.Context, h host.Host, topic *pubsub.Topic, self func() presence, interval time.Duration, clock dkv.WallClock) {
+	var changed <-chan interface{}
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalAddressesUpdated))
+	if err != nil {
+		logger.Warnf("addresses changes will wait for the next presence: %s", err)
+	} else {
+		defer sub.Close()
+		changed = sub.Out()
+	}
+	for {
+		p := self()
+		p.Time = clock.Now()
+		for _, a := range h.Addrs() {
+			p.Addrs = append(p.Addrs, a.String())
+		}
+		data, err := json.Marshal(p)
+		if err != nil {
+			logger.Error(err)
+			return
+		}
+		topic.Publish(ctx, data)
+		select {
+		case <-ctx.Done():
+			return
+		case <-clock.After(interval):
+		case <-changed:
+			logger.Debugf("addresses changed, announcing %s", h.Addrs())
+		}
+	}
+}
+
+// handlePresence processes presence messages from the network topic
+// until the subscription fails. Every sender is tagged so that we do not
+// disconnect from globaldb peers. The timestamps in the messages are
+// compared against our clock, since last-writer-wins resolution silently
+// misbehaves when clocks disagree.
+func handlePresence(ctx context.Context, h host.Host, subs *pubsub.Subscription, ms *members, al *aliases, maxSkew time.Duration) {
+	for {
+		msg, err := subs.Next(ctx)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		from := msg.ReceivedFrom
+		h.ConnManager().TagPeer(from, "keep", 100)
+		if from == h.ID() {
+			continue
+		}
+		p := decodePresence(msg.Data)
+		// Messages are relayed, so the addresses are those of the
+		// author, which may not be the peer that passed them on.
+		if author := msg.GetFrom(); author != h.ID() {
+			for _, s := range p.Addrs {
+				if a, err := multiaddr.NewMultiaddr(s); err == nil {
+					h.Peerstore().AddAddr(author, a, peerstore.AddressTTL)
+				}
+			}
+		}
+		prev, known := ms.update(from, p)
+		if p.Time.IsZero() {
+			continue
+		}
+		skew := absDuration(ms.clock.Now().Sub(p.Time))
+		clockSkew.Observe(skew.Seconds())
+		if skew > maxSkew {
+			clockSkewWarnings.Inc()
+			// Only log when the peer crosses the threshold.
+			if !known || absDuration(prev.Skew) <= maxSkew {
+				logger.Warnf("clock of %s differs from ours by %s (max %s)", al.name(from), skew.Round(time.Millisecond), maxSkew)
+			}
+		}
+	}
+}
+
+// formatLabels renders labels as a sorted, comma separated key=value list.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func printMembers(list []member, al *aliases, now time.Time) {
+	if len(list) == 0 {
+		fmt.Println("no members seen yet")
+		return
+	}
+	for _, m := range list {
+		var status string
+		if m.Maintenance {
+			status = "  [maintenance]"
+		}
+		head := "-"
+		if len(m.Heads) > 0 {
+			head = m.Heads[0]
+			if len(m.Heads) > 1 {
+				head += fmt.Sprintf(" (+%d)", len(m.Heads)-1)
+			}
+		}
+		fmt.Printf("%s  last seen %s ago  skew %s  head %s  %s%s\n", al.name(m.ID), now.Sub(m.LastSeen).Truncate(time.Second), m.Skew.Round(time.Millisecond), head, formatLabels(m.Labels), status)
+	}
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// logMembership logs nodes joining and leaving until the context is
+// cancelled.
+func logMembership(ctx context.Context, bus event.Bus, al *aliases) error {
+	sub, err := bus.Subscribe([]interface{}{new(EvtMemberJoined), new(EvtMemberLeft)})
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-sub.Out():
+				switch e := e.(type) {
+				case EvtMemberJoined:
+					logger.Infof("member %s joined", al.name(e.Member.ID))
+				case EvtMemberLeft:
+					logger.Infof("member %s left, last seen %s", al.name(e.Member.ID), e.Member.LastSeen.Format(time.RFC3339))
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// probeNs holds one key per node running the latency probe, named after
+// its peer ID and holding the time of its last write.
+var probeNs = systemNs.ChildString("probe")
+
+// isProbeKey tells whether k is a probe key.
+func isProbeKey(k ds.Key) bool {
+	return probeNs.IsAncestorOf(k)
+}
+
+// writeProbe writes the current time to the node's probe key. The probe
+// job runs it every -probe-interval.
+func writeProbe(ctx context.Context, kv *db, self peer.ID) error {
+	now := kv.now().UTC().Format(time.RFC3339Nano)
+	if err := kv.Put(ctx, probeNs.ChildString(self.String()), []byte(now)); err != nil {
+		return fmt.Errorf("writing probe: %w", err)
+	}
+	return nil
+}
+
+// probeStats keeps the latest replication latency measured for each
+// member.
+type probeStats struct {
+	self  peer.ID
+	clock dkv.WallClock
+
+	mu     sync.Mutex
+	latest map[peer.ID]probeSample
+}
+
+type probeSample struct {
+	latency time.Duration
+	at      time.Time
+}
+
+func newProbeStats(self peer.ID, clock dkv.WallClock) *probeStats {
+	return &probeStats{self: self, clock: clock, latest: make(map[peer.ID]probeSample)}
+}
+
+// maxLatency returns the highest of the latest latencies measured within
+// the given window, or false when no probe arrived in it.
+func (ps *probeStats) maxLatency(window time.Duration) (time.Duration, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var max time.Duration
+	var found bool
+	now := ps.clock.Now()
+	for _, s := range ps.latest {
+		if now.Sub(s.at) > window {
+			continue
+		}
+		found = true
+		if s.latency > max {
+			max = s.latency
+		}
+	}
+	return max, found
+}
+
+// observe records how long the probe write of another node took to reach
+// us. It is called from the put hook with the payload of the value. The
+// measure includes the clock skew between both nodes.
+func (ps *probeStats) observe(k ds.Key, v []byte) {
+	if !isProbeKey(k) {
+		return
+	}
+	from, err := peer.Decode(k.BaseNamespace())
+	if err != nil || from == ps.self {
+		return
+	}
+	written, err := time.Parse(time.RFC3339Nano, string(v))
+	if err != nil {
+		return
+	}
+	now := ps.clock.Now()
+	latency := now.Sub(written)
+	replicationLatency.WithLabelValues(from.String()).Observe(latency.Seconds())
+	ps.mu.Lock()
+	ps.latest[from] = probeSample{latency: latency, at: now}
+	ps.mu.Unlock()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	badger "github.com/ipfs/go-ds-badger2"
+)
+
+// profile bundles the tunables that change between deployment targets:
+// timer intervals, how much DHT work the node takes on, cache sizes and
+// connection limits.
+type profile struct {
+	Name string
+
+	// RebroadcastInterval is how often the CRDT heads are rebroadcast.
+	RebroadcastInterval time.Duration
+	// PresenceInterval is how often we announce ourselves on the
+	// network topic.
+	PresenceInterval time.Duration
+	// StatusInterval is how often daemon mode prints the peer count.
+	StatusInterval time.Duration
+	// ReprovideInterval is how often blocks are reprovided to the DHT.
+	// A negative value disables reproviding.
+	ReprovideInterval time.Duration
+	// DHTClient keeps the DHT in client mode: the node looks records up
+	// but neither stores nor serves them for other peers.
+	DHTClient bool
+	// GossipHeartbeat is the gossipsub heartbeat interval. Zero keeps
+	// the gossipsub default.
+	GossipHeartbeat time.Duration
+	// DAGWorkers is the number of workers walking the CRDT DAG.
+	DAGWorkers int
+
+	// ConnLow and ConnHigh are the connection manager watermarks.
+	ConnLow  int
+	ConnHigh int
+
+	// BlockCacheSize and IndexCacheSize size the Badger caches. Zero
+	// keeps the Badger defaults.
+	BlockCacheSize int64
+	IndexCacheSize int64
+	// NumMemtables and MaxTableSize bound Badger's in-memory tables.
+	// Zero keeps the Badger defaults.
+	NumMemtables int
+	MaxTableSize int64
+	// UncachedBlockstore skips the ARC cache and bloom filter in front
+	// of the blockstore.
+	UncachedBlockstore bool
+}
+
+var profiles = map[string]profile{
+	"default": {
+		Name:                "default",
+		RebroadcastInterval: 5 * time.Second,
+		PresenceInterval:    20 * time.Second,
+		StatusInterval:      10 * time.Second,
+		DAGWorkers:          5,
+		ConnLow:             100,
+		ConnHigh:            600,
+	},
+	"server": {
+		Name:                "server",
+		RebroadcastInterval: 5 * time.Second,
+		PresenceInterval:    20 * time.Second,
+		StatusInterval:      time.Minute,
+		DAGWorkers:          10,
+		ConnLow:             400,
+		ConnHigh:            1000,
+		BlockCacheSize:      512 << 20,
+		IndexCacheSize:      256 << 20,
+	},
+	// low-power targets SBCs and battery devices: timers fire less
+	// often, the node neither reprovides to the DHT nor serves it, and
+	// memory use is kept small.
+	"low-power": {
+		Name:                "low-power",
+		RebroadcastInterval: 30 * time.Second,
+		PresenceInterval:    time.Minute,
+		StatusInterval:      5 * time.Minute,
+		ReprovideInterval:   -1,
+		DHTClient:           true,
+		GossipHeartbeat:     3 * time.Second,
+		DAGWorkers:          2,
+		ConnLow:             20,
+		ConnHigh:            50,
+		BlockCacheSize:      8 << 20,
+		IndexCacheSize:      4 << 20,
+		NumMemtables:        2,
+		MaxTableSize:        8 << 20,
+		UncachedBlockstore:  true,
+	},
+}
+
+// profileNames returns the names of all known profiles, sorted.
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getProfile returns the profile with the given name.
+func getProfile(name string) (profile, error) {
+	p, ok := profiles[name]
+	if !ok {
+		return profile{}, fmt.Errorf("unknown profile %q (available: %s)", name, strings.Join(profileNames(), ", "))
+	}
+	return p, nil
+}
+
+// applyBadger sets the profile's cache sizes on the datastore options.
+func (p profile) applyBadger(opts *badger.Options) {
+	if p.BlockCacheSize > 0 {
+		opts.BlockCacheSize = p.BlockCacheSize
+	}
+	if p.IndexCacheSize > 0 {
+		opts.IndexCacheSize = p.IndexCacheSize
+	}
+	if p.NumMemtables > 0 {
+		opts.NumMemtables = p.NumMemtables
+	}
+	if p.MaxTableSize > 0 {
+		opts.MaxTableSize = p.MaxTableSize
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/arcinston/dkv/lightclient"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	ipld "github.com/ipfs/go-ipld-format"
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// buildProof looks for the DAG node that wrote the current value of k,
+// walking down from the given heads with local blocks only, and returns
+// the path to it signed with priv at now.
+func buildProof(ctx context.Context, dag ipld.DAGService, heads []cid.Cid, k ds.Key, value []byte, priv crypto.PrivKey, now time.Time) (*lightclient.Proof, error) {
+	for _, head := range heads {
+		path, err := findValue(ctx, dag, head, k.String(), value)
+		if err != nil {
+			return nil, err
+		}
+		if path == nil {
+			continue
+		}
+
+		signer, err := peer.IDFromPrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		signed := now.UTC()
+		sig, err := priv.Sign(lightclient.HeadSignatureData(head, signed))
+		if err != nil {
+			return nil, err
+		}
+		p := &lightclient.Proof{
+			Key:       k.String(),
+			Value:     value,
+			Head:      head.String(),
+			Signer:    signer.String(),
+			Signed:    signed,
+			Signature: sig,
+		}
+		for _, nd := range path {
+			p.Path = append(p.Path, nd.RawData())
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("no DAG node reachable from the heads sets %s to its current value", k)
+}
+
+// parseTrust reads the peers and heads a proof may be vouched for by.
+func parseTrust(args []string) (lightclient.Trust, error) {
+	var t lightclient.Trust
+	for _, a := range args {
+		if p, err := peer.Decode(a); err == nil {
+			t.Signers = append(t.Signers, p)
+			continue
+		}
+		c, err := cid.Decode(a)
+		if err != nil {
+			return t, fmt.Errorf("%q is neither a peer ID nor a CID", a)
+		}
+		t.Heads = append(t.Heads, c)
+	}
+	return t, nil
+}
+
+// findValue walks the DAG breadth-first from head and returns the path to
+// the first node whose delta sets key to value, or nil if there is none.
+func findValue(ctx context.Context, dag ipld.DAGService, head cid.Cid, key string, value []byte) ([]ipld.Node, error) {
+	parents := make(map[cid.Cid]ipld.Node)
+	visited := cid.NewSet()
+	visited.Add(head)
+	queue := []cid.Cid{head}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		nd, err := dag.Get(ctx, c)
+		if err != nil {
+			return nil, fmt.Errorf("getting %s: %w", c, err)
+		}
+		delta, err := lightclient.NodeDelta(nd)
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s: %w", c, err)
+		}
+		for _, e := range delta.GetElements() {
+			if e.GetKey() != key || !bytes.Equal(e.GetValue(), value) {
+				continue
+			}
+			path := []ipld.Node{nd}
+			for p, ok := parents[c]; ok; p, ok = parents[p.Cid()] {
+				path = append([]ipld.Node{p}, path...)
+			}
+			return path, nil
+		}
+		for _, l := range nd.Links() {
+			if visited.Visit(l.Cid) {
+				parents[l.Cid] = nd
+				queue = append(queue, l.Cid)
+			}
+		}
+	}
+	return nil, nil
+}
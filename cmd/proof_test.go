@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/arcinston/dkv/lightclient"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-ds-crdt/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestBuildProof(t *testing.T) {
+	ctx := context.Background()
+	priv, signer := newTestPeer(t)
+	dag := offlineDAG(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())))
+	// The DAG is a chain: head, which sets /c, links to a node setting
+	// /b, which links to one setting /a.
+	var head *merkledag.ProtoNode
+	for i, key := range []string{"/a", "/b", "/c"} {
+		data, err := proto.Marshal(&pb.Delta{
+			Elements: []*pb.Element{{Key: key, Id: "/id", Value: []byte(key + "=1")}},
+			Priority: uint64(i + 1),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd := merkledag.NodeWithData(data)
+		if head != nil {
+			if err := nd.AddNodeLink("", head); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := dag.Add(ctx, nd); err != nil {
+			t.Fatal(err)
+		}
+		head = nd
+	}
+	tests := []struct {
+		name  string
+		key   string
+		value string
+		// path is the length of the path of the proof, 0 when there is
+		// none.
+		path int
+	}{
+		{"in the head", "/c", "/c=1", 1},
+		{"deep", "/a", "/a=1", 3},
+		{"other value", "/a", "/a=2", 0},
+		{"missing", "/d", "/d=1", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := buildProof(ctx, dag, []cid.Cid{head.Cid()}, ds.NewKey(tt.key), []byte(tt.value), priv, time.Unix(0, 0))
+			if tt.path == 0 {
+				if err == nil {
+					t.Fatal("proof built for a value no node sets")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(p.Path) != tt.path {
+				t.Errorf("path of %d blocks, want %d", len(p.Path), tt.path)
+			}
+			if err := p.VerifyTrusted(lightclient.Trust{Signers: []peer.ID{signer}}); err != nil {
+				t.Errorf("proof does not verify: %v", err)
+			}
+		})
+	}
+}
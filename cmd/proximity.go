@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+)
+
+// proximity scores peers by how close they are to us, based on the
+// region label from their presence messages and on measured latency.
+// The score is used by gossipsub to prefer nearby peers in the mesh and by
+// the connection manager to keep them connected, which in turn makes
+// bitswap fetch blocks from them.
+type proximity struct {
+	h      host.Host
+	ms     *members
+	region string
+}
+
+func newProximity(h host.Host, ms *members, labels map[string]string) *proximity {
+	return &proximity{
+		h:      h,
+		ms:     ms,
+		region: labels["region"],
+	}
+}
+
+// score returns a non-negative score for the given peer. Higher is closer.
+func (px *proximity) score(p peer.ID) float64 {
+	var s float64
+	if m, ok := px.ms.get(p); ok && px.region != "" && m.Labels["region"] == px.region {
+		s += 10
+	}
+
+	lat := px.h.Peerstore().LatencyEWMA(p)
+	switch {
+	case lat == 0:
+	case lat < 50*time.Millisecond:
+		s += 5
+	case lat < 150*time.Millisecond:
+		s += 2
+	}
+	return s
+}
+
+// refresh measures the latency to known members and refreshes their
+// connection manager tags. The proximity job runs it.
+func (px *proximity) refresh(ctx context.Context) error {
+	for _, m := range px.ms.Membership() {
+		if len(px.h.Network().ConnsToPeer(m.ID)) == 0 {
+			continue
+		}
+		pctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		res := <-ping.Ping(pctx, px.h, m.ID)
+		cancel()
+		if res.Error != nil {
+			logger.Debugf("ping %s: %s", m.ID, res.Error)
+		}
+		px.h.ConnManager().TagPeer(m.ID, "proximity", int(px.score(m.ID))*5)
+	}
+	return ctx.Err()
+}
+
+// gossipOptions returns the gossipsub options that make the mesh prefer
+// nearby peers. Scores are never negative, so the thresholds only serve
+// to satisfy gossipsub and no peer is ever penalized.
+func (px *proximity) gossipOptions() []pubsub.Option {
+	params := &pubsub.PeerScoreParams{
+		Topics:            map[string]*pubsub.TopicScoreParams{},
+		AppSpecificScore:  px.score,
+		AppSpecificWeight: 1,
+		DecayInterval:     time.Second,
+		DecayToZero:       0.01,
+	}
+	thresholds := &pubsub.PeerScoreThresholds{
+		GossipThreshold:             -500,
+		PublishThreshold:            -1000,
+		GraylistThreshold:           -2500,
+		OpportunisticGraftThreshold: 5,
+	}
+	return []pubsub.Option{pubsub.WithPeerScore(params, thresholds)}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// maxBuckets bounds how many clients a rate limiter tracks before it
+// forgets the ones whose bucket filled up again.
+const maxBuckets = 10000
+
+// tokenBuckets rate limits clients with a token bucket each: a client may
+// make burst requests at once, then rate a second. A rate of zero lets
+// every request through.
+type tokenBuckets struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	clock   dkv.WallClock
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBuckets(rate float64, burst int, clock dkv.WallClock) *tokenBuckets {
+	tb := &tokenBuckets{buckets: make(map[string]*bucket), clock: clock}
+	tb.setLimit(rate, burst)
+	return tb
+}
+
+// setLimit changes the rate and burst, as on reload. The buckets carry
+// over.
+func (tb *tokenBuckets) setLimit(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.rate, tb.burst = max(rate, 0), float64(burst)
+}
+
+// retryAfter is how long until a client out of tokens gets one back.
+func (tb *tokenBuckets) retryAfter() time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.rate == 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / tb.rate)
+}
+
+// take takes a token from the bucket of a client, if there is one left.
+func (tb *tokenBuckets) take(client string) bool {
+	now := tb.clock.Now()
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.rate == 0 {
+		return true
+	}
+	b, ok := tb.buckets[client]
+	if !ok {
+		if len(tb.buckets) >= maxBuckets {
+			tb.sweep(now)
+		}
+		b = &bucket{tokens: tb.burst, last: now}
+		tb.buckets[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * tb.rate
+	if b.tokens > tb.burst {
+		b.tokens = tb.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep forgets the clients whose bucket is full again, which is the same
+// as never having seen them.
+func (tb *tokenBuckets) sweep(now time.Time) {
+	for c, b := range tb.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*tb.rate >= tb.burst {
+			delete(tb.buckets, c)
+		}
+	}
+}
+
+// peerLimiter caps the rate at which each peer may announce heads on the
+// topics of the databases. Announcements over the limit are ignored
+// rather than processed, which spares the DAG walks and block fetches
+// they would cause. Nothing is lost: the next announcement of the peer
+// carries heads that descend from the ignored ones, and rebroadcasts
+// repeat them. The limit may change on reload, and a rate of zero lets
+// everything through.
+type peerLimiter struct {
+	*tokenBuckets
+	self peer.ID
+	// topics are the topics the limit applies to.
+	topics map[string]bool
+}
+
+func newPeerLimiter(rate float64, burst int, self peer.ID, topics []string, clock dkv.WallClock) *peerLimiter {
+	l := &peerLimiter{tokenBuckets: newTokenBuckets(rate, burst, clock), self: self, topics: make(map[string]bool)}
+	for _, t := range topics {
+		l.topics[t] = true
+	}
+	return l
+}
+
+// allow tells whether p may announce heads now. The node itself is never
+// limited.
+func (l *peerLimiter) allow(p peer.ID) bool {
+	return p == l.self || l.take(string(p))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+)
+
+func TestTokenBuckets(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		// steps are the waits before each take, and want what it returns.
+		steps []time.Duration
+		want  []bool
+	}{
+		{"burst", 1, 2, []time.Duration{0, 0, 0}, []bool{true, true, false}},
+		{"refill", 1, 1, []time.Duration{0, 0, time.Second}, []bool{true, false, true}},
+		{"partial refill", 2, 1, []time.Duration{0, 250 * time.Millisecond, 250 * time.Millisecond}, []bool{true, false, true}},
+		{"capped at burst", 10, 1, []time.Duration{0, time.Hour, 0}, []bool{true, true, false}},
+		{"no limit", 0, 1, []time.Duration{0, 0, 0}, []bool{true, true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := dkv.NewManualClock(time.Unix(0, 0))
+			tb := newTokenBuckets(tt.rate, tt.burst, clock)
+			for i, wait := range tt.steps {
+				clock.Advance(wait)
+				if got := tb.take("client"); got != tt.want[i] {
+					t.Errorf("take %d = %t, want %t", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
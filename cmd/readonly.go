@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	crdt "github.com/ipfs/go-ds-crdt"
+)
+
+// ErrReadOnly is returned by writes on a node started with -read-only.
+var ErrReadOnly = errors.New("node is read-only")
+
+// checkReadOnly rejects the options that make a -read-only node write.
+func checkReadOnly(nc nodeCommand) error {
+	switch nc.name {
+	case "import", "migrate":
+		return fmt.Errorf("%s writes to the database and cannot run with -read-only", nc.name)
+	}
+	var bad []string
+	if advertise {
+		bad = append(bad, "-advertise")
+	}
+	if description != "" {
+		bad = append(bad, "-describe")
+	}
+	if probeInterval > 0 {
+		bad = append(bad, "-probe-interval")
+	}
+	if tsRet.Raw > 0 {
+		bad = append(bad, "-ts-retention")
+	}
+	for _, j := range []string{jobProbe, jobTSCompaction} {
+		if s, ok := jobSpecs[j]; ok && s != "off" {
+			bad = append(bad, "-job "+j)
+		}
+	}
+	if len(outboxes) > 0 {
+		bad = append(bad, "-outbox")
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("-read-only cannot be used with flags that write to the database: %s", strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+// muted returns b, or with -read-only a broadcaster that receives the
+// announcements of the peers but never sends any: the node does not even
+// announce the heads it learnt from them.
+func muted(b crdt.Broadcaster) crdt.Broadcaster {
+	if !readOnly {
+		return b
+	}
+	return mutedBroadcaster{b}
+}
+
+type mutedBroadcaster struct {
+	crdt.Broadcaster
+}
+
+func (mutedBroadcaster) Broadcast([]byte) error {
+	return nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arcinston/dkv/lightclient"
+	"github.com/arcinston/dkv/pkg/dkv"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	crdt "github.com/ipfs/go-ds-crdt"
+	ipld "github.com/ipfs/go-ipld-format"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// refScheme starts the values that reference an entry of another
+// database.
+const refScheme = "dkv://"
+
+// maxRefDepth bounds how many references resolve follows when a
+// referenced value is itself a reference.
+const maxRefDepth = 8
+
+// refsNs holds the state of the databases joined to resolve references,
+// one namespace per topic, so that resolving from them again only needs
+// what changed since.
+var refsNs = ds.NewKey("/refs")
+
+// reference points at an entry of another database: a key on a topic, as
+// it is now, or a key as of a snapshot, the CID of a head of the DAG.
+//
+//	dkv://topic/<topic>/<key>
+//	dkv://snapshot/<cid>/<key>
+//
+// The topic is escaped as a URL path segment, so that the topics of named
+// databases, which hold a slash, fit.
+type reference struct {
+	Topic    string
+	Snapshot cid.Cid
+	Key      ds.Key
+}
+
+func parseRef(s string) (reference, error) {
+	rest, ok := strings.CutPrefix(s, refScheme)
+	if !ok {
+		return reference{}, fmt.Errorf("%q is not a reference: it must start with %s", s, refScheme)
+	}
+	kind, rest, _ := strings.Cut(rest, "/")
+	db, key, ok := strings.Cut(rest, "/")
+	if !ok || db == "" || key == "" {
+		return reference{}, fmt.Errorf("%q: expected %stopic/<topic>/<key> or %ssnapshot/<cid>/<key>", s, refScheme, refScheme)
+	}
+	r := reference{Key: ds.NewKey(key)}
+	switch kind {
+	case "topic":
+		topic, err := url.PathUnescape(db)
+		if err != nil {
+			return reference{}, fmt.Errorf("%q: %w", s, err)
+		}
+		r.Topic = topic
+	case "snapshot":
+		c, err := cid.Decode(db)
+		if err != nil {
+			return reference{}, fmt.Errorf("%q: %w", s, err)
+		}
+		r.Snapshot = c
+	default:
+		return reference{}, fmt.Errorf("%q: unknown reference kind %q, use topic or snapshot", s, kind)
+	}
+	return r, nil
+}
+
+func (r reference) String() string {
+	if r.Snapshot.Defined() {
+		return refScheme + "snapshot/" + r.Snapshot.String() + r.Key.String()
+	}
+	return refScheme + "topic/" + url.PathEscape(r.Topic) + r.Key.String()
+}
+
+// resolver fetches the entries references point at. Keys of the
+// databases the node holds are read locally. Other topics are joined for
+// as long as it takes the key to arrive, without ever announcing anything
+// on them, and snapshots are read like a light client does, walking the
+// DAG from the snapshot and checking every block against its CID.
+// Values are decoded with the pipelines of the node.
+type resolver struct {
+	base  *db
+	dbs   *databases
+	topic string
+	psub  *pubsub.PubSub
+	store ds.Datastore
+	dag   ipld.DAGService
+	// opts are the options of the joined stores, without hooks.
+	opts crdt.Options
+
+	// mu keeps two resolves from joining the same topic.
+	mu sync.Mutex
+}
+
+// resolve returns the value a reference points at, following the
+// references it finds up to maxRefDepth. Topics the node does not hold
+// are given timeout to deliver the key.
+func (r *resolver) resolve(ctx context.Context, ref reference, timeout time.Duration) ([]byte, error) {
+	for i := 0; i < maxRefDepth; i++ {
+		v, err := r.fetch(ctx, ref, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ref, err)
+		}
+		if !strings.HasPrefix(string(v), refScheme) {
+			return v, nil
+		}
+		if ref, err = parseRef(string(v)); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("more than %d references to follow", maxRefDepth)
+}
+
+func (r *resolver) fetch(ctx context.Context, ref reference, timeout time.Duration) ([]byte, error) {
+	if ref.Snapshot.Defined() {
+		return r.fetchSnapshot(ctx, ref)
+	}
+	if ref.Topic == r.topic {
+		return r.base.Get(ctx, ref.Key)
+	}
+	for name, d := range r.dbs.byName {
+		if name != defaultDB && dbTopic(r.topic, name) == ref.Topic {
+			return d.Get(ctx, ref.Key)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	l, err := joinListener(ctx, r.psub, ref.Topic)
+	if err != nil {
+		return nil, err
+	}
+	defer l.close()
+	c, err := crdt.New(r.store, refsNs.Child(ds.NewKey(ref.Topic)), r.dag, l, &r.opts)
+	if err != nil {
+		return nil, err
+	}
+	// The store only closes once the listener stops.
+	defer func() {
+		cancel()
+		c.Close()
+	}()
+	d := &db{crdt: c, clock: r.base.clock, pipelines: r.base.pipelines}
+	for {
+		v, err := d.Get(ctx, ref.Key)
+		if !errors.Is(err, ds.ErrNotFound) {
+			return v, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w after %s on %s", ds.ErrNotFound, timeout, ref.Topic)
+		case <-d.clock.Wall.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// listener receives the head announcements of a topic, signed or not,
+// and never sends any. Unlike the pubsub broadcaster of go-ds-crdt, it
+// leaves the topic when closed, so that the topic can be joined again.
+type listener struct {
+	ctx   context.Context
+	topic *pubsub.Topic
+	sub   *pubsub.Subscription
+}
+
+func joinListener(ctx context.Context, psub *pubsub.PubSub, topic string) (*listener, error) {
+	t, err := psub.Join(topic)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := t.Subscribe()
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	return &listener{ctx: ctx, topic: t, sub: sub}, nil
+}
+
+func (l *listener) Broadcast([]byte) error {
+	return nil
+}
+
+func (l *listener) Next() ([]byte, error) {
+	for {
+		msg, err := l.sub.Next(l.ctx)
+		if err != nil {
+			return nil, crdt.ErrNoMoreBroadcast
+		}
+		if heads := announcedHeads(msg.Data); heads != nil {
+			return heads, nil
+		}
+	}
+}
+
+func (l *listener) close() {
+	l.sub.Cancel()
+	if err := l.topic.Close(); err != nil {
+		logger.Debugf("leaving %s: %s", l.topic, err)
+	}
+}
+
+func (r *resolver) fetchSnapshot(ctx context.Context, ref reference) ([]byte, error) {
+	lc := &lightclient.Client{
+		MaxNodes: 100000,
+		Blocks: func(ctx context.Context, id cid.Cid) (blocks.Block, error) {
+			return r.dag.Get(ctx, id)
+		},
+	}
+	v, err := lc.Get(ctx, []cid.Cid{ref.Snapshot}, ref.Key.String())
+	if errors.Is(err, lightclient.ErrNotFound) {
+		return nil, ds.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta, payload := dkv.DecodeValue(v)
+	return r.base.pipelines.Decode(ref.Key, meta, payload)
+}
+
+// parseResolveArgs parses the arguments of
+//
+//	resolve <key>|<reference> [--timeout <duration>]
+func parseResolveArgs(args []string) (target string, timeout time.Duration, err error) {
+	timeout = time.Minute
+	if len(args) == 3 && args[1] == "--timeout" {
+		if timeout, err = time.ParseDuration(args[2]); err != nil {
+			return "", 0, err
+		}
+		args = args[:1]
+	}
+	if len(args) != 1 {
+		return "", 0, errors.New("usage: resolve <key>|<reference> [--timeout <duration>]")
+	}
+	return args[0], timeout, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// reloader re-reads the configuration that can change while the node
+// runs. Each part registers how to reload itself, along with the settings
+// of the config file it applies; changes to the other settings are
+// reported as needing a restart.
+type reloader struct {
+	// config is the config file, applied again before the parts reload.
+	config string
+
+	mu    sync.Mutex
+	names []string
+	fns   []func() error
+	live  map[string]bool
+}
+
+func (r *reloader) register(name string, fn func() error, settings ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names = append(r.names, name)
+	r.fns = append(r.fns, fn)
+	if r.live == nil {
+		r.live = make(map[string]bool)
+	}
+	for _, s := range settings {
+		r.live[s] = true
+	}
+}
+
+// reload runs every registered reload. A part that fails to reload keeps
+// its current configuration and does not stop the others.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var errs []error
+	if r.config != "" {
+		restart, err := reloadConfigFile(r.config, r.live)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("reloading %s: %w", r.config, err))
+		}
+		if len(restart) > 0 {
+			errs = append(errs, fmt.Errorf("%s: restart the node to apply %s", r.config, strings.Join(restart, ", ")))
+		}
+	}
+	for i, fn := range r.fns {
+		if err := fn(); err != nil {
+			errs = append(errs, fmt.Errorf("reloading %s: %w", r.names[i], err))
+		}
+	}
+	err := errors.Join(errs...)
+	if err != nil {
+		logger.Error(err)
+	} else {
+		logger.Infof("reloaded %d configuration sources", len(r.fns))
+	}
+	return err
+}
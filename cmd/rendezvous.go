@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	dualdht "github.com/libp2p/go-libp2p-kad-dht/dual"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	dutil "github.com/libp2p/go-libp2p/p2p/discovery/util"
+)
+
+const (
+	// rendezvousWait is how long a node joining through the DHT waits to
+	// reach it before asking for a bootstrap node.
+	rendezvousWait = 30 * time.Second
+	// rendezvousInterval is how often the DHT is searched for other nodes
+	// of the database.
+	rendezvousInterval = time.Minute
+)
+
+// rendezvousString is what the nodes of the database on a topic advertise
+// themselves under on the DHT.
+func rendezvousString(topic string) string {
+	return "globaldb/" + topic
+}
+
+// waitDHT waits up to timeout, as told by clock, for the routing table of
+// the DHT to hold a peer, and tells whether it did.
+func waitDHT(ctx context.Context, d *dualdht.DHT, timeout time.Duration, clock dkv.WallClock) bool {
+	deadline := clock.After(timeout)
+	for {
+		if d.WAN.RoutingTable().Size() > 0 || d.LAN.RoutingTable().Size() > 0 {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-deadline:
+			return false
+		case <-clock.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// startRendezvous advertises the node on the DHT under the rendezvous
+// string of the topic until the context is cancelled, and returns a
+// function connecting to the other nodes advertised there, so that
+// joining a database only takes knowing its topic. The rendezvous job
+// runs it every rendezvousInterval, to find nodes that joined later or
+// whose addresses changed.
+func startRendezvous(ctx context.Context, h host.Host, d *dualdht.DHT, topic string) func(context.Context) error {
+	ns := rendezvousString(topic)
+	rd := drouting.NewRoutingDiscovery(d)
+	dutil.Advertise(ctx, rd, ns)
+	logger.Infof("advertising on the DHT under %s", ns)
+
+	return func(ctx context.Context) error {
+		found, err := dutil.FindPeers(ctx, rd, ns)
+		if err != nil {
+			return fmt.Errorf("rendezvous %s: %w", ns, err)
+		}
+		var joined int
+		for _, p := range found {
+			if p.ID == h.ID() || len(p.Addrs) == 0 || h.Network().Connectedness(p.ID) == network.Connected {
+				continue
+			}
+			if err := h.Connect(ctx, p); err != nil {
+				logger.Debugf("rendezvous %s: connecting to %s: %s", ns, p.ID, err)
+				continue
+			}
+			h.ConnManager().TagPeer(p.ID, "keep", 100)
+			joined++
+		}
+		if joined > 0 {
+			logger.Infof("rendezvous %s: connected to %d new nodes", ns, joined)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	crdt "github.com/ipfs/go-ds-crdt"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// replayNs holds the state of the head guard: per topic, the counter of
+// the node and, under seen, one key per author. It is local to the node
+// and not replicated.
+var replayNs = ds.NewKey("/replay")
+
+// replayWindow is how old the announcements accepted may be. Counters
+// follow the clock of their author, so older ones are ignored as replays
+// and the authors not heard from within it are forgotten. Nodes whose
+// clock lags further behind are ignored too.
+const replayWindow = time.Hour
+
+// maxSeenAuthors bounds the authors the guard remembers per topic. Once
+// it is reached, the announcements of new authors are ignored until old
+// ones are forgotten.
+const maxSeenAuthors = 1 << 16
+
+// announcementMagic starts the signed head announcements, which tells
+// them apart from the bare CRDT broadcasts of nodes running without
+// -signed-heads.
+var announcementMagic = []byte("globaldb-heads/1\n")
+
+// headAnnouncement is a CRDT broadcast signed by its author, with a
+// counter the author raises on every announcement.
+type headAnnouncement struct {
+	Author  string `json:"author"`
+	Key     []byte `json:"key"`
+	Counter uint64 `json:"counter"`
+	// Heads is the CRDT broadcast, as go-ds-crdt encodes it.
+	Heads []byte `json:"heads"`
+	Sig   []byte `json:"sig"`
+}
+
+// signedBytes are the bytes signed in an announcement. The topic is part
+// of them, so that announcements cannot be replayed on another database.
+func (a *headAnnouncement) signedBytes(topic string) []byte {
+	var b bytes.Buffer
+	b.Write(announcementMagic)
+	b.WriteString(topic)
+	b.WriteByte('\n')
+	binary.Write(&b, binary.BigEndian, a.Counter)
+	b.Write(a.Heads)
+	return b.Bytes()
+}
+
+// announcedHeads returns the CRDT broadcast carried by a pubsub message,
+// signed or not.
+func announcedHeads(data []byte) []byte {
+	data = unstamped(data)
+	rest, ok := bytes.CutPrefix(data, announcementMagic)
+	if !ok {
+		return data
+	}
+	var a headAnnouncement
+	if err := json.Unmarshal(rest, &a); err != nil {
+		return nil
+	}
+	return a.Heads
+}
+
+// replayState is what the guard keeps about a topic.
+type replayState struct {
+	// Sent is the counter of the last announcement of the node.
+	Sent uint64 `json:"sent"`
+	// Seen is the counter of the last announcement accepted from each
+	// author. It is stored one key per author, and only read from the
+	// states saved before that.
+	Seen map[peer.ID]uint64 `json:"seen,omitempty"`
+}
+
+// headGuard signs the head announcements of the node and checks those of
+// its peers. Every announcement carries a counter its author raises each
+// time, so a peer replaying old announcements, which would make the other
+// nodes walk the DAG from old heads again, is ignored: announcements are
+// only accepted when newer than the last one accepted from their author.
+// The counters are kept in the datastore, so that this holds across
+// restarts.
+type headGuard struct {
+	priv   crypto.PrivKey
+	self   peer.ID
+	store  ds.Datastore
+	clock  dkv.WallClock
+	topics map[string]bool
+
+	mu    sync.Mutex
+	state map[string]*replayState
+	// saveMu keeps the writes of the counters of authors in order,
+	// without holding mu.
+	saveMu sync.Mutex
+}
+
+func newHeadGuard(ctx context.Context, store ds.Datastore, priv crypto.PrivKey, topics []string, clock dkv.WallClock) (*headGuard, error) {
+	self, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	g := &headGuard{priv: priv, self: self, store: store, clock: clock, topics: make(map[string]bool), state: make(map[string]*replayState)}
+	for _, t := range topics {
+		g.topics[t] = true
+		st, err := g.load(ctx, t)
+		if err != nil {
+			return nil, fmt.Errorf("replay state of %s: %w", t, err)
+		}
+		g.state[t] = st
+	}
+	return g, nil
+}
+
+// load reads the state of a topic, dropping the authors not heard from
+// within the replay window. The counters of authors saved in the state of
+// the topic itself are moved to their own keys.
+func (g *headGuard) load(ctx context.Context, topic string) (*replayState, error) {
+	st := &replayState{}
+	v, err := g.store.Get(ctx, g.key(topic))
+	switch {
+	case errors.Is(err, ds.ErrNotFound):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(v, st); err != nil {
+			return nil, err
+		}
+	}
+	legacy := st.Seen
+	st.Seen = make(map[peer.ID]uint64)
+	oldest := g.oldest()
+	for p, c := range legacy {
+		if c >= oldest {
+			st.Seen[p] = c
+			if err := g.store.Put(ctx, g.seenKey(topic, p), binary.BigEndian.AppendUint64(nil, c)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(legacy) > 0 {
+		if err := g.saveSent(ctx, topic, st.Sent); err != nil {
+			return nil, err
+		}
+	}
+	prefix := g.key(topic).ChildString("seen")
+	results, err := g.store.Query(ctx, query.Query{Prefix: prefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		k := ds.RawKey(r.Key)
+		p, err := peer.Decode(k.BaseNamespace())
+		if err != nil || len(r.Value) != 8 {
+			continue
+		}
+		if c := binary.BigEndian.Uint64(r.Value); c >= oldest && len(st.Seen) < maxSeenAuthors {
+			st.Seen[p] = max(st.Seen[p], c)
+			continue
+		}
+		if err := g.store.Delete(ctx, k); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+func (g *headGuard) key(topic string) ds.Key {
+	return replayNs.ChildString(hex.EncodeToString([]byte(topic)))
+}
+
+// seenKey holds the counter of the last announcement accepted from an
+// author.
+func (g *headGuard) seenKey(topic string, p peer.ID) ds.Key {
+	return g.key(topic).ChildString("seen").ChildString(p.String())
+}
+
+// oldest is the lowest counter within the replay window.
+func (g *headGuard) oldest() uint64 {
+	return uint64(max(g.clock.Now().Add(-replayWindow).UnixNano(), 0))
+}
+
+// saveSent writes the counter of the node for a topic.
+func (g *headGuard) saveSent(ctx context.Context, topic string, sent uint64) error {
+	v, err := json.Marshal(&replayState{Sent: sent})
+	if err != nil {
+		return err
+	}
+	return g.store.Put(ctx, g.key(topic), v)
+}
+
+// saveSeen writes the counter of an author, along with the removal of
+// the authors forgotten, outside of g.mu. The counter written is the
+// latest, read under saveMu, so that writes racing for an author cannot
+// leave an older one behind.
+func (g *headGuard) saveSeen(topic string, p peer.ID, forgotten []peer.ID) {
+	ctx := context.Background()
+	g.saveMu.Lock()
+	defer g.saveMu.Unlock()
+	for _, f := range forgotten {
+		if err := g.store.Delete(ctx, g.seenKey(topic, f)); err != nil {
+			logger.Warnf("saving the replay state of %s: %s", topic, err)
+		}
+	}
+	g.mu.Lock()
+	c, ok := g.state[topic].Seen[p]
+	g.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err := g.store.Put(ctx, g.seenKey(topic, p), binary.BigEndian.AppendUint64(nil, c)); err != nil {
+		logger.Warnf("saving the replay state of %s: %s", topic, err)
+	}
+}
+
+// forget drops the authors not heard from within the replay window from
+// the state of a topic, returning them. g.mu must be held.
+func (g *headGuard) forget(st *replayState) []peer.ID {
+	oldest := g.oldest()
+	var forgotten []peer.ID
+	for p, c := range st.Seen {
+		if c < oldest {
+			delete(st.Seen, p)
+			forgotten = append(forgotten, p)
+		}
+	}
+	return forgotten
+}
+
+// seal signs a CRDT broadcast for topic. Counters follow the clock, so
+// they keep growing when the state of the node is lost, and always grow
+// by at least one.
+func (g *headGuard) seal(topic string, heads []byte) ([]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st := g.state[topic]
+	st.Sent = max(st.Sent+1, uint64(g.clock.Now().UnixNano()))
+	if err := g.saveSent(context.Background(), topic, st.Sent); err != nil {
+		return nil, err
+	}
+	key, err := crypto.MarshalPublicKey(g.priv.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	a := &headAnnouncement{Author: g.self.String(), Key: key, Counter: st.Sent, Heads: heads}
+	if a.Sig, err = g.priv.Sign(a.signedBytes(topic)); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, announcementMagic...), data...), nil
+}
+
+// validate is the pubsub validator of a guarded topic. Unsigned and
+// forged announcements are rejected, which penalizes the peer that
+// relayed them. Replayed ones, and those older than the replay window,
+// are ignored: they are neither delivered nor forwarded, but an honest
+// peer relaying a late copy is not penalized.
+func (g *headGuard) validate(topic string, msg *pubsub.Message) pubsub.ValidationResult {
+	rest, ok := bytes.CutPrefix(unstamped(msg.Data), announcementMagic)
+	if !ok {
+		logger.Debugf("dropping heads on %s from %s: not signed", topic, msg.GetFrom())
+		broadcastsRejected.WithLabelValues("unsigned").Inc()
+		return pubsub.ValidationReject
+	}
+	var a headAnnouncement
+	if err := json.Unmarshal(rest, &a); err != nil {
+		broadcastsRejected.WithLabelValues("malformed").Inc()
+		return pubsub.ValidationReject
+	}
+	if err := a.verify(topic, msg.GetFrom()); err != nil {
+		logger.Debugf("dropping heads on %s from %s: %s", topic, msg.GetFrom(), err)
+		broadcastsRejected.WithLabelValues("signature").Inc()
+		return pubsub.ValidationReject
+	}
+	from := msg.GetFrom()
+	g.mu.Lock()
+	st := g.state[topic]
+	seen, known := st.Seen[from]
+	var forgotten []peer.ID
+	if !known && len(st.Seen) >= maxSeenAuthors {
+		forgotten = g.forget(st)
+	}
+	switch {
+	case a.Counter <= seen || a.Counter < g.oldest():
+		g.mu.Unlock()
+		logger.Debugf("dropping heads on %s from %s: counter %d already seen", topic, from, a.Counter)
+		broadcastsRejected.WithLabelValues("replay").Inc()
+		return pubsub.ValidationIgnore
+	case !known && len(st.Seen) >= maxSeenAuthors:
+		g.mu.Unlock()
+		logger.Debugf("dropping heads on %s from %s: too many authors", topic, from)
+		broadcastsRejected.WithLabelValues("authors").Inc()
+		return pubsub.ValidationIgnore
+	}
+	st.Seen[from] = a.Counter
+	g.mu.Unlock()
+	g.saveSeen(topic, from, forgotten)
+	return pubsub.ValidationAccept
+}
+
+// verify checks that an announcement was signed by the author of the
+// message carrying it.
+func (a *headAnnouncement) verify(topic string, from peer.ID) error {
+	pub, err := crypto.UnmarshalPublicKey(a.Key)
+	if err != nil {
+		return err
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	if id != from || a.Author != from.String() {
+		return fmt.Errorf("announcement of %s relayed as a message of %s", id, from)
+	}
+	ok, err := pub.Verify(a.signedBytes(topic), a.Sig)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+// wrap signs the broadcasts made through b on topic and unwraps the ones
+// it receives. It returns b itself when g is nil, which is when
+// -signed-heads is off.
+func (g *headGuard) wrap(topic string, b crdt.Broadcaster) crdt.Broadcaster {
+	if g == nil {
+		return b
+	}
+	return &signedBroadcaster{Broadcaster: b, guard: g, topic: topic}
+}
+
+// signedBroadcaster carries the broadcasts of a CRDT store in signed
+// announcements.
+type signedBroadcaster struct {
+	crdt.Broadcaster
+
+	guard *headGuard
+	topic string
+}
+
+func (b *signedBroadcaster) Broadcast(data []byte) error {
+	sealed, err := b.guard.seal(b.topic, data)
+	if err != nil {
+		return err
+	}
+	return b.Broadcaster.Broadcast(sealed)
+}
+
+// Next returns the CRDT broadcast of the next announcement. The pubsub
+// validator already checked it.
+func (b *signedBroadcaster) Next() ([]byte, error) {
+	for {
+		data, err := b.Broadcaster.Next()
+		if err != nil {
+			return nil, err
+		}
+		if heads := announcedHeads(data); heads != nil {
+			return heads, nil
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pubsubpb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func headsMessage(from peer.ID, data []byte) *pubsub.Message {
+	return &pubsub.Message{Message: &pubsubpb.Message{From: []byte(from), Data: data}}
+}
+
+func TestHeadGuardValidate(t *testing.T) {
+	ctx := context.Background()
+	authorKey, author := newTestPeer(t)
+	_, relay := newTestPeer(t)
+	selfKey, _ := newTestPeer(t)
+	heads := []byte("heads")
+
+	// forge replaces the heads of an announcement, keeping its signature.
+	forge := func(t *testing.T, data []byte) []byte {
+		var a headAnnouncement
+		if err := json.Unmarshal(bytes.TrimPrefix(data, announcementMagic), &a); err != nil {
+			t.Fatal(err)
+		}
+		a.Heads = []byte("other heads")
+		forged, err := json.Marshal(&a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(append([]byte{}, announcementMagic...), forged...)
+	}
+	tests := []struct {
+		name string
+		// announce returns the data to check, once first, an earlier
+		// announcement of the author, was accepted.
+		announce func(t *testing.T, g *headGuard, first []byte) []byte
+		from     peer.ID
+		// restart reloads the guard from its store before the check, and
+		// late has the clock move forward.
+		restart bool
+		late    time.Duration
+		want    pubsub.ValidationResult
+	}{
+		{"newer", func(t *testing.T, g *headGuard, _ []byte) []byte { return seal(t, g, "t", heads) }, author, false, 0, pubsub.ValidationAccept},
+		{"replayed", func(_ *testing.T, _ *headGuard, first []byte) []byte { return first }, author, false, 0, pubsub.ValidationIgnore},
+		{"replayed after a restart", func(_ *testing.T, _ *headGuard, first []byte) []byte { return first }, author, true, 0, pubsub.ValidationIgnore},
+		{"newer after a restart", func(t *testing.T, g *headGuard, _ []byte) []byte { return seal(t, g, "t", heads) }, author, true, 0, pubsub.ValidationAccept},
+		{"older than the window", func(t *testing.T, g *headGuard, _ []byte) []byte { return seal(t, g, "t", heads) }, author, false, replayWindow + time.Second, pubsub.ValidationIgnore},
+		{"unsigned", func(*testing.T, *headGuard, []byte) []byte { return heads }, author, false, 0, pubsub.ValidationReject},
+		{"forged", func(t *testing.T, g *headGuard, _ []byte) []byte { return forge(t, seal(t, g, "t", heads)) }, author, false, 0, pubsub.ValidationReject},
+		{"relayed as another peer's", func(t *testing.T, g *headGuard, _ []byte) []byte { return seal(t, g, "t", heads) }, relay, false, 0, pubsub.ValidationReject},
+		{"other topic", func(t *testing.T, g *headGuard, _ []byte) []byte { return seal(t, g, "u", heads) }, author, false, 0, pubsub.ValidationReject},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := dkv.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			sender, err := newHeadGuard(ctx, dssync.MutexWrap(ds.NewMapDatastore()), authorKey, []string{"t", "u"}, clock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := dssync.MutexWrap(ds.NewMapDatastore())
+			g, err := newHeadGuard(ctx, store, selfKey, []string{"t"}, clock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			first := seal(t, sender, "t", heads)
+			if got := g.validate("t", headsMessage(author, first)); got != pubsub.ValidationAccept {
+				t.Fatalf("first announcement: %v", got)
+			}
+
+			data := tt.announce(t, sender, first)
+			clock.Advance(tt.late)
+			if tt.restart {
+				if g, err = newHeadGuard(ctx, store, selfKey, []string{"t"}, clock); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := g.validate("t", headsMessage(tt.from, data)); got != tt.want {
+				t.Errorf("validate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// seal signs heads for topic with g.
+func seal(t *testing.T, g *headGuard, topic string, heads []byte) []byte {
+	t.Helper()
+	data, err := g.seal(topic, heads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestAnnouncedHeads(t *testing.T) {
+	priv, _ := newTestPeer(t)
+	g, err := newHeadGuard(context.Background(), dssync.MutexWrap(ds.NewMapDatastore()), priv, []string{"t"}, dkv.SystemClock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := seal(t, g, "t", []byte("heads"))
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{"signed", sealed, []byte("heads")},
+		{"bare", []byte("heads"), []byte("heads")},
+		{"malformed", append(append([]byte{}, announcementMagic...), '{'), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := announcedHeads(tt.data); !bytes.Equal(got, tt.want) {
+				t.Errorf("announcedHeads = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	badger "github.com/ipfs/go-ds-badger2"
+)
+
+// Keys where a replica keeps its position in the change feed.
+var (
+	replicaEpochKey = ds.NewKey("/_replica/epoch")
+	replicaSeqKey   = ds.NewKey("/_replica/seq")
+	replicaKVNs     = ds.NewKey("/kv")
+)
+
+// replicaConfig holds the options of the replica subcommand.
+type replicaConfig struct {
+	From  string
+	Data  string
+	Wait  time.Duration
+	Token string
+	// Consumer is the name the replica is tracked under by the gateway.
+	Consumer string
+}
+
+// replicaFlags returns the flags of replica, which fill cfg.
+func replicaFlags(cfg *replicaConfig) *flag.FlagSet {
+	fs := flag.NewFlagSet("replica", flag.ContinueOnError)
+	fs.StringVar(&cfg.From, "from", "", "base URL of the gateway change feed, e.g. http://gateway:8081")
+	fs.StringVar(&cfg.Data, "data", "", "folder holding the replica datastore, <data-dir>/replica when unset")
+	fs.DurationVar(&cfg.Wait, "wait", 30*time.Second, "how long each change feed request waits for new changes")
+	fs.StringVar(&cfg.Token, "token", "", "API token sent to the gateway")
+	host, _ := os.Hostname()
+	fs.StringVar(&cfg.Consumer, "consumer", "replica@"+host, "name the gateway tracks the position of the replica under")
+	return fs
+}
+
+// check validates the options once the flags are parsed.
+func (cfg *replicaConfig) check() error {
+	if cfg.From == "" {
+		return errors.New("replica needs -from")
+	}
+	return nil
+}
+
+// httpReplica is a read-only copy of the database that follows a
+// gateway's change feed over HTTP instead of joining the libp2p network.
+type httpReplica struct {
+	cfg    replicaConfig
+	client *http.Client
+	store  ds.Datastore
+	kv     ds.Datastore
+	clock  dkv.WallClock
+}
+
+// sync follows the change feed until the context is cancelled.
+func (r *httpReplica) sync(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := r.pull(ctx); err != nil {
+			logger.Warnf("pulling changes: %s", err)
+			select {
+			case <-ctx.Done():
+			case <-r.clock.After(5 * time.Second):
+			}
+		}
+	}
+}
+
+// pull requests and applies one batch of changes.
+func (r *httpReplica) pull(ctx context.Context) error {
+	epoch, _ := r.store.Get(ctx, replicaEpochKey)
+	var seq uint64
+	if v, err := r.store.Get(ctx, replicaSeqKey); err == nil {
+		seq, _ = strconv.ParseUint(string(v), 10, 64)
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(r.cfg.From, "/") + "/changes")
+	if err != nil {
+		return err
+	}
+	q := url.Values{}
+	q.Set("epoch", string(epoch))
+	q.Set("since", strconv.FormatUint(seq, 10))
+	q.Set("wait", r.cfg.Wait.String())
+	if r.cfg.Consumer != "" {
+		q.Set("consumer", r.cfg.Consumer)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if r.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.cfg.Token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("change feed returned %s", resp.Status)
+	}
+	var changes changesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&changes); err != nil {
+		return err
+	}
+	return r.apply(ctx, changes)
+}
+
+// apply writes a batch of changes and the new feed position.
+func (r *httpReplica) apply(ctx context.Context, changes changesResponse) error {
+	if changes.Compacted {
+		logger.Warnf("fell behind what the change feed of %s retains, reloading everything", r.cfg.From)
+	}
+	if changes.Reset {
+		logger.Infof("change feed reset, loading snapshot of %d keys", len(changes.Changes))
+		results, err := r.kv.Query(ctx, query.Query{KeysOnly: true})
+		if err != nil {
+			return err
+		}
+		entries, err := results.Rest()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := r.kv.Delete(ctx, ds.NewKey(e.Key)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, c := range changes.Changes {
+		var err error
+		switch c.Op {
+		case "put":
+			err = r.kv.Put(ctx, ds.NewKey(c.Key), c.Value)
+		case "delete":
+			err = r.kv.Delete(ctx, ds.NewKey(c.Key))
+		default:
+			logger.Warnf("ignoring unknown change operation %q", c.Op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := r.store.Put(ctx, replicaEpochKey, []byte(changes.Epoch)); err != nil {
+		return err
+	}
+	return r.store.Put(ctx, replicaSeqKey, []byte(strconv.FormatUint(changes.Seq, 10)))
+}
+
+// runReplica opens the replica datastore, follows the change feed in the
+// background, retrying by clock, and serves a read-only REPL.
+func runReplica(ctx context.Context, cfg replicaConfig, clock dkv.WallClock) error {
+	if err := os.MkdirAll(cfg.Data, 0755); err != nil {
+		return err
+	}
+	store, err := badger.NewDatastore(cfg.Data, &badger.DefaultOptions)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	r := &httpReplica{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Wait + 30*time.Second},
+		store:  store,
+		kv:     namespace.Wrap(store, replicaKVNs),
+		clock:  clock,
+	}
+	go r.sync(ctx)
+
+	fmt.Printf(`
+Following: %s
+Data Folder: %s
+Ready!
+
+Commands:
+
+> list               -> list items in the replica
+> get <key>          -> get value for a key
+> exit               -> quit
+
+
+`, cfg.From, cfg.Data)
+
+	fmt.Printf("> ")
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			fmt.Printf("> ")
+			continue
+		}
+		switch fields[0] {
+		case "exit", "quit":
+			return nil
+		case "list":
+			results, err := r.kv.Query(ctx, query.Query{})
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			for e := range results.Next() {
+				if e.Error != nil {
+					printErr(e.Error)
+					continue
+				}
+				fmt.Printf("[%s] -> %s\n", e.Key, string(e.Value))
+			}
+		case "get":
+			if len(fields) < 2 {
+				fmt.Println("get <key>")
+				fmt.Println("> ")
+				continue
+			}
+			k := ds.NewKey(fields[1])
+			v, err := r.kv.Get(ctx, k)
+			if err != nil {
+				printErr(err)
+				continue
+			}
+			fmt.Printf("[%s] -> %s\n", k, string(v))
+		}
+		fmt.Printf("> ")
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+)
+
+// The maintenance jobs of the scheduler, which -job configures.
+const (
+	jobProbe        = "probe"
+	jobTSCompaction = "ts-compaction"
+	jobTiering      = "tiering"
+	jobSQLiteExport = "sqlite-export"
+	jobGC           = "gc"
+	jobBackup       = "backup"
+	jobUsageFlush   = "usage-flush"
+	jobHeartbeat    = "heartbeat"
+	jobAlerts       = "alerts"
+	jobAdvertise    = "advertise"
+	jobRegistry     = "registry"
+	jobProximity    = "proximity"
+	jobRendezvous   = "rendezvous"
+)
+
+var jobNames = []string{jobAdvertise, jobAlerts, jobBackup, jobGC, jobHeartbeat, jobProbe, jobProximity, jobRegistry, jobRendezvous, jobSQLiteExport, jobTiering, jobTSCompaction, jobUsageFlush}
+
+// schedule tells when a job runs next.
+type schedule interface {
+	next(after time.Time) time.Time
+}
+
+// every runs a job at a fixed interval.
+type every time.Duration
+
+func (e every) next(after time.Time) time.Time {
+	return after.Add(time.Duration(e))
+}
+
+// cronSchedule runs a job at the minutes matching a crontab line, in local
+// time. Each field is a bit set of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// As in cron, when both the day of the month and the day of the week
+	// are restricted, a day matching either of them is enough.
+	anyDOM, anyDOW bool
+}
+
+// cronFields are the bounds of the fields of a crontab line.
+var cronFields = [5]struct{ min, max int }{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// cronAliases are the shorthands of cron.
+var cronAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// parseSchedule reads a schedule: a duration, optionally after @every,
+// a crontab line of minute, hour, day of month, month and day of week, or
+// @hourly, @daily, @weekly or @monthly. It returns nil for off.
+func parseSchedule(s string) (schedule, error) {
+	s = strings.TrimSpace(s)
+	if s == "off" {
+		return nil, nil
+	}
+	if d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(s, "@every"))); err == nil {
+		if d <= 0 {
+			return nil, fmt.Errorf("schedule %q: the interval must be positive", s)
+		}
+		return every(d), nil
+	}
+	if line, ok := cronAliases[s]; ok {
+		s = line
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: expected a duration, @every <duration>, @hourly, @daily, @weekly, @monthly, a crontab line or off", s)
+	}
+	var sets [5]uint64
+	for i, f := range fields {
+		set, err := parseCronField(f, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", s, err)
+		}
+		sets[i] = set
+	}
+	// Sunday is both 0 and 7.
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &cronSchedule{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		anyDOM: fields[2] == "*", anyDOW: fields[4] == "*",
+	}, nil
+}
+
+// parseCronField reads a comma-separated list of *, values and ranges,
+// each optionally followed by /step.
+func parseCronField(f string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(f, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("invalid range in %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.anyDOM && c.anyDOW:
+		return true
+	case c.anyDOM:
+		return dow
+	case c.anyDOW:
+		return dom
+	}
+	return dom || dow
+}
+
+func (c *cronSchedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	// Schedules that match a day at all do so within four years, for the
+	// 29th of February.
+	for end := t.AddDate(4, 0, 1); t.Before(end); {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// everySpec is the schedule of a job run every d, off when d is not
+// positive.
+func everySpec(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return "@every " + d.String()
+}
+
+// job is a task the scheduler runs.
+type job struct {
+	name string
+	spec string
+	sch  schedule
+	// atStart runs the job as soon as the scheduler starts, rather than
+	// waiting for its first scheduled time.
+	atStart bool
+	fn      func(ctx context.Context) error
+	clock   dkv.WallClock
+
+	// running keeps a job from overlapping with itself.
+	running sync.Mutex
+
+	mu     sync.Mutex
+	status jobStatus
+}
+
+// jobStatus is the last run of a job, as GET /v1/status and the jobs
+// command report it.
+type jobStatus struct {
+	Name     string     `json:"name"`
+	Schedule string     `json:"schedule"`
+	LastRun  *time.Time `json:"last_run,omitempty"`
+	Duration string     `json:"duration,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Runs     int        `json:"runs"`
+	Failures int        `json:"failures"`
+	Next     *time.Time `json:"next,omitempty"`
+}
+
+// scheduler runs the maintenance jobs of the node. Every job has a
+// default schedule, possibly off, which -job name=schedule overrides.
+type scheduler struct {
+	specs map[string]string
+	clock dkv.WallClock
+
+	mu   sync.Mutex
+	jobs []*job
+	// ctx is the context of the running scheduler, nil before run.
+	ctx context.Context
+}
+
+// newScheduler checks the schedules given with -job. Jobs run by clock.
+func newScheduler(specs map[string]string, clock dkv.WallClock) (*scheduler, error) {
+	for name, spec := range specs {
+		i := sort.SearchStrings(jobNames, name)
+		if i == len(jobNames) || jobNames[i] != name {
+			return nil, fmt.Errorf("-job: unknown job %q, use %s", name, strings.Join(jobNames, ", "))
+		}
+		if _, err := parseSchedule(spec); err != nil {
+			return nil, fmt.Errorf("-job %s: %w", name, err)
+		}
+	}
+	return &scheduler{specs: specs, clock: clock}, nil
+}
+
+// add registers a job with its default schedule, an empty one being off.
+// Jobs added once the scheduler runs start right away.
+func (s *scheduler) add(name, spec string, atStart bool, fn func(ctx context.Context) error) {
+	if override, ok := s.specs[name]; ok {
+		spec = override
+	}
+	if spec == "" {
+		return
+	}
+	// The schedules given with -job were checked by newScheduler, and the
+	// defaults are written by us.
+	sch, err := parseSchedule(spec)
+	if err != nil {
+		logger.Errorf("job %s: %s", name, err)
+		return
+	}
+	if sch == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := &job{name: name, spec: spec, sch: sch, atStart: atStart, fn: fn, clock: s.clock, status: jobStatus{Name: name, Schedule: spec}}
+	s.jobs = append(s.jobs, j)
+	sort.Slice(s.jobs, func(i, j int) bool { return s.jobs[i].name < s.jobs[j].name })
+	if s.ctx != nil {
+		go j.loop(s.ctx)
+	}
+}
+
+// run starts the jobs, and those added later as they are. They stop with
+// ctx.
+func (s *scheduler) run(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx = ctx
+	for _, j := range s.jobs {
+		go j.loop(ctx)
+	}
+}
+
+// warnUnused warns about the schedules given with -job to jobs the node
+// does not have. It is called once every job was added.
+func (s *scheduler) warnUnused() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	added := make(map[string]bool)
+	for _, j := range s.jobs {
+		added[j.name] = true
+	}
+	for name, spec := range s.specs {
+		if !added[name] && spec != "off" {
+			logger.Warnf("-job %s: the job does not exist on this node, see the flags it needs", name)
+		}
+	}
+}
+
+func (j *job) loop(ctx context.Context) {
+	next := j.clock.Now()
+	if !j.atStart {
+		next = j.sch.next(next)
+	}
+	for {
+		if next.IsZero() {
+			logger.Warnf("job %s: its schedule never comes", j.name)
+			return
+		}
+		j.mu.Lock()
+		j.status.Next = &next
+		j.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-j.clock.After(next.Sub(j.clock.Now())):
+		}
+		j.run(ctx)
+		next = j.sch.next(j.clock.Now())
+	}
+}
+
+// errJobRunning is returned when a job is asked to run while it runs.
+var errJobRunning = errors.New("already running")
+
+// run runs the job once and records how it went.
+func (j *job) run(ctx context.Context) error {
+	if !j.running.TryLock() {
+		return errJobRunning
+	}
+	defer j.running.Unlock()
+	start := j.clock.Now()
+	err := j.fn(ctx)
+	took := j.clock.Now().Sub(start)
+	if err != nil && ctx.Err() == nil {
+		logger.Warnf("job %s: %s", j.name, err)
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	jobRuns.WithLabelValues(j.name, result).Inc()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.LastRun = &start
+	j.status.Duration = took.Round(time.Millisecond).String()
+	j.status.Runs++
+	j.status.Error = ""
+	if err != nil {
+		j.status.Failures++
+		j.status.Error = err.Error()
+	}
+	return err
+}
+
+// runNow runs a job out of its schedule and waits for it.
+func (s *scheduler) runNow(ctx context.Context, name string) error {
+	s.mu.Lock()
+	var found *job
+	for _, j := range s.jobs {
+		if j.name == name {
+			found = j
+		}
+	}
+	s.mu.Unlock()
+	if found == nil {
+		return fmt.Errorf("no job %q is scheduled", name)
+	}
+	return found.run(ctx)
+}
+
+// status returns the last runs of the jobs by name.
+func (s *scheduler) status() []jobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]jobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		j.mu.Lock()
+		list = append(list, j.status)
+		j.mu.Unlock()
+	}
+	return list
+}
+
+// formatJobStatus renders a job for the jobs command.
+func formatJobStatus(st jobStatus) string {
+	last := "never run"
+	if st.LastRun != nil {
+		last = fmt.Sprintf("last %s (%s)", st.LastRun.Format(time.Stamp), st.Duration)
+		if st.Error != "" {
+			last += ": " + st.Error
+		}
+	}
+	next := ""
+	if st.Next != nil {
+		next = ", next " + st.Next.Format(time.Stamp)
+	}
+	return fmt.Sprintf("%-14s %-16s %d runs, %d failed, %s%s", st.Name, st.Schedule, st.Runs, st.Failures, last, next)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+)
+
+// waitWaiters waits for the jobs of the scheduler to wait on the clock.
+func waitWaiters(t *testing.T, clock *dkv.ManualClock, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for clock.Waiters() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d jobs waiting, want %d", clock.Waiters(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerRunsJobs(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   map[string]string
+		spec    string
+		atStart bool
+		// before runs the scheduler before adding the job.
+		before bool
+		// steps are how far the clock is moved, one after the other.
+		steps []time.Duration
+		runs  int
+	}{
+		{"every", nil, "@every 1m", false, false, []time.Duration{time.Minute, time.Minute}, 2},
+		{"not due", nil, "@every 1m", false, false, []time.Duration{59 * time.Second}, 0},
+		{"at start", nil, "@every 1m", true, false, []time.Duration{time.Minute}, 2},
+		{"added while running", nil, "@every 1m", false, true, []time.Duration{time.Minute}, 1},
+		{"overridden", map[string]string{jobProbe: "30s"}, "@every 1m", false, false, []time.Duration{30 * time.Second, 30 * time.Second}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := dkv.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			s, err := newScheduler(tt.specs, clock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ran := make(chan struct{}, 10)
+			fn := func(context.Context) error {
+				ran <- struct{}{}
+				return nil
+			}
+			if tt.before {
+				s.run(ctx)
+				s.add(jobProbe, tt.spec, tt.atStart, fn)
+			} else {
+				s.add(jobProbe, tt.spec, tt.atStart, fn)
+				s.run(ctx)
+			}
+			for _, step := range tt.steps {
+				waitWaiters(t, clock, 1)
+				clock.Advance(step)
+			}
+			waitWaiters(t, clock, 1)
+			if len(ran) != tt.runs {
+				t.Errorf("%d runs, want %d", len(ran), tt.runs)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// schemasNs holds one schema per namespace. Like frozen namespaces they
+// are replicated, so every writer validates values against the same
+// schemas and every reader decodes them the same way.
+var schemasNs = systemNs.ChildString("schemas")
+
+// ErrSchema is returned by writes of values that do not match the schema
+// of their namespace.
+var ErrSchema = errors.New("value does not match the schema")
+
+// schemaRecord is what is stored under schemasNs.
+type schemaRecord struct {
+	// Type is "json-schema" or "protobuf".
+	Type string `json:"type"`
+	// Schema is the JSON Schema document.
+	Schema json.RawMessage `json:"schema,omitempty"`
+	// Descriptor is a protobuf FileDescriptorSet and Message the full
+	// name of the message the values hold.
+	Descriptor []byte `json:"descriptor,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+// compiledSchema is a schema ready to check and decode values.
+type compiledSchema struct {
+	validate func(v []byte) error
+	codec    codec
+}
+
+func compileSchema(r schemaRecord) (*compiledSchema, error) {
+	switch r.Type {
+	case "json-schema":
+		sch, err := jsonschema.CompileString("schema.json", string(r.Schema))
+		if err != nil {
+			return nil, err
+		}
+		return &compiledSchema{
+			validate: func(v []byte) error {
+				dec := json.NewDecoder(bytes.NewReader(v))
+				dec.UseNumber()
+				var doc interface{}
+				if err := dec.Decode(&doc); err != nil {
+					return err
+				}
+				return sch.Validate(doc)
+			},
+			codec: jsonCodec{},
+		}, nil
+	case "protobuf":
+		c, err := protoCodecFromSet(r.Descriptor, r.Message)
+		if err != nil {
+			return nil, err
+		}
+		return &compiledSchema{
+			validate: func(v []byte) error {
+				_, err := c.decode(v)
+				return err
+			},
+			codec: c,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown schema type %q", r.Type)
+	}
+}
+
+// readSchema builds a schema record from a file: a JSON Schema document,
+// or "protobuf:<descriptor set file>:<message name>".
+func readSchema(spec string) (schemaRecord, error) {
+	if rest, ok := strings.CutPrefix(spec, "protobuf:"); ok {
+		file, msg, ok := strings.Cut(rest, ":")
+		if !ok || file == "" || msg == "" {
+			return schemaRecord{}, fmt.Errorf("%q is not of the form protobuf:<descriptor set file>:<message name>", spec)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return schemaRecord{}, err
+		}
+		return schemaRecord{Type: "protobuf", Descriptor: data, Message: msg}, nil
+	}
+	data, err := os.ReadFile(spec)
+	if err != nil {
+		return schemaRecord{}, err
+	}
+	if !json.Valid(data) {
+		return schemaRecord{}, fmt.Errorf("%s is not JSON", spec)
+	}
+	return schemaRecord{Type: "json-schema", Schema: data}, nil
+}
+
+// schemaCache keeps compiled schemas by their stored record so that they
+// are only compiled again when they change.
+type schemaCache struct {
+	mu       sync.Mutex
+	compiled map[string]*compiledSchema
+}
+
+func (c *schemaCache) get(raw []byte) (*compiledSchema, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.compiled[string(raw)]; ok {
+		return s, nil
+	}
+	var r schemaRecord
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return nil, err
+	}
+	s, err := compileSchema(r)
+	if err != nil {
+		return nil, err
+	}
+	if c.compiled == nil {
+		c.compiled = make(map[string]*compiledSchema)
+	}
+	c.compiled[string(raw)] = s
+	return s, nil
+}
+
+// schemaFor returns the schema of the closest namespace of k that has one,
+// along with that namespace, or nil.
+func (d *db) schemaFor(ctx context.Context, k ds.Key) (*compiledSchema, ds.Key, error) {
+	if k.Equal(systemNs) || systemNs.IsAncestorOf(k) {
+		return nil, ds.Key{}, nil
+	}
+	for ns := k; ns.String() != "/"; ns = ns.Parent() {
+		v, err := d.crdt.Get(ctx, schemasNs.Child(ns))
+		if errors.Is(err, ds.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, ds.Key{}, err
+		}
+		raw, _, err := d.decode(schemasNs.Child(ns), v)
+		if err != nil {
+			return nil, ds.Key{}, err
+		}
+		s, err := d.schemas.get(raw)
+		if err != nil {
+			return nil, ds.Key{}, fmt.Errorf("schema of %s: %w", ns, err)
+		}
+		return s, ns, nil
+	}
+	return nil, ds.Key{}, nil
+}
+
+// checkSchema returns ErrSchema when v does not match the schema of the
+// namespace of k.
+func (d *db) checkSchema(ctx context.Context, k ds.Key, v []byte) error {
+	s, ns, err := d.schemaFor(ctx, k)
+	if err != nil || s == nil {
+		return err
+	}
+	if err := s.validate(v); err != nil {
+		return fmt.Errorf("%w of %s: %s", ErrSchema, ns, err)
+	}
+	return nil
+}
+
+// schemaCodec is a codecs fallback decoding values with the schema of
+// their namespace.
+func (d *db) schemaCodec(ctx context.Context, k ds.Key) codec {
+	s, _, err := d.schemaFor(ctx, k)
+	if err != nil || s == nil {
+		return nil
+	}
+	return s.codec
+}
+
+// PutSchema publishes the schema of a namespace. Values already stored
+// are not checked again.
+func (d *db) PutSchema(ctx context.Context, ns ds.Key, r schemaRecord) error {
+	if _, err := compileSchema(r); err != nil {
+		return err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return d.Put(ctx, schemasNs.Child(ns), data)
+}
+
+// DeleteSchema removes the schema of a namespace.
+func (d *db) DeleteSchema(ctx context.Context, ns ds.Key) error {
+	return d.Delete(ctx, schemasNs.Child(ns))
+}
+
+// Schemas lists the namespaces that have a schema along with its type.
+func (d *db) Schemas(ctx context.Context) (map[ds.Key]string, error) {
+	results, err := d.Query(ctx, query.Query{Prefix: schemasNs.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	schemas := make(map[ds.Key]string)
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		var rec schemaRecord
+		if err := json.Unmarshal(r.Value, &rec); err != nil {
+			return nil, err
+		}
+		ns := ds.NewKey(strings.TrimPrefix(r.Key, schemasNs.String()))
+		schemas[ns] = rec.Type
+		if rec.Message != "" {
+			schemas[ns] += " " + rec.Message
+		}
+	}
+	return schemas, nil
+}
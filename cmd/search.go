@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// searchIndex is a full-text index over the values under some prefixes.
+// It lives in memory: it is built from the store on startup and kept
+// current by the put and delete hooks. It picks the keys to index and
+// the text to index them by, and leaves the indexing to a textIndex.
+type searchIndex struct {
+	prefixes []ds.Key
+	codecs   *codecs
+	text     textIndex
+}
+
+// textIndex is the engine of a searchIndex. Its methods are called
+// concurrently.
+//
+// Search was meant to use Bleve, which cannot be fetched for this build,
+// so the only engine is invertedIndex. A Bleve engine only needs to
+// implement these three methods, with bleve.NewMemOnly, Index, Delete and
+// a query string query, and be set by newSearchIndex.
+type textIndex interface {
+	// update indexes the text of a key, replacing what it held before.
+	update(k ds.Key, text string)
+	// remove drops a key from the index.
+	remove(k ds.Key)
+	// search returns up to limit keys matching the query, best matches
+	// first, or all of them when limit is 0.
+	search(q string, limit int) []searchHit
+}
+
+// searchHit is a key matching a query.
+type searchHit struct {
+	Key   string  `json:"key"`
+	Score float64 `json:"score"`
+}
+
+func newSearchIndex(prefixes []string, cs *codecs) *searchIndex {
+	idx := &searchIndex{
+		codecs: cs,
+		text:   newInvertedIndex(),
+	}
+	for _, p := range prefixes {
+		idx.prefixes = append(idx.prefixes, ds.NewKey(p))
+	}
+	return idx
+}
+
+// matches returns true when the key falls under an indexed prefix.
+func (idx *searchIndex) matches(k ds.Key) bool {
+	for _, p := range idx.prefixes {
+		if p.Equal(k) || p.IsAncestorOf(k) || p.String() == "/" {
+			return true
+		}
+	}
+	return false
+}
+
+// build indexes the keys already stored under the indexed prefixes.
+func (idx *searchIndex) build(ctx context.Context, kv *db) error {
+	for _, p := range idx.prefixes {
+		results, err := kv.Query(ctx, query.Query{Prefix: p.String()})
+		if err != nil {
+			return err
+		}
+		for r := range results.Next() {
+			if r.Error != nil {
+				results.Close()
+				return r.Error
+			}
+			idx.update(ctx, ds.NewKey(r.Key), r.Value)
+		}
+		results.Close()
+	}
+	return nil
+}
+
+// update indexes the new value of a key. Values with a codec are indexed
+// in their decoded form.
+func (idx *searchIndex) update(ctx context.Context, k ds.Key, v []byte) {
+	if !idx.matches(k) {
+		return
+	}
+	text := string(v)
+	if out, ok, err := idx.codecs.decode(ctx, k, v); ok && err == nil {
+		if data, err := json.Marshal(out); err == nil {
+			text = string(data)
+		}
+	}
+	idx.text.update(k, text)
+}
+
+// remove drops a deleted key from the index.
+func (idx *searchIndex) remove(k ds.Key) {
+	idx.text.remove(k)
+}
+
+// search returns the keys whose value matches the query, best matches
+// first.
+func (idx *searchIndex) search(q string, limit int) []searchHit {
+	return idx.text.search(q, limit)
+}
+
+// invertedIndex is a plain inverted index standing in for Bleve. It is
+// narrower than Bleve in these ways:
+//   - words are only lowercased, with no stemming, stop words or
+//     language analysis, so "runs" does not match "run";
+//   - queries are words, word* prefixes and -word exclusions, with no
+//     phrases, fields, fuzzy matches or boolean operators;
+//   - hits are ranked by a bare TF-IDF sum, without the length
+//     normalization of BM25, so long values rank high;
+//   - the index is not persisted and is rebuilt on every start, in time
+//     and memory proportional to the indexed values.
+type invertedIndex struct {
+	mu sync.RWMutex
+	// terms are the term counts of every indexed key, and postings the
+	// keys holding every term along with the count.
+	terms    map[ds.Key]map[string]int
+	postings map[string]map[ds.Key]int
+}
+
+func newInvertedIndex() *invertedIndex {
+	return &invertedIndex{
+		terms:    make(map[ds.Key]map[string]int),
+		postings: make(map[string]map[ds.Key]int),
+	}
+}
+
+// tokenize splits text into lowercase words.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func (ii *invertedIndex) update(k ds.Key, text string) {
+	counts := make(map[string]int)
+	for _, t := range tokenize(text) {
+		counts[t]++
+	}
+
+	ii.mu.Lock()
+	defer ii.mu.Unlock()
+	ii.removeLocked(k)
+	ii.terms[k] = counts
+	for t, n := range counts {
+		if ii.postings[t] == nil {
+			ii.postings[t] = make(map[ds.Key]int)
+		}
+		ii.postings[t][k] = n
+	}
+}
+
+func (ii *invertedIndex) remove(k ds.Key) {
+	ii.mu.Lock()
+	defer ii.mu.Unlock()
+	ii.removeLocked(k)
+}
+
+func (ii *invertedIndex) removeLocked(k ds.Key) {
+	for t := range ii.terms[k] {
+		delete(ii.postings[t], k)
+		if len(ii.postings[t]) == 0 {
+			delete(ii.postings, t)
+		}
+	}
+	delete(ii.terms, k)
+}
+
+// search returns the keys whose text holds every word of the query. A
+// word ending in * matches any word starting with it and a word starting
+// with - excludes the keys holding it.
+func (ii *invertedIndex) search(q string, limit int) []searchHit {
+	ii.mu.RLock()
+	defer ii.mu.RUnlock()
+
+	var (
+		scores   map[ds.Key]float64
+		excluded = make(map[ds.Key]bool)
+		n        = float64(len(ii.terms))
+	)
+	for _, word := range strings.Fields(q) {
+		exclude := strings.HasPrefix(word, "-")
+		prefix := strings.HasSuffix(word, "*")
+		terms := tokenize(word)
+		if len(terms) == 0 {
+			continue
+		}
+		// Words the tokenizer splits, like e-mail addresses, must match
+		// every part.
+		for i, term := range terms {
+			matched := make(map[ds.Key]float64)
+			for t, keys := range ii.postings {
+				if t != term && !(prefix && i == len(terms)-1 && strings.HasPrefix(t, term)) {
+					continue
+				}
+				idf := math.Log(1 + n/float64(len(keys)))
+				for k, tf := range keys {
+					matched[k] += float64(tf) * idf
+				}
+			}
+			if exclude {
+				for k := range matched {
+					excluded[k] = true
+				}
+				continue
+			}
+			if scores == nil {
+				scores = matched
+				continue
+			}
+			for k := range scores {
+				if s, ok := matched[k]; ok {
+					scores[k] += s
+				} else {
+					delete(scores, k)
+				}
+			}
+		}
+	}
+
+	hits := make([]searchHit, 0, len(scores))
+	for k, s := range scores {
+		if !excluded[k] {
+			hits = append(hits, searchHit{Key: k.String(), Score: s})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Key < hits[j].Key
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
+}
+
+// handler serves GET /v1/search?q=<query>&limit=<n>. Clients only see
+// the keys their token may read.
+func (idx *searchIndex) handler(auth *authorizer) http.Handler {
+	return instrument("search", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token, err := auth.authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if len(idx.prefixes) == 0 {
+			http.Error(w, "search is not enabled, start the node with -search-prefix", http.StatusNotFound)
+			return
+		}
+		q := r.URL.Query()
+		limit, err := strconv.Atoi(q.Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 20
+		}
+		hits := make([]searchHit, 0, limit)
+		for _, h := range idx.search(q.Get("q"), 0) {
+			if len(hits) == limit {
+				break
+			}
+			if permitted(token, verbRead, ds.NewKey(h.Key)) {
+				hits = append(hits, h)
+			}
+		}
+		writeJSON(w, map[string]interface{}{"hits": hits})
+	}))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	ipfslite "github.com/hsanjuan/ipfs-lite"
+	"github.com/ipfs/boxo/bitswap"
+	bsnet "github.com/ipfs/boxo/bitswap/network"
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	dshelp "github.com/ipfs/boxo/datastore/dshelp"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/provider"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+// Serving policies, as given with -serve.
+const (
+	// serveAll serves every block of the blockstore, as IPFS nodes do.
+	serveAll = "all"
+	// serveDAG only serves the blocks of the CRDT DAG, not the files
+	// added with addfile nor any other block the node fetched.
+	serveDAG = "dag"
+	// serveNone serves nothing: the node only takes from the network.
+	serveNone = "none"
+)
+
+// crdtProcessedNs is where go-ds-crdt marks the DAG blocks it processed,
+// as crdtProcessedNs/<multihash>, under the namespace the CRDT store is
+// given.
+var crdtProcessedNs = ds.NewKey("/crdt/b")
+
+// servingPolicy decides which blocks are served to which peers over
+// bitswap.
+type servingPolicy struct {
+	policy string
+	store  ds.Datastore
+	bs     blockstore.Blockstore
+	// quota is how many bytes a peer is served per window, 0 for no
+	// limit.
+	quota  int64
+	window time.Duration
+	clock  dkv.WallClock
+
+	// usage accounts the blocks served by peer, when not nil.
+	usage *usageMeter
+
+	mu     sync.Mutex
+	start  time.Time
+	served map[peer.ID]int64
+}
+
+func newServingPolicy(policy string, quota int64, window time.Duration, clock dkv.WallClock) (*servingPolicy, error) {
+	switch policy {
+	case serveAll, serveDAG, serveNone:
+	default:
+		return nil, fmt.Errorf("-serve must be %s, %s or %s, not %q", serveAll, serveDAG, serveNone, policy)
+	}
+	if quota < 0 {
+		return nil, fmt.Errorf("-serve-quota must not be negative")
+	}
+	return &servingPolicy{policy: policy, quota: quota, window: window, clock: clock, served: make(map[peer.ID]int64)}, nil
+}
+
+// isDefault tells whether the policy serves everything to everyone
+// without counting, which the bitswap of ipfs-lite does.
+func (sp *servingPolicy) isDefault() bool {
+	return sp.policy == serveAll && sp.quota == 0 && sp.usage == nil
+}
+
+// serves tells whether the policy serves a block.
+func (sp *servingPolicy) serves(c cid.Cid) bool {
+	switch sp.policy {
+	case serveNone:
+		return false
+	case serveDAG:
+		ok, err := sp.store.Has(context.Background(), crdtProcessedNs.Child(dshelp.MultihashToDsKey(c.Hash())))
+		return err == nil && ok
+	}
+	return true
+}
+
+// allow is the bitswap block request filter: it tells whether a block
+// may be sent to a peer, counting it against the quota of the peer.
+func (sp *servingPolicy) allow(p peer.ID, c cid.Cid) bool {
+	ctx := context.Background()
+	if !sp.serves(c) {
+		blocksRefused.WithLabelValues("policy").Inc()
+		return false
+	}
+	if sp.quota == 0 && sp.usage == nil {
+		return true
+	}
+	size, err := sp.bs.GetSize(ctx, c)
+	if err != nil {
+		// Not ours to serve anyway.
+		return true
+	}
+	if sp.quota > 0 && !sp.withinQuota(p, size) {
+		blocksRefused.WithLabelValues("quota").Inc()
+		return false
+	}
+	sp.usage.servedBlock(p, size)
+	return true
+}
+
+// withinQuota counts size bytes against the quota of a peer, unless they
+// do not fit.
+func (sp *servingPolicy) withinQuota(p peer.ID, size int) bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if now := sp.clock.Now(); now.Sub(sp.start) >= sp.window {
+		sp.start = now
+		sp.served = make(map[peer.ID]int64)
+	}
+	if sp.served[p]+int64(size) > sp.quota {
+		return false
+	}
+	sp.served[p] += int64(size)
+	return true
+}
+
+// newIPFS sets up the IPFS-Lite peer of the node. Under the default
+// policy it is what ipfs-lite builds; otherwise the peer is built offline
+// and given a DAG service over a bitswap filtering what is served, along
+// with a reprovider announcing the blocks on the DHT when they are all
+// served.
+func newIPFS(ctx context.Context, store ds.Batching, h host.Host, r routing.Routing, cfg *ipfslite.Config, sp *servingPolicy) (*ipfslite.Peer, error) {
+	if sp.isDefault() {
+		return ipfslite.New(ctx, store, nil, h, r, cfg)
+	}
+	offline := *cfg
+	offline.Offline = true
+	ipfs, err := ipfslite.New(ctx, store, nil, h, r, &offline)
+	if err != nil {
+		return nil, err
+	}
+	sp.store, sp.bs = store, ipfs.BlockStore()
+	bswap := bitswap.New(ctx, bsnet.NewFromIpfsHost(h, r), ipfs.BlockStore(),
+		bitswap.WithPeerBlockRequestFilter(sp.allow),
+		bitswap.ProvideEnabled(sp.policy == serveAll),
+	)
+	bserv := blockservice.New(ipfs.BlockStore(), bswap)
+	ipfs.DAGService = merkledag.NewDAGService(bserv)
+
+	if sp.policy == serveAll && cfg.ReprovideInterval >= 0 {
+		interval := cfg.ReprovideInterval
+		if interval == 0 {
+			interval = 12 * time.Hour
+		}
+		prov, err := provider.New(store,
+			provider.DatastorePrefix(ds.NewKey("repro")),
+			provider.Online(r),
+			provider.ReproviderInterval(interval),
+			provider.KeyProvider(provider.NewBlockstoreProvider(ipfs.BlockStore())))
+		if err != nil {
+			bserv.Close()
+			return nil, err
+		}
+		go func() {
+			<-ctx.Done()
+			prov.Close()
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		bserv.Close()
+	}()
+	logger.Infof("serving %s blocks over bitswap, quota %d bytes per peer every %s", sp.policy, sp.quota, sp.window)
+	return ipfs, nil
+}
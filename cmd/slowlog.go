@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ds-crdt/pb"
+	ipld "github.com/ipfs/go-ipld-format"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+)
+
+// slowThresholds are the durations above which operations are logged as
+// slow. A zero threshold disables the check.
+type slowThresholds struct {
+	Get  time.Duration
+	Node time.Duration
+	Hook time.Duration
+}
+
+// logSlow logs and counts an operation that took longer than threshold.
+// Context is given as alternating keys and values.
+func logSlow(op string, threshold time.Duration, start time.Time, context ...interface{}) {
+	took := time.Since(start)
+	if threshold <= 0 || took < threshold {
+		return
+	}
+	slowOperations.WithLabelValues(op).Inc()
+	logger.Warnw("slow "+op, append([]interface{}{"took", took.String(), "threshold", threshold.String()}, context...)...)
+}
+
+// headSources remembers which peer announced each recently seen head, so
+// that slow DAG nodes can be traced back to where they came from. It is
+// installed as a pubsub tracer.
+type headSources struct {
+	noopTracer
+
+	topic string
+	size  int
+
+	mu    sync.Mutex
+	peers map[cid.Cid]peer.ID
+	order []cid.Cid
+}
+
+func newHeadSources(topic string, size int) *headSources {
+	return &headSources{
+		topic: topic,
+		size:  size,
+		peers: make(map[cid.Cid]peer.ID),
+	}
+}
+
+// source returns the peer that announced c, if c is a recent head.
+func (hs *headSources) source(c cid.Cid) (peer.ID, bool) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	p, ok := hs.peers[c]
+	return p, ok
+}
+
+func (hs *headSources) DeliverMessage(msg *pubsub.Message) {
+	if msg.GetTopic() != hs.topic {
+		return
+	}
+	bcast := &pb.CRDTBroadcast{}
+	if err := proto.Unmarshal(announcedHeads(msg.Data), bcast); err != nil {
+		return
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	for _, h := range bcast.Heads {
+		c, err := cid.Cast(h.Cid)
+		if err != nil {
+			continue
+		}
+		if _, ok := hs.peers[c]; !ok {
+			hs.order = append(hs.order, c)
+		}
+		hs.peers[c] = msg.ReceivedFrom
+	}
+	for len(hs.order) > hs.size {
+		delete(hs.peers, hs.order[0])
+		hs.order = hs.order[1:]
+	}
+}
+
+// slowDAG logs DAG nodes that take long to be fetched. The CRDT store
+// fetches every node it processes through it.
+type slowDAG struct {
+	ipld.DAGService
+	threshold time.Duration
+	sources   *headSources
+	aliases   *aliases
+}
+
+func (d *slowDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "dag.Get", trace.WithAttributes(attribute.String("cid", c.String())))
+	nd, err := d.DAGService.Get(ctx, c)
+	if p, ok := d.sources.source(c); ok {
+		span.SetAttributes(attribute.String("peer", p.String()))
+		logSlow("dag node", d.threshold, start, "cid", c, "peer", d.aliases.name(p))
+	} else {
+		logSlow("dag node", d.threshold, start, "cid", c)
+	}
+	endSpan(span, err)
+	return nd, err
+}
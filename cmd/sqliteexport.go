@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// exportSQLite writes a snapshot of the keyspace to a SQLite file for
+// analysts to query offline, e.g.
+//
+//	sqlite3 dump.db "SELECT key, json_extract(json, '$.name') FROM kv WHERE namespace = 'users'"
+//
+// The file holds a single kv table with the key, its first component, the
+// raw value, the value rendered as JSON when a codec knows it or it is
+// JSON already, and the time of the write. It is built next to path and
+// renamed over it, so readers never see a half-written file. System keys
+// are not exported. It returns the number of keys written.
+func exportSQLite(ctx context.Context, kv *db, cs *codecs, path string) (int, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return 0, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	out, err := sql.Open("sqlite3", tmp.Name())
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	if _, err := out.ExecContext(ctx, `CREATE TABLE kv (
+		key TEXT PRIMARY KEY,
+		namespace TEXT NOT NULL,
+		value BLOB NOT NULL,
+		json TEXT,
+		updated_at TIMESTAMP NOT NULL
+	)`); err != nil {
+		return 0, err
+	}
+	if _, err := out.ExecContext(ctx, "CREATE INDEX kv_namespace ON kv (namespace)"); err != nil {
+		return 0, err
+	}
+
+	tx, err := out.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	insert, err := tx.PrepareContext(ctx, "INSERT INTO kv (key, namespace, value, json, updated_at) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return 0, err
+	}
+	defer insert.Close()
+
+	// Read the CRDT store directly to keep the write times.
+	results, err := kv.crdt.Query(ctx, query.Query{})
+	if err != nil {
+		return 0, err
+	}
+	defer results.Close()
+	var n int
+	for r := range results.Next() {
+		if r.Error != nil {
+			return 0, r.Error
+		}
+		k := kv.keys.plain(ds.NewKey(r.Key))
+		if systemNs.IsAncestorOf(k) {
+			continue
+		}
+		v, meta, err := kv.decode(k, r.Value)
+		if err != nil {
+			return 0, err
+		}
+		var doc sql.NullString
+		if decoded, ok, err := cs.decode(ctx, k, v); err == nil && ok {
+			if data, err := json.Marshal(decoded); err == nil {
+				doc = sql.NullString{String: string(data), Valid: true}
+			}
+		} else if !ok && json.Valid(v) {
+			doc = sql.NullString{String: string(v), Valid: true}
+		}
+		var namespace string
+		if parts := k.List(); len(parts) > 1 {
+			namespace = parts[0]
+		}
+		if _, err := insert.ExecContext(ctx, r.Key, namespace, v, doc, meta.HLC.Time().UTC()); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		return 0, err
+	}
+	return n, os.Rename(tmp.Name(), path)
+}
+
+// refreshSQLiteExport exports the keyspace to path, as the sqlite-export
+// job does every -sqlite-export-interval.
+func refreshSQLiteExport(ctx context.Context, kv *db, cs *codecs, path string) error {
+	start := time.Now()
+	n, err := exportSQLite(ctx, kv, cs, path)
+	if err != nil {
+		return fmt.Errorf("exporting to %s: %w", path, err)
+	}
+	logger.Infof("exported %d keys to %s in %s", n, path, time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-datastore/query"
+)
+
+// churnWindow is how far back stats looks in the change feed.
+const churnWindow = time.Hour
+
+// prefixStats summarizes the keys under a prefix.
+type prefixStats struct {
+	Prefix string
+	Keys   int
+	Bytes  int
+	// Changes is the number of puts and deletes within the churn window.
+	Changes int
+}
+
+// keyPrefix returns the first depth components of a key.
+func keyPrefix(k string, depth int) string {
+	parts := strings.SplitN(strings.TrimPrefix(k, "/"), "/", depth+1)
+	if len(parts) > depth {
+		parts = parts[:depth]
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// collectStats counts keys and bytes per prefix, and the changes seen per
+// prefix over the churn window. The feed only retains so many changes, so
+// churn on busy nodes may cover less than the whole window. Without a feed,
+// as for named databases, no changes are counted.
+func collectStats(ctx context.Context, kv *db, feed *changeFeed, depth int) ([]prefixStats, error) {
+	byPrefix := make(map[string]*prefixStats)
+	get := func(k string) *prefixStats {
+		p := keyPrefix(k, depth)
+		st, ok := byPrefix[p]
+		if !ok {
+			st = &prefixStats{Prefix: p}
+			byPrefix[p] = st
+		}
+		return st
+	}
+
+	results, err := kv.Query(ctx, query.Query{})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		st := get(r.Key)
+		st.Keys++
+		st.Bytes += len(r.Key) + len(r.Value)
+	}
+	if feed != nil {
+		for _, c := range feed.recent(kv.now().Add(-churnWindow)) {
+			get(c.Key).Changes++
+		}
+	}
+
+	list := make([]prefixStats, 0, len(byPrefix))
+	for _, st := range byPrefix {
+		list = append(list, *st)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Keys != list[j].Keys {
+			return list[i].Keys > list[j].Keys
+		}
+		if list[i].Bytes != list[j].Bytes {
+			return list[i].Bytes > list[j].Bytes
+		}
+		return list[i].Prefix < list[j].Prefix
+	})
+	return list, nil
+}
+
+// runStats handles the stats command: stats [--top N] [--depth N].
+func runStats(ctx context.Context, args []string, kv *db, feed *changeFeed) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	top := fs.Int("top", 10, "number of prefixes to show")
+	depth := fs.Int("depth", 1, "number of key components that make a prefix")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *depth < 1 {
+		return fmt.Errorf("invalid depth %d", *depth)
+	}
+
+	list, err := collectStats(ctx, kv, feed, *depth)
+	if err != nil {
+		return err
+	}
+	var keys, size, changes int
+	for _, st := range list {
+		keys += st.Keys
+		size += st.Bytes
+		changes += st.Changes
+	}
+	fmt.Printf("%d keys, %d bytes, %d changes in the last %s\n", keys, size, changes, churnWindow)
+	if *top > 0 && len(list) > *top {
+		list = list[:*top]
+	}
+	for _, st := range list {
+		fmt.Printf("%-30s %8d keys %12d bytes %8d changes/h\n", st.Prefix, st.Keys, st.Bytes, st.Changes)
+	}
+	return nil
+}
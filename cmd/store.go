@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	badger "github.com/ipfs/go-ds-badger2"
+)
+
+// uncleanMarker exists in a data folder while its store is open, so that
+// a store left open by a crash is spotted on the next start.
+const uncleanMarker = "UNCLEAN"
+
+// openStore opens the Badger datastore in path, creating it if needed.
+// Badger replays its value log when it was not closed cleanly, so a store
+// left behind by a crash opens like any other. When the end of the value
+// log is corrupt, as after a crash in the middle of a write, it is
+// truncated and what was dropped is reported.
+func openStore(path string, opts *badger.Options) (*badger.Datastore, error) {
+	marker := filepath.Join(path, uncleanMarker)
+	_, err := os.Stat(marker)
+	unclean := err == nil
+
+	store, err := badger.NewDatastore(path, opts)
+	if err != nil && strings.Contains(err.Error(), "Cannot acquire directory lock") {
+		return nil, fmt.Errorf("%s is in use by another node, give this one its own -data-dir: %w", path, err)
+	}
+	if err != nil && strings.Contains(err.Error(), "truncate required") {
+		before := valueLogSize(path)
+		recovery := *opts
+		recovery.Truncate = true
+		store, err = badger.NewDatastore(path, &recovery)
+		if err != nil {
+			return nil, fmt.Errorf("recovering %s: %w", path, err)
+		}
+		fmt.Fprintf(os.Stderr, "%s: recovered the datastore, truncating %d bytes of corrupt value log\n", path, before-valueLogSize(path))
+	} else if err == nil && unclean {
+		fmt.Fprintf(os.Stderr, "%s: the last run did not shut down cleanly, the datastore was recovered from its logs\n", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(marker, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// closeStore closes a store opened by openStore, marking it as cleanly
+// shut down.
+func closeStore(path string, store *badger.Datastore) error {
+	if err := store.Close(); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(path, uncleanMarker))
+}
+
+// valueLogSize is the size of the value log files of a store.
+func valueLogSize(path string) int64 {
+	files, _ := filepath.Glob(filepath.Join(path, "*.vlog"))
+	var n int64
+	for _, f := range files {
+		if st, err := os.Stat(f); err == nil {
+			n += st.Size()
+		}
+	}
+	return n
+}
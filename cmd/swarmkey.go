@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/libp2p/go-libp2p/core/pnet"
+)
+
+// loadSwarmKey reads a libp2p pre-shared key in the swarm.key format used
+// by IPFS private networks.
+func loadSwarmKey(path string) (pnet.PSK, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	psk, err := pnet.DecodeV1PSK(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return psk, nil
+}
+
+// writeSwarmKey writes a new random pre-shared key in the swarm.key
+// format.
+func writeSwarmKey(w io.Writer) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "/key/swarm/psk/1.0.0/\n/base16/\n%s\n", hex.EncodeToString(key))
+	return err
+}
+
+// runKeygen implements the keygen subcommand:
+//
+//	globaldb keygen swarm [file]
+//
+// writes a new swarm key to file, or to stdout. An existing file is never
+// overwritten, as the nodes holding the old key would be cut off.
+func runKeygen(args []string) error {
+	if len(args) == 0 || args[0] != "swarm" || len(args) > 2 {
+		return fmt.Errorf("usage: keygen swarm [file]")
+	}
+	if len(args) == 1 {
+		return writeSwarmKey(os.Stdout)
+	}
+	f, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := writeSwarmKey(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/multiformats/go-multihash"
+)
+
+// tierNs is the namespace of the local datastore where the tiering job
+// keeps when each key was last read, as tierNs/atime/<key>.
+var tierNs = ds.NewKey("/tier")
+
+// crdtValuesNs is where go-ds-crdt keeps the current value of every key,
+// as crdtValuesNs/<key>/v, under the namespace the CRDT store is given.
+var crdtValuesNs = ds.NewKey("/crdt/s/k")
+
+// coldStubHeader starts the payload of a value moved to the cold tier. It
+// is followed by the pack number, the offset and length of the value in
+// the pack, and the CID of the value.
+var coldStubHeader = []byte{0xff, 'c'}
+
+const (
+	// coldMinSize is the size under which values are not worth moving.
+	coldMinSize = 256
+	// coldPackSize is the size after which a new pack is started.
+	coldPackSize = 256 << 20
+	// coldLiveRatio is the share of a pack still in use under which its
+	// values are rewritten to the current pack.
+	coldLiveRatio = 0.5
+)
+
+// coldTier moves the values not read for a while out of Badger into
+// append-only pack files, leaving a stub with their CID and location in
+// their place. Stubbed values are read from the packs transparently, and
+// moved back when they are read with get.
+//
+// Tiering is local to the node: only the stored copy of the current value
+// is replaced, never the replicated one, and the deltas in the DAG are
+// left alone. When two writes land at the same DAG height, go-ds-crdt
+// keeps the greater of the stored and the new value; the store it is given
+// reads stubbed values back from their pack, so that it compares values and
+// never stubs.
+//
+// The bytes of values moved back, overwritten or deleted stay in their
+// pack until the pack is compacted.
+type coldTier struct {
+	store ds.Datastore
+	dir   string
+	after time.Duration
+	clock dkv.WallClock
+
+	// mu serializes the rewrites of stored values with the put hook.
+	mu sync.Mutex
+	// touched are the keys rewritten since the last run, which the put
+	// hook checks for a value it stored being overwritten.
+	touched map[ds.Key]bool
+
+	packMu  sync.Mutex
+	pack    *os.File
+	packID  uint32
+	packLen int64
+
+	readsMu sync.Mutex
+	reads   map[ds.Key]time.Time
+
+	// drained are the packs the last compaction found no value in.
+	drained map[uint32]bool
+}
+
+// newColdTier opens the packs in dir. Values are moved once they were not
+// read for after, as told by clock.
+func newColdTier(store ds.Datastore, dir string, after time.Duration, clock dkv.WallClock) (*coldTier, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	t := &coldTier{
+		store:   store,
+		dir:     dir,
+		after:   after,
+		clock:   clock,
+		touched: make(map[ds.Key]bool),
+		reads:   make(map[ds.Key]time.Time),
+		drained: make(map[uint32]bool),
+	}
+	packs, err := t.packs()
+	if err != nil {
+		return nil, err
+	}
+	if len(packs) > 0 {
+		t.packID = packs[len(packs)-1]
+	}
+	if err := t.openPack(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *coldTier) packPath(id uint32) string {
+	return filepath.Join(t.dir, fmt.Sprintf("pack-%06d.dat", id))
+}
+
+// packs returns the numbers of the packs in the folder, in order.
+func (t *coldTier) packs() ([]uint32, error) {
+	paths, err := filepath.Glob(filepath.Join(t.dir, "pack-*.dat"))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint32, 0, len(paths))
+	for _, p := range paths {
+		n, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), "pack-"), ".dat"), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected pack %s", p)
+		}
+		ids = append(ids, uint32(n))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// openPack opens the current pack for appending. The caller must hold
+// packMu or be the constructor.
+func (t *coldTier) openPack() error {
+	f, err := os.OpenFile(t.packPath(t.packID), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	t.pack, t.packLen = f, st.Size()
+	return nil
+}
+
+// Close closes the current pack.
+func (t *coldTier) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.packMu.Lock()
+	defer t.packMu.Unlock()
+	return t.pack.Close()
+}
+
+// isColdStub tells whether a payload is the stub of a moved value.
+func isColdStub(payload []byte) bool {
+	return bytes.HasPrefix(payload, coldStubHeader)
+}
+
+// write appends a value to the current pack and returns its stub.
+func (t *coldTier) write(v []byte) ([]byte, error) {
+	c, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum(v)
+	if err != nil {
+		return nil, err
+	}
+	t.packMu.Lock()
+	defer t.packMu.Unlock()
+	if t.packLen >= coldPackSize {
+		if err := t.pack.Close(); err != nil {
+			return nil, err
+		}
+		t.packID++
+		if err := t.openPack(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := t.pack.Write(v); err != nil {
+		return nil, err
+	}
+	if err := t.pack.Sync(); err != nil {
+		return nil, err
+	}
+	stub := append([]byte{}, coldStubHeader...)
+	stub = binary.BigEndian.AppendUint32(stub, t.packID)
+	stub = binary.BigEndian.AppendUint64(stub, uint64(t.packLen))
+	stub = binary.BigEndian.AppendUint32(stub, uint32(len(v)))
+	stub = append(stub, c.Bytes()...)
+	t.packLen += int64(len(v))
+	return stub, nil
+}
+
+// coldStub is where a stub says its value is.
+type coldStub struct {
+	pack uint32
+	off  uint64
+	len  uint32
+	cid  cid.Cid
+}
+
+func parseColdStub(stub []byte) (coldStub, error) {
+	rest := stub[len(coldStubHeader):]
+	if len(rest) < 16 {
+		return coldStub{}, errors.New("invalid cold stub")
+	}
+	c, err := cid.Cast(rest[16:])
+	if err != nil {
+		return coldStub{}, fmt.Errorf("invalid cold stub: %w", err)
+	}
+	return coldStub{
+		pack: binary.BigEndian.Uint32(rest),
+		off:  binary.BigEndian.Uint64(rest[4:]),
+		len:  binary.BigEndian.Uint32(rest[12:]),
+		cid:  c,
+	}, nil
+}
+
+// read returns the value a stub points to, checked against its CID.
+func (t *coldTier) read(stub []byte) ([]byte, error) {
+	if t == nil {
+		return nil, errors.New("value is in the cold tier, which is not enabled (-tier-after)")
+	}
+	st, err := parseColdStub(stub)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(t.packPath(st.pack))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	v := make([]byte, st.len)
+	if _, err := f.ReadAt(v, int64(st.off)); err != nil {
+		return nil, fmt.Errorf("reading %s from pack %d: %w", st.cid, st.pack, err)
+	}
+	got, err := st.cid.Prefix().Sum(v)
+	if err != nil {
+		return nil, err
+	}
+	if !got.Equals(st.cid) {
+		return nil, fmt.Errorf("pack %d is corrupt: expected %s, read %s", st.pack, st.cid, got)
+	}
+	return v, nil
+}
+
+// touch records that a key was read or written.
+func (t *coldTier) touch(k ds.Key) {
+	if t == nil {
+		return
+	}
+	t.readsMu.Lock()
+	t.reads[k] = t.clock.Now()
+	t.readsMu.Unlock()
+}
+
+// forget drops what is known about a deleted key.
+func (t *coldTier) forget(ctx context.Context, k ds.Key) {
+	if t == nil {
+		return
+	}
+	t.readsMu.Lock()
+	delete(t.reads, k)
+	t.readsMu.Unlock()
+	if err := t.store.Delete(ctx, tierNs.ChildString("atime").Child(k)); err != nil {
+		logger.Warnf("tiering: %s", err)
+	}
+}
+
+// replace swaps the stored value of k for v if it is still old.
+func (t *coldTier) replace(ctx context.Context, k ds.Key, old, v []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	vk := crdtValuesNs.Child(k).ChildString("v")
+	cur, err := t.store.Get(ctx, vk)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(cur, old) {
+		return nil
+	}
+	t.touched[k] = true
+	return t.store.Put(ctx, vk, v)
+}
+
+// stored is called by the put hook with the value the CRDT store just
+// stored. A value that won while we were replacing the previous one may
+// have been overwritten, so it is stored again.
+func (t *coldTier) stored(ctx context.Context, k ds.Key, v []byte) {
+	if t == nil {
+		return
+	}
+	t.touch(k)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.touched[k] {
+		return
+	}
+	delete(t.touched, k)
+	vk := crdtValuesNs.Child(k).ChildString("v")
+	if cur, err := t.store.Get(ctx, vk); err == nil && !bytes.Equal(cur, v) {
+		if err := t.store.Put(ctx, vk, v); err != nil {
+			logger.Warnf("tiering: restoring %s: %s", k, err)
+		}
+	}
+}
+
+// rehydrate moves a value read from the cold tier back to Badger.
+func (t *coldTier) rehydrate(ctx context.Context, k ds.Key, stored, v []byte) {
+	if err := t.replace(ctx, k, stored, v); err != nil {
+		logger.Warnf("tiering: rehydrating %s: %s", k, err)
+	}
+}
+
+// flushReads saves the read times recorded since the last run.
+func (t *coldTier) flushReads(ctx context.Context) error {
+	t.readsMu.Lock()
+	reads := t.reads
+	t.reads = make(map[ds.Key]time.Time)
+	t.readsMu.Unlock()
+	for k, at := range reads {
+		if err := t.store.Put(ctx, tierNs.ChildString("atime").Child(k), []byte(strconv.FormatInt(at.Unix(), 10))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastRead returns when a key was last read. Keys never read count from
+// the first time the job sees them.
+func (t *coldTier) lastRead(ctx context.Context, k ds.Key, now time.Time) (time.Time, error) {
+	ak := tierNs.ChildString("atime").Child(k)
+	data, err := t.store.Get(ctx, ak)
+	if errors.Is(err, ds.ErrNotFound) {
+		return now, t.store.Put(ctx, ak, []byte(strconv.FormatInt(now.Unix(), 10)))
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	sec, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return now, nil
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// move moves the values not read for longer than the tier delay and
+// returns how many were moved.
+func (t *coldTier) move(ctx context.Context, now time.Time) (int, error) {
+	if err := t.flushReads(ctx); err != nil {
+		return 0, err
+	}
+	t.mu.Lock()
+	t.touched = make(map[ds.Key]bool)
+	t.mu.Unlock()
+
+	results, err := t.store.Query(ctx, query.Query{Prefix: crdtValuesNs.String()})
+	if err != nil {
+		return 0, err
+	}
+	defer results.Close()
+	moved := 0
+	for r := range results.Next() {
+		if r.Error != nil {
+			return moved, r.Error
+		}
+		vk := ds.RawKey(r.Key)
+		if vk.Name() != "v" {
+			continue
+		}
+		k := ds.NewKey(strings.TrimPrefix(vk.Parent().String(), crdtValuesNs.String()))
+		if systemNs.IsAncestorOf(k) {
+			continue
+		}
+		meta, payload := dkv.DecodeValue(r.Value)
+		if len(payload) < coldMinSize || isColdStub(payload) {
+			continue
+		}
+		at, err := t.lastRead(ctx, k, now)
+		if err != nil {
+			return moved, err
+		}
+		if now.Sub(at) < t.after {
+			continue
+		}
+		stub, err := t.write(payload)
+		if err != nil {
+			return moved, err
+		}
+		if err := t.replace(ctx, k, r.Value, dkv.EncodeValue(meta, stub)); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// compact rewrites the values still in the packs that are mostly unused
+// to the current pack, and deletes the packs two runs in a row found no
+// value in, so that the reads of the stubs of the first run are over. It
+// returns how many values were rewritten and packs deleted.
+func (t *coldTier) compact(ctx context.Context) (int, int, error) {
+	type stubbed struct {
+		k      ds.Key
+		stored []byte
+	}
+	var (
+		live  = make(map[uint32]int64)
+		stubs = make(map[uint32][]stubbed)
+	)
+	results, err := t.store.Query(ctx, query.Query{Prefix: crdtValuesNs.String()})
+	if err != nil {
+		return 0, 0, err
+	}
+	for r := range results.Next() {
+		if r.Error != nil {
+			results.Close()
+			return 0, 0, r.Error
+		}
+		vk := ds.RawKey(r.Key)
+		_, payload := dkv.DecodeValue(r.Value)
+		if vk.Name() != "v" || !isColdStub(payload) {
+			continue
+		}
+		st, err := parseColdStub(payload)
+		if err != nil {
+			continue
+		}
+		k := ds.NewKey(strings.TrimPrefix(vk.Parent().String(), crdtValuesNs.String()))
+		live[st.pack] += int64(st.len)
+		stubs[st.pack] = append(stubs[st.pack], stubbed{k, r.Value})
+	}
+	results.Close()
+
+	packs, err := t.packs()
+	if err != nil {
+		return 0, 0, err
+	}
+	t.packMu.Lock()
+	current := t.packID
+	t.packMu.Unlock()
+	drained := make(map[uint32]bool)
+	rewritten, deleted := 0, 0
+	for _, id := range packs {
+		if id == current {
+			continue
+		}
+		if live[id] == 0 {
+			if !t.drained[id] {
+				drained[id] = true
+				continue
+			}
+			if err := os.Remove(t.packPath(id)); err != nil {
+				return rewritten, deleted, err
+			}
+			deleted++
+			continue
+		}
+		fi, err := os.Stat(t.packPath(id))
+		if err != nil {
+			return rewritten, deleted, err
+		}
+		if float64(live[id]) >= coldLiveRatio*float64(fi.Size()) {
+			continue
+		}
+		for _, s := range stubs[id] {
+			meta, payload := dkv.DecodeValue(s.stored)
+			v, err := t.read(payload)
+			if err != nil {
+				return rewritten, deleted, fmt.Errorf("%s: %w", s.k, err)
+			}
+			stub, err := t.write(v)
+			if err != nil {
+				return rewritten, deleted, err
+			}
+			if err := t.replace(ctx, s.k, s.stored, dkv.EncodeValue(meta, stub)); err != nil {
+				return rewritten, deleted, err
+			}
+			rewritten++
+		}
+	}
+	t.drained = drained
+	return rewritten, deleted, nil
+}
+
+// moveCold moves the values gone cold to the cold tier, then compacts the
+// packs.
+func moveCold(ctx context.Context, t *coldTier) error {
+	n, err := t.move(ctx, t.clock.Now())
+	if n > 0 {
+		logger.Infof("tiering: moved %d values to the cold tier", n)
+	}
+	if err != nil {
+		return err
+	}
+	rewritten, deleted, err := t.compact(ctx)
+	if rewritten > 0 || deleted > 0 {
+		logger.Infof("tiering: rewrote %d values and deleted %d packs", rewritten, deleted)
+	}
+	return err
+}
+
+// tieredStore is the store of the CRDT database the cold tier applies to.
+// It moves the values it reads out of the cold tier back to Badger, so
+// go-ds-crdt compares values and not stubs.
+type tieredStore struct {
+	ds.Batching
+	tier *coldTier
+}
+
+// wrap returns the store the CRDT database should use, store itself when
+// tiering is off.
+func (t *coldTier) wrap(store ds.Batching) ds.Batching {
+	if t == nil {
+		return store
+	}
+	return &tieredStore{Batching: store, tier: t}
+}
+
+func (s *tieredStore) Get(ctx context.Context, vk ds.Key) ([]byte, error) {
+	v, err := s.Batching.Get(ctx, vk)
+	if err != nil || vk.Name() != "v" || !crdtValuesNs.IsAncestorOf(vk) {
+		return v, err
+	}
+	meta, payload := dkv.DecodeValue(v)
+	if !isColdStub(payload) {
+		return v, nil
+	}
+	k := ds.NewKey(strings.TrimPrefix(vk.Parent().String(), crdtValuesNs.String()))
+	body, err := s.tier.read(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", k, err)
+	}
+	warm := dkv.EncodeValue(meta, body)
+	s.tier.rehydrate(ctx, k, v, warm)
+	return warm, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+)
+
+func newTestTier(t *testing.T) (ds.Batching, *coldTier) {
+	t.Helper()
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+	tier, err := newColdTier(store, t.TempDir(), time.Hour, dkv.NewManualClock(time.Unix(0, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tier.Close() })
+	return store, tier
+}
+
+// storeCold writes v to the cold tier and stores its stub on k.
+func storeCold(t *testing.T, store ds.Datastore, tier *coldTier, k ds.Key, meta dkv.Meta, v []byte) {
+	t.Helper()
+	stub, err := tier.write(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(context.Background(), crdtValuesNs.Child(k).ChildString("v"), dkv.EncodeValue(meta, stub)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTieredStoreComparesValues(t *testing.T) {
+	ctx := context.Background()
+	meta := dkv.Meta{HLC: 42}
+	cold := bytes.Repeat([]byte("m"), coldMinSize)
+	tests := []struct {
+		name     string
+		incoming []byte
+		// keep is whether go-ds-crdt keeps the stored value over the
+		// incoming one at the same DAG height.
+		keep bool
+	}{
+		{"lower", bytes.Repeat([]byte("a"), coldMinSize), true},
+		{"higher", bytes.Repeat([]byte("z"), coldMinSize), false},
+		{"equal", cold, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, tier := newTestTier(t)
+			k := ds.NewKey("/a")
+			vk := crdtValuesNs.Child(k).ChildString("v")
+			storeCold(t, store, tier, k, meta, cold)
+
+			cur, err := tier.wrap(store).Get(ctx, vk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keep := bytes.Compare(cur, dkv.EncodeValue(meta, tt.incoming)) >= 0; keep != tt.keep {
+				t.Errorf("stored value kept: %t, want %t", keep, tt.keep)
+			}
+			stored, err := store.Get(ctx, vk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(stored, cur) {
+				t.Error("value read from the cold tier not moved back")
+			}
+		})
+	}
+}
+
+func TestColdTierCompact(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		deleted int
+		// rewritten is how many values the first run rewrites, and exists
+		// whether the first pack is left after every run.
+		rewritten int
+		exists    [3]bool
+	}{
+		{"all live", 0, 0, [3]bool{true, true, true}},
+		{"mostly live", 1, 0, [3]bool{true, true, true}},
+		{"mostly dead", 3, 1, [3]bool{true, true, false}},
+		{"all dead", 4, 0, [3]bool{true, false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, tier := newTestTier(t)
+			values := make(map[ds.Key][]byte)
+			for i := 0; i < 4; i++ {
+				k := ds.NewKey(fmt.Sprintf("/k%d", i))
+				values[k] = bytes.Repeat([]byte{byte('a' + i)}, 1000)
+				storeCold(t, store, tier, k, dkv.Meta{HLC: 1}, values[k])
+			}
+			// Start the next pack.
+			tier.packLen = coldPackSize
+			storeCold(t, store, tier, ds.NewKey("/next"), dkv.Meta{HLC: 1}, []byte("next"))
+			for i := 0; i < tt.deleted; i++ {
+				k := ds.NewKey(fmt.Sprintf("/k%d", i))
+				delete(values, k)
+				if err := store.Delete(ctx, crdtValuesNs.Child(k).ChildString("v")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for run, exists := range tt.exists {
+				rewritten, _, err := tier.compact(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if run == 0 && rewritten != tt.rewritten {
+					t.Errorf("rewrote %d values, want %d", rewritten, tt.rewritten)
+				}
+				if _, err := os.Stat(tier.packPath(0)); (err == nil) != exists {
+					t.Errorf("run %d: first pack left: %t, want %t", run+1, err == nil, exists)
+				}
+			}
+			for k, want := range values {
+				v, err := tier.wrap(store).Get(ctx, crdtValuesNs.Child(k).ChildString("v"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, got := dkv.DecodeValue(v); !bytes.Equal(got, want) {
+					t.Errorf("%s changed by the compaction", k)
+				}
+			}
+		})
+	}
+}
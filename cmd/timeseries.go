@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// tsNs holds time series. The samples of a series are stored one per key
+// under tsNs/<series>/raw/<unix nanoseconds>, and the rollups replacing
+// them once they are older than the retention under
+// tsNs/<series>/<rollup>/<unix nanoseconds of the bucket start>.
+var tsNs = ds.NewKey("/ts")
+
+// tsRetention configures the time series job.
+type tsRetention struct {
+	// Raw is how long raw samples are kept before being rolled up.
+	Raw time.Duration
+	// Rollup is the width of the buckets raw samples are rolled up into.
+	Rollup time.Duration
+	// Rollups is how long rollups are kept, forever when 0.
+	Rollups time.Duration
+}
+
+// tsRollup summarizes the samples of a bucket.
+type tsRollup struct {
+	Count int     `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+func (r *tsRollup) add(o tsRollup) {
+	if r.Count == 0 {
+		*r = o
+		return
+	}
+	r.Count += o.Count
+	r.Sum += o.Sum
+	r.Min = math.Min(r.Min, o.Min)
+	r.Max = math.Max(r.Max, o.Max)
+}
+
+// tsSample is a point of a series.
+type tsSample struct {
+	Time  time.Time
+	Value float64
+}
+
+// tsTimeKey formats a time so that keys sort in time order.
+func tsTimeKey(t time.Time) string {
+	return fmt.Sprintf("%020d", t.UnixNano())
+}
+
+func parseTSTimeKey(s string) (time.Time, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, n), nil
+}
+
+// seriesKey returns the namespace of a series, which must be a single key
+// component.
+func seriesKey(series string) (ds.Key, error) {
+	if series == "" || strings.ContainsAny(series, "/") {
+		return ds.Key{}, fmt.Errorf("invalid series name %q", series)
+	}
+	return tsNs.ChildString(series), nil
+}
+
+// tsAdd stores a sample of a series.
+func tsAdd(ctx context.Context, kv *db, series string, t time.Time, v float64) error {
+	ns, err := seriesKey(series)
+	if err != nil {
+		return err
+	}
+	k := ns.ChildString("raw").ChildString(tsTimeKey(t))
+	return kv.Put(ctx, k, []byte(strconv.FormatFloat(v, 'g', -1, 64)))
+}
+
+// tsRaw returns the raw samples of a series since a time, oldest first.
+func tsRaw(ctx context.Context, kv *db, series string, since time.Time) ([]tsSample, error) {
+	ns, err := seriesKey(series)
+	if err != nil {
+		return nil, err
+	}
+	results, err := kv.Query(ctx, query.Query{
+		Prefix: ns.ChildString("raw").String(),
+		Orders: []query.Order{query.OrderByKey{}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	var samples []tsSample
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		t, err := parseTSTimeKey(ds.RawKey(r.Key).Name())
+		if err != nil || t.Before(since) {
+			continue
+		}
+		v, err := strconv.ParseFloat(string(r.Value), 64)
+		if err != nil {
+			continue
+		}
+		samples = append(samples, tsSample{Time: t, Value: v})
+	}
+	return samples, nil
+}
+
+// tsRollups returns the rollups of a series since a time by bucket start.
+func tsRollups(ctx context.Context, kv *db, series string, width time.Duration, since time.Time) (map[time.Time]tsRollup, error) {
+	ns, err := seriesKey(series)
+	if err != nil {
+		return nil, err
+	}
+	results, err := kv.Query(ctx, query.Query{Prefix: ns.ChildString(width.String()).String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	rollups := make(map[time.Time]tsRollup)
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		t, err := parseTSTimeKey(ds.RawKey(r.Key).Name())
+		if err != nil || t.Before(since) {
+			continue
+		}
+		var ru tsRollup
+		if err := json.Unmarshal(r.Value, &ru); err != nil {
+			continue
+		}
+		rollups[t] = ru
+	}
+	return rollups, nil
+}
+
+// tsSeries lists the series.
+func tsSeries(ctx context.Context, kv *db) ([]string, error) {
+	results, err := kv.Query(ctx, query.Query{Prefix: tsNs.String(), KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	seen := make(map[string]bool)
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		if parts := ds.RawKey(r.Key).List(); len(parts) > 1 {
+			seen[parts[1]] = true
+		}
+	}
+	var series []string
+	for s := range seen {
+		series = append(series, s)
+	}
+	sort.Strings(series)
+	return series, nil
+}
+
+// compactSeries rolls up the raw samples of a series older than the
+// retention and drops the rollups older than theirs. Only whole buckets
+// are rolled up, and samples landing in a bucket after it was rolled up
+// are merged into it on the next run.
+func compactSeries(ctx context.Context, kv *db, series string, ret tsRetention, now time.Time) error {
+	ns, err := seriesKey(series)
+	if err != nil {
+		return err
+	}
+	cutoff := now.Add(-ret.Raw).Truncate(ret.Rollup)
+	expired := func(t time.Time) bool {
+		return ret.Rollups > 0 && t.Before(now.Add(-ret.Rollups))
+	}
+	samples, err := tsRaw(ctx, kv, series, time.Time{})
+	if err != nil {
+		return err
+	}
+	buckets := make(map[time.Time]tsRollup)
+	var stale []ds.Key
+	for _, s := range samples {
+		if !s.Time.Before(cutoff) {
+			break
+		}
+		b := buckets[s.Time.Truncate(ret.Rollup)]
+		b.add(tsRollup{Count: 1, Sum: s.Value, Min: s.Value, Max: s.Value})
+		buckets[s.Time.Truncate(ret.Rollup)] = b
+		stale = append(stale, ns.ChildString("raw").ChildString(tsTimeKey(s.Time)))
+	}
+
+	rollupNs := ns.ChildString(ret.Rollup.String())
+	existing, err := tsRollups(ctx, kv, series, ret.Rollup, time.Time{})
+	if err != nil {
+		return err
+	}
+	for t, b := range buckets {
+		if expired(t) {
+			continue
+		}
+		if prev, ok := existing[t]; ok {
+			b.add(prev)
+		}
+		data, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		if err := kv.Put(ctx, rollupNs.ChildString(tsTimeKey(t)), data); err != nil {
+			return err
+		}
+	}
+	for t := range existing {
+		if expired(t) {
+			stale = append(stale, rollupNs.ChildString(tsTimeKey(t)))
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	release, err := kv.fence.enter()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return kv.deleteKeys(ctx, stale)
+}
+
+// compactAllSeries compacts every series as of now, carrying on past the
+// series that fail. A single node needs to run it, as every node receives
+// the resulting rollups and deletes.
+func compactAllSeries(ctx context.Context, kv *db, ret tsRetention, now time.Time) error {
+	series, err := tsSeries(ctx, kv)
+	if err != nil {
+		return fmt.Errorf("listing time series: %w", err)
+	}
+	var errs []error
+	for _, s := range series {
+		if err := compactSeries(ctx, kv, s, ret, now); err != nil {
+			errs = append(errs, fmt.Errorf("compacting time series %s: %w", s, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	crdt "github.com/ipfs/go-ds-crdt"
+	"github.com/ipfs/go-ds-crdt/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// tracer creates the spans of globaldb operations. Spans are only
+// recorded once a tracer provider is installed, which -otlp-endpoint
+// does.
+var tracer = otel.Tracer("github.com/arcinston/dkv")
+
+// traceContext reads W3C traceparent and tracestate headers.
+var traceContext = propagation.TraceContext{}
+
+// startRequestSpan starts the server span of an API request, as a child
+// of the trace given in the request headers if any.
+func startRequestSpan(r *http.Request, endpoint string) (context.Context, trace.Span) {
+	ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return tracer.Start(ctx, endpoint,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.URL.Path),
+		),
+	)
+}
+
+// startSpan starts the span of a datastore operation on a key.
+func startSpan(ctx context.Context, name, key string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attribute.String("key", key)))
+}
+
+// endSpan records the error, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// setupTracing exports the spans of the node to the OTLP/HTTP collector
+// at endpoint, e.g. http://localhost:4318, sampling the given ratio of
+// the traces that do not come with a sampling decision. It returns the
+// function flushing the last spans on exit.
+func setupTracing(endpoint string, ratio float64, self peer.ID) (func(context.Context) error, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("-otlp-endpoint: %w", err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	exp, err := otlptrace.New(context.Background(), &otlpHTTPClient{url: u.String(), client: &http.Client{Timeout: 10 * time.Second}})
+	if err != nil {
+		return nil, err
+	}
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceNameKey.String("globaldb"),
+		semconv.ServiceInstanceIDKey.String(self.String()),
+	)
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// otlpHTTPClient sends spans to a collector with OTLP over HTTP, in the
+// protobuf encoding.
+type otlpHTTPClient struct {
+	url    string
+	client *http.Client
+}
+
+func (c *otlpHTTPClient) Start(context.Context) error { return nil }
+
+func (c *otlpHTTPClient) Stop(context.Context) error { return nil }
+
+// UploadTraces posts an ExportTraceServiceRequest, whose only field is
+// the repeated resource spans, numbered 1.
+func (c *otlpHTTPClient) UploadTraces(ctx context.Context, spans []*tracepb.ResourceSpans) error {
+	var body []byte
+	for _, rs := range spans {
+		b, err := proto.Marshal(rs)
+		if err != nil {
+			return err
+		}
+		body = protowire.AppendTag(body, 1, protowire.BytesType)
+		body = protowire.AppendBytes(body, b)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("exporting spans to %s: %s", c.url, resp.Status)
+	}
+	return nil
+}
+
+// headCIDs lists the heads of an announcement.
+func headCIDs(data []byte) []string {
+	bcast := &pb.CRDTBroadcast{}
+	if err := proto.Unmarshal(data, bcast); err != nil {
+		return nil
+	}
+	heads := make([]string, 0, len(bcast.Heads))
+	for _, h := range bcast.Heads {
+		if c, err := cid.Cast(h.Cid); err == nil {
+			heads = append(heads, c.String())
+		}
+	}
+	return heads
+}
+
+// tracedBroadcaster records a span for every head announcement sent or
+// received on a topic, with the heads it carries, so that the DAG nodes
+// of a write can be followed from the node that made it to the ones
+// applying it.
+type tracedBroadcaster struct {
+	crdt.Broadcaster
+	topic string
+}
+
+func traceBroadcasts(topic string, b crdt.Broadcaster) crdt.Broadcaster {
+	return &tracedBroadcaster{Broadcaster: b, topic: topic}
+}
+
+func (b *tracedBroadcaster) Broadcast(data []byte) error {
+	_, span := tracer.Start(context.Background(), "crdt.Broadcast", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		attribute.String("topic", b.topic),
+		attribute.StringSlice("heads", headCIDs(data)),
+		attribute.Int("bytes", len(data)),
+	))
+	err := b.Broadcaster.Broadcast(data)
+	endSpan(span, err)
+	return err
+}
+
+func (b *tracedBroadcaster) Next() ([]byte, error) {
+	data, err := b.Broadcaster.Next()
+	if err != nil {
+		return nil, err
+	}
+	_, span := tracer.Start(context.Background(), "crdt.Receive", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+		attribute.String("topic", b.topic),
+		attribute.StringSlice("heads", headCIDs(data)),
+	))
+	span.End()
+	return data, nil
+}
+
+// traceApply records the application of a replicated write, with how
+// long after it was made it got applied here at now, from its HLC
+// timestamp. Deletes carry no timestamp.
+func traceApply(op string, k ds.Key, meta *dkv.Meta, now time.Time) trace.Span {
+	attrs := []attribute.KeyValue{attribute.String("op", op), attribute.String("key", k.String())}
+	if meta != nil {
+		attrs = append(attrs,
+			attribute.String("hlc", meta.HLC.String()),
+			attribute.Int64("replication.lag_ms", now.Sub(meta.HLC.Time()).Milliseconds()),
+		)
+	}
+	_, span := tracer.Start(context.Background(), "crdt.Apply", trace.WithAttributes(attrs...))
+	return span
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/multiformats/go-multiaddr"
+)
+
+// defaultListenAddrs are the addresses listened on without -listen: a
+// port drawn from rng on 127.0.0.1 over TCP.
+func defaultListenAddrs(rng *rand.Rand) []string {
+	return []string{fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", 4000+rng.Intn(1000))}
+}
+
+// parseListenAddrs parses the -listen addresses, checking that the node
+// has a transport for each:
+//
+//	/ip4/0.0.0.0/tcp/4001
+//	/ip4/0.0.0.0/udp/4001/quic-v1
+//	/ip4/0.0.0.0/udp/4001/quic-v1/webtransport
+//	/ip4/0.0.0.0/tcp/4002/ws
+//
+// Browsers join over WebSocket or WebTransport. Private networks only
+// have TCP and WebSocket, since the QUIC handshake cannot be wrapped in
+// the swarm key.
+func parseListenAddrs(addrs []string, private bool) ([]multiaddr.Multiaddr, error) {
+	var mas []multiaddr.Multiaddr
+	for _, a := range addrs {
+		ma, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			return nil, fmt.Errorf("-listen %s: %w", a, err)
+		}
+		switch t := listenTransport(ma); t {
+		case "tcp", "ws":
+		case "quic-v1", "webtransport":
+			if private {
+				return nil, fmt.Errorf("-listen %s: %s cannot be used with -swarm-key, use tcp or ws", a, t)
+			}
+		default:
+			return nil, fmt.Errorf("-listen %s: unsupported transport, use tcp, ws, quic-v1 or webtransport", a)
+		}
+		mas = append(mas, ma)
+	}
+	return mas, nil
+}
+
+// listenTransport names the transport of a listen address, or returns ""
+// when there is none for it.
+func listenTransport(ma multiaddr.Multiaddr) string {
+	var names []string
+	for _, p := range ma.Protocols() {
+		names = append(names, p.Name)
+	}
+	if len(names) < 2 {
+		return ""
+	}
+	switch strings.Join(names[1:], "/") {
+	case "tcp":
+		return "tcp"
+	case "tcp/ws":
+		return "ws"
+	case "udp/quic-v1":
+		return "quic-v1"
+	case "udp/quic-v1/webtransport":
+		return "webtransport"
+	}
+	return ""
+}
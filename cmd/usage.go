@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// usageNs is the namespace in the local datastore holding the usage
+// counters, under <kind>/<escaped account>. They are not replicated: each
+// gateway bills what it served.
+var usageNs = ds.NewKey("/usage")
+
+// The kinds of usage accounts.
+const (
+	// usageToken accounts the API requests made with a token, by token
+	// name, "anonymous" for the requests made without one.
+	usageToken = "token"
+	// usagePeer accounts the blocks served to a peer over bitswap as
+	// reads, and the head announcements it made as writes.
+	usagePeer = "peer"
+)
+
+// anonymousAccount is the account of the API requests made without a
+// token.
+const anonymousAccount = "anonymous"
+
+// usageFlushInterval is how often the usage-flush job saves the usage
+// counters by default.
+const usageFlushInterval = time.Minute
+
+type usageAccount struct {
+	Kind string
+	ID   string
+}
+
+// usageCounts are the counters of an account, since the last reset.
+type usageCounts struct {
+	Reads        uint64    `json:"reads"`
+	Writes       uint64    `json:"writes"`
+	BytesRead    uint64    `json:"bytes_read"`
+	BytesWritten uint64    `json:"bytes_written"`
+	Since        time.Time `json:"since"`
+}
+
+// usageMeter counts reads, writes and bytes by API token and by peer, so
+// that operators of gateways may enforce quotas or bill for them. The
+// counters are saved to the local datastore by the usage-flush job and on
+// close. A nil usageMeter counts nothing.
+type usageMeter struct {
+	store ds.Datastore
+	clock dkv.WallClock
+
+	mu     sync.Mutex
+	counts map[usageAccount]*usageCounts
+	dirty  map[usageAccount]bool
+}
+
+func usageKey(a usageAccount) ds.Key {
+	return usageNs.ChildString(a.Kind).ChildString(url.PathEscape(a.ID))
+}
+
+// loadUsage reads the usage counters kept in the local datastore. New
+// accounts are counted from the time of clock.
+func loadUsage(ctx context.Context, store ds.Datastore, clock dkv.WallClock) (*usageMeter, error) {
+	m := &usageMeter{store: store, clock: clock, counts: make(map[usageAccount]*usageCounts), dirty: make(map[usageAccount]bool)}
+	results, err := store.Query(ctx, query.Query{Prefix: usageNs.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		k := ds.RawKey(r.Key)
+		id, err := url.PathUnescape(k.BaseNamespace())
+		if err != nil {
+			continue
+		}
+		var c usageCounts
+		if err := json.Unmarshal(r.Value, &c); err != nil {
+			logger.Warnf("ignoring usage of %s: %s", k, err)
+			continue
+		}
+		m.counts[usageAccount{Kind: k.Parent().BaseNamespace(), ID: id}] = &c
+	}
+	return m, nil
+}
+
+// tokenAccount is the account of the requests made with a token.
+func tokenAccount(token *apiToken) string {
+	if token == nil {
+		return anonymousAccount
+	}
+	return token.Name
+}
+
+func (m *usageMeter) account(kind, id string) *usageCounts {
+	a := usageAccount{Kind: kind, ID: id}
+	c, ok := m.counts[a]
+	if !ok {
+		c = &usageCounts{Since: m.clock.Now().UTC()}
+		m.counts[a] = c
+	}
+	m.dirty[a] = true
+	return c
+}
+
+// read counts a read of n bytes.
+func (m *usageMeter) read(kind, id string, n int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.account(kind, id)
+	c.Reads++
+	c.BytesRead += uint64(n)
+}
+
+// write counts a write of n bytes.
+func (m *usageMeter) write(kind, id string, n int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.account(kind, id)
+	c.Writes++
+	c.BytesWritten += uint64(n)
+}
+
+type usageEntry struct {
+	Kind    string `json:"kind"`
+	Account string `json:"account"`
+	usageCounts
+}
+
+// snapshot returns the counters by kind and account.
+func (m *usageMeter) snapshot() []usageEntry {
+	m.mu.Lock()
+	entries := make([]usageEntry, 0, len(m.counts))
+	for a, c := range m.counts {
+		entries = append(entries, usageEntry{Kind: a.Kind, Account: a.ID, usageCounts: *c})
+	}
+	m.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Kind != entries[j].Kind {
+			return entries[i].Kind < entries[j].Kind
+		}
+		return entries[i].Account < entries[j].Account
+	})
+	return entries
+}
+
+// reset zeroes every counter, such as at the end of a billing period.
+func (m *usageMeter) reset(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for a := range m.counts {
+		if err := m.store.Delete(ctx, usageKey(a)); err != nil {
+			return err
+		}
+	}
+	m.counts = make(map[usageAccount]*usageCounts)
+	m.dirty = make(map[usageAccount]bool)
+	return nil
+}
+
+// flush saves the counters that changed since the last flush.
+func (m *usageMeter) flush(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for a := range m.dirty {
+		v, err := json.Marshal(m.counts[a])
+		if err != nil {
+			return err
+		}
+		if err := m.store.Put(ctx, usageKey(a), v); err != nil {
+			return err
+		}
+		delete(m.dirty, a)
+	}
+	return nil
+}
+
+var (
+	usageOpsDesc = prometheus.NewDesc("globaldb_usage_operations_total",
+		"Number of reads and writes by account, since the last usage reset.",
+		[]string{"kind", "account", "op"}, nil)
+	usageBytesDesc = prometheus.NewDesc("globaldb_usage_bytes_total",
+		"Bytes read and written by account, since the last usage reset.",
+		[]string{"kind", "account", "op"}, nil)
+)
+
+// Describe and Collect export the counters as Prometheus metrics.
+func (m *usageMeter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- usageOpsDesc
+	ch <- usageBytesDesc
+}
+
+func (m *usageMeter) Collect(ch chan<- prometheus.Metric) {
+	for _, e := range m.snapshot() {
+		ch <- prometheus.MustNewConstMetric(usageOpsDesc, prometheus.CounterValue, float64(e.Reads), e.Kind, e.Account, "read")
+		ch <- prometheus.MustNewConstMetric(usageOpsDesc, prometheus.CounterValue, float64(e.Writes), e.Kind, e.Account, "write")
+		ch <- prometheus.MustNewConstMetric(usageBytesDesc, prometheus.CounterValue, float64(e.BytesRead), e.Kind, e.Account, "read")
+		ch <- prometheus.MustNewConstMetric(usageBytesDesc, prometheus.CounterValue, float64(e.BytesWritten), e.Kind, e.Account, "write")
+	}
+}
+
+// usageTracer counts the head announcements each peer makes on the
+// topics of the databases as its writes. It is installed as a pubsub
+// tracer.
+type usageTracer struct {
+	noopTracer
+
+	usage  *usageMeter
+	topics map[string]bool
+}
+
+func newUsageTracer(usage *usageMeter, topics []string) *usageTracer {
+	t := &usageTracer{usage: usage, topics: make(map[string]bool)}
+	for _, topic := range topics {
+		t.topics[topic] = true
+	}
+	return t
+}
+
+func (t *usageTracer) DeliverMessage(msg *pubsub.Message) {
+	if t.topics[msg.GetTopic()] {
+		t.usage.write(usagePeer, msg.GetFrom().String(), len(msg.Data))
+	}
+}
+
+// servedBlock counts a block served to a peer as its read.
+func (m *usageMeter) servedBlock(p peer.ID, size int) {
+	m.read(usagePeer, p.String(), size)
+}
+
+// usage serves GET /admin/usage: the usage counters as CSV, or as JSON
+// with ?format=json.
+func (a *adminAPI) usage(w http.ResponseWriter, r *http.Request) {
+	if a.usageMeter == nil {
+		http.Error(w, "usage accounting is off, see -usage-accounting", http.StatusNotFound)
+		return
+	}
+	entries := a.usageMeter.snapshot()
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, entries)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"kind", "account", "reads", "writes", "bytes_read", "bytes_written", "since"})
+	for _, e := range entries {
+		cw.Write([]string{
+			e.Kind, e.Account,
+			strconv.FormatUint(e.Reads, 10), strconv.FormatUint(e.Writes, 10),
+			strconv.FormatUint(e.BytesRead, 10), strconv.FormatUint(e.BytesWritten, 10),
+			e.Since.Format(time.RFC3339),
+		})
+	}
+	cw.Flush()
+}
+
+// resetUsage serves POST /admin/usage/reset.
+func (a *adminAPI) resetUsage(w http.ResponseWriter, r *http.Request) {
+	if a.usageMeter == nil {
+		http.Error(w, "usage accounting is off, see -usage-accounting", http.StatusNotFound)
+		return
+	}
+	if err := a.usageMeter.reset(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	crdt "github.com/ipfs/go-ds-crdt"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// vectorsEpoch is the wall-clock time of the first write of the test
+// vectors. Every write is one millisecond after the one before.
+var vectorsEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// vectorWrite is a write of a scripted step.
+type vectorWrite struct {
+	Op  string `json:"op"` // "put" or "delete"
+	Key string `json:"key"`
+	// Payload is the value written, Value what is stored for it: the
+	// payload behind its metadata header, hex-encoded.
+	Payload string `json:"payload,omitempty"`
+	Value   string `json:"value,omitempty"`
+}
+
+// vectorStep is the outcome of a step: the DAG node it produced, the
+// broadcast announcing it and the state of the store after it.
+type vectorStep struct {
+	Writes []vectorWrite `json:"writes"`
+	// Block is the CID and hex-encoded bytes of the DAG node.
+	Block struct {
+		CID  string `json:"cid"`
+		Data string `json:"data"`
+	} `json:"block"`
+	// Broadcast is the hex-encoded pubsub message announcing the node.
+	Broadcast string   `json:"broadcast"`
+	Heads     []string `json:"heads"`
+	// Snapshot maps the keys of the store to their hex-encoded stored
+	// values.
+	Snapshot map[string]string `json:"snapshot"`
+}
+
+// vectors is the file written by gen-vectors.
+type vectors struct {
+	Version     int          `json:"version"`
+	Description string       `json:"description"`
+	Steps       []vectorStep `json:"steps"`
+}
+
+// vectorScript is the scripted sequence of operations: every step is
+// committed as one delta.
+var vectorScript = [][]vectorWrite{
+	{{Op: "put", Key: "/a", Payload: "1"}},
+	{{Op: "put", Key: "/b", Payload: "2"}},
+	{{Op: "put", Key: "/a", Payload: "3"}},
+	{{Op: "delete", Key: "/b"}},
+	{{Op: "put", Key: "/c/d", Payload: "4"}, {Op: "put", Key: "/c/e", Payload: "5"}, {Op: "delete", Key: "/a"}},
+}
+
+// captureBroadcaster keeps the messages the CRDT store broadcasts.
+type captureBroadcaster struct {
+	ctx  context.Context
+	sent [][]byte
+}
+
+func (b *captureBroadcaster) Broadcast(data []byte) error {
+	b.sent = append(b.sent, append([]byte{}, data...))
+	return nil
+}
+
+func (b *captureBroadcaster) Next() ([]byte, error) {
+	<-b.ctx.Done()
+	return nil, crdt.ErrNoMoreBroadcast
+}
+
+// runGenVectors runs
+//
+//	globaldb gen-vectors [dir]
+//
+// which replays a scripted sequence of writes on an in-memory CRDT store
+// with fixed timestamps and writes the DAG nodes, broadcasts and
+// snapshots they produce to dir/vectors.json. The output only depends on
+// the script, so that other implementations can check they encode the
+// same bytes.
+func runGenVectors(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: gen-vectors [dir]")
+	}
+	dir := "vectors"
+	if len(args) == 1 {
+		dir = args[0]
+	}
+	v, err := genVectors()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "vectors.json")
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %d steps to %s\n", len(v.Steps), path)
+	return nil
+}
+
+func genVectors() (*vectors, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+	bs := blockstore.NewBlockstore(store)
+	bcast := &captureBroadcaster{ctx: ctx}
+	opts := crdt.DefaultOptions()
+	opts.Logger = logging.Logger("vectors")
+	// Only the broadcasts of new deltas are wanted.
+	opts.RebroadcastInterval = time.Hour
+	c, err := crdt.New(store, ds.NewKey("crdt"), offlineDAG(bs), bcast, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// Close waits for the broadcast reader, which waits for ctx.
+		cancel()
+		c.Close()
+	}()
+
+	out := &vectors{
+		Version:     1,
+		Description: "globaldb CRDT test vectors: values are the d701 header, the big-endian HLC timestamp and the payload, in go-ds-crdt delta nodes",
+	}
+	hlc := dkv.TimestampFromTime(vectorsEpoch)
+	for _, writes := range vectorScript {
+		b, err := c.Batch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		step := vectorStep{}
+		for _, w := range writes {
+			k := ds.NewKey(w.Key)
+			if w.Op == "delete" {
+				err = b.Delete(ctx, k)
+			} else {
+				v := dkv.EncodeValue(dkv.Meta{HLC: hlc}, []byte(w.Payload))
+				hlc += 1 << 16
+				w.Value = hex.EncodeToString(v)
+				w.Payload = hex.EncodeToString([]byte(w.Payload))
+				err = b.Put(ctx, k, v)
+			}
+			if err != nil {
+				return nil, err
+			}
+			step.Writes = append(step.Writes, w)
+		}
+		sent := len(bcast.sent)
+		if err := b.Commit(ctx); err != nil {
+			return nil, err
+		}
+		if len(bcast.sent) != sent+1 {
+			return nil, fmt.Errorf("expected one broadcast per step, got %d", len(bcast.sent)-sent)
+		}
+		step.Broadcast = hex.EncodeToString(bcast.sent[sent])
+
+		heads := c.InternalStats().Heads
+		for _, h := range heads {
+			step.Heads = append(step.Heads, h.String())
+		}
+		if len(heads) != 1 {
+			return nil, fmt.Errorf("expected a single head, got %d", len(heads))
+		}
+		if err := vectorBlock(ctx, bs, heads[0], &step); err != nil {
+			return nil, err
+		}
+		if step.Snapshot, err = vectorSnapshot(ctx, c); err != nil {
+			return nil, err
+		}
+		out.Steps = append(out.Steps, step)
+	}
+	return out, nil
+}
+
+func vectorBlock(ctx context.Context, bs blockstore.Blockstore, c cid.Cid, step *vectorStep) error {
+	blk, err := bs.Get(ctx, c)
+	if err != nil {
+		return err
+	}
+	step.Block.CID = c.String()
+	step.Block.Data = hex.EncodeToString(blk.RawData())
+	return nil
+}
+
+func vectorSnapshot(ctx context.Context, c *crdt.Datastore) (map[string]string, error) {
+	results, err := c.Query(ctx, query.Query{})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	snap := make(map[string]string)
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		snap[r.Key] = hex.EncodeToString(r.Value)
+	}
+	return snap, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/arcinston/dkv/lightclient"
+	"github.com/arcinston/dkv/pkg/dkv"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/ipfs/go-ds-crdt/pb"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// deletesNs holds the records of deletes, as deletesNs/<stored key>. With
+// -signed-writes, every delete is written along with a signed record in
+// the same delta, as the tombstones of go-ds-crdt carry nothing a
+// signature could go in. The record is a value like any other, so a peer
+// that deletes a key signs it, and the deltas holding tombstones without
+// their record are rejected.
+//
+// A record holds the IDs of the elements the delete tombstones, one per
+// line, and only covers those: copied into another delta, it cannot
+// delete the values written since.
+var deletesNs = systemNs.ChildString("deletes")
+
+// errRejected is returned for the DAG nodes carrying deltas the node
+// rejects.
+var errRejected = errors.New("delta rejected")
+
+// rejected tells whether an error is that of a value that does not pass
+// -signed-writes or the ACL, which is skipped rather than returned when
+// listing.
+func rejected(err error) bool {
+	return errors.Is(err, dkv.ErrUnsigned) || errors.Is(err, dkv.ErrSignature) || errors.Is(err, ErrDenied)
+}
+
+// deleteOps returns the writes removing a key, along with its record when
+// deletes are signed. The caller checks that the key may be deleted.
+func (d *db) deleteOps(ctx context.Context, k ds.Key) ([]batchOp, error) {
+	sk := d.keys.stored(k)
+	// Records are not recorded themselves: dropping one deletes no data.
+	if !d.pipelines.SignaturesRequired() || deletesNs.IsAncestorOf(k) {
+		return []batchOp{{k: sk}}, nil
+	}
+	rk := deletesNs.Child(sk)
+	ids, err := d.liveIDs(ctx, sk)
+	if err != nil {
+		return nil, err
+	}
+	meta := dkv.Meta{HLC: d.clock.Now()}
+	v, err := d.pipelines.Encode(rk, meta, []byte(strings.Join(ids, "\n")))
+	if err != nil {
+		return nil, err
+	}
+	record := batchOp{k: rk, v: dkv.EncodeValue(meta, v), label: kvNamespaces.label(rk)}
+	// go-ds-crdt commits a batch by itself right after the write that
+	// makes its delta outgrow MaxBatchDeltaSize. The record goes on both
+	// sides of the tombstones, so that the delta holding them has it
+	// either way.
+	return []batchOp{record, {k: sk}, record}, nil
+}
+
+// liveIDs returns the IDs of the elements holding the stored key sk that
+// are not tombstoned yet, which is what deleting sk tombstones. They are
+// read from the set of the CRDT store, under ns/s: its elements are kept
+// as s/<key>/<id> and its tombstones as t/<key>/<id>. A value merged
+// between this and the delete is tombstoned too, and the other nodes then
+// reject the delete for lack of a record covering it.
+func (d *db) liveIDs(ctx context.Context, sk ds.Key) ([]string, error) {
+	set := d.ns.ChildString("s")
+	elems := set.ChildString("s").Child(sk)
+	results, err := d.store.Query(ctx, query.Query{Prefix: elems.String(), KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	var ids []string
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		// IDs keep their leading slash, as in tombstones. Elements of the
+		// keys under sk are skipped.
+		id := strings.TrimPrefix(r.Key, elems.String())
+		if !ds.RawKey(id).IsTopLevel() {
+			continue
+		}
+		tombed, err := d.store.Has(ctx, set.ChildString("t").Child(sk).ChildString(id))
+		if err != nil {
+			return nil, err
+		}
+		if !tombed {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// deleteRecord is a record of deletes as read from a delta.
+type deleteRecord struct {
+	signer crypto.PubKey
+	ids    map[string]bool
+}
+
+// verifiedDAG checks the deltas of the DAG nodes before the CRDT store
+// merges them. With -signed-writes, a node carrying a value that is not
+// signed, or whose signature does not check out, or a tombstone without
+// its signed record, fails to load, as does one writing or deleting a key
+// its signer may not write under the ACL. The CRDT store then leaves the
+// branch of the DAG holding it unmerged, rather than storing values that
+// reads would reject.
+type verifiedDAG struct {
+	ipld.DAGService
+	pipelines *dkv.Pipelines
+	keys      keyMapper
+	// acl is nil when any signer may write any key.
+	acl *peerACL
+}
+
+func (d *verifiedDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	nd, err := d.DAGService.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.verify(nd); err != nil {
+		return nil, err
+	}
+	return nd, nil
+}
+
+func (d *verifiedDAG) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	in := d.DAGService.GetMany(ctx, cids)
+	out := make(chan *ipld.NodeOption, len(cids))
+	go func() {
+		defer close(out)
+		for opt := range in {
+			if opt.Err == nil {
+				if err := d.verify(opt.Node); err != nil {
+					opt = &ipld.NodeOption{Err: err}
+				}
+			}
+			out <- opt
+		}
+	}()
+	return out
+}
+
+// verify checks the delta of a node.
+func (d *verifiedDAG) verify(nd ipld.Node) error {
+	if !d.pipelines.SignaturesRequired() {
+		return nil
+	}
+	delta, err := lightclient.NodeDelta(nd)
+	if err != nil {
+		deltasRejected.WithLabelValues("malformed").Inc()
+		return fmt.Errorf("%w: %s: %s", errRejected, nd.Cid(), err)
+	}
+	if reason, err := d.verifyDelta(delta); err != nil {
+		deltasRejected.WithLabelValues(reason).Inc()
+		return fmt.Errorf("%w: %s: %s", errRejected, nd.Cid(), err)
+	}
+	return nil
+}
+
+// verifyDelta checks the values and tombstones of a delta, returning the
+// reason of the rejection along with the error.
+func (d *verifiedDAG) verifyDelta(delta *pb.Delta) (string, error) {
+	// records are the records of deletes of the delta, by stored key.
+	records := make(map[string]deleteRecord)
+	for _, e := range delta.GetElements() {
+		sk := ds.NewKey(e.GetKey())
+		k := d.keys.plain(sk)
+		meta, payload := dkv.DecodeValue(e.GetValue())
+		// Records are read for the IDs they cover, and checked against
+		// the keys they delete.
+		if deletesNs.IsAncestorOf(sk) {
+			ids, pub, err := d.pipelines.DecodeSigner(k, meta, payload)
+			if err != nil {
+				return signatureReason(err), fmt.Errorf("%s: %w", k, err)
+			}
+			rec := deleteRecord{signer: pub, ids: make(map[string]bool)}
+			for _, id := range strings.Split(string(ids), "\n") {
+				rec.ids[id] = true
+			}
+			records[sk.String()] = rec
+			continue
+		}
+		pub, err := d.pipelines.Verify(k, meta, payload)
+		if err != nil {
+			return signatureReason(err), fmt.Errorf("%s: %w", k, err)
+		}
+		if d.acl != nil && pub != nil {
+			if err := d.acl.authorize(k, pub); err != nil {
+				return "acl", err
+			}
+		}
+	}
+	for _, t := range delta.GetTombstones() {
+		sk := ds.NewKey(t.GetKey())
+		if deletesNs.IsAncestorOf(sk) {
+			continue
+		}
+		k := d.keys.plain(sk)
+		rec, ok := records[deletesNs.Child(sk).String()]
+		if !ok || rec.signer == nil {
+			return "delete", fmt.Errorf("%s: deleted without a signed record", k)
+		}
+		if !rec.ids[t.GetId()] {
+			return "delete", fmt.Errorf("%s: the record of the delete does not cover %s", k, t.GetId())
+		}
+		if d.acl != nil {
+			if err := d.acl.authorize(k, rec.signer); err != nil {
+				return "acl", err
+			}
+		}
+	}
+	return "", nil
+}
+
+// signatureReason is the reason a value failing to verify is counted
+// under.
+func signatureReason(err error) string {
+	if errors.Is(err, dkv.ErrUnsigned) {
+		return "unsigned"
+	}
+	return "signature"
+}
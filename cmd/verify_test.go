@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/arcinston/dkv/pkg/dkv"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-ds-crdt/pb"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"google.golang.org/protobuf/proto"
+)
+
+// signedElement is the element of a delta putting v on k, signed by priv.
+func signedElement(t *testing.T, priv crypto.PrivKey, k ds.Key, v string) *pb.Element {
+	t.Helper()
+	sign, err := dkv.Sign(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := dkv.NewPipelines()
+	if err := p.Add(ds.NewKey("/"), dkv.Pipeline{sign}); err != nil {
+		t.Fatal(err)
+	}
+	meta := dkv.Meta{HLC: 1}
+	enc, err := p.Encode(k, meta, []byte(v))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pb.Element{Key: k.String(), Value: dkv.EncodeValue(meta, enc)}
+}
+
+func TestVerifiedDAG(t *testing.T) {
+	writer, writerID := newTestPeer(t)
+	outsider, _ := newTestPeer(t)
+	acl, err := loadACL("", []string{writerID.String()}, writerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipelines := dkv.NewPipelines()
+	pipelines.RequireSigned()
+	vd := &verifiedDAG{pipelines: pipelines, acl: acl}
+
+	k := ds.NewKey("/a")
+	record := deletesNs.Child(k)
+	tombstone := &pb.Element{Key: k.String(), Id: "/id1"}
+	forged := signedElement(t, writer, k, "1")
+	forged.Value[len(forged.Value)-8] ^= 1
+	tests := []struct {
+		name       string
+		elements   []*pb.Element
+		tombstones []*pb.Element
+		// reason is what the delta is rejected for, empty when accepted.
+		reason string
+	}{
+		{"signed put", []*pb.Element{signedElement(t, writer, k, "1")}, nil, ""},
+		{"unsigned put", []*pb.Element{{Key: k.String(), Value: dkv.EncodeValue(dkv.Meta{HLC: 1}, []byte("1"))}}, nil, "unsigned"},
+		{"forged put", []*pb.Element{forged}, nil, "signature"},
+		{"put outside the ACL", []*pb.Element{signedElement(t, outsider, k, "1")}, nil, "acl"},
+		{"signed delete", []*pb.Element{signedElement(t, writer, record, "/id1")}, []*pb.Element{tombstone}, ""},
+		{"delete without a record", nil, []*pb.Element{tombstone}, "delete"},
+		{"record of other elements", []*pb.Element{signedElement(t, writer, record, "/id2\n/id3")}, []*pb.Element{tombstone}, "delete"},
+		{"unsigned record", []*pb.Element{{Key: record.String(), Value: dkv.EncodeValue(dkv.Meta{HLC: 1}, []byte("/id1"))}}, []*pb.Element{tombstone}, "unsigned"},
+		{"delete outside the ACL", []*pb.Element{signedElement(t, outsider, record, "/id1")}, []*pb.Element{tombstone}, "acl"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delta := &pb.Delta{Elements: tt.elements, Tombstones: tt.tombstones, Priority: 1}
+			reason, err := vd.verifyDelta(delta)
+			if reason != tt.reason {
+				t.Errorf("rejected for %q (%v), want %q", reason, err, tt.reason)
+			}
+			data, err := proto.Marshal(delta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = vd.verify(merkledag.NodeWithData(data))
+			if rejected := errors.Is(err, errRejected); rejected != (tt.reason != "") {
+				t.Errorf("verify: %v, want rejected %t", err, tt.reason != "")
+			}
+		})
+	}
+}
+
+func TestVerifiedDAGUnsignedAllowed(t *testing.T) {
+	vd := &verifiedDAG{pipelines: dkv.NewPipelines()}
+	delta := &pb.Delta{
+		Elements:   []*pb.Element{{Key: "/a", Value: []byte("x")}},
+		Tombstones: []*pb.Element{{Key: "/b", Id: "/id"}},
+	}
+	data, err := proto.Marshal(delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vd.verify(merkledag.NodeWithData(data)); err != nil {
+		t.Errorf("verify without -signed-writes: %v", err)
+	}
+}
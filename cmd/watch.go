@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/arcinston/dkv/pkg/dkvpb"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// replWatching is set while the REPL watches a prefix, so that the hooks
+// do not print every change on top of the watched ones.
+var replWatching atomic.Bool
+
+// replWatch prints the changes under a prefix as they are applied, until
+// a line is entered. It returns false when the REPL should stop, because
+// stdin was closed or the process was interrupted.
+func replWatch(wh *watchHub, prefix ds.Key, lines <-chan string, signals <-chan os.Signal) bool {
+	w := wh.subscribe(prefix)
+	defer wh.unsubscribe(w)
+	replWatching.Store(true)
+	defer replWatching.Store(false)
+	fmt.Printf("Watching %s, press Enter to stop\n", prefix)
+	for {
+		select {
+		case e := <-w.events:
+			if e.Op == dkvpb.Event_OP_DELETE {
+				fmt.Printf("delete [%s]\n", e.Key)
+			} else {
+				fmt.Printf("put [%s] -> %s\n", e.Key, e.Value)
+			}
+		case <-w.lagged:
+			fmt.Println("fell too far behind, stopped watching")
+			return true
+		case _, ok := <-lines:
+			return ok
+		case <-signals:
+			fmt.Println()
+			return false
+		}
+	}
+}
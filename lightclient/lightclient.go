@@ -0,0 +1,192 @@
+// Package lightclient reads and verifies globaldb entries without joining
+// the network. It needs no pubsub and no local datastore: it starts from
+// head CIDs the caller trusts (obtained from IPNS, a gateway or a signed
+// proof) and fetches the DAG blocks it needs from any IPFS gateway that
+// serves raw blocks, checking each one against its CID.
+package lightclient
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ipfs/boxo/ipld/merkledag"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ds-crdt/pb"
+	ipld "github.com/ipfs/go-ipld-format"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrNotFound is returned when the key has no value in the DAG.
+var ErrNotFound = errors.New("key not found")
+
+// maxBlockSize bounds how much is read from the gateway for one block.
+const maxBlockSize = 4 << 20
+
+// NodeDelta decodes the CRDT delta carried by a DAG node.
+func NodeDelta(nd ipld.Node) (*pb.Delta, error) {
+	protonode, ok := nd.(*merkledag.ProtoNode)
+	if !ok {
+		return nil, errors.New("node is not a ProtoNode")
+	}
+	d := &pb.Delta{}
+	err := proto.Unmarshal(protonode.Data(), d)
+	return d, err
+}
+
+// Client fetches blocks from an IPFS gateway.
+type Client struct {
+	// Gateway is the base URL of the gateway, e.g. https://ipfs.io.
+	Gateway string
+	// HTTPClient is used for the requests. http.DefaultClient is used
+	// when nil.
+	HTTPClient *http.Client
+	// MaxNodes bounds how many DAG nodes Get walks before giving up. 0
+	// means no limit.
+	MaxNodes int
+	// Blocks, when set, fetches the blocks instead of the gateway, such
+	// as from the blockstore or the bitswap session of a node. They are
+	// still checked against their CID.
+	Blocks func(ctx context.Context, id cid.Cid) (blocks.Block, error)
+}
+
+// New returns a client using the given gateway.
+func New(gateway string) *Client {
+	return &Client{Gateway: strings.TrimSuffix(gateway, "/")}
+}
+
+// Block fetches a raw block and checks that it matches its CID.
+func (c *Client) Block(ctx context.Context, id cid.Cid) (blocks.Block, error) {
+	if c.Blocks != nil {
+		blk, err := c.Blocks(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		return blocks.NewBlockWithCid(blk.RawData(), id)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Gateway+"/ipfs/"+id.String()+"?format=raw", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.raw")
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gateway returned %s for %s", resp.Status, id)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBlockSize))
+	if err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithCid(data, id)
+}
+
+// Node fetches a DAG node and decodes its delta.
+func (c *Client) Node(ctx context.Context, id cid.Cid) (ipld.Node, *pb.Delta, error) {
+	blk, err := c.Block(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	nd, err := merkledag.DecodeProtobufBlock(blk)
+	if err != nil {
+		return nil, nil, err
+	}
+	delta, err := NodeDelta(nd)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nd, delta, nil
+}
+
+// Get returns the value of key, as stored, according to the given heads.
+// It walks the DAG from the highest nodes down and stops at the first
+// height where the key was written or deleted. When several writes share
+// that height the greatest value wins, as in the CRDT store. Deletes are
+// taken to remove every earlier write, which holds unless a write was
+// concurrent with the delete.
+func (c *Client) Get(ctx context.Context, heads []cid.Cid, key string) ([]byte, error) {
+	q := &nodeQueue{}
+	visited := cid.NewSet()
+	push := func(id cid.Cid) error {
+		if !visited.Visit(id) {
+			return nil
+		}
+		if c.MaxNodes > 0 && visited.Len() > c.MaxNodes {
+			return fmt.Errorf("gave up after walking %d nodes", c.MaxNodes)
+		}
+		nd, delta, err := c.Node(ctx, id)
+		if err != nil {
+			return err
+		}
+		heap.Push(q, queuedNode{nd, delta})
+		return nil
+	}
+	for _, h := range heads {
+		if err := push(h); err != nil {
+			return nil, err
+		}
+	}
+
+	var found []byte
+	var foundAt uint64
+	for q.Len() > 0 {
+		n := heap.Pop(q).(queuedNode)
+		prio := n.delta.GetPriority()
+		if found != nil && prio < foundAt {
+			break
+		}
+		for _, e := range n.delta.GetTombstones() {
+			if e.GetKey() == key && found == nil {
+				return nil, ErrNotFound
+			}
+		}
+		for _, e := range n.delta.GetElements() {
+			if e.GetKey() == key && (found == nil || string(e.GetValue()) > string(found)) {
+				found, foundAt = e.GetValue(), prio
+			}
+		}
+		if found != nil {
+			continue
+		}
+		for _, l := range n.nd.Links() {
+			if err := push(l.Cid); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+type queuedNode struct {
+	nd    ipld.Node
+	delta *pb.Delta
+}
+
+// nodeQueue is a max-heap of nodes by height.
+type nodeQueue []queuedNode
+
+func (q nodeQueue) Len() int            { return len(q) }
+func (q nodeQueue) Less(i, j int) bool  { return q[i].delta.GetPriority() > q[j].delta.GetPriority() }
+func (q nodeQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *nodeQueue) Push(x interface{}) { *q = append(*q, x.(queuedNode)) }
+func (q *nodeQueue) Pop() interface{} {
+	old := *q
+	n := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return n
+}
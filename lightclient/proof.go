@@ -0,0 +1,151 @@
+package lightclient
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/boxo/ipld/merkledag"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// headSignaturePrefix is prepended to what a node signs when vouching for
+// one of its heads, so that the signature cannot be mistaken for anything
+// else signed with the same key.
+var headSignaturePrefix = []byte("globaldb-head:")
+
+// HeadSignatureData returns the bytes a node signs to vouch for head at
+// the given time.
+func HeadSignatureData(head cid.Cid, signed time.Time) []byte {
+	buf := append([]byte{}, headSignaturePrefix...)
+	buf = append(buf, head.Bytes()...)
+	return binary.BigEndian.AppendUint64(buf, uint64(signed.UnixNano()))
+}
+
+// Proof shows that a key was given a value by a DAG node reachable from a
+// head signed by some peer. It can be checked without access to the
+// network or to any datastore, against the peers or heads the reader
+// trusts: anyone can sign a head of their own.
+//
+// A proof does not show that the value is current. Deltas after the one
+// it points at, which it does not carry, may have overwritten or deleted
+// the key since.
+type Proof struct {
+	Key string `json:"key"`
+	// Value is the value as stored, metadata included.
+	Value []byte `json:"value"`
+	Head  string `json:"head"`
+	// Signer is the peer that vouches for Head at Signed.
+	Signer    string    `json:"signer"`
+	Signed    time.Time `json:"signed"`
+	Signature []byte    `json:"signature"`
+	// Path holds the raw blocks from the head down to the node that
+	// carries the value. Each block links to the next one.
+	Path [][]byte `json:"path"`
+}
+
+// Trust lists the signers and heads a proof may be vouched for by.
+type Trust struct {
+	Signers []peer.ID
+	Heads   []cid.Cid
+}
+
+// ErrUntrusted is returned for proofs whose signer and head are both
+// untrusted.
+var ErrUntrusted = errors.New("proof is neither signed by a trusted peer nor under a trusted head")
+
+// VerifyTrusted checks that the proof is signed by one of the trusted
+// signers or that its head is one of the trusted heads, that the head is
+// signed by the signer, that every block of the path hashes to the CID
+// its parent links to and that the last block sets the key to the value.
+func (p *Proof) VerifyTrusted(trust Trust) error {
+	if !trust.allows(p) {
+		return fmt.Errorf("%w: signer %s, head %s", ErrUntrusted, p.Signer, p.Head)
+	}
+	return p.verify()
+}
+
+func (t Trust) allows(p *Proof) bool {
+	for _, s := range t.Signers {
+		if s.String() == p.Signer {
+			return true
+		}
+	}
+	for _, h := range t.Heads {
+		if h.String() == p.Head {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proof) verify() error {
+	head, err := cid.Decode(p.Head)
+	if err != nil {
+		return fmt.Errorf("invalid head: %w", err)
+	}
+	signer, err := peer.Decode(p.Signer)
+	if err != nil {
+		return fmt.Errorf("invalid signer: %w", err)
+	}
+	pub, err := signer.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("cannot get the public key of %s: %w", signer, err)
+	}
+	ok, err := pub.Verify(HeadSignatureData(head, p.Signed), p.Signature)
+	if err != nil || !ok {
+		return errors.New("head signature does not verify")
+	}
+	if len(p.Path) == 0 {
+		return errors.New("empty path")
+	}
+
+	want := head
+	var nd *merkledag.ProtoNode
+	for i, data := range p.Path {
+		blk, err := blocks.NewBlockWithCid(data, want)
+		if err != nil {
+			return fmt.Errorf("block %d does not match %s: %w", i, want, err)
+		}
+		nd, err = merkledag.DecodeProtobuf(blk.RawData())
+		if err != nil {
+			return fmt.Errorf("decoding block %d: %w", i, err)
+		}
+		if i == len(p.Path)-1 {
+			break
+		}
+		// Blocks of the same DAG share the CID settings of the head.
+		next, err := want.Prefix().Sum(p.Path[i+1])
+		if err != nil {
+			return err
+		}
+		if !linksTo(nd, next) {
+			return fmt.Errorf("block %d does not link to block %d", i, i+1)
+		}
+		want = next
+	}
+
+	delta, err := NodeDelta(nd)
+	if err != nil {
+		return err
+	}
+	for _, e := range delta.GetElements() {
+		if e.GetKey() == p.Key && bytes.Equal(e.GetValue(), p.Value) {
+			return nil
+		}
+	}
+	return fmt.Errorf("last block does not set %s to the given value", p.Key)
+}
+
+func linksTo(nd *merkledag.ProtoNode, c cid.Cid) bool {
+	for _, l := range nd.Links() {
+		if l.Cid.Equals(c) {
+			return true
+		}
+	}
+	return false
+}
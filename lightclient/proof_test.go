@@ -0,0 +1,115 @@
+package lightclient
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-ds-crdt/pb"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/proto"
+)
+
+func deltaNode(t *testing.T, key, value string, priority uint64) *merkledag.ProtoNode {
+	t.Helper()
+	data, err := proto.Marshal(&pb.Delta{
+		Elements: []*pb.Element{{Key: key, Id: "/id", Value: []byte(value)}},
+		Priority: priority,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return merkledag.NodeWithData(data)
+}
+
+// testProof returns a proof that leaf, linked to by head, sets /a to 1,
+// signed by priv.
+func testProof(t *testing.T, priv crypto.PrivKey) *Proof {
+	t.Helper()
+	leaf := deltaNode(t, "/a", "1", 1)
+	head := deltaNode(t, "/b", "2", 2)
+	if err := head.AddNodeLink("", leaf); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sig, err := priv.Sign(HeadSignatureData(head.Cid(), signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Proof{
+		Key:       "/a",
+		Value:     []byte("1"),
+		Head:      head.Cid().String(),
+		Signer:    signer.String(),
+		Signed:    signed,
+		Signature: sig,
+		Path:      [][]byte{head.RawData(), leaf.RawData()},
+	}
+}
+
+func TestProofVerifyTrusted(t *testing.T) {
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// unlinked sets the value too, but the head does not link to it.
+	unlinked := deltaNode(t, "/a", "1", 3)
+	tests := []struct {
+		name string
+		// trust is nil to trust the signer.
+		trust  func(p *Proof) Trust
+		tamper func(p *Proof)
+		ok     bool
+		err    error
+	}{
+		{"trusted signer", nil, func(*Proof) {}, true, nil},
+		{"trusted head", func(p *Proof) Trust { return Trust{Heads: []cid.Cid{cid.MustParse(p.Head)}} }, func(*Proof) {}, true, nil},
+		{"untrusted", func(*Proof) Trust { return Trust{} }, func(*Proof) {}, false, ErrUntrusted},
+		{"other value", nil, func(p *Proof) { p.Value = []byte("2") }, false, nil},
+		{"other key", nil, func(p *Proof) { p.Key = "/b" }, false, nil},
+		{"signed at another time", nil, func(p *Proof) { p.Signed = p.Signed.Add(time.Second) }, false, nil},
+		{"signed by another key", nil, func(p *Proof) {
+			sig, err := other.Sign(HeadSignatureData(cid.MustParse(p.Head), p.Signed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Signature = sig
+		}, false, nil},
+		{"block swapped", nil, func(p *Proof) { p.Path[1] = unlinked.RawData() }, false, nil},
+		{"head swapped", nil, func(p *Proof) { p.Path[0] = p.Path[1] }, false, nil},
+		{"empty path", nil, func(p *Proof) { p.Path = nil }, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testProof(t, priv)
+			trust := Trust{Signers: []peer.ID{signer}}
+			if tt.trust != nil {
+				trust = tt.trust(p)
+			}
+			tt.tamper(p)
+			err := p.VerifyTrusted(trust)
+			if (err == nil) != tt.ok {
+				t.Fatalf("VerifyTrusted: %v, want ok %t", err, tt.ok)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("VerifyTrusted: %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
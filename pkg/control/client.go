@@ -0,0 +1,183 @@
+// Package control is a client for the control API a globaldb daemon
+// serves on a Unix socket, or on a loopback address where there are none.
+// It is what the dkv command and the client subcommands of globaldb use to
+// work with the store of a running node.
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Socket is the name of the control socket in the folder of a node.
+const Socket = "control.sock"
+
+// DefaultAddr is where a daemon started with the same environment
+// listens: $GLOBALDB_CONTROL, or else <data-dir>/<name>/control.sock.
+func DefaultAddr() string {
+	if v := os.Getenv("GLOBALDB_CONTROL"); v != "" {
+		return v
+	}
+	dir := os.Getenv("GLOBALDB_DATA_DIR")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, "globaldb-example")
+	}
+	name := os.Getenv("GLOBALDB_NAME")
+	if name == "" {
+		name = "node"
+	}
+	return filepath.Join(dir, name, Socket)
+}
+
+// Entry is a key and its value, as listed by List.
+type Entry struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// Peer is a connected peer, as listed by Peers.
+type Peer struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// CatalogEntry is a database advertised in the catalog, as listed by
+// Catalog.
+type CatalogEntry struct {
+	Name        string    `json:"name"`
+	Topic       string    `json:"topic"`
+	Description string    `json:"description,omitempty"`
+	Schema      string    `json:"schema,omitempty"`
+	Access      string    `json:"access"`
+	Publisher   string    `json:"publisher"`
+	Updated     time.Time `json:"updated"`
+}
+
+// Client calls the control API of a daemon.
+type Client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// New returns a client of the daemon listening on addr, a Unix socket
+// path or a host:port. The token is only checked over TCP.
+func New(addr, token string) *Client {
+	c := &Client{base: "http://" + addr, token: token, http: &http.Client{}}
+	if _, _, err := net.SplitHostPort(addr); err != nil || strings.Contains(addr, "/") {
+		// Over the Unix socket the host of the URLs does not matter.
+		c.base = "http://globaldb"
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", addr)
+			},
+		}
+	}
+	return c
+}
+
+// do calls the API and returns the response body, failing on errors.
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach the daemon, is it running? %w", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, errors.New(strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
+
+func keyPath(k string) string {
+	return "/v1/kv/" + strings.TrimPrefix(k, "/")
+}
+
+// Put stores a value on a key.
+func (c *Client) Put(ctx context.Context, key string, value []byte) error {
+	_, err := c.do(ctx, http.MethodPut, keyPath(key), strings.NewReader(string(value)))
+	return err
+}
+
+// Get returns the value of a key.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	return c.do(ctx, http.MethodGet, keyPath(key), nil)
+}
+
+// Delete deletes a key.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.do(ctx, http.MethodDelete, keyPath(key), nil)
+	return err
+}
+
+// List returns the keys under a prefix with their values, at most limit
+// of them unless it is 0.
+func (c *Client) List(ctx context.Context, prefix string, limit int) ([]Entry, error) {
+	q := url.Values{"prefix": {prefix}}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	b, err := c.do(ctx, http.MethodGet, "/v1/kv?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	return entries, json.Unmarshal(b, &entries)
+}
+
+// Peers returns the peers the node is connected to.
+func (c *Client) Peers(ctx context.Context) ([]Peer, error) {
+	b, err := c.do(ctx, http.MethodGet, "/v1/peers", nil)
+	if err != nil {
+		return nil, err
+	}
+	var peers []Peer
+	return peers, json.Unmarshal(b, &peers)
+}
+
+// Status returns the state of the node, as GET /v1/status reports it.
+func (c *Client) Status(ctx context.Context) (map[string]interface{}, error) {
+	b, err := c.do(ctx, http.MethodGet, "/v1/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	var status map[string]interface{}
+	return status, json.Unmarshal(b, &status)
+}
+
+// Catalog returns the databases advertised in the catalog of the node.
+func (c *Client) Catalog(ctx context.Context) ([]CatalogEntry, error) {
+	b, err := c.do(ctx, http.MethodGet, "/v1/catalog", nil)
+	if err != nil {
+		return nil, err
+	}
+	var entries []CatalogEntry
+	return entries, json.Unmarshal(b, &entries)
+}
@@ -0,0 +1,232 @@
+package dkv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// Keys of the change log in the datastore: entries as
+// changeLogNs/e/<seq>, and the cursors of consumer groups as
+// changeLogNs/c/<group>.
+var (
+	changeLogNs      = ds.NewKey("/changelog")
+	changeEntriesNs  = changeLogNs.ChildString("e")
+	changeCursorsNs  = changeLogNs.ChildString("c")
+	errChangesClosed = errors.New("dkv: node closed")
+)
+
+// ErrChangesDisabled is returned by Changes when Config.ChangeLog is 0.
+var ErrChangesDisabled = errors.New("dkv: the change log is disabled, set Config.ChangeLog")
+
+// ErrGroupBusy is returned by Changes when the group is already being
+// consumed.
+var ErrGroupBusy = errors.New("dkv: consumer group already open")
+
+// ErrCompacted is returned by Consumer.Next when changes the group had not
+// got yet were dropped from the change log. The next call continues with
+// the oldest change kept; what was missed can be caught up with Query.
+var ErrCompacted = errors.New("dkv: changes were dropped before the consumer group got them")
+
+// Change is an event of the change log along with its position.
+type Change struct {
+	// Seq numbers the changes applied by this node, from 1.
+	Seq uint64
+	Event
+}
+
+// changeLog keeps the last changes applied to the database in the
+// datastore, so that consumer groups get every change, across restarts
+// of the node or of the consumer.
+type changeLog struct {
+	store ds.Datastore
+	size  uint64
+
+	mu      sync.Mutex
+	first   uint64 // oldest kept, 0 when empty
+	last    uint64
+	updated chan struct{} // closed and replaced on every change
+	closed  chan struct{}
+	groups  map[string]bool
+}
+
+func changeKey(seq uint64) ds.Key {
+	return changeEntriesNs.ChildString(fmt.Sprintf("%020d", seq))
+}
+
+// openChangeLog loads the bounds of the change log in store.
+func openChangeLog(ctx context.Context, store ds.Datastore, size int) (*changeLog, error) {
+	l := &changeLog{
+		store:   store,
+		size:    uint64(size),
+		updated: make(chan struct{}),
+		closed:  make(chan struct{}),
+		groups:  make(map[string]bool),
+	}
+	// Badger cannot iterate a prefix backwards, and the log is bounded:
+	// scan it for its bounds.
+	results, err := store.Query(ctx, query.Query{Prefix: changeEntriesNs.String(), KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	for r := range results.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		seq, err := strconv.ParseUint(ds.RawKey(r.Key).Name(), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("dkv: change log entry %s: %w", r.Key, err)
+		}
+		if l.first == 0 {
+			l.first = seq
+		}
+		l.last = seq
+	}
+	return l, nil
+}
+
+// append records an event, dropping the oldest one when the log is full.
+func (l *changeLog) append(e Event) {
+	v, err := json.Marshal(e)
+	if err != nil {
+		logger.Errorf("change log: %s", err)
+		return
+	}
+	ctx := context.Background()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.store.Put(ctx, changeKey(l.last+1), v); err != nil {
+		logger.Errorf("change log: %s", err)
+		return
+	}
+	l.last++
+	if l.first == 0 {
+		l.first = l.last
+	}
+	for l.last-l.first >= l.size {
+		if err := l.store.Delete(ctx, changeKey(l.first)); err != nil {
+			logger.Errorf("change log: %s", err)
+			break
+		}
+		l.first++
+	}
+	close(l.updated)
+	l.updated = make(chan struct{})
+}
+
+func (l *changeLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+}
+
+// Consumer reads the changes of a consumer group in order. It is not safe
+// for concurrent use.
+type Consumer struct {
+	log   *changeLog
+	group string
+	// next is the sequence number of the next change to deliver.
+	next uint64
+}
+
+// Changes opens the consumer group name. Groups are independent: each
+// one gets every change applied to the database, put or delete, local or
+// from a peer, in the order this node applied them, starting after the
+// last change it acknowledged. Changes not acknowledged before a restart
+// are delivered again, so consumers must handle repeats.
+//
+// A group is read by a single consumer at a time, until it is closed.
+// New groups start with the oldest change kept.
+func (d *DB) Changes(ctx context.Context, group string) (*Consumer, error) {
+	if d.changes == nil {
+		return nil, ErrChangesDisabled
+	}
+	if group == "" || ds.NewKey(group).String() != "/"+group {
+		return nil, fmt.Errorf("dkv: invalid consumer group name %q", group)
+	}
+	l := d.changes
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.groups[group] {
+		return nil, ErrGroupBusy
+	}
+	c := &Consumer{log: l, group: group, next: 1}
+	v, err := l.store.Get(ctx, changeCursorsNs.ChildString(group))
+	switch {
+	case err == nil:
+		acked, err := strconv.ParseUint(string(v), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("dkv: cursor of %s: %w", group, err)
+		}
+		c.next = acked + 1
+	case errors.Is(err, ds.ErrNotFound):
+		c.next = max(l.first, 1)
+	default:
+		return nil, err
+	}
+	l.groups[group] = true
+	return c, nil
+}
+
+// Next returns the next change, waiting for one until the context is
+// done or the node is closed.
+func (c *Consumer) Next(ctx context.Context) (Change, error) {
+	for {
+		l := c.log
+		l.mu.Lock()
+		first, last, updated := l.first, l.last, l.updated
+		l.mu.Unlock()
+		if c.next <= last {
+			if c.next < first {
+				c.next = first
+				return Change{}, ErrCompacted
+			}
+			v, err := l.store.Get(ctx, changeKey(c.next))
+			if errors.Is(err, ds.ErrNotFound) {
+				// Dropped since the bounds were read.
+				continue
+			}
+			if err != nil {
+				return Change{}, err
+			}
+			ch := Change{Seq: c.next}
+			if err := json.Unmarshal(v, &ch.Event); err != nil {
+				return Change{}, fmt.Errorf("dkv: change %d: %w", c.next, err)
+			}
+			c.next++
+			return ch, nil
+		}
+		select {
+		case <-ctx.Done():
+			return Change{}, ctx.Err()
+		case <-l.closed:
+			return Change{}, errChangesClosed
+		case <-updated:
+		}
+	}
+}
+
+// Ack records that the group processed every change up to seq, which are
+// then not delivered again when it is next opened.
+func (c *Consumer) Ack(ctx context.Context, seq uint64) error {
+	return c.log.store.Put(ctx, changeCursorsNs.ChildString(c.group), []byte(strconv.FormatUint(seq, 10)))
+}
+
+// Close releases the group for another consumer. The position of the
+// group is what it acknowledged last.
+func (c *Consumer) Close() {
+	c.log.mu.Lock()
+	delete(c.log.groups, c.group)
+	c.log.mu.Unlock()
+}
@@ -0,0 +1,500 @@
+// Package dkv embeds a globaldb node in a Go program. A node stores its
+// data in Badger, joins the database's pubsub topic and replicates the
+// keys through a Merkle-CRDT, exactly like the globaldb command, so that
+// embedded nodes and command-line nodes share the same database:
+//
+//	db, err := dkv.New(ctx, dkv.Config{
+//		DataDir:   "/var/lib/myapp/dkv",
+//		Bootstrap: []string{"/ip4/203.0.113.7/tcp/4001/p2p/12D3Koo..."},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer db.Close()
+//	err = db.Put(ctx, ds.NewKey("/greeting"), []byte("hello"))
+//
+// Values are stamped with a hybrid logical clock timestamp, so that the
+// latest write wins when two land at the same DAG height.
+package dkv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	ipfslite "github.com/hsanjuan/ipfs-lite"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	badger "github.com/ipfs/go-ds-badger2"
+	crdt "github.com/ipfs/go-ds-crdt"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht/dual"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	multiaddr "github.com/multiformats/go-multiaddr"
+)
+
+var logger = logging.Logger("dkv")
+
+// DefaultTopic is the topic the globaldb command uses.
+const DefaultTopic = "globaldb-example"
+
+// Config configures a node.
+type Config struct {
+	// DataDir holds the datastore and the node's private key. It is
+	// created if needed.
+	DataDir string
+	// Topic is the pubsub topic of the database. Defaults to
+	// DefaultTopic.
+	Topic string
+	// ListenAddrs are the multiaddrs to listen on. Defaults to a random
+	// TCP port on every interface.
+	ListenAddrs []string
+	// Bootstrap are the addresses of peers to join, as /p2p or /dnsaddr
+	// multiaddrs.
+	Bootstrap []string
+	// PrivateKey is the node's identity. When nil it is read from
+	// DataDir, or generated there on first use.
+	PrivateKey crypto.PrivKey
+	// RebroadcastInterval is how often the current heads are announced.
+	// Defaults to the go-ds-crdt default.
+	RebroadcastInterval time.Duration
+	// SwarmKey makes the node join the private network of the key, where
+	// only nodes holding it can connect.
+	SwarmKey pnet.PSK
+	// Pipelines transform values per key prefix before they are stored.
+	// Values are stored as they are when nil.
+	Pipelines *Pipelines
+	// ChangeLog is how many changes are kept in the datastore for the
+	// consumer groups of Changes. Changes is disabled when 0.
+	ChangeLog int
+	// Clock is the wall clock the timestamps of writes follow. Defaults
+	// to SystemClock; tests pass a ManualClock.
+	Clock WallClock
+}
+
+// Event is a change applied to the database, either by this node or
+// received from a peer.
+type Event struct {
+	// Op is "put" or "delete".
+	Op    string
+	Key   ds.Key
+	Value []byte
+}
+
+// subscription receives the events under a prefix.
+type subscription struct {
+	prefix ds.Key
+	ch     chan Event
+}
+
+// subscriptionBuffer is how many events a subscriber may fall behind
+// before further events are dropped for it.
+const subscriptionBuffer = 1024
+
+// DB is a running node.
+type DB struct {
+	cancel context.CancelFunc
+	store  *badger.Datastore
+	host   host.Host
+	dht    *dht.DHT
+	crdt   *crdt.Datastore
+	clock  Clock
+	// pipelines transform values, nil when there are none.
+	pipelines *Pipelines
+	// changes is the change log, nil when disabled.
+	changes *changeLog
+
+	mu   sync.Mutex
+	subs map[*subscription]struct{}
+	// writeMu serializes the writes of the node, so that none comes
+	// between the checks of a compare-and-swap or transaction and its
+	// write, and none joins the delta of a committing batch.
+	writeMu sync.Mutex
+	// batchMu is held by the open batch of the node, from DB.Batch to
+	// Batch.Commit or Batch.Discard.
+	batchMu sync.Mutex
+	// maxDelta is the size above which go-ds-crdt splits a batch.
+	maxDelta int
+}
+
+// New starts a node. It returns once the node is set up; joining the
+// bootstrap peers and syncing happen in the background. The context
+// bounds the lifetime of the node, along with Close.
+func New(ctx context.Context, cfg Config) (_ *DB, err error) {
+	if cfg.DataDir == "" {
+		return nil, errors.New("dkv: Config.DataDir is required")
+	}
+	if cfg.Topic == "" {
+		cfg.Topic = DefaultTopic
+	}
+	if len(cfg.ListenAddrs) == 0 {
+		cfg.ListenAddrs = []string{"/ip4/0.0.0.0/tcp/0"}
+	}
+	listen := make([]multiaddr.Multiaddr, 0, len(cfg.ListenAddrs))
+	for _, a := range cfg.ListenAddrs {
+		ma, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			return nil, fmt.Errorf("dkv: listen address %q: %w", a, err)
+		}
+		listen = append(listen, ma)
+	}
+	if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+		return nil, err
+	}
+	if cfg.PrivateKey == nil {
+		cfg.PrivateKey, err = LoadKey(filepath.Join(cfg.DataDir, "key"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	d := &DB{cancel: cancel, pipelines: cfg.Pipelines, subs: make(map[*subscription]struct{})}
+	d.clock.Wall = cfg.Clock
+	defer func() {
+		if err != nil {
+			d.Close()
+		}
+	}()
+
+	d.store, err = badger.NewDatastore(cfg.DataDir, &badger.DefaultOptions)
+	if err != nil {
+		return nil, err
+	}
+	d.host, d.dht, err = ipfslite.SetupLibp2p(ctx, cfg.PrivateKey, cfg.SwarmKey, listen, nil, libp2p.NATPortMap())
+	if err != nil {
+		return nil, err
+	}
+	psub, err := pubsub.NewGossipSub(ctx, d.host)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ChangeLog > 0 {
+		d.changes, err = openChangeLog(ctx, d.store, cfg.ChangeLog)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ipfs, err := ipfslite.New(ctx, d.store, nil, d.host, d.dht, nil)
+	if err != nil {
+		return nil, err
+	}
+	bcast, err := crdt.NewPubSubBroadcaster(ctx, psub, cfg.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := crdt.DefaultOptions()
+	opts.Logger = logger
+	if cfg.RebroadcastInterval > 0 {
+		opts.RebroadcastInterval = cfg.RebroadcastInterval
+	}
+	opts.PutHook = func(k ds.Key, v []byte) {
+		meta, payload := DecodeValue(v)
+		if !d.clock.Update(meta.HLC) {
+			logger.Warnf("%s: timestamp %s is more than %s ahead of the clock", k, meta.HLC, MaxDrift)
+		}
+		payload, err := d.pipelines.Decode(k, meta, payload)
+		if err != nil {
+			logger.Warnf("%s: %s", k, err)
+			return
+		}
+		d.notify(Event{Op: "put", Key: k, Value: payload})
+	}
+	opts.DeleteHook = func(k ds.Key) {
+		d.notify(Event{Op: "delete", Key: k})
+	}
+	d.maxDelta = opts.MaxBatchDeltaSize
+	d.crdt, err = crdt.New(d.store, ds.NewKey("crdt"), ipfs, bcast, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []string
+	for _, b := range cfg.Bootstrap {
+		infos, err := ResolveBootstrap(ctx, b)
+		if err != nil {
+			return nil, fmt.Errorf("dkv: bootstrap address %q: %w", b, err)
+		}
+		for _, inf := range infos {
+			d.host.ConnManager().TagPeer(inf.ID, "keep", 100)
+			peers = append(peers, inf.ID.String())
+		}
+		go ipfs.Bootstrap(infos)
+	}
+	logger.Infof("node %s joined %s, bootstrapping from [%s]", d.host.ID(), cfg.Topic, strings.Join(peers, ", "))
+	return d, nil
+}
+
+// Host returns the libp2p host of the node.
+func (d *DB) Host() host.Host {
+	return d.host
+}
+
+// Put stores a value on a key.
+func (d *DB) Put(ctx context.Context, k ds.Key, v []byte) error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	return d.put(ctx, k, v)
+}
+
+// put is Put for callers holding writeMu.
+func (d *DB) put(ctx context.Context, k ds.Key, v []byte) error {
+	meta := Meta{HLC: d.clock.Now()}
+	v, err := d.pipelines.Encode(k, meta, v)
+	if err != nil {
+		return err
+	}
+	return d.crdt.Put(ctx, k, EncodeValue(meta, v))
+}
+
+// Get returns the value of a key, or ds.ErrNotFound.
+func (d *DB) Get(ctx context.Context, k ds.Key) ([]byte, error) {
+	v, _, err := d.GetWithMeta(ctx, k)
+	return v, err
+}
+
+// GetWithMeta returns the value of a key along with its metadata.
+func (d *DB) GetWithMeta(ctx context.Context, k ds.Key) ([]byte, Meta, error) {
+	v, err := d.crdt.Get(ctx, k)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	meta, payload := DecodeValue(v)
+	payload, err = d.pipelines.Decode(k, meta, payload)
+	return payload, meta, err
+}
+
+// Delete removes a key.
+func (d *DB) Delete(ctx context.Context, k ds.Key) error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	return d.crdt.Delete(ctx, k)
+}
+
+// CompareAndSwap stores v on a key if it holds old, or does not exist
+// when old is nil, and tells whether it did. Compare-and-swaps are only
+// serialized with the others of this node: two nodes may both swap the
+// same key, and the last write wins once they sync. This suits optimistic
+// concurrency between the users of a node, not locking across the
+// network.
+func (d *DB) CompareAndSwap(ctx context.Context, k ds.Key, old, v []byte) (bool, error) {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	cur, err := d.Get(ctx, k)
+	switch {
+	case errors.Is(err, ds.ErrNotFound):
+		if old != nil {
+			return false, nil
+		}
+	case err != nil:
+		return false, err
+	case old == nil || !bytes.Equal(cur, old):
+		return false, nil
+	}
+	return true, d.put(ctx, k, v)
+}
+
+// write is a put of an encoded value, or a delete when v is nil.
+type write struct {
+	k ds.Key
+	v []byte
+}
+
+// commit writes ws in a single delta. go-ds-crdt builds one delta for all
+// the open batches of the store and cannot take writes back out of it, so
+// the caller holds writeMu and hands over every write at once.
+func (d *DB) commit(ctx context.Context, ws []write) error {
+	if len(ws) == 0 {
+		return nil
+	}
+	b, err := d.crdt.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	for _, w := range ws {
+		if w.v == nil {
+			err = b.Delete(ctx, w.k)
+		} else {
+			err = b.Put(ctx, w.k, w.v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return b.Commit(ctx)
+}
+
+// Batch groups puts and deletes into a single delta, which is only
+// broadcast once the batch is committed. Writes are held by the batch
+// until then, so that a batch that is discarded, or fails to encode a
+// value, writes nothing. Other batches of the node wait for an open batch
+// to be committed or discarded, which must be done. It is not safe for
+// concurrent use.
+type Batch struct {
+	d      *DB
+	writes []write
+	open   bool
+}
+
+// Batch starts a batch. Loading many keys through a batch sends one
+// delta instead of one per key.
+func (d *DB) Batch(ctx context.Context) (*Batch, error) {
+	d.batchMu.Lock()
+	return &Batch{d: d, open: true}, nil
+}
+
+// Put adds the put of a value to the batch.
+func (b *Batch) Put(ctx context.Context, k ds.Key, v []byte) error {
+	if !b.open {
+		return errBatchClosed
+	}
+	meta := Meta{HLC: b.d.clock.Now()}
+	v, err := b.d.pipelines.Encode(k, meta, v)
+	if err != nil {
+		return err
+	}
+	b.writes = append(b.writes, write{k: k, v: EncodeValue(meta, v)})
+	return nil
+}
+
+// Delete adds the removal of a key to the batch.
+func (b *Batch) Delete(ctx context.Context, k ds.Key) error {
+	if !b.open {
+		return errBatchClosed
+	}
+	b.writes = append(b.writes, write{k: k})
+	return nil
+}
+
+// Commit applies the batch, broadcasts its delta and closes the batch.
+func (b *Batch) Commit(ctx context.Context) error {
+	if !b.open {
+		return errBatchClosed
+	}
+	defer b.Discard()
+	b.d.writeMu.Lock()
+	defer b.d.writeMu.Unlock()
+	return b.d.commit(ctx, b.writes)
+}
+
+// Discard closes the batch without writing anything, if it is still open.
+func (b *Batch) Discard() {
+	if !b.open {
+		return
+	}
+	b.open = false
+	b.writes = nil
+	b.d.batchMu.Unlock()
+}
+
+// errBatchClosed is returned for writes to a committed or discarded batch.
+var errBatchClosed = errors.New("dkv: the batch is closed")
+
+// Query runs a query over the database. Filters and orders that look at
+// values see the values with their metadata header.
+func (d *DB) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	results, err := d.crdt.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return query.ResultsFromIterator(q, query.Iterator{
+		Next: func() (query.Result, bool) {
+			r, ok := results.NextSync()
+			if ok && r.Error == nil && r.Value != nil {
+				var meta Meta
+				meta, r.Value = DecodeValue(r.Value)
+				r.Value, r.Error = d.pipelines.Decode(ds.RawKey(r.Key), meta, r.Value)
+			}
+			return r, ok
+		},
+		Close: results.Close,
+	}), nil
+}
+
+// Subscribe returns the changes to keys under prefix until the context is
+// cancelled or the node is closed, when the channel is closed. Events are
+// dropped for subscribers that fall too far behind.
+func (d *DB) Subscribe(ctx context.Context, prefix ds.Key) <-chan Event {
+	s := &subscription{prefix: prefix, ch: make(chan Event, subscriptionBuffer)}
+	d.mu.Lock()
+	if d.subs == nil { // closed
+		close(s.ch)
+	} else {
+		d.subs[s] = struct{}{}
+	}
+	d.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		d.unsubscribe(s)
+	}()
+	return s.ch
+}
+
+func (d *DB) unsubscribe(s *subscription) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.subs[s]; ok {
+		delete(d.subs, s)
+		close(s.ch)
+	}
+}
+
+func (d *DB) notify(e Event) {
+	if d.changes != nil {
+		d.changes.append(e)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for s := range d.subs {
+		if !s.prefix.Equal(e.Key) && !s.prefix.IsAncestorOf(e.Key) && s.prefix.String() != "/" {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			logger.Warnf("subscriber to %s is too slow, dropping %s of %s", s.prefix, e.Op, e.Key)
+		}
+	}
+}
+
+// Close stops the node and closes its datastore.
+func (d *DB) Close() error {
+	d.mu.Lock()
+	for s := range d.subs {
+		close(s.ch)
+	}
+	d.subs = nil
+	d.mu.Unlock()
+	if d.changes != nil {
+		d.changes.close()
+	}
+
+	// The broadcaster stops with the context, and the CRDT store only
+	// closes once it has.
+	d.cancel()
+	var errs []error
+	if d.crdt != nil {
+		errs = append(errs, d.crdt.Close())
+	}
+	if d.dht != nil {
+		errs = append(errs, d.dht.Close())
+	}
+	if d.host != nil {
+		errs = append(errs, d.host.Close())
+	}
+	if d.store != nil {
+		errs = append(errs, d.store.Close())
+	}
+	return errors.Join(errs...)
+}
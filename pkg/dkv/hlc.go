@@ -0,0 +1,94 @@
+package dkv
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Timestamp is a hybrid logical clock timestamp. The upper 48 bits
+// hold wall-clock milliseconds and the lower 16 bits a logical counter,
+// so timestamps compare as plain integers and a counter overflow simply
+// carries into the next millisecond.
+type Timestamp uint64
+
+const hlcLogicalBits = 16
+
+// TimestampFromTime returns the first timestamp of the millisecond of t.
+func TimestampFromTime(t time.Time) Timestamp {
+	return Timestamp(uint64(t.UnixMilli()) << hlcLogicalBits)
+}
+
+// Time returns the physical component of the timestamp.
+func (ts Timestamp) Time() time.Time {
+	return time.UnixMilli(int64(ts >> hlcLogicalBits))
+}
+
+// Logical returns the logical component of the timestamp.
+func (ts Timestamp) Logical() uint16 {
+	return uint16(ts)
+}
+
+func (ts Timestamp) String() string {
+	return fmt.Sprintf("%s+%d", ts.Time().UTC().Format(time.RFC3339Nano), ts.Logical())
+}
+
+// MaxDrift is how far ahead of the wall clock a remote timestamp may move
+// a Clock. Timestamps further ahead are taken as MaxDrift ahead, so that a
+// single replica with a wrong clock, or a forged timestamp, cannot push
+// every clock far into the future for good.
+const MaxDrift = 5 * time.Minute
+
+// Clock is a hybrid logical clock. It follows wall-clock time when clocks
+// are in sync, but never goes backwards and moves past the timestamps it
+// has observed, up to MaxDrift ahead of its wall clock, so a write that
+// causally follows another gets a higher timestamp even if the writers'
+// clocks disagree by less than that.
+type Clock struct {
+	// Wall is the physical clock, SystemClock when nil.
+	Wall WallClock
+
+	mu   sync.Mutex
+	last Timestamp
+}
+
+// WallTime returns the time of the wall clock.
+func (c *Clock) WallTime() time.Time {
+	if c.Wall == nil {
+		return SystemClock.Now()
+	}
+	return c.Wall.Now()
+}
+
+// Now returns a timestamp for a local event.
+func (c *Clock) Now() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last = max(c.last.next(), TimestampFromTime(c.WallTime()))
+	return c.last
+}
+
+// Update advances the clock past a timestamp received from another
+// replica, or to MaxDrift ahead of the wall clock if it is further ahead.
+// It tells whether the timestamp was within MaxDrift.
+func (c *Clock) Update(remote Timestamp) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wall := c.WallTime()
+	limit := TimestampFromTime(wall.Add(MaxDrift))
+	ok := remote <= limit
+	if !ok {
+		remote = limit
+	}
+	c.last = max(c.last.next(), remote.next(), TimestampFromTime(wall))
+	return ok
+}
+
+// next is the timestamp after ts, which stays at the largest one rather
+// than wrapping around.
+func (ts Timestamp) next() Timestamp {
+	if ts == ^Timestamp(0) {
+		return ts
+	}
+	return ts + 1
+}
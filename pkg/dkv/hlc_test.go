@@ -0,0 +1,56 @@
+package dkv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockUpdate(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	wall := TimestampFromTime(start)
+	tests := []struct {
+		name   string
+		remote Timestamp
+		ok     bool
+		// want is the timestamp the clock is at after the update.
+		want Timestamp
+	}{
+		{"behind", TimestampFromTime(start.Add(-time.Second)), true, wall},
+		{"same millisecond", wall + 5, true, wall + 6},
+		{"ahead", TimestampFromTime(start.Add(time.Minute)), true, TimestampFromTime(start.Add(time.Minute)) + 1},
+		{"at the drift limit", TimestampFromTime(start.Add(MaxDrift)), true, TimestampFromTime(start.Add(MaxDrift)) + 1},
+		{"beyond the drift limit", TimestampFromTime(start.Add(time.Hour)), false, TimestampFromTime(start.Add(MaxDrift)) + 1},
+		{"largest", ^Timestamp(0), false, TimestampFromTime(start.Add(MaxDrift)) + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Clock{Wall: NewManualClock(start)}
+			if ok := c.Update(tt.remote); ok != tt.ok {
+				t.Errorf("Update(%s) = %t, want %t", tt.remote, ok, tt.ok)
+			}
+			if c.last != tt.want {
+				t.Errorf("clock at %s, want %s", c.last, tt.want)
+			}
+			if next := c.Now(); next <= tt.want {
+				t.Errorf("next timestamp %s not after %s", next, tt.want)
+			}
+		})
+	}
+}
+
+func TestClockNeverGoesBack(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	wall := NewManualClock(start)
+	c := &Clock{Wall: wall}
+	c.Update(TimestampFromTime(start.Add(time.Minute)))
+	ahead := c.Now()
+	// The wall clock catching up does not move the clock back.
+	wall.Advance(30 * time.Second)
+	if ts := c.Now(); ts <= ahead {
+		t.Errorf("timestamp %s after %s", ts, ahead)
+	}
+	wall.Advance(time.Minute)
+	if got := c.Now().Time(); !got.Equal(wall.Now()) {
+		t.Errorf("timestamp at %s once the wall clock passed it, want %s", got, wall.Now())
+	}
+}
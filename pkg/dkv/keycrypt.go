@@ -0,0 +1,115 @@
+package dkv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+
+	ds "github.com/ipfs/go-datastore"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PassphraseKeys are the keys derived from a passphrase.
+type PassphraseKeys struct {
+	// Values encrypts values, as in AESGCM.
+	Values []byte
+	// Keys encrypts keys, as in NewKeyCipher.
+	Keys []byte
+}
+
+// DerivePassphraseKeys derives the encryption keys of a database from a
+// passphrase with scrypt. Every node sharing the passphrase and the salt,
+// usually the topic, derives the same keys.
+func DerivePassphraseKeys(passphrase, salt string) (PassphraseKeys, error) {
+	if passphrase == "" {
+		return PassphraseKeys{}, errors.New("empty passphrase")
+	}
+	master, err := scrypt.Key([]byte(passphrase), []byte("dkv/"+salt), 1<<15, 8, 1, 32)
+	if err != nil {
+		return PassphraseKeys{}, err
+	}
+	expand := func(info string, n int) ([]byte, error) {
+		out := make([]byte, n)
+		_, err := io.ReadFull(hkdf.Expand(sha256.New, master, []byte(info)), out)
+		return out, err
+	}
+	var pk PassphraseKeys
+	if pk.Values, err = expand("dkv values", 32); err != nil {
+		return PassphraseKeys{}, err
+	}
+	if pk.Keys, err = expand("dkv keys", 64); err != nil {
+		return PassphraseKeys{}, err
+	}
+	return pk, nil
+}
+
+// keyEncoding encodes encrypted key components, which must not contain
+// slashes.
+var keyEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// KeyCipher encrypts keys one component at a time and deterministically,
+// so that a key always encrypts the same way and prefix queries still
+// work on encrypted keys. Each component is encrypted with AES-CTR under
+// a synthetic IV, an HMAC of the component that also authenticates it.
+// Equal components are visible as such, and key order is not preserved.
+type KeyCipher struct {
+	mac   []byte
+	block cipher.Block
+}
+
+// NewKeyCipher returns a key cipher for a 64-byte key.
+func NewKeyCipher(key []byte) (*KeyCipher, error) {
+	if len(key) != 64 {
+		return nil, fmt.Errorf("key ciphers take 64-byte keys, not %d", len(key))
+	}
+	block, err := aes.NewCipher(key[32:])
+	if err != nil {
+		return nil, err
+	}
+	return &KeyCipher{mac: key[:32], block: block}, nil
+}
+
+func (c *KeyCipher) iv(component string) []byte {
+	h := hmac.New(sha256.New, c.mac)
+	h.Write([]byte(component))
+	return h.Sum(nil)[:aes.BlockSize]
+}
+
+// Encrypt encrypts every component of a key.
+func (c *KeyCipher) Encrypt(k ds.Key) ds.Key {
+	parts := k.List()
+	for i, p := range parts {
+		iv := c.iv(p)
+		out := make([]byte, len(iv)+len(p))
+		copy(out, iv)
+		cipher.NewCTR(c.block, iv).XORKeyStream(out[len(iv):], []byte(p))
+		parts[i] = keyEncoding.EncodeToString(out)
+	}
+	return ds.KeyWithNamespaces(parts)
+}
+
+// Decrypt decrypts a key encrypted by Encrypt. It fails on keys that were
+// not encrypted with the same key.
+func (c *KeyCipher) Decrypt(k ds.Key) (ds.Key, error) {
+	parts := k.List()
+	for i, p := range parts {
+		data, err := keyEncoding.DecodeString(p)
+		if err != nil || len(data) < aes.BlockSize {
+			return ds.Key{}, fmt.Errorf("%s is not an encrypted key", k)
+		}
+		iv, ct := data[:aes.BlockSize], data[aes.BlockSize:]
+		pt := make([]byte, len(ct))
+		cipher.NewCTR(c.block, iv).XORKeyStream(pt, ct)
+		if !hmac.Equal(iv, c.iv(string(pt))) {
+			return ds.Key{}, fmt.Errorf("%s is not encrypted with this key", k)
+		}
+		parts[i] = string(pt)
+	}
+	return ds.KeyWithNamespaces(parts), nil
+}
@@ -0,0 +1,60 @@
+package dkv
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	multiaddr "github.com/multiformats/go-multiaddr"
+	madns "github.com/multiformats/go-multiaddr-dns"
+)
+
+// LoadKey reads the private key of a node from path, generating and
+// writing an Ed25519 key there first if there is none, so that the node
+// keeps its peer ID across restarts.
+func LoadKey(path string) (crypto.PrivKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		priv, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 1)
+		if err != nil {
+			return nil, err
+		}
+		data, err := crypto.MarshalPrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		return priv, os.WriteFile(path, data, 0400)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return crypto.UnmarshalPrivateKey(data)
+}
+
+// ResolveBootstrap turns a bootstrap address into the peers to connect
+// to. Besides /p2p multiaddrs it accepts /dnsaddr/<domain> addresses,
+// which are resolved through their _dnsaddr TXT records so that the set
+// of bootstrap peers can change without touching any configuration.
+func ResolveBootstrap(ctx context.Context, addr string) ([]peer.AddrInfo, error) {
+	ma, err := multiaddr.NewMultiaddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []multiaddr.Multiaddr{ma}
+	if madns.Matches(ma) {
+		addrs, err = madns.DefaultResolver.Resolve(ctx, ma)
+		if err != nil {
+			return nil, err
+		}
+	}
+	infos, err := peer.AddrInfosFromP2pAddrs(addrs...)
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, errors.New("no peers found at " + addr)
+	}
+	return infos, nil
+}
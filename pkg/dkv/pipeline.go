@@ -0,0 +1,525 @@
+package dkv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// Stage orders the transforms of a pipeline. Values are compressed, then
+// encrypted, then signed, as any other order either wastes the
+// compression or leaves part of the value unsigned.
+type Stage int
+
+const (
+	StageCompress Stage = iota + 1
+	StageEncrypt
+	StageSign
+)
+
+func (s Stage) String() string {
+	switch s {
+	case StageCompress:
+		return "compress"
+	case StageEncrypt:
+		return "encrypt"
+	case StageSign:
+		return "sign"
+	default:
+		return fmt.Sprintf("stage(%d)", int(s))
+	}
+}
+
+// Transform is a reversible step applied to values before they are
+// stored. Its ID is recorded in the header of every value it encoded, so
+// that readers know how to undo it whatever their own configuration.
+type Transform interface {
+	ID() byte
+	Name() string
+	Stage() Stage
+	Encode(k ds.Key, v []byte) ([]byte, error)
+	Decode(k ds.Key, v []byte) ([]byte, error)
+}
+
+// ErrTransform is returned when a value cannot be decoded by the
+// transforms known locally.
+var ErrTransform = errors.New("cannot decode value")
+
+// pipelineHeader starts every value encoded by a pipeline. 0xff never
+// starts UTF-8 text nor a CBOR item, so plain values are not mistaken for
+// encoded ones. It is followed by the header version, the number of
+// transforms and their IDs in the order they were applied.
+var pipelineHeader = []byte{0xff, 'v'}
+
+// pipelineVersion is the version of the headers written. Signatures of
+// version 1 only cover the key and the body of the value; from version 2
+// they also cover the metadata and the pipeline header, so that neither
+// the HLC timestamp nor the list of transforms can be changed.
+const pipelineVersion = 2
+
+// Pipeline is an ordered list of transforms.
+type Pipeline []Transform
+
+// NewPipeline checks that transforms come in stage order, with at most
+// one per stage.
+func NewPipeline(ts ...Transform) (Pipeline, error) {
+	for i := 1; i < len(ts); i++ {
+		if ts[i].Stage() <= ts[i-1].Stage() {
+			return nil, fmt.Errorf("%s (%s) cannot follow %s (%s): transforms go compress, encrypt, sign, one of each at most",
+				ts[i].Name(), ts[i].Stage(), ts[i-1].Name(), ts[i-1].Stage())
+		}
+	}
+	return Pipeline(ts), nil
+}
+
+// Pipelines applies a pipeline per key prefix, the longest matching
+// prefix winning.
+type Pipelines struct {
+	prefixes []ds.Key // longest first
+	byPrefix map[ds.Key]Pipeline
+	// known are the transforms values may be decoded with, by ID.
+	known map[byte]Transform
+	// requireSigned rejects the values that are not signed.
+	requireSigned bool
+	// authorize checks that the signer of a value may write its key.
+	authorize func(k ds.Key, signer crypto.PubKey) error
+}
+
+// ErrUnsigned is returned when decoding a value that is not signed while
+// signatures are required.
+var ErrUnsigned = errors.New("value is not signed")
+
+// ErrSignature is returned for values whose signature does not check
+// out.
+var ErrSignature = errors.New("invalid signature")
+
+// RequireSigned makes Decode reject the values that are not signed.
+func (p *Pipelines) RequireSigned() {
+	p.requireSigned = true
+}
+
+// SignaturesRequired tells whether RequireSigned was called.
+func (p *Pipelines) SignaturesRequired() bool {
+	return p != nil && p.requireSigned
+}
+
+// Authorize makes Decode reject the signed values for which fn returns an
+// error, such as those signed by keys not allowed to write their key.
+func (p *Pipelines) Authorize(fn func(k ds.Key, signer crypto.PubKey) error) {
+	p.authorize = fn
+}
+
+// NewPipelines returns an empty set of pipelines. Gzip and signature
+// checking are always available to decode values.
+func NewPipelines() *Pipelines {
+	p := &Pipelines{
+		byPrefix: make(map[ds.Key]Pipeline),
+		known:    make(map[byte]Transform),
+	}
+	for _, t := range []Transform{Gzip(), verifier{}} {
+		p.known[t.ID()] = t
+	}
+	return p
+}
+
+// Add sets the pipeline of the values under prefix.
+func (p *Pipelines) Add(prefix ds.Key, pl Pipeline) error {
+	for _, t := range pl {
+		// Every signature is checked the same way, whatever the key.
+		if t.ID() == idSign {
+			continue
+		}
+		if k, ok := p.known[t.ID()]; ok {
+			if a, ok := k.(*aesGCM); ok && a.fingerprint != t.(*aesGCM).fingerprint {
+				return errors.New("values can only be encrypted with a single key")
+			}
+			continue
+		}
+		p.known[t.ID()] = t
+	}
+	if _, ok := p.byPrefix[prefix]; !ok {
+		p.prefixes = append(p.prefixes, prefix)
+		sort.Slice(p.prefixes, func(i, j int) bool {
+			return len(p.prefixes[i].String()) > len(p.prefixes[j].String())
+		})
+	}
+	p.byPrefix[prefix] = pl
+	return nil
+}
+
+func (p *Pipelines) lookup(k ds.Key) Pipeline {
+	for _, prefix := range p.prefixes {
+		if prefix.Equal(k) || prefix.IsAncestorOf(k) || prefix.String() == "/" {
+			return p.byPrefix[prefix]
+		}
+	}
+	return nil
+}
+
+// Encode runs the value of k through the pipeline of its prefix. Values
+// under no pipeline are returned as they are. meta is the metadata the
+// value is stored with, which its signature covers.
+func (p *Pipelines) Encode(k ds.Key, meta Meta, v []byte) ([]byte, error) {
+	if p == nil {
+		return v, nil
+	}
+	pl := p.lookup(k)
+	if len(pl) == 0 {
+		return v, nil
+	}
+	header := append([]byte{}, pipelineHeader...)
+	header = append(header, pipelineVersion, byte(len(pl)))
+	for _, t := range pl {
+		header = append(header, t.ID())
+	}
+	for _, t := range pl {
+		var err error
+		if s, ok := t.(*signer); ok {
+			v, err = s.sign(k, signedContext(meta, header), v)
+		} else {
+			v, err = t.Encode(k, v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", t.Name(), err)
+		}
+	}
+	return append(header, v...), nil
+}
+
+// Decode undoes the transforms recorded in the header of a value stored
+// with meta. Values without a header are returned as they are.
+func (p *Pipelines) Decode(k ds.Key, meta Meta, v []byte) ([]byte, error) {
+	v, _, err := p.decode(k, meta, v, true)
+	return v, err
+}
+
+// DecodeSigner is Decode without Authorize, which also returns the key
+// that signed the value, nil for values that are not signed.
+func (p *Pipelines) DecodeSigner(k ds.Key, meta Meta, v []byte) ([]byte, crypto.PubKey, error) {
+	return p.decode(k, meta, v, false)
+}
+
+func (p *Pipelines) decode(k ds.Key, meta Meta, v []byte, authorize bool) ([]byte, crypto.PubKey, error) {
+	if !bytes.HasPrefix(v, pipelineHeader) {
+		if p != nil && p.requireSigned {
+			return nil, nil, ErrUnsigned
+		}
+		return v, nil, nil
+	}
+	version, ids, body, err := splitHeader(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	signed := len(ids) > 0 && ids[len(ids)-1] == idSign
+	if p != nil && p.requireSigned && (!signed || version < 2) {
+		return nil, nil, ErrUnsigned
+	}
+	known := NewPipelines().known
+	if p != nil {
+		known = p.known
+	}
+	var signer crypto.PubKey
+	for i := len(ids) - 1; i >= 0; i-- {
+		t, ok := known[ids[i]]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: %s is not configured", ErrTransform, transformName(ids[i]))
+		}
+		if ids[i] == idSign {
+			var context []byte
+			if version >= 2 {
+				context = signedContext(meta, v[:len(v)-len(body)])
+			}
+			pub, signed, err := VerifySigned(k, context, body)
+			if err != nil {
+				return nil, nil, err
+			}
+			if authorize && p != nil && p.authorize != nil {
+				if err := p.authorize(k, pub); err != nil {
+					return nil, nil, err
+				}
+			}
+			signer, body = pub, signed
+			continue
+		}
+		var err error
+		if body, err = t.Decode(k, body); err != nil {
+			return nil, nil, fmt.Errorf("%w: %s: %s", ErrTransform, t.Name(), err)
+		}
+	}
+	return body, signer, nil
+}
+
+// splitHeader splits an encoded value into the version of its header, the
+// IDs of the transforms it went through and its body.
+func splitHeader(v []byte) (byte, []byte, []byte, error) {
+	rest := v[len(pipelineHeader):]
+	if len(rest) < 2 || rest[0] < 1 || rest[0] > pipelineVersion || len(rest) < 2+int(rest[1]) {
+		return 0, nil, nil, fmt.Errorf("%w: unsupported header", ErrTransform)
+	}
+	return rest[0], rest[2 : 2+int(rest[1])], rest[2+int(rest[1]):], nil
+}
+
+// signedContext is what the signature of a value covers besides its key
+// and body: its metadata and pipeline header.
+func signedContext(meta Meta, header []byte) []byte {
+	return append(EncodeValue(meta, nil), header...)
+}
+
+// Signer returns the key that signed the value of k stored with meta,
+// after checking the signature. It returns ErrUnsigned for values that
+// are not signed, or whose signature leaves their headers out.
+func Signer(k ds.Key, meta Meta, v []byte) (crypto.PubKey, error) {
+	if !bytes.HasPrefix(v, pipelineHeader) {
+		return nil, ErrUnsigned
+	}
+	version, ids, body, err := splitHeader(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 || ids[len(ids)-1] != idSign || version < 2 {
+		return nil, ErrUnsigned
+	}
+	pub, _, err := VerifySigned(k, signedContext(meta, v[:len(v)-len(body)]), body)
+	return pub, err
+}
+
+// Verify checks the signature of the value of k stored with meta without
+// decoding it, as Decode would: it returns ErrUnsigned when signatures
+// are required and the value is not signed, and the signer otherwise, nil
+// for values that are not signed. It does not apply Authorize.
+func (p *Pipelines) Verify(k ds.Key, meta Meta, v []byte) (crypto.PubKey, error) {
+	pub, err := Signer(k, meta, v)
+	if errors.Is(err, ErrUnsigned) && (p == nil || !p.requireSigned) {
+		return nil, nil
+	}
+	return pub, err
+}
+
+// Transform IDs. They are stored in values and must never change.
+const (
+	idGzip   byte = 1
+	idAESGCM byte = 2
+	idSign   byte = 3
+)
+
+func transformName(id byte) string {
+	switch id {
+	case idGzip:
+		return "gzip"
+	case idAESGCM:
+		return "aes-gcm"
+	case idSign:
+		return "sign"
+	default:
+		return fmt.Sprintf("transform %d", id)
+	}
+}
+
+type gzipTransform struct{}
+
+// MaxGzipSize is the largest value gzip compresses or decompresses.
+// Every node decompresses the values it receives, so a small compressed
+// value must not make them all allocate without bound.
+const MaxGzipSize = 64 << 20
+
+// ErrTooLarge is returned for values above MaxGzipSize.
+var ErrTooLarge = errors.New("value too large")
+
+// Gzip compresses values.
+func Gzip() Transform { return gzipTransform{} }
+
+func (gzipTransform) ID() byte     { return idGzip }
+func (gzipTransform) Name() string { return "gzip" }
+func (gzipTransform) Stage() Stage { return StageCompress }
+
+func (gzipTransform) Encode(_ ds.Key, v []byte) ([]byte, error) {
+	if len(v) > MaxGzipSize {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d", ErrTooLarge, len(v), MaxGzipSize)
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(v); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipTransform) Decode(_ ds.Key, v []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(v))
+	if err != nil {
+		return nil, err
+	}
+	out, err := io.ReadAll(io.LimitReader(r, MaxGzipSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > MaxGzipSize {
+		return nil, fmt.Errorf("%w: more than %d bytes once decompressed", ErrTooLarge, MaxGzipSize)
+	}
+	return out, nil
+}
+
+// aesGCM encrypts values with AES-256-GCM. The key is bound to the
+// ciphertext so that a value cannot be moved to another key, and a key
+// fingerprint is stored ahead of the nonce to tell wrong keys from
+// corrupt values.
+type aesGCM struct {
+	aead        cipher.AEAD
+	fingerprint [4]byte
+}
+
+// AESGCM encrypts values with a 32-byte key.
+func AESGCM(key []byte) (Transform, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("AES-256 keys are 32 bytes, not %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	t := &aesGCM{aead: aead}
+	sum := sha256.Sum256(key)
+	copy(t.fingerprint[:], sum[:])
+	return t, nil
+}
+
+func (t *aesGCM) ID() byte     { return idAESGCM }
+func (t *aesGCM) Name() string { return "aes-gcm" }
+func (t *aesGCM) Stage() Stage { return StageEncrypt }
+
+func (t *aesGCM) Encode(k ds.Key, v []byte) ([]byte, error) {
+	out := make([]byte, len(t.fingerprint)+t.aead.NonceSize(), len(t.fingerprint)+t.aead.NonceSize()+len(v)+t.aead.Overhead())
+	copy(out, t.fingerprint[:])
+	nonce := out[len(t.fingerprint):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return t.aead.Seal(out, nonce, v, k.Bytes()), nil
+}
+
+func (t *aesGCM) Decode(k ds.Key, v []byte) ([]byte, error) {
+	n := len(t.fingerprint) + t.aead.NonceSize()
+	if len(v) < n {
+		return nil, errors.New("value too short")
+	}
+	if !bytes.Equal(v[:len(t.fingerprint)], t.fingerprint[:]) {
+		return nil, errors.New("value was encrypted with another key")
+	}
+	return t.aead.Open(nil, v[len(t.fingerprint):n], v[n:], k.Bytes())
+}
+
+// signer signs values with a libp2p key. The signature covers the key and
+// the value, and is appended along with the public key:
+// value | public key | signature | len(public key) | len(signature).
+type signer struct {
+	priv crypto.PrivKey
+	pub  []byte
+}
+
+// Sign signs values with a private key, typically the node identity.
+// Readers check the signature without any configuration.
+func Sign(priv crypto.PrivKey) (Transform, error) {
+	pub, err := crypto.MarshalPublicKey(priv.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	return &signer{priv: priv, pub: pub}, nil
+}
+
+func (s *signer) ID() byte     { return idSign }
+func (s *signer) Name() string { return "sign" }
+func (s *signer) Stage() Stage { return StageSign }
+
+// signedBytes are the bytes a signature covers: the key, then the
+// context of the value, then the value.
+func signedBytes(k ds.Key, context, v []byte) []byte {
+	return append(append(append(k.Bytes(), 0), context...), v...)
+}
+
+// Encode signs a value on its own. Pipelines sign through sign, so that
+// the signature covers the headers of the value too.
+func (s *signer) Encode(k ds.Key, v []byte) ([]byte, error) {
+	return s.sign(k, nil, v)
+}
+
+func (s *signer) sign(k ds.Key, context, v []byte) ([]byte, error) {
+	sig, err := s.priv.Sign(signedBytes(k, context, v))
+	if err != nil {
+		return nil, err
+	}
+	out := append(append(append([]byte{}, v...), s.pub...), sig...)
+	return binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(out, uint16(len(s.pub))), uint16(len(sig))), nil
+}
+
+func (s *signer) Decode(k ds.Key, v []byte) ([]byte, error) {
+	return verifier{}.Decode(k, v)
+}
+
+// verifier checks the signatures of values signed by any key.
+type verifier struct{}
+
+func (verifier) ID() byte     { return idSign }
+func (verifier) Name() string { return "sign" }
+func (verifier) Stage() Stage { return StageSign }
+
+func (verifier) Encode(ds.Key, []byte) ([]byte, error) {
+	return nil, errors.New("no signing key")
+}
+
+func (verifier) Decode(k ds.Key, v []byte) ([]byte, error) {
+	_, v, err := VerifySigned(k, nil, v)
+	return v, err
+}
+
+// VerifySigned checks the signature of a value encoded by Sign with
+// context, and returns the key that signed it along with the value.
+// Failures wrap ErrSignature.
+func VerifySigned(k ds.Key, context, v []byte) (crypto.PubKey, []byte, error) {
+	pub, v, err := verifySigned(k, context, v)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrSignature, err)
+	}
+	return pub, v, nil
+}
+
+func verifySigned(k ds.Key, context, v []byte) (crypto.PubKey, []byte, error) {
+	if len(v) < 4 {
+		return nil, nil, errors.New("value too short")
+	}
+	pubLen := int(binary.BigEndian.Uint16(v[len(v)-4:]))
+	sigLen := int(binary.BigEndian.Uint16(v[len(v)-2:]))
+	end := len(v) - 4 - pubLen - sigLen
+	if end < 0 {
+		return nil, nil, errors.New("value too short")
+	}
+	pub, err := crypto.UnmarshalPublicKey(v[end : end+pubLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	ok, err := pub.Verify(signedBytes(k, context, v[:end]), v[end+pubLen:end+pubLen+sigLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, errors.New("signature mismatch")
+	}
+	return pub, v[:end], nil
+}
@@ -0,0 +1,182 @@
+package dkv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+func newTestKey(t *testing.T) crypto.PrivKey {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+// signedPipelines signs every value with priv.
+func signedPipelines(t *testing.T, priv crypto.PrivKey) *Pipelines {
+	t.Helper()
+	sign, err := Sign(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPipelines()
+	if err := p.Add(ds.NewKey("/"), Pipeline{sign}); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPipelinesRoundTrip(t *testing.T) {
+	priv := newTestKey(t)
+	sign, err := Sign(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aes, err := AESGCM(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := ds.NewKey("/a/b")
+	meta := Meta{HLC: 42}
+	value := bytes.Repeat([]byte("value "), 100)
+	tests := []struct {
+		name     string
+		pipeline []Transform
+		signed   bool
+	}{
+		{"none", nil, false},
+		{"gzip", []Transform{Gzip()}, false},
+		{"aes-gcm", []Transform{aes}, false},
+		{"sign", []Transform{sign}, true},
+		{"all", []Transform{Gzip(), aes, sign}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl, err := NewPipeline(tt.pipeline...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := NewPipelines()
+			if err := p.Add(ds.NewKey("/a"), pl); err != nil {
+				t.Fatal(err)
+			}
+			enc, err := p.Encode(k, meta, value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, signer, err := p.DecodeSigner(k, meta, enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, value) {
+				t.Errorf("decoded %q, want %q", got, value)
+			}
+			if signed := signer != nil; signed != tt.signed {
+				t.Fatalf("signed: %t, want %t", signed, tt.signed)
+			}
+			if tt.signed && !signer.Equals(priv.GetPublic()) {
+				t.Error("signed by another key")
+			}
+		})
+	}
+}
+
+func TestNewPipelineOrder(t *testing.T) {
+	sign, err := Sign(newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		pipeline []Transform
+		ok       bool
+	}{
+		{"in order", []Transform{Gzip(), sign}, true},
+		{"sign first", []Transform{sign, Gzip()}, false},
+		{"twice", []Transform{Gzip(), Gzip()}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewPipeline(tt.pipeline...); (err == nil) != tt.ok {
+				t.Errorf("NewPipeline: %v, want ok %t", err, tt.ok)
+			}
+		})
+	}
+}
+
+// errDenied is what the authorizer of the tests returns.
+var errDenied = errors.New("denied")
+
+func TestPipelinesRejectTampering(t *testing.T) {
+	priv, other := newTestKey(t), newTestKey(t)
+	k := ds.NewKey("/a")
+	meta := Meta{HLC: 42}
+	value := []byte("hello")
+	tests := []struct {
+		name string
+		// tamper changes what is decoded from the value encoded for k
+		// and meta.
+		tamper func(k *ds.Key, meta *Meta, v []byte) []byte
+		err    error
+	}{
+		{"untouched", func(*ds.Key, *Meta, []byte) []byte { return nil }, nil},
+		{"other key", func(k *ds.Key, _ *Meta, _ []byte) []byte {
+			*k = ds.NewKey("/b")
+			return nil
+		}, ErrSignature},
+		{"other timestamp", func(_ *ds.Key, meta *Meta, _ []byte) []byte {
+			meta.HLC++
+			return nil
+		}, ErrSignature},
+		{"body changed", func(_ *ds.Key, _ *Meta, v []byte) []byte {
+			v[len(pipelineHeader)+3] ^= 1
+			return nil
+		}, ErrSignature},
+		{"header downgraded", func(_ *ds.Key, _ *Meta, v []byte) []byte {
+			v[len(pipelineHeader)] = 1
+			return nil
+		}, ErrUnsigned},
+		{"not signed", func(*ds.Key, *Meta, []byte) []byte { return []byte("hello") }, ErrUnsigned},
+		{"signed by another key", func(k *ds.Key, meta *Meta, _ []byte) []byte {
+			v, err := signedPipelines(t, other).Encode(*k, *meta, value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}, errDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := signedPipelines(t, priv)
+			p.RequireSigned()
+			p.Authorize(func(_ ds.Key, signer crypto.PubKey) error {
+				if !signer.Equals(priv.GetPublic()) {
+					return errDenied
+				}
+				return nil
+			})
+			v, err := p.Encode(k, meta, value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			k, meta := k, meta
+			if replaced := tt.tamper(&k, &meta, v); replaced != nil {
+				v = replaced
+			}
+			got, err := p.Decode(k, meta, v)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Decode: %v, want %v", err, tt.err)
+			}
+			if err == nil && !bytes.Equal(got, value) {
+				t.Errorf("decoded %q, want %q", got, value)
+			}
+		})
+	}
+}
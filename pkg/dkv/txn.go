@@ -0,0 +1,153 @@
+package dkv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// ErrConflict is returned by DB.Txn when a key the transaction read was
+// changed on this node before the transaction committed.
+var ErrConflict = errors.New("dkv: transaction conflict")
+
+// ErrTxnTooLarge is returned by DB.Txn when the writes of a transaction
+// do not fit in a single delta.
+var ErrTxnTooLarge = errors.New("dkv: transaction too large for a single delta")
+
+// txnOverhead is what a write adds to the size of a delta on top of its
+// key and value, for the block identifiers and the protobuf framing.
+const txnOverhead = 128
+
+// Txn reads and writes keys within DB.Txn. Writes are buffered until the
+// transaction commits, and reads see them.
+type Txn interface {
+	Get(k ds.Key) ([]byte, error)
+	Put(k ds.Key, v []byte) error
+	Delete(k ds.Key) error
+}
+
+// read is a value a transaction read, to check on commit.
+type read struct {
+	v     []byte
+	found bool
+}
+
+type txn struct {
+	ctx   context.Context
+	d     *DB
+	reads map[ds.Key]read
+	// writes are the buffered writes, nil for deletes, in the order
+	// they were first made.
+	writes map[ds.Key][]byte
+	order  []ds.Key
+}
+
+func (t *txn) Get(k ds.Key) ([]byte, error) {
+	if v, ok := t.writes[k]; ok {
+		if v == nil {
+			return nil, ds.ErrNotFound
+		}
+		return v, nil
+	}
+	if r, ok := t.reads[k]; ok {
+		if !r.found {
+			return nil, ds.ErrNotFound
+		}
+		return r.v, nil
+	}
+	v, err := t.d.Get(t.ctx, k)
+	switch {
+	case errors.Is(err, ds.ErrNotFound):
+		t.reads[k] = read{}
+	case err != nil:
+		return nil, err
+	default:
+		t.reads[k] = read{v: v, found: true}
+	}
+	return v, err
+}
+
+func (t *txn) write(k ds.Key, v []byte) {
+	if _, ok := t.writes[k]; !ok {
+		t.order = append(t.order, k)
+	}
+	t.writes[k] = v
+}
+
+func (t *txn) Put(k ds.Key, v []byte) error {
+	if v == nil {
+		v = []byte{}
+	}
+	t.write(k, v)
+	return nil
+}
+
+func (t *txn) Delete(k ds.Key) error {
+	t.write(k, nil)
+	return nil
+}
+
+// Txn runs fn and commits the writes it made as a single delta, so that
+// the other nodes apply either all of them or none: there is no point
+// where a replica holds some of the keys of a transaction but not the
+// others. Nothing is written when fn returns an error, which Txn returns.
+//
+// Transactions are optimistic. If a key fn read was changed on this node
+// before the commit, nothing is written and Txn returns ErrConflict, so
+// that the caller may run it again. As with CompareAndSwap, this does not
+// hold across the network: a concurrent write on another node is merged
+// with the transaction, and the last write wins key by key.
+func (d *DB) Txn(ctx context.Context, fn func(tx Txn) error) error {
+	t := &txn{ctx: ctx, d: d, reads: make(map[ds.Key]read), writes: make(map[ds.Key][]byte)}
+	if err := fn(t); err != nil {
+		return err
+	}
+	if len(t.writes) == 0 {
+		return nil
+	}
+
+	// Encoding may fail, and the batch splits deltas above maxDelta:
+	// both are checked before anything is written.
+	ws := make([]write, 0, len(t.order))
+	size := 0
+	for _, k := range t.order {
+		size += len(k.String()) + txnOverhead
+		v := t.writes[k]
+		if v == nil {
+			ws = append(ws, write{k: k})
+			continue
+		}
+		meta := Meta{HLC: d.clock.Now()}
+		v, err := d.pipelines.Encode(k, meta, v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+		ws = append(ws, write{k: k, v: EncodeValue(meta, v)})
+		size += len(v) + len(k.String())
+	}
+	if size > d.maxDelta {
+		return fmt.Errorf("%w: about %d bytes, at most %d", ErrTxnTooLarge, size, d.maxDelta)
+	}
+
+	// Puts, deletes and batches of this node take writeMu too, so none
+	// comes between the check and the commit.
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	for k, r := range t.reads {
+		v, err := d.Get(ctx, k)
+		switch {
+		case errors.Is(err, ds.ErrNotFound):
+			if r.found {
+				return ErrConflict
+			}
+		case err != nil:
+			return err
+		case !r.found || !bytes.Equal(v, r.v):
+			return ErrConflict
+		}
+	}
+	return d.commit(ctx, ws)
+}
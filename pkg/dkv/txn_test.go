@@ -0,0 +1,233 @@
+package dkv
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	crdt "github.com/ipfs/go-ds-crdt"
+)
+
+// nopBroadcaster broadcasts nowhere and receives nothing until its
+// context is done.
+type nopBroadcaster struct {
+	ctx context.Context
+}
+
+func (nopBroadcaster) Broadcast([]byte) error { return nil }
+
+func (b nopBroadcaster) Next() ([]byte, error) {
+	<-b.ctx.Done()
+	return nil, crdt.ErrNoMoreBroadcast
+}
+
+// newTestDB returns a DB over an in-memory CRDT store and DAG, with no
+// network.
+func newTestDB(t *testing.T, pipelines *Pipelines) *DB {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+	bs := blockstore.NewBlockstore(store)
+	dag := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+	d := &DB{cancel: cancel, pipelines: pipelines, subs: make(map[*subscription]struct{})}
+	d.clock.Wall = NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	opts := crdt.DefaultOptions()
+	opts.Logger = logger
+	opts.RebroadcastInterval = time.Hour
+	d.maxDelta = opts.MaxBatchDeltaSize
+	c, err := crdt.New(store, ds.NewKey("crdt"), dag, nopBroadcaster{ctx}, opts)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	d.crdt = c
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// height is the height of the DAG of d, which every delta raises by one.
+func height(d *DB) uint64 {
+	return d.crdt.InternalStats().MaxHeight
+}
+
+func TestTxnConflicts(t *testing.T) {
+	ctx := context.Background()
+	a, b, c := ds.NewKey("/a"), ds.NewKey("/b"), ds.NewKey("/c")
+	errFn := errors.New("fn failed")
+	tests := []struct {
+		name string
+		// read is the key the transaction reads, if any, before
+		// meanwhile writes to the database.
+		read      *ds.Key
+		meanwhile func(d *DB) error
+		fnErr     error
+		maxDelta  int
+		err       error
+	}{
+		{"read unchanged", &a, nil, nil, 0, nil},
+		{"read changed", &a, func(d *DB) error { return d.Put(ctx, a, []byte("2")) }, nil, 0, ErrConflict},
+		{"read rewritten as is", &a, func(d *DB) error { return d.Put(ctx, a, []byte("1")) }, nil, 0, nil},
+		{"read deleted", &a, func(d *DB) error { return d.Delete(ctx, a) }, nil, 0, ErrConflict},
+		{"read missing, created", &b, func(d *DB) error { return d.Put(ctx, b, []byte("2")) }, nil, 0, ErrConflict},
+		{"blind write", nil, func(d *DB) error { return d.Put(ctx, a, []byte("2")) }, nil, 0, nil},
+		{"fn failed", &a, nil, errFn, 0, errFn},
+		{"too large", nil, nil, nil, 64, ErrTxnTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDB(t, nil)
+			if tt.maxDelta > 0 {
+				d.maxDelta = tt.maxDelta
+			}
+			if err := d.Put(ctx, a, []byte("1")); err != nil {
+				t.Fatal(err)
+			}
+			before := height(d)
+			err := d.Txn(ctx, func(tx Txn) error {
+				if tt.read != nil {
+					if _, err := tx.Get(*tt.read); err != nil && !errors.Is(err, ds.ErrNotFound) {
+						return err
+					}
+				}
+				if tt.meanwhile != nil {
+					if err := tt.meanwhile(d); err != nil {
+						t.Fatal(err)
+					}
+					before = height(d)
+				}
+				if err := tx.Put(c, []byte("x")); err != nil {
+					return err
+				}
+				if v, err := tx.Get(c); err != nil || string(v) != "x" {
+					t.Errorf("transaction reads %q, %v of its own write", v, err)
+				}
+				return tt.fnErr
+			})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Txn: %v, want %v", err, tt.err)
+			}
+			_, err = d.Get(ctx, c)
+			if written := err == nil; written != (tt.err == nil) {
+				t.Errorf("write committed: %t, want %t", written, tt.err == nil)
+			}
+			want := before
+			if tt.err == nil {
+				want++
+			}
+			if got := height(d); got != want {
+				t.Errorf("DAG at height %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+// failingTransform fails to encode every value.
+type failingTransform struct{}
+
+func (failingTransform) ID() byte     { return 0xfe }
+func (failingTransform) Name() string { return "failing" }
+func (failingTransform) Stage() Stage { return StageCompress }
+func (failingTransform) Encode(ds.Key, []byte) ([]byte, error) {
+	return nil, errors.New("cannot encode")
+}
+func (failingTransform) Decode(ds.Key, []byte) ([]byte, error) {
+	return nil, errors.New("cannot decode")
+}
+
+func TestBatchAtomicity(t *testing.T) {
+	ctx := context.Background()
+	a, b, c, bad := ds.NewKey("/a"), ds.NewKey("/b"), ds.NewKey("/c"), ds.NewKey("/bad/x")
+	tests := []struct {
+		name string
+		// writes fills the batch, and the batch is committed when it
+		// returns nil, discarded otherwise.
+		writes func(b *Batch) error
+		// applied tells whether the writes are applied, in one delta.
+		applied bool
+	}{
+		{"committed", func(bt *Batch) error {
+			if err := bt.Put(ctx, a, []byte("2")); err != nil {
+				return err
+			}
+			if err := bt.Put(ctx, b, []byte("2")); err != nil {
+				return err
+			}
+			return bt.Delete(ctx, c)
+		}, true},
+		{"discarded", func(bt *Batch) error {
+			if err := bt.Put(ctx, a, []byte("2")); err != nil {
+				return err
+			}
+			return errors.New("discard")
+		}, false},
+		{"encoding failed", func(bt *Batch) error {
+			if err := bt.Put(ctx, a, []byte("2")); err != nil {
+				return err
+			}
+			if err := bt.Delete(ctx, c); err != nil {
+				return err
+			}
+			return bt.Put(ctx, bad, []byte("2"))
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPipelines()
+			if err := p.Add(ds.NewKey("/bad"), Pipeline{failingTransform{}}); err != nil {
+				t.Fatal(err)
+			}
+			d := newTestDB(t, p)
+			for _, k := range []ds.Key{a, c} {
+				if err := d.Put(ctx, k, []byte("1")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before := height(d)
+			bt, err := d.Batch(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.writes(bt); err != nil {
+				bt.Discard()
+			} else if err := bt.Commit(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[ds.Key]string{a: "1", c: "1"}
+			if tt.applied {
+				want = map[ds.Key]string{a: "2", b: "2"}
+			}
+			for _, k := range []ds.Key{a, b, c} {
+				v, err := d.Get(ctx, k)
+				if errors.Is(err, ds.ErrNotFound) {
+					v = nil
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				if string(v) != want[k] {
+					t.Errorf("%s = %q, want %q", k, v, want[k])
+				}
+			}
+			wantHeight := before
+			if tt.applied {
+				wantHeight++
+			}
+			if got := height(d); got != wantHeight {
+				t.Errorf("DAG at height %d, want %d", got, wantHeight)
+			}
+			// The batch released the node for the next one.
+			next, err := d.Batch(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next.Discard()
+		})
+	}
+}
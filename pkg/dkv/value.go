@@ -0,0 +1,42 @@
+package dkv
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// valueHeader prefixes every value written by this version. It is
+// followed by the big-endian HLC timestamp of the write and the payload.
+var valueHeader = []byte{0xd7, 0x01}
+
+const valueHeaderLen = 2 + 8
+
+// Meta is the metadata stored alongside each value.
+type Meta struct {
+	// HLC is the hybrid logical clock timestamp of the write.
+	HLC Timestamp
+}
+
+// EncodeValue wraps a payload with its metadata. The timestamp goes
+// first so that, when two concurrent writes land at the same DAG height,
+// the CRDT (which then keeps the lexicographically greater value) picks
+// the one with the higher HLC timestamp.
+func EncodeValue(meta Meta, payload []byte) []byte {
+	buf := make([]byte, valueHeaderLen, valueHeaderLen+len(payload))
+	copy(buf, valueHeader)
+	binary.BigEndian.PutUint64(buf[2:], uint64(meta.HLC))
+	return append(buf, payload...)
+}
+
+// DecodeValue splits a stored value into its metadata and payload.
+// Values written by older versions carry no header and get empty
+// metadata.
+func DecodeValue(v []byte) (Meta, []byte) {
+	if len(v) < valueHeaderLen || !bytes.HasPrefix(v, valueHeader) {
+		return Meta{}, v
+	}
+	meta := Meta{
+		HLC: Timestamp(binary.BigEndian.Uint64(v[2:valueHeaderLen])),
+	}
+	return meta, v[valueHeaderLen:]
+}
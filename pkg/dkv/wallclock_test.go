@@ -0,0 +1,69 @@
+package dkv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManualClockAfter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		wait    time.Duration
+		advance time.Duration
+		fired   bool
+	}{
+		{"not due", time.Minute, 59 * time.Second, false},
+		{"due", time.Minute, time.Minute, true},
+		{"past due", time.Minute, time.Hour, true},
+		{"no wait", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewManualClock(start)
+			ch := c.After(tt.wait)
+			c.Advance(tt.advance)
+			select {
+			case at := <-ch:
+				if !tt.fired {
+					t.Fatalf("fired at %s", at)
+				}
+				if want := start.Add(tt.advance); !at.Equal(want) {
+					t.Errorf("fired at %s, want %s", at, want)
+				}
+			default:
+				if tt.fired {
+					t.Fatal("did not fire")
+				}
+				if c.Waiters() != 1 {
+					t.Errorf("%d waiters, want 1", c.Waiters())
+				}
+			}
+		})
+	}
+}
+
+func TestManualClockSetBackwards(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewManualClock(start)
+	c.Set(start.Add(-time.Hour))
+	if got := c.Now(); !got.Equal(start) {
+		t.Errorf("Now() = %s after setting it back, want %s", got, start)
+	}
+}
+
+func TestClockFollowsWallClock(t *testing.T) {
+	wall := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := &Clock{Wall: wall}
+	first := c.Now()
+	if got := first.Time(); !got.Equal(wall.Now()) {
+		t.Errorf("first timestamp at %s, want %s", got, wall.Now())
+	}
+	if second := c.Now(); second <= first {
+		t.Errorf("second timestamp %s not after %s with the clock stopped", second, first)
+	}
+	wall.Advance(time.Second)
+	if got := c.Now().Time(); !got.Equal(wall.Now()) {
+		t.Errorf("timestamp at %s after a second, want %s", got, wall.Now())
+	}
+}
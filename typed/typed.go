@@ -0,0 +1,111 @@
+// Package typed stores and loads Go values in globaldb instead of raw
+// bytes. Values are turned into bytes by an Encoding, so that every
+// participant of a database can agree on one (JSON, CBOR or protobuf)
+// while applications work with their own types:
+//
+//	type Profile struct{ Name string }
+//
+//	err := typed.PutAs(ctx, store, key, typed.CBOR, Profile{Name: "ana"})
+//	p, err := typed.GetAs[Profile](ctx, store, key, typed.CBOR)
+//
+// Any datastore works, including the globaldb CRDT store.
+package typed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	ds "github.com/ipfs/go-datastore"
+	"google.golang.org/protobuf/proto"
+)
+
+// Encoding turns values into bytes and back.
+type Encoding interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Getter is the read side of a datastore.
+type Getter interface {
+	Get(ctx context.Context, k ds.Key) ([]byte, error)
+}
+
+// Putter is the write side of a datastore.
+type Putter interface {
+	Put(ctx context.Context, k ds.Key, v []byte) error
+}
+
+// GetAs reads the value of k and decodes it into a T.
+func GetAs[T any](ctx context.Context, g Getter, k ds.Key, enc Encoding) (T, error) {
+	var v T
+	data, err := g.Get(ctx, k)
+	if err != nil {
+		return v, err
+	}
+	if err := enc.Unmarshal(data, &v); err != nil {
+		return v, fmt.Errorf("decoding %s: %w", k, err)
+	}
+	return v, nil
+}
+
+// PutAs encodes v and stores it on k.
+func PutAs[T any](ctx context.Context, p Putter, k ds.Key, enc Encoding, v T) error {
+	data, err := enc.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding %s: %w", k, err)
+	}
+	return p.Put(ctx, k, data)
+}
+
+// The built-in encodings.
+var (
+	JSON     Encoding = jsonEncoding{}
+	CBOR     Encoding = cborEncoding{}
+	Protobuf Encoding = protoEncoding{}
+)
+
+type jsonEncoding struct{}
+
+func (jsonEncoding) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonEncoding) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// cborEncoding uses the core deterministic encoding, so that equal values
+// are stored as equal bytes.
+type cborEncoding struct{}
+
+var cborEncMode, _ = cbor.CoreDetEncOptions().EncMode()
+
+func (cborEncoding) Marshal(v interface{}) ([]byte, error)      { return cborEncMode.Marshal(v) }
+func (cborEncoding) Unmarshal(data []byte, v interface{}) error { return cbor.Unmarshal(data, v) }
+
+// protoEncoding handles types implementing proto.Message. GetAs is called
+// with the message type itself, e.g. GetAs[*pb.Profile], and a new message
+// is allocated for it.
+type protoEncoding struct{}
+
+func (protoEncoding) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a protobuf message", v)
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(m)
+}
+
+func (protoEncoding) Unmarshal(data []byte, v interface{}) error {
+	// v is a pointer to the message pointer.
+	ptr := reflect.ValueOf(v)
+	if ptr.Kind() != reflect.Pointer || ptr.Elem().Kind() != reflect.Pointer {
+		return fmt.Errorf("%T does not point to a protobuf message", v)
+	}
+	if ptr.Elem().IsNil() {
+		ptr.Elem().Set(reflect.New(ptr.Elem().Type().Elem()))
+	}
+	m, ok := ptr.Elem().Interface().(proto.Message)
+	if !ok {
+		return fmt.Errorf("%s is not a protobuf message", ptr.Elem().Type())
+	}
+	return proto.Unmarshal(data, m)
+}